@@ -0,0 +1,141 @@
+package analytics
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxRangesPerFile caps the distinct ranges remembered per file; further ranges are counted as other
+const maxRangesPerFile = 64
+
+// topRanges is the number of most requested ranges reported per file
+const topRanges = 10
+
+// Downloads records how each file is downloaded, telling complete downloads
+// apart from partial ones made with Range requests
+type Downloads struct {
+	mu    sync.Mutex
+	files map[string]*fileDownloads
+}
+
+// fileDownloads holds the counts for one file
+type fileDownloads struct {
+	complete      int64
+	partial       int64
+	resumed       int64
+	unsatisfiable int64
+	bytesServed   int64
+	ranges        map[string]int64
+	otherRanges   int64
+	last          time.Time
+}
+
+// NewDownloads creates an empty download recorder
+func NewDownloads() *Downloads {
+	return &Downloads{files: make(map[string]*fileDownloads)}
+}
+
+// Complete records a download of a whole file
+func (d *Downloads) Complete(name string, bytes int64) {
+	d.update(name, func(f *fileDownloads) {
+		f.complete++
+		f.bytesServed += bytes
+	})
+}
+
+// Partial records a download of the byte range "START-END" of a file.
+// Ranges starting past zero and running to the end of the file count as resumed downloads.
+func (d *Downloads) Partial(name, byteRange string, bytes int64, resumed bool) {
+	d.update(name, func(f *fileDownloads) {
+		f.partial++
+		f.bytesServed += bytes
+		if resumed {
+			f.resumed++
+		}
+
+		if _, ok := f.ranges[byteRange]; ok || len(f.ranges) < maxRangesPerFile {
+			f.ranges[byteRange]++
+		} else {
+			f.otherRanges++
+		}
+	})
+}
+
+// Unsatisfiable records a range request for a file that lay past its end
+func (d *Downloads) Unsatisfiable(name string) {
+	d.update(name, func(f *fileDownloads) {
+		f.unsatisfiable++
+	})
+}
+
+// update applies fn to the counts of a file under the lock
+func (d *Downloads) update(name string, fn func(f *fileDownloads)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	f, ok := d.files[name]
+	if !ok {
+		f = &fileDownloads{ranges: make(map[string]int64)}
+		d.files[name] = f
+	}
+	fn(f)
+	f.last = time.Now()
+}
+
+// RangeCount is the number of requests for one byte range
+type RangeCount struct {
+	Range    string `json:"range"`
+	Requests int64  `json:"requests"`
+}
+
+// FileReport summarises the downloads of one file
+type FileReport struct {
+	File          string       `json:"file"`
+	Complete      int64        `json:"complete"`
+	Partial       int64        `json:"partial"`
+	Resumed       int64        `json:"resumed"`
+	Unsatisfiable int64        `json:"unsatisfiable"`
+	BytesServed   int64        `json:"bytesServed"`
+	TopRanges     []RangeCount `json:"topRanges"`
+	OtherRanges   int64        `json:"otherRanges"`
+	LastDownload  time.Time    `json:"lastDownload"`
+}
+
+// Report returns the download summary of every file, sorted by name
+func (d *Downloads) Report() []FileReport {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	reports := make([]FileReport, 0, len(d.files))
+	for name, f := range d.files {
+		ranges := make([]RangeCount, 0, len(f.ranges))
+		for r, n := range f.ranges {
+			ranges = append(ranges, RangeCount{Range: r, Requests: n})
+		}
+		sort.Slice(ranges, func(i, j int) bool {
+			if ranges[i].Requests != ranges[j].Requests {
+				return ranges[i].Requests > ranges[j].Requests
+			}
+			return ranges[i].Range < ranges[j].Range
+		})
+		if len(ranges) > topRanges {
+			ranges = ranges[:topRanges]
+		}
+
+		reports = append(reports, FileReport{
+			File:          name,
+			Complete:      f.complete,
+			Partial:       f.partial,
+			Resumed:       f.resumed,
+			Unsatisfiable: f.unsatisfiable,
+			BytesServed:   f.bytesServed,
+			TopRanges:     ranges,
+			OtherRanges:   f.otherRanges,
+			LastDownload:  f.last,
+		})
+	}
+
+	sort.Slice(reports, func(i, j int) bool { return reports[i].File < reports[j].File })
+	return reports
+}
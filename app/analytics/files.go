@@ -0,0 +1,144 @@
+package analytics
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FileStats counts how often a file was downloaded and uploaded
+type FileStats struct {
+	Downloads     int64     `json:"downloads"`
+	Uploads       int64     `json:"uploads"`
+	BytesServed   int64     `json:"bytesServed"`
+	BytesReceived int64     `json:"bytesReceived"`
+	LastDownload  time.Time `json:"lastDownload,omitzero"`
+	LastUpload    time.Time `json:"lastUpload,omitzero"`
+	LastAccess    time.Time `json:"lastAccess,omitzero"`
+}
+
+// Files records access statistics per file, optionally persisted to a JSON file
+type Files struct {
+	mu    sync.Mutex
+	stats map[string]*FileStats
+	dirty bool
+}
+
+// NewFiles creates an empty file statistics recorder
+func NewFiles() *Files {
+	return &Files{stats: make(map[string]*FileStats)}
+}
+
+// Download records that bytes of a file were served
+func (f *Files) Download(name string, bytes int64) {
+	f.update(name, func(s *FileStats, now time.Time) {
+		s.Downloads++
+		s.BytesServed += bytes
+		s.LastDownload = now
+	})
+}
+
+// Upload records that a file of the given size was stored
+func (f *Files) Upload(name string, bytes int64) {
+	f.update(name, func(s *FileStats, now time.Time) {
+		s.Uploads++
+		s.BytesReceived += bytes
+		s.LastUpload = now
+	})
+}
+
+// update applies fn to the statistics of a file under the lock
+func (f *Files) update(name string, fn func(s *FileStats, now time.Time)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s, ok := f.stats[name]
+	if !ok {
+		s = &FileStats{}
+		f.stats[name] = s
+	}
+	now := time.Now().UTC()
+	fn(s, now)
+	s.LastAccess = now
+	f.dirty = true
+}
+
+// Get returns the statistics of a file, reporting false if it was never accessed
+func (f *Files) Get(name string) (FileStats, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s, ok := f.stats[name]
+	if !ok {
+		return FileStats{}, false
+	}
+	return *s, true
+}
+
+// Load reads statistics previously written by Save, replacing those recorded.
+// A missing file is not an error.
+func (f *Files) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	stats := make(map[string]*FileStats)
+	if err := json.Unmarshal(data, &stats); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stats = stats
+	f.dirty = false
+	return nil
+}
+
+// Save writes the statistics to path as JSON if they changed since the last
+// Load or Save. The file is replaced atomically.
+func (f *Files) Save(path string) error {
+	f.mu.Lock()
+	if !f.dirty {
+		f.mu.Unlock()
+		return nil
+	}
+	data, err := json.MarshalIndent(f.stats, "", "  ")
+	f.dirty = false
+	f.mu.Unlock()
+
+	if err == nil {
+		err = writeFile(path, data)
+	}
+	if err != nil {
+		// Try again on the next save
+		f.mu.Lock()
+		f.dirty = true
+		f.mu.Unlock()
+	}
+	return err
+}
+
+// writeFile writes data to a temporary file next to path and renames it into place
+func writeFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".stats-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,10 @@
+package buildinfo
+
+import "time"
+
+// Version is the server version, set at build time with
+// -ldflags "-X octo-server/app/buildinfo.Version=..."
+var Version = "dev"
+
+// StartTime is when the server process started
+var StartTime = time.Now()
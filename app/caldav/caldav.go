@@ -0,0 +1,169 @@
+// Package caldav serves a directory of iCalendar files to calendar apps
+// through a minimal, read-only subset of CalDAV (RFC 4791)
+package caldav
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Extension is the file extension of calendar object resources
+const Extension = ".ics"
+
+// ContentType is the media type of calendar object resources
+const ContentType = "text/calendar; charset=utf-8"
+
+// ErrNotFound is returned for paths that name no calendar, calendar object or the home itself
+var ErrNotFound = errors.New("no such calendar resource")
+
+// Kind tells what a resource is
+type Kind int
+
+const (
+	// KindHome is the calendar home, a collection of calendars
+	KindHome Kind = iota
+	// KindCalendar is a calendar collection, holding calendar objects
+	KindCalendar
+	// KindObject is a calendar object resource, one .ics file
+	KindObject
+)
+
+// Home is a calendar home backed by a directory: each subdirectory of Root
+// is a calendar, and the .ics files in it are its events and tasks. Hidden
+// files and directories are left out.
+type Home struct {
+	Root string
+	// Prefix is the URL path the home is served at, e.g. "/caldav"
+	Prefix string
+}
+
+// Resource is the home, a calendar or a calendar object
+type Resource struct {
+	Kind Kind
+	// Name is the last segment of the resource's path, empty for the home
+	Name string
+	// Href is the escaped URL path of the resource, ending in "/" for collections
+	Href string
+	// Path is the file system path backing the resource
+	Path string
+	Info os.FileInfo
+}
+
+// Lookup resolves a path below the home's prefix, such as "work/" or
+// "work/standup.ics", to a resource
+func (h *Home) Lookup(name string) (*Resource, error) {
+	var segments []string
+	for _, segment := range strings.Split(name, "/") {
+		if segment == "" {
+			continue
+		}
+		if strings.HasPrefix(segment, ".") || !filepath.IsLocal(segment) {
+			return nil, ErrNotFound
+		}
+		segments = append(segments, segment)
+	}
+
+	r := &Resource{Kind: KindHome, Href: h.Prefix + "/", Path: h.Root}
+	for _, segment := range segments {
+		if r.Kind == KindObject {
+			return nil, ErrNotFound
+		}
+		r = h.child(r, segment)
+	}
+
+	info, err := os.Stat(r.Path)
+	if err != nil || info.IsDir() != (r.Kind != KindObject) {
+		return nil, ErrNotFound
+	}
+	if r.Kind == KindObject && (!info.Mode().IsRegular() || !strings.EqualFold(filepath.Ext(r.Name), Extension)) {
+		return nil, ErrNotFound
+	}
+	r.Info = info
+	return r, nil
+}
+
+// child returns the resource named name within a collection, without checking it exists
+func (h *Home) child(parent *Resource, name string) *Resource {
+	r := &Resource{
+		Kind: parent.Kind + 1,
+		Name: name,
+		Href: parent.Href + url.PathEscape(name),
+		Path: filepath.Join(parent.Path, name),
+	}
+	if r.Kind != KindObject {
+		r.Href += "/"
+	}
+	return r
+}
+
+// Children lists the calendars of the home or the calendar objects of a calendar, sorted by name
+func (h *Home) Children(parent *Resource) ([]*Resource, error) {
+	if parent.Kind == KindObject {
+		return nil, nil
+	}
+	entries, err := os.ReadDir(parent.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var children []*Resource
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		if parent.Kind == KindHome && !entry.IsDir() {
+			continue
+		}
+		if parent.Kind == KindCalendar && (!entry.Type().IsRegular() || !strings.EqualFold(filepath.Ext(name), Extension)) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		child := h.child(parent, name)
+		child.Info = info
+		children = append(children, child)
+	}
+	return children, nil
+}
+
+// ETag returns the entity tag of a calendar object, which changes whenever its file does
+func ETag(r *Resource) string {
+	return fmt.Sprintf(`"%x-%x"`, r.Info.ModTime().UnixNano(), r.Info.Size())
+}
+
+// CTag returns a tag of a calendar that changes whenever any of its objects
+// is added, removed or changed, letting clients skip unchanged calendars
+func (h *Home) CTag(r *Resource) string {
+	children, _ := h.Children(r)
+	hash := sha1.New()
+	for _, child := range children {
+		fmt.Fprintf(hash, "%s %s\n", child.Name, ETag(child))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Components returns the names of the components an iCalendar object contains,
+// such as VCALENDAR, VEVENT and VALARM, in upper case
+func Components(data []byte) map[string]bool {
+	components := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) > 6 && strings.EqualFold(line[:6], "BEGIN:") {
+			components[strings.ToUpper(line[6:])] = true
+		}
+	}
+	return components
+}
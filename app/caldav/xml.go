@@ -0,0 +1,252 @@
+package caldav
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"strconv"
+
+	"octo-server/app/http"
+)
+
+// XML namespaces of the properties served
+const (
+	NamespaceDAV            = "DAV:"
+	NamespaceCalDAV         = "urn:ietf:params:xml:ns:caldav"
+	NamespaceCalendarServer = "http://calendarserver.org/ns/"
+)
+
+// Names of the supported REPORT requests
+var (
+	CalendarQuery    = xml.Name{Space: NamespaceCalDAV, Local: "calendar-query"}
+	CalendarMultiget = xml.Name{Space: NamespaceCalDAV, Local: "calendar-multiget"}
+)
+
+// PropFind is the body of a PROPFIND request. A request without a body asks for all properties.
+type PropFind struct {
+	XMLName  xml.Name  `xml:"DAV: propfind"`
+	AllProp  *struct{} `xml:"DAV: allprop"`
+	PropName *struct{} `xml:"DAV: propname"`
+	Prop     PropNames `xml:"DAV: prop"`
+}
+
+// Report is the body of a calendar-query or calendar-multiget REPORT request
+type Report struct {
+	XMLName xml.Name
+	AllProp *struct{} `xml:"DAV: allprop"`
+	Prop    PropNames `xml:"DAV: prop"`
+	// Hrefs are the calendar objects asked for by a calendar-multiget
+	Hrefs []string `xml:"DAV: href"`
+	// Filter selects the calendar objects returned by a calendar-query
+	Filter *Filter `xml:"urn:ietf:params:xml:ns:caldav filter"`
+}
+
+// Filter is the filter of a calendar-query, whose top-level component filter names VCALENDAR
+type Filter struct {
+	CompFilter CompFilter `xml:"urn:ietf:params:xml:ns:caldav comp-filter"`
+}
+
+// CompFilter selects calendar objects by the components they contain.
+// Time ranges and property filters are not evaluated, so a calendar-query
+// may return more objects than it asked for, which clients filter again.
+type CompFilter struct {
+	Name         string       `xml:"name,attr"`
+	IsNotDefined *struct{}    `xml:"urn:ietf:params:xml:ns:caldav is-not-defined"`
+	CompFilters  []CompFilter `xml:"urn:ietf:params:xml:ns:caldav comp-filter"`
+}
+
+// Matches reports whether an object with the given components passes the filter
+func (f *CompFilter) Matches(components map[string]bool) bool {
+	if f.IsNotDefined != nil {
+		return !components[f.Name]
+	}
+	if !components[f.Name] {
+		return false
+	}
+	for i := range f.CompFilters {
+		if !f.CompFilters[i].Matches(components) {
+			return false
+		}
+	}
+	return true
+}
+
+// PropNames are the names of the properties asked for in a prop element
+type PropNames []xml.Name
+
+// UnmarshalXML implements xml.Unmarshaler, collecting the names of the child elements
+func (p *PropNames) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	for {
+		token, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			*p = append(*p, t.Name)
+			if err := d.Skip(); err != nil {
+				return err
+			}
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
+// Multistatus is the body of the 207 Multi-Status response to PROPFIND and REPORT requests
+type Multistatus struct {
+	XMLName   xml.Name   `xml:"DAV: multistatus"`
+	Responses []Response `xml:"response"`
+}
+
+// Response holds the properties of one resource, grouped by status, or the status of a missing one
+type Response struct {
+	Href      string     `xml:"href"`
+	Propstats []Propstat `xml:"propstat,omitempty"`
+	Status    string     `xml:"status,omitempty"`
+}
+
+// Propstat holds properties sharing a status, e.g. those a resource does not have
+type Propstat struct {
+	Prop   Prop   `xml:"prop"`
+	Status string `xml:"status"`
+}
+
+// Prop holds property elements
+type Prop struct {
+	Properties []Property
+}
+
+// Property is a property element with its content as raw XML
+type Property struct {
+	XMLName xml.Name
+	Content string `xml:",innerxml"`
+}
+
+// Status formats a status line as used in multistatus responses
+func Status(code int) string {
+	return fmt.Sprintf("HTTP/1.1 %d %s", code, http.StatusCodeToText(code))
+}
+
+// PropertyNames returns the names of the properties a resource has, as returned for allprop.
+// calendar-data is only returned when asked for by name.
+func PropertyNames(r *Resource) []xml.Name {
+	names := []xml.Name{
+		{Space: NamespaceDAV, Local: "resourcetype"},
+		{Space: NamespaceDAV, Local: "displayname"},
+		{Space: NamespaceDAV, Local: "getlastmodified"},
+	}
+	switch r.Kind {
+	case KindCalendar:
+		names = append(names,
+			xml.Name{Space: NamespaceCalendarServer, Local: "getctag"},
+			xml.Name{Space: NamespaceCalDAV, Local: "supported-calendar-component-set"},
+			xml.Name{Space: NamespaceDAV, Local: "supported-report-set"},
+		)
+	case KindObject:
+		names = append(names,
+			xml.Name{Space: NamespaceDAV, Local: "getetag"},
+			xml.Name{Space: NamespaceDAV, Local: "getcontenttype"},
+			xml.Name{Space: NamespaceDAV, Local: "getcontentlength"},
+		)
+	}
+	return names
+}
+
+// Propstats returns the named properties of a resource, grouped into those it
+// has and, with status 404 Not Found, those it does not
+func (h *Home) Propstats(r *Resource, names []xml.Name) []Propstat {
+	var found, missing []Property
+	for _, name := range names {
+		content, ok := h.property(r, name)
+		if ok {
+			found = append(found, Property{XMLName: name, Content: content})
+		} else {
+			missing = append(missing, Property{XMLName: name})
+		}
+	}
+
+	var propstats []Propstat
+	if len(found) > 0 {
+		propstats = append(propstats, Propstat{Prop: Prop{found}, Status: Status(200)})
+	}
+	if len(missing) > 0 {
+		propstats = append(propstats, Propstat{Prop: Prop{missing}, Status: Status(404)})
+	}
+	return propstats
+}
+
+// property returns the content of a property of a resource as raw XML, and whether the resource has it
+func (h *Home) property(r *Resource, name xml.Name) (string, bool) {
+	isCollection := r.Kind != KindObject
+
+	switch name {
+	case xml.Name{Space: NamespaceDAV, Local: "resourcetype"}:
+		switch r.Kind {
+		case KindHome:
+			return `<collection xmlns="DAV:"/>`, true
+		case KindCalendar:
+			return `<collection xmlns="DAV:"/><calendar xmlns="urn:ietf:params:xml:ns:caldav"/>`, true
+		}
+		return "", true
+	case xml.Name{Space: NamespaceDAV, Local: "displayname"}:
+		if r.Kind == KindHome {
+			return "Calendars", true
+		}
+		return escape(r.Name), true
+	case xml.Name{Space: NamespaceDAV, Local: "getlastmodified"}:
+		return r.Info.ModTime().UTC().Format(http.TimeFormat), true
+	case xml.Name{Space: NamespaceDAV, Local: "current-user-principal"},
+		xml.Name{Space: NamespaceCalDAV, Local: "calendar-home-set"}:
+		return `<href xmlns="DAV:">` + escape(h.Prefix+"/") + `</href>`, true
+	case xml.Name{Space: NamespaceDAV, Local: "current-user-privilege-set"}:
+		return `<privilege xmlns="DAV:"><read/></privilege>`, true
+	}
+
+	if r.Kind == KindCalendar {
+		switch name {
+		case xml.Name{Space: NamespaceCalendarServer, Local: "getctag"}:
+			return h.CTag(r), true
+		case xml.Name{Space: NamespaceCalDAV, Local: "supported-calendar-component-set"}:
+			return `<comp xmlns="urn:ietf:params:xml:ns:caldav" name="VEVENT"/>` +
+				`<comp xmlns="urn:ietf:params:xml:ns:caldav" name="VTODO"/>` +
+				`<comp xmlns="urn:ietf:params:xml:ns:caldav" name="VJOURNAL"/>`, true
+		case xml.Name{Space: NamespaceDAV, Local: "supported-report-set"}:
+			return `<supported-report xmlns="DAV:"><report><calendar-query xmlns="urn:ietf:params:xml:ns:caldav"/></report></supported-report>` +
+				`<supported-report xmlns="DAV:"><report><calendar-multiget xmlns="urn:ietf:params:xml:ns:caldav"/></report></supported-report>`, true
+		}
+	}
+
+	if !isCollection {
+		switch name {
+		case xml.Name{Space: NamespaceDAV, Local: "getetag"}:
+			return escape(ETag(r)), true
+		case xml.Name{Space: NamespaceDAV, Local: "getcontenttype"}:
+			return ContentType, true
+		case xml.Name{Space: NamespaceDAV, Local: "getcontentlength"}:
+			return strconv.FormatInt(r.Info.Size(), 10), true
+		case xml.Name{Space: NamespaceCalDAV, Local: "calendar-data"}:
+			data, err := os.ReadFile(r.Path)
+			if err != nil {
+				return "", false
+			}
+			return escape(string(data)), true
+		}
+	}
+	return "", false
+}
+
+// escape escapes text for use as XML character data
+func escape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// Error is the body of a response refused for a failed precondition, such as
+// DAV:supported-report for unknown REPORT requests (RFC 4918, section 16)
+type Error struct {
+	XMLName   xml.Name `xml:"DAV: error"`
+	Condition Property
+}
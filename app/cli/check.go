@@ -0,0 +1,25 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"octo-server/app/config"
+)
+
+// newCheckCommand creates the check command, which validates the configuration without serving
+func newCheckCommand(cfg *config.Config) *cobra.Command {
+	return &cobra.Command{
+		Use:   "check",
+		Short: "Validate the configuration and exit",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := cfg.Validate(); err != nil {
+				return fmt.Errorf("invalid configuration: %w", err)
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), "Configuration OK")
+			return nil
+		},
+	}
+}
@@ -0,0 +1,25 @@
+package cli
+
+import "github.com/spf13/pflag"
+
+// secretFlags are the settings whose values are left out of crash reports
+var secretFlags = map[string]bool{
+	"s3-secret-key":    true,
+	"crash-report-dsn": true,
+}
+
+// configSnapshot returns the settings given on the command line, in the
+// environment or in the config file by flag name, for crash reports
+func configSnapshot(flags *pflag.FlagSet) map[string]string {
+	settings := make(map[string]string)
+	flags.VisitAll(func(f *pflag.Flag) {
+		switch {
+		case !f.Changed:
+		case secretFlags[f.Name]:
+			settings[f.Name] = "[redacted]"
+		default:
+			settings[f.Name] = f.Value.String()
+		}
+	})
+	return settings
+}
@@ -0,0 +1,37 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// envPrefix prefixes the environment variable equivalent of every configuration flag
+const envPrefix = "OCTO_"
+
+// envName returns the environment variable equivalent of a flag, e.g. OCTO_MAX_CONNS_PER_IP
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// applyEnv sets every flag not given on the command line from its environment
+// variable, if present, so that flags take precedence over the environment
+func applyEnv(flags *pflag.FlagSet) error {
+	var err error
+	flags.VisitAll(func(f *pflag.Flag) {
+		if err != nil || f.Changed {
+			return
+		}
+
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			return
+		}
+		if setErr := flags.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid value %q for %s: %w", value, envName(f.Name), setErr)
+		}
+	})
+	return err
+}
@@ -0,0 +1,178 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"go.yaml.in/yaml/v3"
+)
+
+// configFlag names the flag giving the path of the configuration file
+const configFlag = "config"
+
+// configFile applies the settings of a YAML configuration file to the configuration flags
+type configFile struct {
+	path  string
+	flags *pflag.FlagSet
+	// overridden are the flags given on the command line or through the environment
+	overridden map[string]bool
+	// seen maps the flags set by the file to the node that set them
+	seen map[string]*yaml.Node
+}
+
+// applyConfigFile sets every flag not given on the command line or through the
+// environment from the YAML file at path. Its keys are flag names, which may be
+// nested, e.g. "tls: {cert: ...}" for --tls-cert, and repeatable flags take lists.
+func applyConfigFile(flags *pflag.FlagSet, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil
+	}
+
+	file := &configFile{path: path, flags: flags, overridden: make(map[string]bool), seen: make(map[string]*yaml.Node)}
+	flags.VisitAll(func(f *pflag.Flag) {
+		file.overridden[f.Name] = f.Changed
+	})
+	return file.apply(doc.Content[0], "")
+}
+
+// apply applies a mapping of settings whose keys are prefixed by prefix
+func (c *configFile) apply(node *yaml.Node, prefix string) error {
+	node = resolve(node)
+	if node.Kind != yaml.MappingNode {
+		return c.errorf(node, "expected a mapping of settings")
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], resolve(node.Content[i+1])
+		name := prefix + key.Value
+		f := c.flags.Lookup(name)
+
+		switch {
+		case name == configFlag:
+			return c.errorf(key, "%s cannot be set in the config file itself", name)
+		case value.Kind == yaml.MappingNode:
+			if err := c.apply(value, name+"-"); err != nil {
+				return err
+			}
+			continue
+		case f == nil:
+			if suggestion := c.suggest(name); suggestion != "" {
+				return c.errorf(key, "unknown setting %q (did you mean %q?)", name, suggestion)
+			}
+			return c.errorf(key, "unknown setting %q", name)
+		}
+
+		if previous, ok := c.seen[name]; ok {
+			return c.errorf(key, "%s is already set on line %d", name, previous.Line)
+		}
+		c.seen[name] = key
+		if c.overridden[name] {
+			continue
+		}
+		if err := c.set(f, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// set sets a flag from a scalar, or from each item of a list for list-valued flags
+func (c *configFile) set(f *pflag.Flag, value *yaml.Node) error {
+	switch value.Kind {
+	case yaml.ScalarNode:
+		if value.Tag == "!!null" {
+			return c.errorf(value, "%s has no value", f.Name)
+		}
+		return c.setValue(f, value)
+
+	case yaml.SequenceNode:
+		slice, isSlice := f.Value.(pflag.SliceValue)
+		if !isSlice && !strings.Contains(f.Usage, "repeatable") {
+			return c.errorf(value, "%s takes a single value, not a list", f.Name)
+		}
+		if isSlice && len(value.Content) == 0 {
+			f.Changed = true
+			return slice.Replace(nil)
+		}
+		for _, item := range value.Content {
+			item = resolve(item)
+			if item.Kind != yaml.ScalarNode || item.Tag == "!!null" {
+				return c.errorf(item, "%s takes a list of values", f.Name)
+			}
+			if err := c.setValue(f, item); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	default:
+		return c.errorf(value, "%s takes a value, not a mapping", f.Name)
+	}
+}
+
+// setValue sets a flag from a scalar, reporting invalid values at their location
+func (c *configFile) setValue(f *pflag.Flag, value *yaml.Node) error {
+	if err := c.flags.Set(f.Name, value.Value); err != nil {
+		return c.errorf(value, "%v", err)
+	}
+	return nil
+}
+
+// errorf returns an error located at a node of the file, as FILE:LINE:COLUMN
+func (c *configFile) errorf(node *yaml.Node, format string, args ...any) error {
+	return fmt.Errorf("%s:%d:%d: %s", c.path, node.Line, node.Column, fmt.Sprintf(format, args...))
+}
+
+// suggest returns the flag name closest to an unknown setting, if any is close enough to be a typo
+func (c *configFile) suggest(name string) string {
+	best, bestDistance := "", 3
+	c.flags.VisitAll(func(f *pflag.Flag) {
+		if f.Name == configFlag {
+			return
+		}
+		if d := editDistance(name, f.Name); d < bestDistance {
+			best, bestDistance = f.Name, d
+		}
+	})
+	return best
+}
+
+// resolve follows an alias node to the node it refers to
+func resolve(node *yaml.Node) *yaml.Node {
+	for node.Kind == yaml.AliasNode && node.Alias != nil {
+		node = node.Alias
+	}
+	return node
+}
+
+// editDistance returns the Levenshtein distance between two strings
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr := make([]int, len(b)+1)
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev = curr
+	}
+	return prev[len(b)]
+}
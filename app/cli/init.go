@@ -0,0 +1,57 @@
+package cli
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+
+	"octo-server/app/scaffold"
+)
+
+// newInitCommand creates the init command, which generates a Go module embedding the server
+func newInitCommand() *cobra.Command {
+	var opts scaffold.Options
+
+	cmd := &cobra.Command{
+		Use:   "init DIR",
+		Short: "Create a Go module embedding the server, with sample routes, middleware, settings and tests",
+		Long: "Create a Go module in DIR whose program serves the server's routes along with its own,\n" +
+			"with a middleware stack, a YAML settings file and tests against a running server.\n" +
+			"The module is built against the server's source, found from the current directory unless given with --source.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dir := args[0]
+			if opts.Module == "" {
+				abs, err := filepath.Abs(dir)
+				if err != nil {
+					return err
+				}
+				opts.Module = filepath.Base(abs)
+			}
+			if opts.Source == "" {
+				source, err := scaffold.FindSource(".")
+				if err != nil {
+					return fmt.Errorf("%w: run init from the server's source or give it with --source", err)
+				}
+				opts.Source = source
+			}
+
+			names, err := scaffold.Generate(dir, opts)
+			if err != nil {
+				return err
+			}
+			out := cmd.OutOrStdout()
+			for _, name := range names {
+				fmt.Fprintf(out, "Created %s\n", filepath.Join(dir, name))
+			}
+			fmt.Fprintf(out, "\nNext steps:\n  cd %s\n  go mod tidy\n  go test ./...\n  go run . -config app.yaml\n", dir)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&opts.Module, "module", "", "Module path of the generated module (default: the name of DIR)")
+	cmd.Flags().StringVar(&opts.Source, "source", "", "Directory of the server's source the module is built against (default: the one containing the current directory)")
+
+	return cmd
+}
@@ -0,0 +1,136 @@
+package cli
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"octo-server/app/config"
+	"octo-server/app/fileio"
+)
+
+// newIOBenchCommand creates the iobench command, which compares the file I/O backends of this build
+func newIOBenchCommand() *cobra.Command {
+	var (
+		dir   string
+		size  = config.ByteSize(256 << 20)
+		block = config.ByteSize(4 << 20)
+		runs  int
+	)
+
+	cmd := &cobra.Command{
+		Use:   "iobench",
+		Short: "Measure the write and read throughput of each file I/O backend in this build",
+		Long: "Write a file through each file I/O backend the way uploads are stored, then read it back\n" +
+			"the way downloads are served, and print the best throughput of several runs. Reads are\n" +
+			"usually served from the page cache, so they measure system call overhead, not the disk.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if size <= 0 || block <= 0 || runs <= 0 {
+				return errors.New("size, block and runs must be positive")
+			}
+
+			pattern := make([]byte, 1<<20)
+			if _, err := rand.Read(pattern); err != nil {
+				return err
+			}
+
+			out := cmd.OutOrStdout()
+			fmt.Fprintf(out, "%-8s %12s %12s\n", "backend", "write MB/s", "read MB/s")
+			for _, backend := range fileio.Backends() {
+				var bestWrite, bestRead time.Duration
+				for range runs {
+					write, read, err := benchBackend(backend, dir, int64(size), int64(block), pattern)
+					if err != nil {
+						return fmt.Errorf("%s: %w", backend.Name(), err)
+					}
+					if bestWrite == 0 || write < bestWrite {
+						bestWrite = write
+					}
+					if bestRead == 0 || read < bestRead {
+						bestRead = read
+					}
+				}
+				fmt.Fprintf(out, "%-8s %12.0f %12.0f\n", backend.Name(), throughput(int64(size), bestWrite), throughput(int64(size), bestRead))
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&dir, "dir", os.TempDir(), "Directory to write the benchmark file in")
+	cmd.Flags().Var(&size, "size", "Size of the benchmark file, e.g. 256MB")
+	cmd.Flags().Var(&block, "block", "Size of each read, like the length of a ranged download, e.g. 4MB")
+	cmd.Flags().IntVar(&runs, "runs", 3, "Number of runs per backend, of which the fastest is reported")
+
+	return cmd
+}
+
+// benchBackend writes a file of size bytes repeating pattern through backend, then reads it
+// back block by block, and returns how long each took. The file is removed afterwards.
+func benchBackend(backend fileio.Backend, dir string, size, block int64, pattern []byte) (time.Duration, time.Duration, error) {
+	f, err := os.CreateTemp(dir, ".iobench-*")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	src := io.LimitReader(&repeatReader{pattern: pattern}, size)
+	start := time.Now()
+	written, err := backend.Copy(f, src)
+	if err != nil {
+		return 0, 0, err
+	}
+	if written != size {
+		return 0, 0, fmt.Errorf("wrote %d bytes, expected %d", written, size)
+	}
+	write := time.Since(start)
+
+	buf := make([]byte, block)
+	start = time.Now()
+	for off := int64(0); off < size; off += block {
+		p := buf[:min(block, size-off)]
+		if _, err := backend.ReadAt(f, p, off); err != nil && !errors.Is(err, io.EOF) {
+			return 0, 0, err
+		}
+		if !bytes.Equal(p[:min(len(p), 64)], expected(pattern, off, min(len(p), 64))) {
+			return 0, 0, fmt.Errorf("read back wrong data at offset %d", off)
+		}
+	}
+	return write, time.Since(start), nil
+}
+
+// repeatReader reads its pattern over and over
+type repeatReader struct {
+	pattern []byte
+	off     int
+}
+
+// Read fills p from the pattern, wrapping around at its end
+func (r *repeatReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		copied := copy(p[n:], r.pattern[r.off:])
+		n += copied
+		r.off = (r.off + copied) % len(r.pattern)
+	}
+	return n, nil
+}
+
+// expected returns the n bytes a repeatReader over pattern produces at offset off
+func expected(pattern []byte, off int64, n int) []byte {
+	p := make([]byte, n)
+	(&repeatReader{pattern: pattern, off: int(off % int64(len(pattern)))}).Read(p)
+	return p
+}
+
+// throughput returns the rate at which size bytes were moved in d, in MB/s
+func throughput(size int64, d time.Duration) float64 {
+	return float64(size) / (1 << 20) / d.Seconds()
+}
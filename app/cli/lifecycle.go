@@ -0,0 +1,38 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"octo-server/app/config"
+	"octo-server/app/lifecycle"
+)
+
+// newLifecycleCommand creates the lifecycle command, which applies the lifecycle rules once
+func newLifecycleCommand(cfg *config.Config) *cobra.Command {
+	return &cobra.Command{
+		Use:   "lifecycle",
+		Short: "Apply the lifecycle rules to the files directory once and exit",
+		Long: "Apply the lifecycle rules to the files directory once and exit.\n" +
+			"Combine with --lifecycle-dry-run to preview what the server would do.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := cfg.Validate(); err != nil {
+				return fmt.Errorf("invalid configuration: %w", err)
+			}
+			if !cfg.Lifecycle.Enabled() {
+				return fmt.Errorf("no lifecycle rule configured")
+			}
+
+			runner := lifecycle.NewRunner(cfg.Directory, cfg.Lifecycle, nil)
+			runner.SetLog(cmd.OutOrStdout())
+			actions, err := runner.Run()
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "%d lifecycle actions\n", len(actions))
+			return nil
+		},
+	}
+}
@@ -0,0 +1,150 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/pflag"
+
+	"octo-server/app/config"
+	"octo-server/app/crash"
+	"octo-server/app/metrics"
+	"octo-server/app/server"
+)
+
+// configPollInterval is how often the config file is checked for changes
+const configPollInterval = 2 * time.Second
+
+// reloadableFlags are the settings server.Reload applies; changing any other
+// setting takes a restart
+var reloadableFlags = map[string]bool{
+	"directory":               true,
+	"mount":                   true,
+	"vhost":                   true,
+	"rewrite":                 true,
+	"redirect":                true,
+	"maintenance":             true,
+	"maintenance-page":        true,
+	"maintenance-retry-after": true,
+	"error-page":              true,
+	"referer-rule":            true,
+	"route-limit":             true,
+	"max-conns-per-ip":        true,
+	"max-workers":             true,
+	"request-timeout":         true,
+	"proxy-protocol-from":     true,
+	"trusted-proxies":         true,
+	"deny-fingerprints":       true,
+	"exempt-cidrs":            true,
+	"allow-cidrs":             true,
+	"deny-cidrs":              true,
+	"upload-max-file-size":    true,
+	"upload-max-total-size":   true,
+	"tls-cert":                true,
+	"tls-key":                 true,
+	"tls-sni-cert":            true,
+}
+
+// reloader reloads the configuration of a running server from the same
+// command-line arguments, environment variables and config file it started with
+type reloader struct {
+	srv  *server.Server
+	args []string
+	// flags are the configuration flags the server started with
+	flags *pflag.FlagSet
+}
+
+// watchReload reloads the configuration of srv on SIGHUP and, if the server
+// was started with a config file, whenever that file changes
+func watchReload(srv *server.Server, flags *pflag.FlagSet, args []string) {
+	r := &reloader{srv: srv, args: args, flags: flags}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var changed <-chan time.Time
+	path, _ := flags.GetString(configFlag)
+	if path != "" {
+		ticker := time.NewTicker(configPollInterval)
+		changed = ticker.C
+	}
+	last := fileVersion(path)
+
+	for {
+		select {
+		case <-hup:
+			last = fileVersion(path)
+			r.reload("SIGHUP")
+		case <-changed:
+			if version := fileVersion(path); version != last {
+				last = version
+				r.reload("config file change")
+			}
+		}
+	}
+}
+
+// fileVersion identifies the contents of a file by its modification time and size
+func fileVersion(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d/%d", info.ModTime().UnixNano(), info.Size())
+}
+
+// reload loads the configuration again and applies it, keeping the running
+// configuration if it is invalid
+func (r *reloader) reload(cause string) {
+	cfg, flags, err := loadConfig(r.args)
+	if err == nil {
+		err = r.srv.Reload(cfg)
+	}
+	if err != nil {
+		metrics.Default.Inc("config_reloads_total", "result", "failed")
+		fmt.Fprintf(os.Stderr, "Config reload on %s failed, keeping the running configuration: %v\n", cause, err)
+		return
+	}
+
+	flags.VisitAll(func(f *pflag.Flag) {
+		if running := r.flags.Lookup(f.Name); running != nil && !reloadableFlags[f.Name] && f.Name != configFlag &&
+			f.Value.String() != running.Value.String() {
+			fmt.Fprintf(os.Stderr, "Config reload: %s changed, restart the server to apply it\n", f.Name)
+		}
+	})
+	crash.Default.SetConfig(configSnapshot(flags))
+	metrics.Default.Inc("config_reloads_total", "result", "success")
+	fmt.Fprintf(os.Stdout, "Configuration reloaded on %s\n", cause)
+}
+
+// loadConfig builds and validates a configuration the way the root command
+// does at startup, from command-line arguments, the environment and the config file
+func loadConfig(args []string) (*config.Config, *pflag.FlagSet, error) {
+	cfg := &config.Config{}
+	flags := pflag.NewFlagSet("octo-server", pflag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	// Subcommands and their flags are not configuration
+	flags.ParseErrorsWhitelist.UnknownFlags = true
+	flags.String(configFlag, "", "")
+	bindConfigFlags(flags, cfg)
+
+	if err := flags.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	if err := applyEnv(flags); err != nil {
+		return nil, nil, err
+	}
+	if path, _ := flags.GetString(configFlag); path != "" {
+		if err := applyConfigFile(flags, path); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, nil, err
+	}
+	return cfg, flags, nil
+}
@@ -0,0 +1,85 @@
+package cli
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// newReplayCommand creates the replay command, which sends recorded raw requests to a server
+func newReplayCommand() *cobra.Command {
+	var (
+		addr    string
+		crlf    bool
+		timeout time.Duration
+	)
+
+	cmd := &cobra.Command{
+		Use:   "replay FILE...",
+		Short: "Send raw HTTP requests recorded in files to a server and print the responses",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			for _, path := range args {
+				data, err := os.ReadFile(path)
+				if err != nil {
+					return fmt.Errorf("failed to read %s: %w", path, err)
+				}
+				if crlf {
+					data = toCRLF(data)
+				}
+
+				fmt.Fprintf(cmd.ErrOrStderr(), "==> %s\n", path)
+				if err := replay(addr, data, timeout, cmd.OutOrStdout()); err != nil {
+					return fmt.Errorf("failed to replay %s: %w", path, err)
+				}
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&addr, "addr", "localhost:4221", "Address of the server to replay against")
+	cmd.Flags().BoolVar(&crlf, "crlf", false, "Convert bare LF line endings in the files to CRLF")
+	cmd.Flags().DurationVar(&timeout, "timeout", 2*time.Second, "How long to wait for the server to go quiet")
+
+	return cmd
+}
+
+// replay writes data to a new connection and copies everything received to out
+// until the server closes the connection or stays silent for timeout
+func replay(addr string, data []byte, timeout time.Duration, out io.Writer) error {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write(data); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 32*1024)
+	for {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		n, err := conn.Read(buf)
+		out.Write(buf[:n])
+		if err != nil {
+			var netErr net.Error
+			if errors.Is(err, io.EOF) || (errors.As(err, &netErr) && netErr.Timeout()) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// toCRLF converts bare LF line endings to CRLF
+func toCRLF(data []byte) []byte {
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))
+}
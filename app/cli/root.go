@@ -0,0 +1,163 @@
+package cli
+
+import (
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"octo-server/app/config"
+	"octo-server/app/lifecycle"
+	"octo-server/app/proxy"
+	"octo-server/app/trash"
+)
+
+// Execute runs the command selected by the command-line arguments
+func Execute() error {
+	return NewRootCommand().Execute()
+}
+
+// NewRootCommand creates the octo-server command and its subcommands.
+// Running it without a subcommand serves, so existing invocations keep working.
+func NewRootCommand() *cobra.Command {
+	cfg := &config.Config{}
+
+	root := &cobra.Command{
+		Use:          "octo-server",
+		Short:        "A lightweight HTTP/1.1, HTTP/2 and HTTP/3 server",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			flags := cmd.Root().PersistentFlags()
+			if err := applyEnv(flags); err != nil {
+				return err
+			}
+			if path, _ := flags.GetString(configFlag); path != "" {
+				return applyConfigFile(flags, path)
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runServe(cmd, cfg)
+		},
+	}
+	root.PersistentFlags().String(configFlag, "", "YAML file of settings keyed by flag name; flags and OCTO_* environment variables override it")
+	bindConfigFlags(root.PersistentFlags(), cfg)
+
+	root.AddCommand(
+		newServeCommand(cfg),
+		newCheckCommand(cfg),
+		newLifecycleCommand(cfg),
+		newRoutesCommand(cfg),
+		newReplayCommand(),
+		newIOBenchCommand(),
+		newVersionCommand(),
+		newSelftestCommand(),
+		newInitCommand(),
+	)
+
+	return root
+}
+
+// bindConfigFlags registers the server configuration flags, storing their values in cfg.
+// Each flag can also be given through its OCTO_* environment variable.
+func bindConfigFlags(flags *pflag.FlagSet, cfg *config.Config) {
+	flags.StringVar(&cfg.Directory, "directory", "", "The directory from which files should be served")
+	flags.StringVar(&cfg.Port, "port", "4221", "The port on which the server should listen")
+	flags.StringVar(&cfg.Addr, "addr", "", "Address to listen on as HOST:PORT, e.g. 127.0.0.1:8080 or [::]:443, instead of --port on every interface")
+	flags.Var((*config.ListenerFlag)(&cfg.Listeners), "listen", "Listen on 'ADDRESS[,OPTION...]' with options tls, h2c, proxy-protocol and ipv6only, where ADDRESS is HOST:PORT, :PORT or unix:PATH, instead of --addr and --port (repeatable)")
+	flags.BoolVar(&cfg.ReusePort, "reuse-port", false, "Bind TCP and HTTP/3 sockets with SO_REUSEPORT, so another server process can listen on the same addresses")
+	flags.IntVar(&cfg.WorkerProcesses, "worker-processes", 0, "Serve from this many worker processes sharing the listening sockets, supervised and restarted by the main process (0 serves from the main process)")
+	flags.DurationVar(&cfg.DrainTimeout, "drain-timeout", 30*time.Second, "How long open connections may take to finish when the server shuts down or upgrades")
+	flags.Var((*config.MountFlag)(&cfg.Mounts), "mount", "Serve a directory below a URL path prefix as 'PREFIX=DIR[:OPTIONS]', with options 'ro' and 'listing', e.g. '/assets=/srv/assets:ro' (repeatable)")
+	flags.Var((*config.VirtualHostFlag)(&cfg.VirtualHosts), "vhost", "Serve another directory to requests for a host as 'HOST=DIR', e.g. 'b.example.com=/var/www/b' (comma-separated, repeatable)")
+	flags.Var((*config.RedirectFlag)(&cfg.Rewrites), "redirect", "Redirect applied before routing as 'PATH TARGET [STATUS]', where a PATH starting with '^' is a pattern (repeatable)")
+	flags.Var((*config.RefererRuleFlag)(&cfg.RefererRules), "referer-rule", "Restrict a path prefix to requests from pages of the given hosts as 'PREFIX HOST[,HOST...] [PLACEHOLDER]', serving the PLACEHOLDER file or else 403 to others (repeatable)")
+	flags.Var((*config.RewriteFlag)(&cfg.Rewrites), "rewrite", "Rewrite rule applied before routing as 'PATTERN REPLACEMENT [FLAGS]', with flags 'last' and 'redirect[=STATUS]' (repeatable)")
+	flags.Var((*config.RouteLimitFlag)(&cfg.RouteLimits), "route-limit", "Server-wide rate limit for a route as '[METHOD ]PREFIX=RATE[:BURST]' (comma-separated, repeatable)")
+	flags.IntVar(&cfg.MaxConnsPerIP, "max-conns-per-ip", 0, "Maximum number of open connections per client IP (0 for unlimited)")
+	flags.IntVar(&cfg.IPv6Prefix, "ipv6-prefix", 64, "Prefix length IPv6 clients are grouped by for --max-conns-per-ip, e.g. 64 for the network of one household (0 or 128 counts each address)")
+	flags.IntVar(&cfg.MaxWorkers, "max-workers", 0, "Maximum number of requests handled at once, the rest waiting in the order of their Priority header (0 for unlimited)")
+	flags.DurationVar(&cfg.RequestTimeout, "request-timeout", 0, "Give up on requests still being handled after this long, cancelling their context and answering 503 if nothing was sent yet (0 for none)")
+	flags.Var(&cfg.ProxyProtocolFrom, "proxy-protocol-from", "Comma-separated CIDRs of the load balancers allowed to connect to proxy-protocol listeners (default: any; repeatable)")
+	flags.Var(&cfg.TrustedProxies, "trusted-proxies", "Comma-separated CIDRs of the reverse proxies whose Forwarded and X-Forwarded-For headers name the client (repeatable)")
+	flags.Var((*config.ListFlag)(&cfg.DenyFingerprints), "deny-fingerprints", "JA3, JA4 or header order fingerprints of clients to refuse with 403 (comma-separated, repeatable)")
+	flags.BoolVar(&cfg.LogFingerprints, "log-fingerprints", false, "Log the JA3, JA4 and header order fingerprints of every request")
+	flags.BoolVar(&cfg.AccessLog, "access-log", false, "Log every request with its client, status, size and duration")
+	flags.Var((*config.ListFlag)(&cfg.AccessLogHeaders), "access-log-headers", "Request headers to include in the access log, e.g. Referer,X-Request-ID (comma-separated, repeatable)")
+	flags.Var((*config.ListFlag)(&cfg.AccessLogResponseHeaders), "access-log-response-headers", "Response headers to include in the access log, e.g. Content-Type (comma-separated, repeatable)")
+	flags.IntVar(&cfg.RecentRequests, "recent-requests", 100, "Number of the latest requests kept in memory for crash reports and --recent-requests-endpoint (0 keeps none)")
+	flags.BoolVar(&cfg.RecentRequestsEndpoint, "recent-requests-endpoint", false, "List the latest requests with their clients at GET /api/requests")
+	flags.DurationVar(&cfg.ConnStuckAfter, "conn-stuck-after", 10*time.Minute, "Log and count connections stuck in one state, such as a request being handled, for this long (0 disables)")
+	flags.BoolVar(&cfg.ConnectionsEndpoint, "connections-endpoint", false, "List the open connections with their states and ages at GET /api/connections")
+	flags.Var(&cfg.ExemptCIDRs, "exempt-cidrs", "Comma-separated CIDRs whose clients bypass rate and connection limits (repeatable)")
+	flags.Var(&cfg.IPFilter.Allow, "allow-cidrs", "Comma-separated CIDRs allowed to connect; all others are refused (repeatable)")
+	flags.Var(&cfg.IPFilter.Deny, "deny-cidrs", "Comma-separated CIDRs refused before any parsing (repeatable)")
+	flags.Var(&cfg.MemoryBudget, "memory-budget", "Approximate memory all connections may hold for buffers and request bodies, e.g. 512MB (0 for unlimited)")
+	flags.Var(&cfg.UploadMaxFileSize, "upload-max-file-size", "Largest file accepted in a multipart upload, e.g. 100MB (0 for unlimited)")
+	flags.Var(&cfg.UploadMaxTotalSize, "upload-max-total-size", "Largest total size of the files in a multipart upload (0 for unlimited)")
+	flags.StringVar(&cfg.TextCharset, "text-charset", "", "Serve text files as text, declaring this charset, e.g. utf-8, unless a byte order mark gives another (empty serves them as octet streams)")
+	flags.Var((*config.ListFlag)(&cfg.TextExtensions), "text-extensions", "Extensions of the text files --text-charset applies to (comma-separated, repeatable; default txt, csv)")
+	flags.Var(&cfg.MmapMinSize, "mmap-min-size", "Serve downloads of at least this size from memory-mapped files, e.g. 64MB (0 reads them into memory instead)")
+	flags.IntVar(&cfg.GCPercent, "gc-percent", 0, "Garbage collection target percentage like GOGC; -1 turns the collector off (0 keeps GOGC or the default of 100)")
+	flags.Var(&cfg.MemoryLimit, "memory-limit", "Soft limit on the memory of the whole process like GOMEMLIMIT, e.g. 2GB (0 keeps GOMEMLIMIT or no limit)")
+	flags.Var(&cfg.ReadBufferSize, "read-buffer-size", "Size of each connection's request read buffer, e.g. 16KB (default 4KB)")
+	flags.Var(&cfg.SocketSendBuffer, "socket-send-buffer", "Kernel send buffer size of each connection, e.g. 1MB (0 for the OS default)")
+	flags.Var(&cfg.SocketReceiveBuffer, "socket-receive-buffer", "Kernel receive buffer size of each connection, e.g. 1MB (0 for the OS default)")
+	flags.Var((*config.Duration)(&cfg.PerfLogInterval), "perf-log-interval", "Performance profile mode: log allocation and GC statistics at this interval, e.g. 10s (0 disables)")
+	flags.BoolVar(&cfg.Maintenance, "maintenance", false, "Maintenance mode: answer every request but those for /metrics and /api/upstreams with 503")
+	flags.StringVar(&cfg.MaintenancePage, "maintenance-page", "", "File sent as the body of maintenance mode responses (default: a short plain text notice)")
+	flags.DurationVar(&cfg.MaintenanceRetryAfter, "maintenance-retry-after", 5*time.Minute, "Retry-After sent with maintenance mode responses")
+	flags.Var((*config.ErrorPageFlag)(&cfg.ErrorPages), "error-page", "File sent as the body of error responses with a status as 'CODE=FILE', e.g. '404=/srv/errors/404.html'; files ending in .tmpl are Go templates (repeatable)")
+	flags.BoolVar(&cfg.AuditContentLength, "audit-content-length", false, "Debug mode: log responses whose Content-Length does not match the body bytes written")
+	flags.StringVar(&cfg.ServerHeader, "server-header", "octo-server", "Server header sent with responses that do not set their own (empty for none)")
+	flags.Var((*config.JSONEndpointFlag)(&cfg.JSONEndpoints), "json-endpoint", "Computed JSON endpoint as '/PATH=TEMPLATE' or '/PATH=@FILE', using Go template syntax (repeatable)")
+	flags.Var((*config.ProxyFlag)(&cfg.Proxies), "proxy", "Forward requests under a path prefix to upstream servers as '[HOST]PREFIX=URL[|URL...]' (comma-separated, repeatable)")
+	flags.Var((*config.Duration)(&cfg.ProxyHealth.Interval), "proxy-health-interval", "How often proxy upstreams are probed, taking unhealthy ones out of the rotation (0 disables health checks)")
+	flags.StringVar(&cfg.ProxyHealth.Path, "proxy-health-path", "", "Path probed with GET on each upstream, healthy on 2xx or 3xx (default: TCP connect)")
+	flags.Var(&cfg.ProxyCacheSize, "proxy-cache-size", "Memory for caching proxied responses as Cache-Control allows, e.g. 256MB (0 disables caching unless --proxy-cache-dir is set)")
+	flags.StringVar(&cfg.ProxyCacheDir, "proxy-cache-dir", "", "Directory cached proxy responses spill to once they outgrow --proxy-cache-size; emptied on startup")
+	flags.Var(&cfg.ProxyCacheDiskSize, "proxy-cache-disk-size", "Total size of the cached responses in --proxy-cache-dir, e.g. 10GB (0 for unlimited)")
+	flags.StringVar(&cfg.GitRoot, "git-root", "", "Directory of bare git repositories served below /git/ through the smart HTTP protocol")
+	flags.BoolVar(&cfg.GitPush, "git-push", false, "Allow pushing to the repositories in --git-root; anyone who can reach the server can push")
+	flags.StringVar(&cfg.CalDAVRoot, "caldav-root", "", "Directory whose subdirectories of .ics files are served as read-only calendars below /caldav/")
+	flags.BoolVar(&cfg.ForwardProxy, "forward-proxy", false, "Act as a forward proxy, tunneling CONNECT requests to the requested host and port")
+	flags.IntSliceVar(&cfg.ConnectPorts, "connect-ports", []int{443}, "Comma-separated ports CONNECT requests may tunnel to")
+	flags.StringVar(&cfg.ProxyBalance, "proxy-balance", proxy.RoundRobin, "How proxy routes with several upstreams spread requests: round-robin or least-conns")
+	flags.Var((*config.OriginFlag)(&cfg.MirrorOrigin), "mirror-origin", "Fetch files missing from the directory from this URL, storing them locally (pull-through cache)")
+	flags.StringVar(&cfg.S3Bucket, "s3-bucket", "", "Serve the files as this bucket through an S3-compatible API below /s3")
+	flags.StringVar(&cfg.S3AccessKey, "s3-access-key", "", "Access key ID S3 clients sign requests with (default: anonymous access)")
+	flags.StringVar(&cfg.S3SecretKey, "s3-secret-key", "", "Secret access key for --s3-access-key; prefer the OCTO_S3_SECRET_KEY environment variable")
+	flags.StringVar(&cfg.StatsFile, "stats-file", "", "JSON file persisting per-file access statistics across restarts")
+	flags.StringVar(&cfg.CrashDir, "crash-dir", "", "Directory crash reports are written to when the server panics or hits a fatal runtime error")
+	flags.StringVar(&cfg.CrashReportDSN, "crash-report-dsn", "", "Sentry DSN crash reports are also sent to, e.g. https://KEY@sentry.example.com/1; prefer the OCTO_CRASH_REPORT_DSN environment variable")
+	flags.BoolVar(&cfg.RecoverPanics, "recover-panics", true, "Answer requests whose handler panics with 500 and keep serving, rather than crashing the server")
+	flags.IntVar(&cfg.VersionsKeep, "versions-keep", 0, "Number of previous versions kept when a file is overwritten (0 disables versioning)")
+	flags.Var(&cfg.VersionsMaxSize, "versions-max-size", "Total size of kept versions, evicting the oldest first, e.g. 5GB (0 for unlimited)")
+	cfg.TrashRetention = trash.DefaultRetention
+	flags.Var((*config.Duration)(&cfg.TrashRetention), "trash-retention", "How long deleted files stay in the trash and can be restored (0 deletes immediately)")
+	flags.Var((*config.Duration)(&cfg.Lifecycle.DeleteAfter), "lifecycle-delete-after", "Delete files not modified for this long, e.g. 30d (0 to keep)")
+	flags.Var((*config.Duration)(&cfg.Lifecycle.ArchiveAfter), "lifecycle-archive-after", "Move files not modified for this long into the archive directory, e.g. 7d (0 to keep)")
+	flags.StringVar(&cfg.Lifecycle.ArchiveDir, "lifecycle-archive-dir", lifecycle.DefaultArchiveDir, "Subdirectory of the files directory that archived files are moved to")
+	flags.Var((*config.ByteSize)(&cfg.Lifecycle.MaxSize), "lifecycle-max-size", "Cap the total size of the files, evicting the least recently used first, e.g. 10GB (0 for unlimited)")
+	flags.Var((*config.Duration)(&cfg.Lifecycle.Interval), "lifecycle-interval", "How often lifecycle rules are applied (default 1h)")
+	flags.BoolVar(&cfg.Lifecycle.DryRun, "lifecycle-dry-run", false, "Log the lifecycle actions that would be taken without changing any file")
+	flags.StringVar(&cfg.TLSCert, "tls-cert", "", "PEM certificate file; serves TLS with HTTP/2 negotiated through ALPN (requires --tls-key)")
+	flags.StringVar(&cfg.TLSKey, "tls-key", "", "PEM private key file for --tls-cert")
+	flags.Var((*config.SNICertificateFlag)(&cfg.SNICertificates), "tls-sni-cert", "Serve another certificate to clients asking for a host through SNI as 'HOST=CERT:KEY', e.g. 'b.example.com=/etc/tls/b.pem:/etc/tls/b.key'; --tls-cert is served for other hosts (comma-separated, repeatable)")
+	flags.BoolVar(&cfg.HTTP3, "http3", false, "Also serve HTTP/3 over QUIC on the same UDP port, advertised through Alt-Svc (requires --tls-cert)")
+	flags.StringVar(&cfg.HTTP3Port, "http3-port", "", "UDP port to serve HTTP/3 on instead of the port of each TLS listener")
+	flags.BoolVar(&cfg.HTTP3EarlyData, "http3-0rtt", false, "Accept requests in 0-RTT early data on resumed HTTP/3 connections; those that are not GET, HEAD or OPTIONS get 425 Too Early")
+	flags.StringVar(&cfg.TLS.Profile, "tls-profile", "", "TLS settings profile: modern (TLS 1.3 only), intermediate or old (TLS 1.0 and legacy ciphers) (default intermediate)")
+	flags.StringVar(&cfg.TLS.MinVersion, "tls-min-version", "", "Lowest TLS version to accept: 1.0, 1.1, 1.2 or 1.3 (default from --tls-profile)")
+	flags.StringVar(&cfg.TLS.MaxVersion, "tls-max-version", "", "Highest TLS version to accept (default 1.3)")
+	flags.Var((*config.ListFlag)(&cfg.TLS.CipherSuites), "tls-cipher-suites", "TLS 1.2 and earlier cipher suites by IANA name, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 (comma-separated, repeatable; default from --tls-profile)")
+	flags.Var((*config.ListFlag)(&cfg.TLS.Curves), "tls-curves", "Key exchange groups in order of preference: X25519MLKEM768, X25519, P-256, P-384, P-521 and others (comma-separated, repeatable; default Go's)")
+	flags.BoolVar(&cfg.TLS.DisableSessionTickets, "tls-disable-session-tickets", false, "Do not issue session tickets, so clients cannot resume TLS sessions")
+	flags.BoolVar(&cfg.TLS.DisableOCSPStapling, "tls-disable-ocsp-stapling", false, "Do not fetch OCSP responses for the certificate from its issuer to staple to TLS handshakes")
+	flags.StringVar(&cfg.TLS.TicketKeyFile, "tls-ticket-keys", "", "File of base64 32-byte session ticket keys, one per line with the first used to issue tickets, shared by servers behind a load balancer so sessions resume on any of them")
+	flags.BoolVar(&cfg.H2C, "h2c", false, "Accept cleartext HTTP/2, with prior knowledge or through 'Upgrade: h2c'")
+	flags.IntVar(&cfg.Compression.MinSize, "compress-min-size", 0, "Smallest response body size, in bytes, to compress")
+	flags.IntVar(&cfg.Compression.MaxConcurrent, "compress-max-concurrent", 0, "Maximum number of response bodies compressed at once; others are sent uncompressed (0 for unlimited)")
+	flags.Var((*config.ListFlag)(&cfg.Compression.ContentTypes), "compress-types", "Content type prefixes to compress (comma-separated, repeatable; default text/, JSON, JavaScript, XML, SVG)")
+}
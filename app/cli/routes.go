@@ -0,0 +1,32 @@
+package cli
+
+import (
+	"fmt"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"octo-server/app/config"
+	"octo-server/app/server"
+)
+
+// newRoutesCommand creates the routes command, which prints the route table
+func newRoutesCommand(cfg *config.Config) *cobra.Command {
+	return &cobra.Command{
+		Use:   "routes",
+		Short: "Print the routes served, in matching order",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			tw := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+			fmt.Fprintln(tw, "HOST\tMETHOD\tPATTERN\tDESCRIPTION")
+			for _, route := range server.NewServer(cfg).Router().Routes() {
+				host := route.Host
+				if host == "" {
+					host = "*"
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", host, route.Method, route.Pattern, route.Description)
+			}
+			return tw.Flush()
+		},
+	}
+}
@@ -0,0 +1,27 @@
+package cli
+
+import (
+	"github.com/spf13/cobra"
+
+	"octo-server/app/selftest"
+)
+
+// newSelftestCommand creates the selftest command, which runs end-to-end checks against an in-process server
+func newSelftestCommand() *cobra.Command {
+	var filter string
+
+	cmd := &cobra.Command{
+		Use:   "selftest",
+		Short: "Boot a server on an ephemeral port and run end-to-end checks against it",
+		Long: "Boot a server on an ephemeral port and run end-to-end checks against it over real sockets.\n" +
+			"Build with -race, e.g. 'go run -race ./app selftest', to also detect data races.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return selftest.Run(cmd.OutOrStdout(), filter)
+		},
+	}
+
+	cmd.Flags().StringVar(&filter, "run", "", "Only run the checks whose names match this regular expression")
+
+	return cmd
+}
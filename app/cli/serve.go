@@ -0,0 +1,46 @@
+package cli
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"octo-server/app/config"
+	"octo-server/app/crash"
+	"octo-server/app/server"
+)
+
+// newServeCommand creates the serve command
+func newServeCommand(cfg *config.Config) *cobra.Command {
+	return &cobra.Command{
+		Use:   "serve",
+		Short: "Start the server (the default command)",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runServe(cmd, cfg)
+		},
+	}
+}
+
+// runServe starts the server and blocks until it stops, reloading its
+// configuration on SIGHUP or when the config file changes, shutting it down
+// on SIGTERM or SIGINT and upgrading it on SIGUSR2. With worker processes,
+// this process supervises them instead, passing the signals on.
+func runServe(cmd *cobra.Command, cfg *config.Config) error {
+	if err := crash.Default.Configure(cfg.CrashDir, cfg.CrashReportDSN); err != nil {
+		return err
+	}
+	defer crash.Default.Close()
+	crash.Default.SetConfig(configSnapshot(cmd.Root().PersistentFlags()))
+
+	if cfg.WorkerProcesses > 0 && !server.IsWorker() {
+		supervisor := server.NewSupervisor(cfg)
+		go watchSupervisorSignals(supervisor)
+		return supervisor.Run()
+	}
+
+	srv := server.NewServer(cfg)
+	go watchReload(srv, cmd.Root().PersistentFlags(), os.Args[1:])
+	go watchSignals(srv)
+	return srv.Start()
+}
@@ -0,0 +1,72 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"octo-server/app/server"
+)
+
+// watchSignals shuts srv down gracefully on SIGTERM or SIGINT, exiting at once
+// on a second one, and upgrades it to the binary on disk on the upgrade signal
+// where the platform has one
+func watchSignals(srv *server.Server) {
+	stop := make(chan os.Signal, 2)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	upgrade := make(chan os.Signal, 1)
+	if upgradeSignal != nil {
+		signal.Notify(upgrade, upgradeSignal)
+	}
+
+	for {
+		select {
+		case <-stop:
+			srv.Shutdown()
+			go func() {
+				<-stop
+				fmt.Fprintf(os.Stderr, "Exiting without draining connections\n")
+				os.Exit(1)
+			}()
+			return
+		case <-upgrade:
+			if err := srv.Upgrade(); err != nil {
+				fmt.Fprintf(os.Stderr, "Upgrade failed, keeping this server process: %v\n", err)
+			}
+		}
+	}
+}
+
+// watchSupervisorSignals stops the worker processes of supervisor on SIGTERM
+// or SIGINT, exiting at once on a second one, has them reload their
+// configuration on SIGHUP and replaces them on the upgrade signal
+func watchSupervisorSignals(supervisor *server.Supervisor) {
+	stop := make(chan os.Signal, 2)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	upgrade := make(chan os.Signal, 1)
+	if upgradeSignal != nil {
+		signal.Notify(upgrade, upgradeSignal)
+	}
+
+	for {
+		select {
+		case <-stop:
+			supervisor.Shutdown()
+			go func() {
+				<-stop
+				fmt.Fprintf(os.Stderr, "Exiting without waiting for worker processes\n")
+				os.Exit(1)
+			}()
+			return
+		case <-hup:
+			supervisor.Reload()
+		case <-upgrade:
+			if err := supervisor.Upgrade(); err != nil {
+				fmt.Fprintf(os.Stderr, "Upgrade failed: %v\n", err)
+			}
+		}
+	}
+}
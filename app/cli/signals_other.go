@@ -0,0 +1,8 @@
+//go:build !unix
+
+package cli
+
+import "os"
+
+// upgradeSignal is nil, since this platform has no signal to ask for an upgrade
+var upgradeSignal os.Signal
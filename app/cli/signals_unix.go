@@ -0,0 +1,11 @@
+//go:build unix
+
+package cli
+
+import (
+	"os"
+	"syscall"
+)
+
+// upgradeSignal asks a running server to upgrade to the binary on disk
+var upgradeSignal os.Signal = syscall.SIGUSR2
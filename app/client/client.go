@@ -0,0 +1,294 @@
+// Package client calls the files API of an octo-server: uploads, appends that
+// resume where the server's copy ends, downloads of whole files or byte ranges,
+// listings and deletes. It depends on the standard library only, so programs
+// talking to a server need not import the server itself.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	nethttp "net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned for files the server does not have
+var ErrNotFound = errors.New("file not found")
+
+// StatusError is returned when the server answers with an unexpected status
+type StatusError struct {
+	Code   int
+	Status string
+}
+
+// Error implements error
+func (e *StatusError) Error() string {
+	return "server responded with " + e.Status
+}
+
+// OffsetError is returned by AppendAt and Resume when the offset is not the size of the
+// file on the server, which is where appending must resume
+type OffsetError struct {
+	Size int64
+}
+
+// Error implements error
+func (e *OffsetError) Error() string {
+	return fmt.Sprintf("append offset does not match the file size of %d", e.Size)
+}
+
+// File is a file of the server's directory
+type File struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// AppendResult tells where an append was written and how large the file became
+type AppendResult struct {
+	Offset   int64 `json:"offset"`
+	Appended int64 `json:"appended"`
+	Size     int64 `json:"size"`
+}
+
+// Client calls a server's files API
+type Client struct {
+	base *url.URL
+	http *nethttp.Client
+}
+
+// New creates a client of the server at baseURL, e.g. "http://localhost:4221",
+// sending requests with httpClient, or nethttp.DefaultClient if nil
+func New(baseURL string, httpClient *nethttp.Client) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid server URL %q: must be an http or https URL", baseURL)
+	}
+	if httpClient == nil {
+		httpClient = nethttp.DefaultClient
+	}
+	return &Client{base: u, http: httpClient}, nil
+}
+
+// Upload stores the content of r as a file, replacing any previous content.
+// The server only puts the file in place once all of it was received.
+func (c *Client) Upload(ctx context.Context, name string, r io.Reader) error {
+	resp, err := c.do(ctx, "PUT", fileURL(name), nil, r)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return expectStatus(resp, nethttp.StatusCreated)
+}
+
+// Append appends data to a file wherever it ends, creating the file if missing
+func (c *Client) Append(ctx context.Context, name string, data []byte) (AppendResult, error) {
+	return c.appendFile(ctx, name, map[string]string{"X-Append": "true"}, bytes.NewReader(data), int64(len(data)))
+}
+
+// AppendAt appends data to a file at offset, which must be the file's current
+// size. Otherwise nothing is written and the error is an *OffsetError with
+// that size, so an append that did arrive is never applied twice.
+func (c *Client) AppendAt(ctx context.Context, name string, offset int64, data []byte) (AppendResult, error) {
+	if len(data) == 0 {
+		return AppendResult{}, errors.New("nothing to append")
+	}
+	contentRange := fmt.Sprintf("bytes %d-%d/*", offset, offset+int64(len(data))-1)
+	return c.appendFile(ctx, name, map[string]string{"Content-Range": contentRange}, bytes.NewReader(data), int64(len(data)))
+}
+
+// appendFile sends an append of size bytes, with the headers choosing where it goes
+func (c *Client) appendFile(ctx context.Context, name string, headers map[string]string, body io.Reader, size int64) (AppendResult, error) {
+	req, err := c.newRequest(ctx, "PATCH", fileURL(name), headers, body)
+	if err != nil {
+		return AppendResult{}, err
+	}
+	req.ContentLength = size
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return AppendResult{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == nethttp.StatusRequestedRangeNotSatisfiable {
+		if size, ok := completeLength(resp.Header.Get("Content-Range")); ok {
+			return AppendResult{}, &OffsetError{Size: size}
+		}
+	}
+	if err := expectStatus(resp, nethttp.StatusOK); err != nil {
+		return AppendResult{}, err
+	}
+	var result AppendResult
+	return result, json.NewDecoder(resp.Body).Decode(&result)
+}
+
+// Resume uploads the part of r the server's copy of a file is missing,
+// appending from the size of that copy, so an upload cut short continues
+// where it stopped. It returns the size of the file once complete.
+func (c *Client) Resume(ctx context.Context, name string, r io.ReadSeeker) (int64, error) {
+	total, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	offset, err := c.Size(ctx, name)
+	if errors.Is(err, ErrNotFound) {
+		offset = 0
+	} else if err != nil {
+		return 0, err
+	}
+	if offset > total {
+		return offset, fmt.Errorf("file on the server is larger than the upload, %d bytes", offset)
+	}
+	if offset == total {
+		return total, nil
+	}
+	if _, err := r.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	headers := map[string]string{"Content-Range": fmt.Sprintf("bytes %d-%d/%d", offset, total-1, total)}
+	result, err := c.appendFile(ctx, name, headers, io.LimitReader(r, total-offset), total-offset)
+	return result.Size, err
+}
+
+// Size returns the size of a file
+func (c *Client) Size(ctx context.Context, name string) (int64, error) {
+	resp, err := c.do(ctx, "GET", fileURL(name), map[string]string{"Range": "bytes=0-0"}, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case nethttp.StatusPartialContent, nethttp.StatusRequestedRangeNotSatisfiable:
+		// Empty files have no range to send
+		if size, ok := completeLength(resp.Header.Get("Content-Range")); ok {
+			return size, nil
+		}
+	case nethttp.StatusOK:
+		return resp.ContentLength, nil
+	}
+	return 0, expectStatus(resp, nethttp.StatusPartialContent)
+}
+
+// Download returns the content of a file, which the caller must close
+func (c *Client) Download(ctx context.Context, name string) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, "GET", fileURL(name), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := expectStatus(resp, nethttp.StatusOK); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// DownloadRange returns length bytes of a file from offset, or all of them
+// from offset if length is negative. The caller must close the content.
+func (c *Client) DownloadRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	spec := fmt.Sprintf("bytes=%d-", offset)
+	if length >= 0 {
+		if length == 0 {
+			return io.NopCloser(strings.NewReader("")), nil
+		}
+		spec += strconv.FormatInt(offset+length-1, 10)
+	}
+	resp, err := c.do(ctx, "GET", fileURL(name), map[string]string{"Range": spec}, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := expectStatus(resp, nethttp.StatusPartialContent); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// List returns the files of the server's directory
+func (c *Client) List(ctx context.Context) ([]File, error) {
+	resp, err := c.do(ctx, "GET", "/api/files", map[string]string{"Accept": "application/json"}, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := expectStatus(resp, nethttp.StatusOK); err != nil {
+		return nil, err
+	}
+	var files []File
+	return files, json.NewDecoder(resp.Body).Decode(&files)
+}
+
+// Delete deletes a file, which the server may keep in its trash
+func (c *Client) Delete(ctx context.Context, name string) error {
+	resp, err := c.do(ctx, "DELETE", fileURL(name), nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == nethttp.StatusNoContent {
+		return nil
+	}
+	return expectStatus(resp, nethttp.StatusOK)
+}
+
+// do sends a request for a path below the base URL
+func (c *Client) do(ctx context.Context, method, urlPath string, headers map[string]string, body io.Reader) (*nethttp.Response, error) {
+	req, err := c.newRequest(ctx, method, urlPath, headers, body)
+	if err != nil {
+		return nil, err
+	}
+	return c.http.Do(req)
+}
+
+// newRequest creates a request for a path below the base URL
+func (c *Client) newRequest(ctx context.Context, method, urlPath string, headers map[string]string, body io.Reader) (*nethttp.Request, error) {
+	// The server takes file names as they appear in the URL, without unescaping them
+	target := *c.base
+	target.Path = strings.TrimSuffix(target.Path, "/") + urlPath
+	target.RawPath = ""
+	if !strings.HasSuffix(target.EscapedPath(), urlPath) || path.Clean(urlPath) != urlPath {
+		return nil, fmt.Errorf("invalid path %q: file names cannot contain characters needing escapes or dot segments", urlPath)
+	}
+	req, err := nethttp.NewRequestWithContext(ctx, method, target.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	return req, nil
+}
+
+// fileURL returns the path of a file in the files API
+func fileURL(name string) string {
+	return "/files/" + strings.TrimPrefix(name, "/")
+}
+
+// expectStatus returns nil if a response has the wanted status, ErrNotFound
+// for 404, or else a *StatusError
+func expectStatus(resp *nethttp.Response, want int) error {
+	switch resp.StatusCode {
+	case want:
+		return nil
+	case nethttp.StatusNotFound:
+		return ErrNotFound
+	}
+	return &StatusError{Code: resp.StatusCode, Status: resp.Status}
+}
+
+// completeLength returns the complete length of a Content-Range header such
+// as "bytes 0-0/1234" or "bytes */1234"
+func completeLength(contentRange string) (int64, bool) {
+	_, total, ok := strings.Cut(contentRange, "/")
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(total, 10, 64)
+	return n, err == nil && n >= 0
+}
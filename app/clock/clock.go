@@ -0,0 +1,67 @@
+package clock
+
+import "time"
+
+// Clock tells the time and schedules work on it. Time-dependent code takes a
+// Clock rather than calling the time package, so tests can drive it with a Fake.
+type Clock interface {
+	// Now returns the current time
+	Now() time.Time
+	// NewTicker returns a ticker sending the time on its channel every d
+	NewTicker(d time.Duration) Ticker
+	// AfterFunc calls f in its own goroutine once d has passed
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Ticker delivers ticks of a Clock at intervals
+type Ticker interface {
+	// C returns the channel the ticks are delivered on
+	C() <-chan time.Time
+	// Stop turns off the ticker; no more ticks are sent after it returns
+	Stop()
+}
+
+// Timer is a function call scheduled by AfterFunc
+type Timer interface {
+	// Stop prevents the call, reporting false if it was already made or stopped
+	Stop() bool
+}
+
+// Real is the system clock
+var Real Clock = realClock{}
+
+// Or returns c, or Real if c is nil
+func Or(c Clock) Clock {
+	if c == nil {
+		return Real
+	}
+	return c
+}
+
+// realClock is a Clock backed by the time package
+type realClock struct{}
+
+// Now implements Clock
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// NewTicker implements Clock
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+// AfterFunc implements Clock
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// realTicker adapts a time.Ticker to Ticker
+type realTicker struct {
+	*time.Ticker
+}
+
+// C implements Ticker
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
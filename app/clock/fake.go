@@ -0,0 +1,156 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Fake is a Clock whose time only moves when told to, letting tests of
+// expiry and timeouts run without sleeping
+type Fake struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*waiter
+}
+
+// waiter is a pending tick or function call of a Fake
+type waiter struct {
+	at     time.Time
+	period time.Duration // zero for AfterFunc
+	f      func()
+	ticks  chan time.Time
+}
+
+// NewFake creates a fake clock reading now
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+// Now implements Clock
+func (c *Fake) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTicker implements Clock. Like a time.Ticker, ticks are dropped while the
+// channel holds an unread one.
+func (c *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("clock: non-positive interval for NewTicker")
+	}
+	w := &waiter{period: d, ticks: make(chan time.Time, 1)}
+	c.schedule(w, d)
+	return &fakeTicker{clock: c, waiter: w}
+}
+
+// AfterFunc implements Clock. The function is called by Advance, before it returns.
+func (c *Fake) AfterFunc(d time.Duration, f func()) Timer {
+	w := &waiter{f: f}
+	c.schedule(w, d)
+	return &fakeTimer{clock: c, waiter: w}
+}
+
+// Advance moves the clock forward by d, delivering the ticks and making the
+// calls that fall due on the way, in order of their time
+func (c *Fake) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	c.mu.Unlock()
+
+	for {
+		c.mu.Lock()
+		w := c.next(end)
+		if w == nil {
+			c.now = end
+			c.mu.Unlock()
+			return
+		}
+		c.now = w.at
+		c.remove(w)
+		if w.period > 0 {
+			w.at = w.at.Add(w.period)
+			c.waiters = append(c.waiters, w)
+		}
+		now := c.now
+		c.mu.Unlock()
+
+		if w.f != nil {
+			w.f()
+			continue
+		}
+		select {
+		case w.ticks <- now:
+		default:
+		}
+	}
+}
+
+// Waiters returns the number of pending tickers and calls, so tests can wait
+// until the code under test has scheduled its work before advancing the clock
+func (c *Fake) Waiters() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.waiters)
+}
+
+// schedule adds a waiter falling due after d
+func (c *Fake) schedule(w *waiter, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w.at = c.now.Add(d)
+	c.waiters = append(c.waiters, w)
+}
+
+// next returns the earliest waiter due by end, or nil; c.mu must be held
+func (c *Fake) next(end time.Time) *waiter {
+	var earliest *waiter
+	for _, w := range c.waiters {
+		if !w.at.After(end) && (earliest == nil || w.at.Before(earliest.at)) {
+			earliest = w
+		}
+	}
+	return earliest
+}
+
+// remove takes a waiter off the schedule, reporting whether it was on it; c.mu must be held
+func (c *Fake) remove(w *waiter) bool {
+	for i, pending := range c.waiters {
+		if pending == w {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// fakeTicker is a Ticker of a Fake
+type fakeTicker struct {
+	clock  *Fake
+	waiter *waiter
+}
+
+// C implements Ticker
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.waiter.ticks
+}
+
+// Stop implements Ticker
+func (t *fakeTicker) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	t.clock.remove(t.waiter)
+}
+
+// fakeTimer is a Timer of a Fake
+type fakeTimer struct {
+	clock  *Fake
+	waiter *waiter
+}
+
+// Stop implements Timer
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	return t.clock.remove(t.waiter)
+}
@@ -3,31 +3,186 @@ package compression
 import (
 	"bytes"
 	"compress/gzip"
+	"compress/zlib"
 	"fmt"
+	"os"
 	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+
+	"octo-server/app/http"
+	"octo-server/app/metrics"
+)
+
+// Content codings supported by the compressor
+const (
+	EncodingBrotli   = "br"
+	EncodingZstd     = "zstd"
+	EncodingGzip     = "gzip"
+	EncodingDeflate  = "deflate"
+	EncodingIdentity = "identity"
 )
 
+// encodings lists the supported content codings in server preference order
+var encodings = []string{EncodingBrotli, EncodingZstd, EncodingGzip, EncodingDeflate}
+
+// precompressedExtensions maps content codings to the file extensions of
+// precompressed variants, in server preference order
+var precompressedExtensions = []struct {
+	encoding  string
+	extension string
+}{
+	{EncodingBrotli, ".br"},
+	{EncodingZstd, ".zst"},
+	{EncodingGzip, ".gz"},
+}
+
+// zstdWindowSize caps the zstd window at the 8 MB HTTP clients are required to support (RFC 9659)
+const zstdWindowSize = 8 << 20
+
+// DefaultContentTypes lists the content type prefixes compressed by default
+var DefaultContentTypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"image/svg+xml",
+}
+
+// Options controls which responses are compressed
+type Options struct {
+	// MinSize is the smallest body size, in bytes, worth compressing
+	MinSize int
+	// ContentTypes lists the content type prefixes eligible for compression
+	ContentTypes []string
+	// MaxConcurrent caps how many bodies are compressed at once; responses
+	// over the cap are sent uncompressed. Zero means unlimited.
+	MaxConcurrent int
+}
+
 // Compressor handles content compression
-type Compressor struct{}
+type Compressor struct {
+	options     Options
+	zstdEncoder *zstd.Encoder
+	// slots holds a token per body being compressed, when MaxConcurrent is set
+	slots chan struct{}
+}
 
 // NewCompressor creates a new compressor
-func NewCompressor() *Compressor {
-	return &Compressor{}
+func NewCompressor(options Options) *Compressor {
+	if options.ContentTypes == nil {
+		options.ContentTypes = DefaultContentTypes
+	}
+
+	// A nil writer is fine since the encoder is only used through EncodeAll, which is safe for concurrent use
+	zstdEncoder, err := zstd.NewWriter(nil, zstd.WithWindowSize(zstdWindowSize))
+	if err != nil {
+		panic(fmt.Sprintf("failed to create zstd encoder: %v", err))
+	}
+
+	c := &Compressor{
+		options:     options,
+		zstdEncoder: zstdEncoder,
+	}
+	if options.MaxConcurrent > 0 {
+		c.slots = make(chan struct{}, options.MaxConcurrent)
+	}
+	return c
 }
 
 // SupportsGzip checks if the Accept-Encoding header supports gzip
 func (c *Compressor) SupportsGzip(acceptEncoding string) bool {
-	if acceptEncoding == "" {
-		return false
+	return weight(http.ParseQualityList(acceptEncoding), EncodingGzip) > 0
+}
+
+// Negotiate picks the content coding to use for a client sending the given
+// Accept-Encoding header, or returns an empty string to send the body as is.
+// The coding with the highest q value wins; ties go to brotli, then zstd, gzip
+// and deflate, and any acceptable coding is preferred over identity at equal weight.
+func (c *Compressor) Negotiate(acceptEncoding string) string {
+	return NegotiateFrom(acceptEncoding, encodings)
+}
+
+// NegotiateFrom picks the content coding to use among the offered ones, listed in
+// preference order, following the same rules as Compressor.Negotiate
+func NegotiateFrom(acceptEncoding string, offered []string) string {
+	accepted := http.ParseQualityList(acceptEncoding)
+
+	best, bestQ := "", 0.0
+	for _, encoding := range offered {
+		if q := weight(accepted, encoding); q > bestQ {
+			best, bestQ = encoding, q
+		}
 	}
 
-	encodings := strings.Split(acceptEncoding, ",")
-	for _, enc := range encodings {
-		if strings.TrimSpace(enc) == "gzip" {
-			return true
+	if best == "" || bestQ < weight(accepted, EncodingIdentity) {
+		return ""
+	}
+	return best
+}
+
+// FindPrecompressed looks for precompressed variants of the file at path, such as
+// path.br or path.gz, and returns the best one for the Accept-Encoding header along
+// with its coding. The returned path is empty if no acceptable variant exists.
+// found reports whether any variant exists at all, in which case the response
+// varies on Accept-Encoding even when the original file is served.
+func FindPrecompressed(path, acceptEncoding string) (variant, encoding string, found bool) {
+	var offered []string
+	for _, pc := range precompressedExtensions {
+		if info, err := os.Stat(path + pc.extension); err == nil && info.Mode().IsRegular() {
+			offered = append(offered, pc.encoding)
 		}
 	}
-	return false
+	if len(offered) == 0 {
+		return "", "", false
+	}
+
+	encoding = NegotiateFrom(acceptEncoding, offered)
+	for _, pc := range precompressedExtensions {
+		if pc.encoding == encoding {
+			return path + pc.extension, encoding, true
+		}
+	}
+	return "", "", true
+}
+
+// Compress compresses data with the given content coding
+func (c *Compressor) Compress(encoding string, data []byte) ([]byte, error) {
+	switch encoding {
+	case EncodingBrotli:
+		return c.CompressBrotli(data)
+	case EncodingZstd:
+		return c.CompressZstd(data), nil
+	case EncodingGzip:
+		return c.CompressGzip(data)
+	case EncodingDeflate:
+		return c.CompressDeflate(data)
+	default:
+		return nil, fmt.Errorf("unsupported content coding %q", encoding)
+	}
+}
+
+// weight returns the q value a parsed Accept-Encoding header gives to a coding.
+// Codings not listed take the weight of "*" if present; otherwise only identity is acceptable.
+func weight(accepted []http.QualityValue, encoding string) float64 {
+	wildcard := -1.0
+	for _, qv := range accepted {
+		if qv.Value == encoding {
+			return qv.Quality
+		}
+		if qv.Value == "*" {
+			wildcard = qv.Quality
+		}
+	}
+
+	if wildcard >= 0 {
+		return wildcard
+	}
+	if encoding == EncodingIdentity {
+		return 1
+	}
+	return 0
 }
 
 // CompressGzip compresses data using gzip
@@ -45,3 +200,100 @@ func (c *Compressor) CompressGzip(data []byte) ([]byte, error) {
 
 	return buf.Bytes(), nil
 }
+
+// CompressDeflate compresses data using the zlib format, which is what the deflate content coding means in HTTP
+func (c *Compressor) CompressDeflate(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zlibWriter := zlib.NewWriter(&buf)
+
+	if _, err := zlibWriter.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to write compressed data: %w", err)
+	}
+
+	if err := zlibWriter.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close deflate writer: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// CompressBrotli compresses data using brotli
+func (c *Compressor) CompressBrotli(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	brWriter := brotli.NewWriterLevel(&buf, brotli.DefaultCompression)
+
+	if _, err := brWriter.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to write compressed data: %w", err)
+	}
+
+	if err := brWriter.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close brotli writer: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// CompressZstd compresses data using zstd
+func (c *Compressor) CompressZstd(data []byte) []byte {
+	return c.zstdEncoder.EncodeAll(data, nil)
+}
+
+// Filter returns a response filter that compresses eligible response bodies
+// for a client sending the given Accept-Encoding header
+func (c *Compressor) Filter(acceptEncoding string) http.ResponseFilter {
+	return func(resp *http.Response) error {
+		if !c.compressible(resp) {
+			return nil
+		}
+
+		// The representation depends on Accept-Encoding whether or not this client gets it compressed
+		resp.AddVary("Accept-Encoding")
+
+		encoding := c.Negotiate(acceptEncoding)
+		if encoding == "" {
+			return nil
+		}
+
+		if c.slots != nil {
+			select {
+			case c.slots <- struct{}{}:
+				defer func() { <-c.slots }()
+			default:
+				metrics.Default.Inc("compression_skipped_total", "reason", "busy")
+				return nil
+			}
+		}
+
+		compressed, err := c.Compress(encoding, resp.Body)
+		if err != nil {
+			return err
+		}
+
+		resp.Headers.Set("Content-Encoding", encoding)
+		resp.Headers.Set("Content-Length", fmt.Sprintf("%d", len(compressed)))
+		resp.Body = compressed
+		return nil
+	}
+}
+
+// compressible reports whether a response body is eligible for compression
+func (c *Compressor) compressible(resp *http.Response) bool {
+	if len(resp.Body) == 0 || len(resp.Body) < c.options.MinSize {
+		return false
+	}
+	// A byte range of a representation cannot be recoded on its own
+	if resp.StatusCode == 206 {
+		return false
+	}
+	if resp.Headers.Has("Content-Encoding") {
+		return false
+	}
+
+	contentType := resp.Headers.Get("Content-Type")
+	for _, prefix := range c.options.ContentTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
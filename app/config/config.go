@@ -1,13 +1,142 @@
 package config
 
 import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"net"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"octo-server/app/compression"
+	"octo-server/app/crash"
+	"octo-server/app/handler"
+	"octo-server/app/ipfilter"
+	"octo-server/app/lifecycle"
+	"octo-server/app/mirror"
+	"octo-server/app/proxy"
+	"octo-server/app/ratelimit"
+	"octo-server/app/referer"
+	"octo-server/app/rewrite"
+	"octo-server/app/tlsconf"
 )
 
 // Config holds the server configuration
 type Config struct {
-	Directory string
-	Port      string
+	Directory         string
+	Port              string
+	Addr              string
+	Listeners         []Listener
+	ReusePort         bool
+	DrainTimeout      time.Duration
+	WorkerProcesses   int
+	VirtualHosts      []VirtualHost
+	Mounts            []handler.Mount
+	RouteLimits       []ratelimit.RouteRule
+	Rewrites          []rewrite.Rule
+	RefererRules      []referer.Rule
+	MaxConnsPerIP     int
+	IPv6Prefix        int
+	MaxWorkers        int
+	RequestTimeout    time.Duration
+	ExemptCIDRs       ipfilter.CIDRList
+	ProxyProtocolFrom ipfilter.CIDRList
+	TrustedProxies    ipfilter.CIDRList
+	DenyFingerprints  []string
+	LogFingerprints   bool
+	IPFilter          ipfilter.Filter
+	Compression       compression.Options
+	MemoryBudget      ByteSize
+
+	UploadMaxFileSize  ByteSize
+	UploadMaxTotalSize ByteSize
+
+	MmapMinSize ByteSize
+
+	TextCharset    string
+	TextExtensions []string
+
+	GCPercent           int
+	MemoryLimit         ByteSize
+	ReadBufferSize      ByteSize
+	SocketSendBuffer    ByteSize
+	SocketReceiveBuffer ByteSize
+	PerfLogInterval     time.Duration
+
+	AuditContentLength bool
+
+	ServerHeader string
+
+	Maintenance           bool
+	MaintenancePage       string
+	MaintenanceRetryAfter time.Duration
+
+	ErrorPages map[int]string
+
+	AccessLog                bool
+	AccessLogHeaders         []string
+	AccessLogResponseHeaders []string
+
+	RecentRequests         int
+	RecentRequestsEndpoint bool
+
+	// ConnStuckAfter is how long a connection may stay in one state before it is reported stuck
+	ConnStuckAfter      time.Duration
+	ConnectionsEndpoint bool
+
+	TLSCert string
+	TLSKey  string
+	// SNICertificates are served instead of TLSCert to clients asking for their hosts
+	SNICertificates []tlsconf.KeyPair
+	H2C             bool
+	HTTP3           bool
+	HTTP3Port       string
+	// HTTP3EarlyData accepts requests in 0-RTT data on resumed HTTP/3 connections
+	HTTP3EarlyData bool
+	TLS            tlsconf.Options
+
+	StatsFile string
+
+	CrashDir       string
+	CrashReportDSN string
+	RecoverPanics  bool
+
+	Lifecycle lifecycle.Policy
+
+	TrashRetention time.Duration
+
+	VersionsKeep    int
+	VersionsMaxSize ByteSize
+
+	JSONEndpoints []handler.VirtualEndpoint
+
+	S3Bucket    string
+	S3AccessKey string
+	S3SecretKey string
+
+	GitRoot string
+	GitPush bool
+
+	CalDAVRoot string
+
+	ForwardProxy bool
+	ConnectPorts []int
+
+	Proxies      []proxy.Route
+	ProxyBalance string
+	ProxyHealth  proxy.HealthCheck
+
+	ProxyCacheSize     ByteSize
+	ProxyCacheDir      string
+	ProxyCacheDiskSize ByteSize
+
+	MirrorOrigin string
 }
 
 // NewConfig creates a new configuration from command-line flags
@@ -20,16 +149,465 @@ func NewConfig(directory, port string) *Config {
 
 // ValidateDirectory checks if the configured directory exists and is valid
 func (c *Config) ValidateDirectory() bool {
-	if c.Directory == "" {
+	return c.Directory != "" && isDir(c.Directory)
+}
+
+// isDir reports whether path exists and is a directory
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
 		return false
 	}
 
-	info, err := os.Stat(c.Directory)
+	return info.IsDir()
+}
+
+// Validate reports the first problem found in the configuration
+func (c *Config) Validate() error {
+	if c.Directory != "" && !c.ValidateDirectory() {
+		return fmt.Errorf("directory %q does not exist or is not a directory", c.Directory)
+	}
+
+	port, err := strconv.Atoi(c.Port)
+	if err != nil || port < 0 || port > 65535 {
+		return fmt.Errorf("port %q is not a valid TCP port", c.Port)
+	}
+	if c.Addr != "" {
+		_, addrPort, err := net.SplitHostPort(c.Addr)
+		if err != nil {
+			return fmt.Errorf("addr %q is not a HOST:PORT address", c.Addr)
+		}
+		if port, err := strconv.Atoi(addrPort); err != nil || port < 0 || port > 65535 {
+			return fmt.Errorf("addr %q does not have a valid TCP port", c.Addr)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, vhost := range c.VirtualHosts {
+		if seen[vhost.Host] {
+			return fmt.Errorf("vhost %q is given more than once", vhost.Host)
+		}
+		seen[vhost.Host] = true
+		if info, err := os.Stat(vhost.Directory); err != nil || !info.IsDir() {
+			return fmt.Errorf("directory %q of vhost %q does not exist or is not a directory", vhost.Directory, vhost.Host)
+		}
+	}
+
+	prefixes := make(map[string]bool)
+	for _, m := range c.Mounts {
+		if prefixes[m.Prefix] {
+			return fmt.Errorf("mount prefix %q is given more than once", m.Prefix)
+		}
+		prefixes[m.Prefix] = true
+		if !isDir(m.Directory) {
+			return fmt.Errorf("directory %q of mount %q does not exist or is not a directory", m.Directory, m.Prefix)
+		}
+	}
+
+	for _, rule := range c.RefererRules {
+		if info, err := os.Stat(rule.Placeholder); rule.Placeholder != "" && (err != nil || !info.Mode().IsRegular()) {
+			return fmt.Errorf("placeholder %q of referer rule %q does not exist or is not a file", rule.Placeholder, rule.Prefix)
+		}
+	}
+
+	if c.MaxConnsPerIP < 0 {
+		return fmt.Errorf("max-conns-per-ip must not be negative, got %d", c.MaxConnsPerIP)
+	}
+	if c.IPv6Prefix < 0 || c.IPv6Prefix > 128 {
+		return fmt.Errorf("ipv6-prefix must be between 0 and 128, got %d", c.IPv6Prefix)
+	}
+	if c.WorkerProcesses < 0 {
+		return fmt.Errorf("worker-processes must not be negative, got %d", c.WorkerProcesses)
+	}
+	if c.WorkerProcesses > 0 && c.HTTP3 {
+		return errors.New("worker-processes cannot be combined with http3, whose UDP socket cannot be shared between processes")
+	}
+	if c.WorkerProcesses > 0 && c.StatsFile != "" {
+		return errors.New("worker-processes cannot be combined with stats-file, which every process would overwrite")
+	}
+	if c.MaxWorkers < 0 {
+		return fmt.Errorf("max-workers must not be negative, got %d", c.MaxWorkers)
+	}
+	if c.RequestTimeout < 0 {
+		return fmt.Errorf("request-timeout must not be negative, got %s", c.RequestTimeout)
+	}
+	if c.RecentRequests < 0 {
+		return fmt.Errorf("recent-requests must not be negative, got %d", c.RecentRequests)
+	}
+	if c.RecentRequestsEndpoint && c.RecentRequests == 0 {
+		return errors.New("recent-requests-endpoint requires recent-requests")
+	}
+	if c.ConnStuckAfter < 0 {
+		return fmt.Errorf("conn-stuck-after must not be negative, got %s", c.ConnStuckAfter)
+	}
+	if c.MemoryBudget < 0 {
+		return fmt.Errorf("memory-budget must not be negative, got %d", c.MemoryBudget)
+	}
+	if c.GCPercent < -1 {
+		return fmt.Errorf("gc-percent must be -1 (off), 0 (the runtime default) or positive, got %d", c.GCPercent)
+	}
+	if c.MemoryLimit < 0 {
+		return fmt.Errorf("memory-limit must not be negative, got %d", c.MemoryLimit)
+	}
+	if c.ReadBufferSize != 0 && (c.ReadBufferSize < 1<<10 || c.ReadBufferSize > 16<<20) {
+		return fmt.Errorf("read-buffer-size must be between 1KB and 16MB, got %d", c.ReadBufferSize)
+	}
+	if c.SocketSendBuffer < 0 || c.SocketReceiveBuffer < 0 {
+		return fmt.Errorf("socket buffer sizes must not be negative")
+	}
+	if c.PerfLogInterval < 0 {
+		return fmt.Errorf("perf-log-interval must not be negative, got %s", c.PerfLogInterval)
+	}
+	if c.Compression.MaxConcurrent < 0 {
+		return fmt.Errorf("compress-max-concurrent must not be negative, got %d", c.Compression.MaxConcurrent)
+	}
+	if c.TextCharset != "" && strings.ContainsAny(c.TextCharset, " \t;,\"=") {
+		return fmt.Errorf("text-charset %q is not a charset name", c.TextCharset)
+	}
+	if c.MmapMinSize < 0 {
+		return fmt.Errorf("mmap-min-size must not be negative, got %d", c.MmapMinSize)
+	}
+	if c.Compression.MinSize < 0 {
+		return fmt.Errorf("compress-min-size must not be negative, got %d", c.Compression.MinSize)
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return fmt.Errorf("tls-cert and tls-key must be given together")
+	}
+	if len(c.SNICertificates) > 0 && !c.TLSEnabled() {
+		return fmt.Errorf("tls-sni-cert requires tls-cert and tls-key for clients asking for other hosts")
+	}
+	sniHosts := make(map[string]bool)
+	for _, pair := range c.SNICertificates {
+		if sniHosts[pair.Host] {
+			return fmt.Errorf("tls-sni-cert for %q is given more than once", pair.Host)
+		}
+		sniHosts[pair.Host] = true
+	}
+	if err := c.TLS.Apply(&tls.Config{}); err != nil {
+		return err
+	}
+	if c.HTTP3 && c.TLS.MaxVersion != "" && c.TLS.MaxVersion != "1.3" {
+		return fmt.Errorf("http3 requires TLS 1.3, which tls-max-version %s rules out", c.TLS.MaxVersion)
+	}
+	if c.HTTP3EarlyData && !c.HTTP3 {
+		return fmt.Errorf("http3-0rtt requires http3")
+	}
+	if c.HTTP3 && !c.TLSEnabled() {
+		return fmt.Errorf("http3 requires tls-cert and tls-key")
+	}
+	if c.HTTP3 && len(c.Listeners) > 0 && !slices.ContainsFunc(c.Listeners, func(l Listener) bool { return l.TLS && l.Network == "tcp" }) {
+		return fmt.Errorf("http3 requires a TCP listener with the tls option")
+	}
+	if c.HTTP3Port != "" {
+		if !c.HTTP3 {
+			return fmt.Errorf("http3-port requires http3")
+		}
+		if port, err := strconv.Atoi(c.HTTP3Port); err != nil || port < 1 || port > 65535 {
+			return fmt.Errorf("http3-port %q is not a valid UDP port", c.HTTP3Port)
+		}
+		// TLS listeners on several hosts bind the port once each, which fails if one covers every address
+		var hosts []string
+		for _, l := range c.ListenersOrDefault() {
+			if host, _, _ := net.SplitHostPort(l.Address); l.TLS && l.Network == "tcp" && !slices.Contains(hosts, host) {
+				hosts = append(hosts, host)
+			}
+		}
+		if len(hosts) > 1 && slices.ContainsFunc(hosts, func(host string) bool { return host == "" || net.ParseIP(host).IsUnspecified() }) {
+			return fmt.Errorf("http3-port %s cannot be shared by TLS listeners on different hosts when one of them listens on every address", c.HTTP3Port)
+		}
+	}
+	if c.DrainTimeout < 0 {
+		return fmt.Errorf("drain-timeout must not be negative, got %s", c.DrainTimeout)
+	}
+	addresses := make(map[string]bool)
+	for _, l := range c.Listeners {
+		if addresses[l.Network+" "+l.Address] {
+			return fmt.Errorf("listener %q is given more than once", l.Address)
+		}
+		addresses[l.Network+" "+l.Address] = true
+		if l.TLS && !c.TLSEnabled() {
+			return fmt.Errorf("listener %q uses TLS, which requires tls-cert and tls-key", l)
+		}
+	}
+	// A dual-stack listener holds its port on every address of both families
+	for _, l := range c.Listeners {
+		if !l.dualStack() {
+			continue
+		}
+		_, port, _ := net.SplitHostPort(l.Address)
+		for _, other := range c.Listeners {
+			if _, otherPort, _ := net.SplitHostPort(other.Address); other != l && other.Network == "tcp" && otherPort == port {
+				return fmt.Errorf("listener %q accepts IPv4 and IPv6 connections, so %q cannot listen on port %s too; give the IPv6 listener the ipv6only option", l, other, port)
+			}
+		}
+	}
+	if c.VersionsKeep < 0 {
+		return fmt.Errorf("versions-keep must not be negative, got %d", c.VersionsKeep)
+	}
+	if c.MaintenancePage != "" {
+		if info, err := os.Stat(c.MaintenancePage); err != nil || !info.Mode().IsRegular() {
+			return fmt.Errorf("maintenance page %q does not exist or is not a file", c.MaintenancePage)
+		}
+	}
+	if c.MaintenanceRetryAfter < 0 {
+		return fmt.Errorf("maintenance-retry-after must not be negative, got %s", c.MaintenanceRetryAfter)
+	}
+	for _, code := range slices.Sorted(maps.Keys(c.ErrorPages)) {
+		page := c.ErrorPages[code]
+		if info, err := os.Stat(page); err != nil || !info.Mode().IsRegular() {
+			return fmt.Errorf("error page %q for %d does not exist or is not a file", page, code)
+		}
+		if err := handler.CheckErrorPage(page); err != nil {
+			return fmt.Errorf("error page %q for %d: %w", page, code, err)
+		}
+	}
+	if c.TrashRetention < 0 {
+		return fmt.Errorf("trash-retention must not be negative, got %s", c.TrashRetention)
+	}
+	if c.ProxyBalance != "" {
+		if err := proxy.ValidateBalance(c.ProxyBalance); err != nil {
+			return err
+		}
+	}
+	if c.ProxyHealth.Interval < 0 {
+		return fmt.Errorf("proxy-health-interval must not be negative, got %s", c.ProxyHealth.Interval)
+	}
+	if c.ProxyCacheSize < 0 {
+		return fmt.Errorf("proxy-cache-size must not be negative, got %d", c.ProxyCacheSize)
+	}
+	if c.ProxyCacheDiskSize < 0 {
+		return fmt.Errorf("proxy-cache-disk-size must not be negative, got %d", c.ProxyCacheDiskSize)
+	}
+	if c.S3Bucket != "" && c.Directory == "" {
+		return fmt.Errorf("s3-bucket requires a directory")
+	}
+	if (c.S3AccessKey == "") != (c.S3SecretKey == "") {
+		return fmt.Errorf("s3-access-key and s3-secret-key must be given together")
+	}
+	if c.CalDAVRoot != "" {
+		if info, err := os.Stat(c.CalDAVRoot); err != nil || !info.IsDir() {
+			return fmt.Errorf("caldav-root %q does not exist or is not a directory", c.CalDAVRoot)
+		}
+	}
+	if c.GitRoot != "" {
+		if info, err := os.Stat(c.GitRoot); err != nil || !info.IsDir() {
+			return fmt.Errorf("git-root %q does not exist or is not a directory", c.GitRoot)
+		}
+	}
+	for _, port := range c.ConnectPorts {
+		if port <= 0 || port > 65535 {
+			return fmt.Errorf("connect-ports must be valid TCP ports, got %d", port)
+		}
+	}
+	if c.MirrorOrigin != "" && c.Directory == "" {
+		return fmt.Errorf("mirror-origin requires a directory")
+	}
+	if c.CrashReportDSN != "" {
+		if err := crash.CheckDSN(c.CrashReportDSN); err != nil {
+			return err
+		}
+	}
+	if err := c.Lifecycle.Validate(); err != nil {
+		return err
+	}
+	if c.Lifecycle.Enabled() && c.Directory == "" {
+		return fmt.Errorf("lifecycle rules require a directory")
+	}
+
+	return nil
+}
+
+// TLSEnabled reports whether the server should serve TLS
+func (c *Config) TLSEnabled() bool {
+	return c.TLSCert != "" && c.TLSKey != ""
+}
+
+// KeyPairs returns the TLS certificates to serve: the default one, then those chosen by SNI
+func (c *Config) KeyPairs() []tlsconf.KeyPair {
+	return append([]tlsconf.KeyPair{{CertFile: c.TLSCert, KeyFile: c.TLSKey}}, c.SNICertificates...)
+}
+
+// ListenAddr returns the address to listen on: Addr if given, else Port on
+// every interface, for IPv4 and IPv6
+func (c *Config) ListenAddr() string {
+	if c.Addr != "" {
+		return c.Addr
+	}
+	return ":" + c.Port
+}
+
+// ListenPort returns the port of the address to listen on
+func (c *Config) ListenPort() string {
+	_, port, err := net.SplitHostPort(c.ListenAddr())
 	if err != nil {
+		return c.Port
+	}
+	return port
+}
+
+// Listener is an address the server accepts connections on
+type Listener struct {
+	// Network is "tcp", or "unix" for a Unix domain socket
+	Network string
+	// Address is HOST:PORT for TCP, or the path of the socket
+	Address string
+	// TLS serves HTTPS with the --tls-cert certificate, and HTTP/3 alongside with --http3
+	TLS bool
+	// H2C accepts cleartext HTTP/2, as --h2c does on every plain listener
+	H2C bool
+	// ProxyProtocol expects each connection to start with a PROXY protocol
+	// header giving the address of the client behind a load balancer
+	ProxyProtocol bool
+	// IPv6Only accepts only IPv6 connections on an address such as [::]:PORT or
+	// :PORT, which otherwise accepts IPv4 connections as well (dual-stack)
+	IPv6Only bool
+}
+
+// Name returns the address of the listener, prefixed by "unix:" for a Unix socket
+func (l Listener) Name() string {
+	if l.Network == "unix" {
+		return "unix:" + l.Address
+	}
+	return l.Address
+}
+
+// String formats the listener as accepted by --listen
+func (l Listener) String() string {
+	s := l.Name()
+	if l.TLS {
+		s += ",tls"
+	}
+	if l.H2C {
+		s += ",h2c"
+	}
+	if l.ProxyProtocol {
+		s += ",proxy-protocol"
+	}
+	if l.IPv6Only {
+		s += ",ipv6only"
+	}
+	return s
+}
+
+// Family returns the IP version the listener's socket is restricted to: "4"
+// for an IPv4 address, including 0.0.0.0, "6" for an IPv6-only listener, or
+// "" for both, appended to "tcp" or "udp" as the network given to net.Listen
+func (l Listener) Family() string {
+	if l.Network != "tcp" {
+		return ""
+	}
+	if l.IPv6Only {
+		return "6"
+	}
+	host, _, _ := net.SplitHostPort(l.Address)
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		return "4"
+	}
+	return ""
+}
+
+// dualStack reports whether the listener accepts both IPv4 and IPv6
+// connections, being bound to every address of both families
+func (l Listener) dualStack() bool {
+	if l.Network != "tcp" || l.IPv6Only {
 		return false
 	}
+	host, _, _ := net.SplitHostPort(l.Address)
+	return host == "" || host == "::"
+}
 
-	return info.IsDir()
+// ParseListener parses a listener of the form "ADDRESS[,OPTION...]", where
+// ADDRESS is HOST:PORT, [IPV6]:PORT, :PORT or unix:PATH and the options are
+// "tls", "h2c", "proxy-protocol" and "ipv6only", e.g. ":443,tls",
+// "[::]:80,ipv6only" or "unix:/run/octo-server.sock"
+func ParseListener(s string) (Listener, error) {
+	parts := strings.Split(strings.TrimSpace(s), ",")
+	l := Listener{Network: "tcp", Address: parts[0]}
+	if path, ok := strings.CutPrefix(l.Address, "unix:"); ok {
+		l.Network, l.Address = "unix", path
+		if path == "" {
+			return Listener{}, fmt.Errorf("invalid listener %q: expected unix:PATH", s)
+		}
+	} else {
+		_, port, err := net.SplitHostPort(l.Address)
+		if err != nil {
+			return Listener{}, fmt.Errorf("invalid listener %q: expected HOST:PORT, :PORT or unix:PATH", s)
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+			return Listener{}, fmt.Errorf("invalid listener %q: invalid TCP port", s)
+		}
+	}
+
+	for _, option := range parts[1:] {
+		switch strings.TrimSpace(option) {
+		case "tls":
+			l.TLS = true
+		case "h2c":
+			l.H2C = true
+		case "proxy-protocol":
+			l.ProxyProtocol = true
+		case "ipv6only":
+			l.IPv6Only = true
+		default:
+			return Listener{}, fmt.Errorf("invalid listener %q: unknown option %q", s, option)
+		}
+	}
+	if l.TLS && l.H2C {
+		return Listener{}, fmt.Errorf("invalid listener %q: h2c is cleartext HTTP/2 and cannot be used with tls", s)
+	}
+	if l.IPv6Only {
+		host, _, _ := net.SplitHostPort(l.Address)
+		if ip := net.ParseIP(host); l.Network != "tcp" || (host != "" && (ip == nil || ip.To4() != nil)) {
+			return Listener{}, fmt.Errorf("invalid listener %q: ipv6only needs an IPv6 address such as [::]:PORT, or :PORT", s)
+		}
+	}
+	return l, nil
+}
+
+// ListenerFlag collects repeated --listen flags
+type ListenerFlag []Listener
+
+// String returns the flag value as a space-separated list of listeners
+func (f *ListenerFlag) String() string {
+	listeners := make([]string, 0, len(*f))
+	for _, l := range *f {
+		listeners = append(listeners, l.String())
+	}
+	return strings.Join(listeners, " ")
+}
+
+// Type returns the flag value type name shown in usage
+func (f *ListenerFlag) Type() string {
+	return "listener"
+}
+
+// Set parses and appends a listener
+func (f *ListenerFlag) Set(value string) error {
+	l, err := ParseListener(value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, l)
+	return nil
+}
+
+// HTTP3Address returns the UDP address HTTP/3 is served on alongside the TLS
+// listener l: the address of l, on HTTP3Port if given
+func (c *Config) HTTP3Address(l Listener) string {
+	if c.HTTP3Port == "" {
+		return l.Address
+	}
+	host, _, _ := net.SplitHostPort(l.Address)
+	return net.JoinHostPort(host, c.HTTP3Port)
+}
+
+// ListenersOrDefault returns the configured listeners, or else the single
+// listener on ListenAddr, serving TLS if a certificate is configured
+func (c *Config) ListenersOrDefault() []Listener {
+	if len(c.Listeners) > 0 {
+		return c.Listeners
+	}
+	return []Listener{{Network: "tcp", Address: c.ListenAddr(), TLS: c.TLSEnabled()}}
 }
 
 // GetDirectory returns the directory path if valid, empty string otherwise
@@ -39,3 +617,533 @@ func (c *Config) GetDirectory() string {
 	}
 	return c.Directory
 }
+
+// RouteLimitFlag collects repeated -route-limit flags
+type RouteLimitFlag []ratelimit.RouteRule
+
+// String returns the flag value as a comma-separated list of rules
+func (f *RouteLimitFlag) String() string {
+	rules := make([]string, 0, len(*f))
+	for _, rule := range *f {
+		rules = append(rules, rule.String())
+	}
+	return strings.Join(rules, ",")
+}
+
+// Type returns the flag value type name shown in usage
+func (f *RouteLimitFlag) Type() string {
+	return "rule"
+}
+
+// Set parses and appends comma-separated rules
+func (f *RouteLimitFlag) Set(value string) error {
+	for _, part := range strings.Split(value, ",") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		rule, err := ratelimit.ParseRouteRule(part)
+		if err != nil {
+			return err
+		}
+		*f = append(*f, rule)
+	}
+	return nil
+}
+
+// RewriteFlag collects repeated --rewrite flags. Rules are not comma-separated
+// since their patterns may contain commas.
+type RewriteFlag []rewrite.Rule
+
+// String returns the flag value as a comma-separated list of rules
+func (f *RewriteFlag) String() string {
+	rules := make([]string, 0, len(*f))
+	for _, rule := range *f {
+		rules = append(rules, rule.String())
+	}
+	return strings.Join(rules, ",")
+}
+
+// Type returns the flag value type name shown in usage
+func (f *RewriteFlag) Type() string {
+	return "rule"
+}
+
+// Set parses and appends a rule
+func (f *RewriteFlag) Set(value string) error {
+	rule, err := rewrite.ParseRule(value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, rule)
+	return nil
+}
+
+// RedirectFlag collects repeated --redirect flags into the rewrite rules,
+// so redirects and rewrites apply in the order they were given
+type RedirectFlag []rewrite.Rule
+
+// String returns the flag value as a comma-separated list of rules
+func (f *RedirectFlag) String() string {
+	return (*RewriteFlag)(f).String()
+}
+
+// Type returns the flag value type name shown in usage
+func (f *RedirectFlag) Type() string {
+	return "redirect"
+}
+
+// Set parses and appends a redirect
+func (f *RedirectFlag) Set(value string) error {
+	rule, err := rewrite.ParseRedirect(value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, rule)
+	return nil
+}
+
+// RefererRuleFlag collects repeated --referer-rule flags. Rules are not
+// comma-separated since their host lists are.
+type RefererRuleFlag []referer.Rule
+
+// String returns the flag value as a comma-separated list of rules
+func (f *RefererRuleFlag) String() string {
+	rules := make([]string, 0, len(*f))
+	for _, rule := range *f {
+		rules = append(rules, rule.String())
+	}
+	return strings.Join(rules, ",")
+}
+
+// Type returns the flag value type name shown in usage
+func (f *RefererRuleFlag) Type() string {
+	return "rule"
+}
+
+// Set parses and appends a rule
+func (f *RefererRuleFlag) Set(value string) error {
+	rule, err := referer.ParseRule(value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, rule)
+	return nil
+}
+
+// ProxyFlag collects repeated --proxy flags
+type ProxyFlag []proxy.Route
+
+// String returns the flag value as a comma-separated list of routes
+func (f *ProxyFlag) String() string {
+	routes := make([]string, 0, len(*f))
+	for _, route := range *f {
+		routes = append(routes, route.String())
+	}
+	return strings.Join(routes, ",")
+}
+
+// Type returns the flag value type name shown in usage
+func (f *ProxyFlag) Type() string {
+	return "route"
+}
+
+// Set parses and appends comma-separated routes
+func (f *ProxyFlag) Set(value string) error {
+	for _, part := range strings.Split(value, ",") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		route, err := proxy.ParseRoute(part)
+		if err != nil {
+			return err
+		}
+		*f = append(*f, route)
+	}
+	return nil
+}
+
+// OriginFlag holds the URL of a --mirror-origin flag, validated when set
+type OriginFlag string
+
+// String returns the origin URL
+func (f *OriginFlag) String() string {
+	return string(*f)
+}
+
+// Type returns the flag value type name shown in usage
+func (f *OriginFlag) Type() string {
+	return "url"
+}
+
+// Set validates and stores the origin URL
+func (f *OriginFlag) Set(value string) error {
+	if _, err := mirror.ParseOrigin(value); err != nil {
+		return err
+	}
+	*f = OriginFlag(value)
+	return nil
+}
+
+// ErrorPageFlag holds the error pages of --error-page flags by status
+type ErrorPageFlag map[int]string
+
+// String returns the flag value as a comma-separated list of CODE=FILE pairs
+func (f *ErrorPageFlag) String() string {
+	pages := make([]string, 0, len(*f))
+	for _, code := range slices.Sorted(maps.Keys(*f)) {
+		pages = append(pages, strconv.Itoa(code)+"="+(*f)[code])
+	}
+	return strings.Join(pages, ",")
+}
+
+// Type returns the flag value type name shown in usage
+func (f *ErrorPageFlag) Type() string {
+	return "page"
+}
+
+// Set parses an error page of the form "CODE=FILE", replacing any earlier page for CODE
+func (f *ErrorPageFlag) Set(value string) error {
+	code, page, ok := strings.Cut(strings.TrimSpace(value), "=")
+	status, err := strconv.Atoi(code)
+	if !ok || err != nil || page == "" {
+		return fmt.Errorf("invalid error page %q: expected CODE=FILE", value)
+	}
+	if status < 400 || status > 599 {
+		return fmt.Errorf("invalid error page %q: %d is not an error status", value, status)
+	}
+	if *f == nil {
+		*f = make(ErrorPageFlag)
+	}
+	(*f)[status] = page
+	return nil
+}
+
+// VirtualHost serves the files of Directory to requests for Host instead of the default directory
+type VirtualHost struct {
+	Host      string
+	Directory string
+}
+
+// ParseVirtualHost parses a virtual host of the form "HOST=DIR", where HOST
+// may start with "*." to match every subdomain, e.g. "*.example.com=/var/www/example"
+func ParseVirtualHost(s string) (VirtualHost, error) {
+	host, dir, ok := strings.Cut(strings.TrimSpace(s), "=")
+	host = strings.ToLower(strings.TrimSpace(host))
+	if !ok || dir == "" {
+		return VirtualHost{}, fmt.Errorf("invalid vhost %q: expected HOST=DIR", s)
+	}
+	if host == "" || strings.ContainsAny(host, "/:[] ") || strings.Contains(strings.TrimPrefix(host, "*."), "*") {
+		return VirtualHost{}, fmt.Errorf("invalid vhost %q: %q is not a host name", s, host)
+	}
+	return VirtualHost{Host: host, Directory: strings.TrimSpace(dir)}, nil
+}
+
+// VirtualHostFlag collects repeated --vhost flags
+type VirtualHostFlag []VirtualHost
+
+// String returns the flag value as a comma-separated list of virtual hosts
+func (f *VirtualHostFlag) String() string {
+	vhosts := make([]string, 0, len(*f))
+	for _, vhost := range *f {
+		vhosts = append(vhosts, vhost.Host+"="+vhost.Directory)
+	}
+	return strings.Join(vhosts, ",")
+}
+
+// Type returns the flag value type name shown in usage
+func (f *VirtualHostFlag) Type() string {
+	return "vhost"
+}
+
+// Set parses and appends comma-separated virtual hosts
+func (f *VirtualHostFlag) Set(value string) error {
+	for _, part := range strings.Split(value, ",") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		vhost, err := ParseVirtualHost(part)
+		if err != nil {
+			return err
+		}
+		*f = append(*f, vhost)
+	}
+	return nil
+}
+
+// ParseSNICertificate parses a certificate chosen by SNI of the form
+// "HOST=CERT:KEY", where HOST may start with "*." to match every subdomain,
+// e.g. "*.example.com=/etc/tls/example.pem:/etc/tls/example.key"
+func ParseSNICertificate(s string) (tlsconf.KeyPair, error) {
+	host, files, ok := strings.Cut(strings.TrimSpace(s), "=")
+	host = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+	i := strings.LastIndex(files, ":")
+	if !ok || i <= 0 || i == len(files)-1 {
+		return tlsconf.KeyPair{}, fmt.Errorf("invalid tls-sni-cert %q: expected HOST=CERT:KEY", s)
+	}
+	if host == "" || strings.ContainsAny(host, "/:[] ") || strings.Contains(strings.TrimPrefix(host, "*."), "*") {
+		return tlsconf.KeyPair{}, fmt.Errorf("invalid tls-sni-cert %q: %q is not a host name", s, host)
+	}
+	return tlsconf.KeyPair{Host: host, CertFile: files[:i], KeyFile: files[i+1:]}, nil
+}
+
+// SNICertificateFlag collects repeated --tls-sni-cert flags
+type SNICertificateFlag []tlsconf.KeyPair
+
+// String returns the flag value as a comma-separated list of certificates
+func (f *SNICertificateFlag) String() string {
+	pairs := make([]string, 0, len(*f))
+	for _, pair := range *f {
+		pairs = append(pairs, pair.Host+"="+pair.CertFile+":"+pair.KeyFile)
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Type returns the flag value type name shown in usage
+func (f *SNICertificateFlag) Type() string {
+	return "sni-cert"
+}
+
+// Set parses and appends comma-separated certificates
+func (f *SNICertificateFlag) Set(value string) error {
+	for _, part := range strings.Split(value, ",") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		pair, err := ParseSNICertificate(part)
+		if err != nil {
+			return err
+		}
+		*f = append(*f, pair)
+	}
+	return nil
+}
+
+// mountOptions are the options a mount may end with, after a colon
+var mountOptions = []string{"ro", "rw", "listing", "nolisting"}
+
+// ParseMount parses a mount of the form "PREFIX=DIR[:OPTIONS]", where OPTIONS
+// is a comma-separated list of "ro" or "rw" and "listing" or "nolisting",
+// e.g. "/assets=/srv/assets:ro,listing". Mounts are read-write without
+// listings by default.
+func ParseMount(s string) (handler.Mount, error) {
+	prefix, dir, ok := strings.Cut(strings.TrimSpace(s), "=")
+	if !ok || dir == "" {
+		return handler.Mount{}, fmt.Errorf("invalid mount %q: expected PREFIX=DIR[:OPTIONS]", s)
+	}
+	if !strings.HasPrefix(prefix, "/") || strings.ContainsAny(prefix, "?# ") || slices.Contains(strings.Split(prefix, "/"), "..") {
+		return handler.Mount{}, fmt.Errorf("invalid mount %q: prefix must be a path starting with '/'", s)
+	}
+
+	mount := handler.Mount{Prefix: prefix, Directory: dir}
+	// The options follow the last colon, which may also be part of a Windows path
+	if i := strings.LastIndex(dir, ":"); i >= 0 {
+		options := strings.Split(dir[i+1:], ",")
+		if !slices.ContainsFunc(options, func(option string) bool { return !slices.Contains(mountOptions, option) }) {
+			mount.Directory = dir[:i]
+			for _, option := range options {
+				switch option {
+				case "ro", "rw":
+					mount.ReadOnly = option == "ro"
+				case "listing", "nolisting":
+					mount.Listing = option == "listing"
+				}
+			}
+		}
+	}
+	if mount.Directory == "" {
+		return handler.Mount{}, fmt.Errorf("invalid mount %q: expected PREFIX=DIR[:OPTIONS]", s)
+	}
+	return mount, nil
+}
+
+// MountFlag collects repeated --mount flags
+type MountFlag []handler.Mount
+
+// String returns the flag value as a comma-separated list of mounts
+func (f *MountFlag) String() string {
+	mounts := make([]string, 0, len(*f))
+	for _, m := range *f {
+		mounts = append(mounts, m.String())
+	}
+	return strings.Join(mounts, ",")
+}
+
+// Type returns the flag value type name shown in usage
+func (f *MountFlag) Type() string {
+	return "mount"
+}
+
+// Set parses and appends a mount
+func (f *MountFlag) Set(value string) error {
+	mount, err := ParseMount(value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, mount)
+	return nil
+}
+
+// ListFlag collects comma-separated values from a repeatable flag
+type ListFlag []string
+
+// String returns the values as a comma-separated list
+func (f *ListFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+// Type returns the flag value type name shown in usage
+func (f *ListFlag) Type() string {
+	return "list"
+}
+
+// Set splits value on commas and appends the non-empty parts
+func (f *ListFlag) Set(value string) error {
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			*f = append(*f, part)
+		}
+	}
+	return nil
+}
+
+// ByteSize is a size in bytes. As a flag it accepts a number with an optional
+// binary unit suffix, e.g. 4096, 512K, 64MB or 1GiB.
+type ByteSize int64
+
+// byteUnits maps unit suffixes to their multipliers, longest suffixes first
+var byteUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	{"KIB", 1 << 10}, {"MIB", 1 << 20}, {"GIB", 1 << 30}, {"TIB", 1 << 40},
+	{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30}, {"TB", 1 << 40},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40},
+	{"B", 1},
+}
+
+// ParseByteSize parses a size such as 64MB
+func ParseByteSize(s string) (ByteSize, error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+	for _, unit := range byteUnits {
+		if strings.HasSuffix(str, unit.suffix) {
+			str = strings.TrimSpace(strings.TrimSuffix(str, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(str, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return ByteSize(n * multiplier), nil
+}
+
+// String returns the size in bytes
+func (b *ByteSize) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+// Type returns the flag value type name shown in usage
+func (b *ByteSize) Type() string {
+	return "size"
+}
+
+// Set parses a size such as 64MB
+func (b *ByteSize) Set(value string) error {
+	size, err := ParseByteSize(value)
+	if err != nil {
+		return err
+	}
+	*b = size
+	return nil
+}
+
+// JSONEndpointFlag collects repeated -json-endpoint flags of the form PATH=TEMPLATE,
+// where a template starting with '@' is read from the named file
+type JSONEndpointFlag []handler.VirtualEndpoint
+
+// String returns the configured endpoint paths
+func (f *JSONEndpointFlag) String() string {
+	paths := make([]string, 0, len(*f))
+	for _, endpoint := range *f {
+		paths = append(paths, endpoint.Path)
+	}
+	return strings.Join(paths, ",")
+}
+
+// Type returns the flag value type name shown in usage
+func (f *JSONEndpointFlag) Type() string {
+	return "endpoint"
+}
+
+// Set parses the endpoint and its template
+func (f *JSONEndpointFlag) Set(value string) error {
+	path, source, ok := strings.Cut(value, "=")
+	if !ok || !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("invalid JSON endpoint %q: expected /PATH=TEMPLATE", value)
+	}
+
+	if file, isFile := strings.CutPrefix(source, "@"); isFile {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read template for %s: %w", path, err)
+		}
+		source = string(content)
+	}
+
+	tmpl, err := template.New(path).Funcs(handler.TemplateFuncs).Parse(source)
+	if err != nil {
+		return fmt.Errorf("invalid template for %s: %w", path, err)
+	}
+
+	*f = append(*f, handler.VirtualEndpoint{Path: path, Template: tmpl})
+	return nil
+}
+
+// Duration is a time.Duration flag that also accepts a leading number of days, e.g. 30d or 1d12h
+type Duration time.Duration
+
+// ParseDuration parses a duration such as 90m, 30d or 1d12h
+func ParseDuration(s string) (Duration, error) {
+	str := strings.TrimSpace(s)
+
+	var days int64
+	if before, after, ok := strings.Cut(str, "d"); ok {
+		n, err := strconv.ParseInt(before, 10, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		days, str = n, after
+	}
+
+	var d time.Duration
+	if str != "" {
+		var err error
+		if d, err = time.ParseDuration(str); err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+	}
+	return Duration(time.Duration(days)*24*time.Hour + d), nil
+}
+
+// String returns the duration in Go syntax
+func (d *Duration) String() string {
+	return time.Duration(*d).String()
+}
+
+// Type returns the flag value type name shown in usage
+func (d *Duration) Type() string {
+	return "duration"
+}
+
+// Set parses the duration
+func (d *Duration) Set(value string) error {
+	parsed, err := ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
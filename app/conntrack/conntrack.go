@@ -0,0 +1,187 @@
+// Package conntrack keeps track of the open client connections and what each
+// of them is doing, to find connections stuck in one state, such as a
+// handler that never returns
+package conntrack
+
+import (
+	"bytes"
+	"cmp"
+	"runtime"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"octo-server/app/clock"
+)
+
+// Connection states
+const (
+	// StateHandshake is a TLS handshake in progress
+	StateHandshake = "handshake"
+	// StateIdle is waiting for or reading the next request
+	StateIdle = "idle"
+	// StateQueued is a request waiting for a worker
+	StateQueued = "queued"
+	// StateActive is a request being handled
+	StateActive = "active"
+	// StateHTTP2 is an HTTP/2 connection multiplexing requests
+	StateHTTP2 = "http2"
+	// StateTunnel is a CONNECT tunnel relaying bytes
+	StateTunnel = "tunnel"
+)
+
+// States lists the connection states
+var States = []string{StateHandshake, StateIdle, StateQueued, StateActive, StateHTTP2, StateTunnel}
+
+// longLived are the states connections stay in for as long as they are open
+// by design, which are never stuck
+var longLived = []string{StateHTTP2, StateTunnel}
+
+// Conn describes an open connection
+type Conn struct {
+	ID       uint64 `json:"id"`
+	Remote   string `json:"remote"`
+	Listener string `json:"listener"`
+	// Goroutine is the ID of the goroutine serving the connection, as shown in stack dumps
+	Goroutine uint64    `json:"goroutine"`
+	Opened    time.Time `json:"opened"`
+	State     string    `json:"state"`
+	Since     time.Time `json:"since"`
+	// Target is the request being handled, in the queued and active states
+	Target   string `json:"target,omitempty"`
+	Requests int    `json:"requests"`
+}
+
+// Registry is the set of open connections
+type Registry struct {
+	clock clock.Clock
+
+	mu     sync.Mutex
+	conns  map[uint64]*Tracked
+	nextID uint64
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{clock: clock.Real, conns: make(map[uint64]*Tracked)}
+}
+
+// SetClock sets the clock states are timed with
+func (r *Registry) SetClock(c clock.Clock) {
+	r.clock = clock.Or(c)
+}
+
+// Tracked is an open connection in a registry
+type Tracked struct {
+	registry *Registry
+	// conn is guarded by the registry's mutex
+	conn Conn
+	// reported is set once the connection was reported stuck in its current state
+	reported bool
+}
+
+// Open adds a connection served by the calling goroutine to the registry, in the given state
+func (r *Registry) Open(remote, listener, state string) *Tracked {
+	now := r.clock.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextID++
+	t := &Tracked{registry: r, conn: Conn{
+		ID:        r.nextID,
+		Remote:    remote,
+		Listener:  listener,
+		Goroutine: goroutineID(),
+		Opened:    now,
+		State:     state,
+		Since:     now,
+	}}
+	r.conns[t.conn.ID] = t
+	return t
+}
+
+// Set moves the connection into a state, handling target in the queued and active states
+func (t *Tracked) Set(state, target string) {
+	now := t.registry.clock.Now()
+	t.registry.mu.Lock()
+	defer t.registry.mu.Unlock()
+	if state == StateQueued {
+		t.conn.Requests++
+	}
+	if state != t.conn.State {
+		t.conn.State, t.conn.Since, t.reported = state, now, false
+	}
+	t.conn.Target = target
+}
+
+// Close removes the connection from the registry
+func (t *Tracked) Close() {
+	t.registry.mu.Lock()
+	defer t.registry.mu.Unlock()
+	delete(t.registry.conns, t.conn.ID)
+}
+
+// Conns returns the open connections, oldest first
+func (r *Registry) Conns() []Conn {
+	r.mu.Lock()
+	conns := make([]Conn, 0, len(r.conns))
+	for _, t := range r.conns {
+		conns = append(conns, t.conn)
+	}
+	r.mu.Unlock()
+	slices.SortFunc(conns, byID)
+	return conns
+}
+
+// Count returns the number of open connections in a state
+func (r *Registry) Count(state string) int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var n int64
+	for _, t := range r.conns {
+		if t.conn.State == state {
+			n++
+		}
+	}
+	return n
+}
+
+// Stuck returns the connections that have been in a state other than http2 or
+// tunnel for at least threshold, and the ones among them not returned by an
+// earlier call for the same state
+func (r *Registry) Stuck(threshold time.Duration) (stuck, newly []Conn) {
+	now := r.clock.Now()
+	r.mu.Lock()
+	for _, t := range r.conns {
+		if slices.Contains(longLived, t.conn.State) || now.Sub(t.conn.Since) < threshold {
+			continue
+		}
+		stuck = append(stuck, t.conn)
+		if !t.reported {
+			t.reported = true
+			newly = append(newly, t.conn)
+		}
+	}
+	r.mu.Unlock()
+	slices.SortFunc(stuck, byID)
+	slices.SortFunc(newly, byID)
+	return stuck, newly
+}
+
+// byID orders connections by when they were opened
+func byID(a, b Conn) int {
+	return cmp.Compare(a.ID, b.ID)
+}
+
+// goroutineID returns the ID of the calling goroutine, read from the header
+// of its stack trace, "goroutine 42 [running]:"
+func goroutineID() uint64 {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	buf = bytes.TrimPrefix(buf, []byte("goroutine "))
+	if i := bytes.IndexByte(buf, ' '); i >= 0 {
+		buf = buf[:i]
+	}
+	id, _ := strconv.ParseUint(string(buf), 10, 64)
+	return id
+}
@@ -0,0 +1,305 @@
+// Package crash writes a report when the server crashes or recovers from a
+// panic, with the stack, the requests it was serving and its configuration,
+// and can send it to a Sentry-compatible service, so crashes can be
+// investigated afterwards
+package crash
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"octo-server/app/buildinfo"
+	"octo-server/app/recent"
+)
+
+// fatalPattern matches the files the runtime writes fatal errors to, one per process
+const fatalPattern = "fatal-*.log"
+
+// Frame is a function call on the stack of a panic
+type Frame struct {
+	Function string `json:"function"`
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+}
+
+// Report describes a crash
+type Report struct {
+	Time    time.Time `json:"time"`
+	PID     int       `json:"pid"`
+	Version string    `json:"version,omitempty"`
+	// Panic is the value the server panicked with, or the message of a fatal error
+	Panic string `json:"panic"`
+	// Recovered is set if the server carried on after the panic
+	Recovered bool `json:"recovered,omitempty"`
+	// Frames are the calls leading to a panic, innermost first
+	Frames []Frame `json:"frames,omitempty"`
+	// Stack is the stack trace of every goroutine
+	Stack string `json:"stack"`
+	// Requests are the latest requests, oldest first, including those in progress
+	Requests []recent.Request `json:"requests,omitempty"`
+	// Config is the settings the server was started with, by flag name
+	Config map[string]string `json:"config,omitempty"`
+}
+
+// Reporter writes and sends crash reports. It does nothing until configured.
+type Reporter struct {
+	enabled atomic.Bool
+	// reported is set once a report was made, as the process is going down
+	reported atomic.Bool
+
+	mu       sync.Mutex
+	dir      string
+	sentry   *sentry
+	config   map[string]string
+	requests *recent.Log
+	fatal    *os.File
+	// recovered are the places recovered panics were reported for, as file:line
+	recovered map[string]bool
+}
+
+// Default is the process-wide crash reporter
+var Default = &Reporter{}
+
+// Configure has crash reports written to dir and sent to the Sentry DSN, either
+// of which may be empty. Fatal runtime errors, which cannot be recovered from,
+// are written by the runtime to a file in dir that is turned into a report
+// the next time the server is configured with the same dir.
+func (r *Reporter) Configure(dir, dsn string) error {
+	var s *sentry
+	if dsn != "" {
+		var err error
+		if s, err = parseDSN(dsn); err != nil {
+			return err
+		}
+	}
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return fmt.Errorf("failed to create the crash directory: %w", err)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dir, r.sentry = dir, s
+	r.enabled.Store(dir != "" || s != nil)
+	if dir == "" {
+		return nil
+	}
+
+	r.closeFatal()
+	previous := r.collectFatal()
+	f, err := os.OpenFile(filepath.Join(dir, "fatal-"+strconv.Itoa(os.Getpid())+".log"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create the fatal error file: %w", err)
+	}
+	if err := debug.SetCrashOutput(f, debug.CrashOptions{}); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to set the fatal error file: %w", err)
+	}
+	r.fatal = f
+	if len(previous) > 0 {
+		go r.deliver(previous)
+	}
+	return nil
+}
+
+// Close stops writing fatal errors to the crash directory, removing the
+// file they would have been written to, once the server has stopped cleanly
+func (r *Reporter) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closeFatal()
+}
+
+// closeFatal stops writing fatal errors to the crash directory; r.mu must be held
+func (r *Reporter) closeFatal() {
+	if r.fatal == nil {
+		return
+	}
+	debug.SetCrashOutput(nil, debug.CrashOptions{})
+	r.fatal.Close()
+	os.Remove(r.fatal.Name())
+	r.fatal = nil
+}
+
+// SetConfig sets the configuration included in reports
+func (r *Reporter) SetConfig(config map[string]string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.config = config
+}
+
+// SetRequests sets the log of the latest requests included in reports
+func (r *Reporter) SetRequests(requests *recent.Log) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = requests
+}
+
+// Recover reports a panic and panics again, so the server still crashes as it
+// would have. It must be deferred directly, at the start of a goroutine.
+func (r *Reporter) Recover() {
+	v := recover()
+	if v == nil {
+		return
+	}
+	if r.enabled.Load() && !r.reported.Swap(true) {
+		pcs := make([]uintptr, 64)
+		n := runtime.Callers(2, pcs)
+		report := r.newReport(fmt.Sprint(v), frames(pcs[:n]))
+		// The report replaces what the runtime would write as the process crashes
+		r.mu.Lock()
+		r.closeFatal()
+		r.mu.Unlock()
+		r.deliver([]*Report{report})
+	}
+	panic(v)
+}
+
+// Recovered reports a panic the server recovered from and carried on after,
+// once for each place panicking, since the same bug tends to panic again and
+// again. It must be called by the deferred function that recovered.
+func (r *Reporter) Recovered(v any) {
+	if !r.enabled.Load() {
+		return
+	}
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(3, pcs)
+	calls := frames(pcs[:n])
+	var where string
+	if len(calls) > 0 {
+		where = calls[0].File + ":" + strconv.Itoa(calls[0].Line)
+	}
+
+	r.mu.Lock()
+	if r.recovered[where] {
+		r.mu.Unlock()
+		return
+	}
+	if r.recovered == nil {
+		r.recovered = make(map[string]bool)
+	}
+	r.recovered[where] = true
+	r.mu.Unlock()
+
+	report := r.newReport(fmt.Sprint(v), calls)
+	report.Recovered = true
+	go r.deliver([]*Report{report})
+}
+
+// newReport builds the report of a panic with the value and the calls leading to it
+func (r *Reporter) newReport(value string, calls []Frame) *Report {
+	stack := make([]byte, 1<<20)
+	stack = stack[:runtime.Stack(stack, true)]
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return &Report{
+		Time:     time.Now().UTC(),
+		PID:      os.Getpid(),
+		Version:  buildinfo.Version,
+		Panic:    value,
+		Frames:   calls,
+		Stack:    string(stack),
+		Requests: r.requests.Requests(),
+		Config:   r.config,
+	}
+}
+
+// frames returns the calls of a panicking stack, leaving out the runtime's
+// panic handling above the call that panicked
+func frames(pcs []uintptr) []Frame {
+	var calls []Frame
+	frames := runtime.CallersFrames(pcs)
+	for {
+		frame, more := frames.Next()
+		if len(calls) > 0 || !strings.HasPrefix(frame.Function, "runtime.") {
+			calls = append(calls, Frame{Function: frame.Function, File: frame.File, Line: frame.Line})
+		}
+		if !more {
+			break
+		}
+	}
+	return calls
+}
+
+// deliver writes reports to the crash directory and sends them to Sentry
+func (r *Reporter) deliver(reports []*Report) {
+	r.mu.Lock()
+	dir, s := r.dir, r.sentry
+	r.mu.Unlock()
+
+	for _, report := range reports {
+		if dir != "" {
+			if path, err := writeReport(dir, report); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to write crash report: %v\n", err)
+			} else {
+				fmt.Fprintf(os.Stderr, "Crash report written to %s\n", path)
+			}
+		}
+		if s != nil {
+			if err := s.send(report); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to send crash report: %v\n", err)
+			}
+		}
+	}
+}
+
+// writeReport writes a report to a file of its own in dir, returning its path
+func writeReport(dir string, report *Report) (string, error) {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("crash-%s-%d.json", report.Time.Format("20060102T150405.000Z"), report.PID)
+	path := filepath.Join(dir, name)
+	return path, os.WriteFile(path, append(data, '\n'), 0600)
+}
+
+// collectFatal turns the fatal errors processes wrote to the crash directory
+// before dying into reports, removing their files. Empty files are left to the
+// processes still running, which remove them when they stop.
+func (r *Reporter) collectFatal() []*Report {
+	paths, _ := filepath.Glob(filepath.Join(r.dir, fatalPattern))
+	var reports []*Report
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil || info.Size() == 0 {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		os.Remove(path)
+
+		pid, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "fatal-"), ".log"))
+		reports = append(reports, &Report{
+			Time:  info.ModTime().UTC(),
+			PID:   pid,
+			Panic: fatalMessage(string(data)),
+			Stack: string(data),
+		})
+	}
+	return reports
+}
+
+// fatalMessage returns the message of the fatal error or panic the runtime
+// wrote a stack trace for, which some fatal errors leave out
+func fatalMessage(output string) string {
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, "fatal error: ") || strings.HasPrefix(line, "panic: ") {
+			return line
+		}
+	}
+	return "fatal error"
+}
@@ -0,0 +1,167 @@
+package crash
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	nethttp "net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"octo-server/app/buildinfo"
+)
+
+// sendTimeout bounds sending a report, which holds up a crashing process from exiting
+const sendTimeout = 5 * time.Second
+
+// sentry sends reports as events to the store endpoint of a Sentry-compatible service
+type sentry struct {
+	endpoint string
+	key      string
+	client   *nethttp.Client
+}
+
+// parseDSN parses a Sentry DSN of the form "https://KEY@HOST[/PATH]/PROJECT"
+func parseDSN(dsn string) (*sentry, error) {
+	u, err := url.Parse(dsn)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User == nil || u.User.Username() == "" {
+		return nil, fmt.Errorf("invalid crash report DSN %q: must be of the form https://KEY@HOST/PROJECT", dsn)
+	}
+	prefix, project := path.Split(strings.TrimSuffix(u.Path, "/"))
+	if project == "" {
+		return nil, fmt.Errorf("invalid crash report DSN %q: no project ID", dsn)
+	}
+	endpoint := url.URL{Scheme: u.Scheme, Host: u.Host, Path: path.Join(prefix, "api", project, "store") + "/"}
+	return &sentry{
+		endpoint: endpoint.String(),
+		key:      u.User.Username(),
+		client:   &nethttp.Client{Timeout: sendTimeout},
+	}, nil
+}
+
+// CheckDSN returns why a Sentry DSN is invalid, or nil if it is valid
+func CheckDSN(dsn string) error {
+	_, err := parseDSN(dsn)
+	return err
+}
+
+// event is a Sentry event describing a crash
+type event struct {
+	EventID    string         `json:"event_id"`
+	Timestamp  string         `json:"timestamp"`
+	Level      string         `json:"level"`
+	Platform   string         `json:"platform"`
+	Logger     string         `json:"logger"`
+	Release    string         `json:"release,omitempty"`
+	ServerName string         `json:"server_name,omitempty"`
+	Exception  exceptions     `json:"exception"`
+	Extra      map[string]any `json:"extra"`
+}
+
+// exceptions, exception, stacktrace and stackFrame describe the panic or
+// fatal error of an event
+type (
+	exceptions struct {
+		Values []exception `json:"values"`
+	}
+	exception struct {
+		Type       string      `json:"type"`
+		Value      string      `json:"value"`
+		Stacktrace *stacktrace `json:"stacktrace,omitempty"`
+	}
+	stacktrace struct {
+		Frames []stackFrame `json:"frames"`
+	}
+	stackFrame struct {
+		Function string `json:"function"`
+		Module   string `json:"module,omitempty"`
+		AbsPath  string `json:"abs_path"`
+		Lineno   int    `json:"lineno"`
+		InApp    bool   `json:"in_app"`
+	}
+)
+
+// send posts a report as an event
+func (s *sentry) send(report *Report) error {
+	id := make([]byte, 16)
+	rand.Read(id)
+	hostname, _ := os.Hostname()
+	ev := event{
+		EventID:    hex.EncodeToString(id),
+		Timestamp:  report.Time.Format(time.RFC3339),
+		Level:      "fatal",
+		Platform:   "go",
+		Logger:     "octo-server",
+		Release:    report.Version,
+		ServerName: hostname,
+		Extra: map[string]any{
+			"pid":   report.PID,
+			"stack": report.Stack,
+		},
+	}
+	if report.Recovered {
+		ev.Level = "error"
+	}
+	if len(report.Requests) > 0 {
+		ev.Extra["requests"] = report.Requests
+	}
+	if len(report.Config) > 0 {
+		ev.Extra["config"] = report.Config
+	}
+
+	exc := exception{Type: "fatal error", Value: report.Panic}
+	if len(report.Frames) > 0 {
+		exc.Type = "panic"
+		exc.Stacktrace = &stacktrace{}
+		// Sentry lists frames outermost first
+		for _, frame := range slices.Backward(report.Frames) {
+			module, function := splitFunction(frame.Function)
+			exc.Stacktrace.Frames = append(exc.Stacktrace.Frames, stackFrame{
+				Function: function,
+				Module:   module,
+				AbsPath:  frame.File,
+				Lineno:   frame.Line,
+				InApp:    strings.HasPrefix(module, "octo-server/"),
+			})
+		}
+	}
+	ev.Exception.Values = []exception{exc}
+
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	req, err := nethttp.NewRequest("POST", s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", fmt.Sprintf("Sentry sentry_version=7, sentry_key=%s, sentry_client=octo-server/%s", s.key, buildinfo.Version))
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s answered %s", s.endpoint, resp.Status)
+	}
+	return nil
+}
+
+// splitFunction splits a qualified function name such as
+// "octo-server/app/handler.(*Router).serve" into its package and function
+func splitFunction(name string) (string, string) {
+	slash := strings.LastIndex(name, "/") + 1
+	if dot := strings.Index(name[slash:], "."); dot >= 0 {
+		return name[:slash+dot], name[slash+dot+1:]
+	}
+	return "", name
+}
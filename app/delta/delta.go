@@ -0,0 +1,320 @@
+package delta
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Block size limits; DefaultBlockSize suits files from a few megabytes up
+const (
+	DefaultBlockSize = 8 * 1024
+	MinBlockSize     = 512
+	MaxBlockSize     = 1024 * 1024
+)
+
+// strongSize is the number of bytes of a block's SHA-256 kept in its signature
+const strongSize = 16
+
+// maxLiteral bounds a single literal run in a delta
+const maxLiteral = 1024 * 1024
+
+// magic starts every encoded delta
+const magic = "OCTD"
+
+// Delta operations
+const (
+	opCopy    = 'C' // uint64 first block, uint32 block count
+	opLiteral = 'L' // uint32 length, then the bytes
+	opEnd     = 'E' // SHA-256 of the whole target
+)
+
+var (
+	// ErrMalformed is returned for deltas that cannot be decoded or reference missing blocks
+	ErrMalformed = errors.New("malformed delta")
+	// ErrChecksumMismatch is returned when the reconstructed file does not match the
+	// delta's checksum, typically because the file changed after its signature was taken
+	ErrChecksumMismatch = errors.New("reconstructed file does not match the delta checksum")
+)
+
+// Block is the signature of one block of a file
+type Block struct {
+	Weak   uint32 `json:"weak"`
+	Strong string `json:"strong"`
+}
+
+// Signature describes a file block by block, so a client can find which
+// of its blocks the server already has
+type Signature struct {
+	BlockSize int     `json:"blockSize"`
+	Size      int64   `json:"size"`
+	Blocks    []Block `json:"blocks"`
+}
+
+// ValidBlockSize reports whether n is an accepted block size
+func ValidBlockSize(n int) bool {
+	return n >= MinBlockSize && n <= MaxBlockSize
+}
+
+// NewSignature computes the signature of the content read from r
+func NewSignature(r io.Reader, blockSize int) (*Signature, error) {
+	sig := &Signature{BlockSize: blockSize, Blocks: []Block{}}
+	buf := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			sig.Size += int64(n)
+			sig.Blocks = append(sig.Blocks, Block{Weak: weakSum(buf[:n]), Strong: strongSum(buf[:n])})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sig, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// weakSum returns the rolling checksum of a block, as used by rsync
+func weakSum(block []byte) uint32 {
+	var a, b uint32
+	n := uint32(len(block))
+	for i, c := range block {
+		a += uint32(c)
+		b += (n - uint32(i)) * uint32(c)
+	}
+	return a&0xffff | b<<16
+}
+
+// strongSum returns the hex-encoded truncated SHA-256 of a block
+func strongSum(block []byte) string {
+	sum := sha256.Sum256(block)
+	return hex.EncodeToString(sum[:strongSize])
+}
+
+// Diff encodes to w a delta turning the file described by sig into target,
+// copying the blocks the file already has and sending the rest literally.
+// This is the client side of a delta sync.
+func Diff(sig *Signature, target []byte, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	header := binary.BigEndian.AppendUint32([]byte(magic), uint32(sig.BlockSize))
+	bw.Write(header)
+
+	index := make(map[uint32][]int, len(sig.Blocks))
+	for i, block := range sig.Blocks {
+		index[block.Weak] = append(index[block.Weak], i)
+	}
+
+	e := &encoder{w: bw}
+	size := sig.BlockSize
+	literalStart := 0
+	pos := 0
+	var a, b uint32
+	rolled := false
+
+	// Slide a window of a block's size over the target, one byte at a time
+	for pos+size <= len(target) {
+		window := target[pos : pos+size]
+		if !rolled {
+			sum := weakSum(window)
+			a, b = sum&0xffff, sum>>16
+			rolled = true
+		}
+
+		if match, ok := findBlock(sig, index, a|b<<16, window); ok {
+			e.literal(target[literalStart:pos])
+			e.copyBlock(match)
+			pos += size
+			literalStart = pos
+			rolled = false
+			continue
+		}
+
+		if pos+size < len(target) {
+			out, in := uint32(target[pos]), uint32(target[pos+size])
+			a = (a - out + in) & 0xffff
+			b = (b - uint32(size)*out + a) & 0xffff
+		}
+		pos++
+	}
+
+	// A short last block of the file can only match the end of the target
+	if lastLen := int(sig.Size % int64(size)); lastLen > 0 && len(target)-literalStart >= lastLen {
+		tail := target[len(target)-lastLen:]
+		if match, ok := findBlock(sig, index, weakSum(tail), tail); ok {
+			e.literal(target[literalStart : len(target)-lastLen])
+			e.copyBlock(match)
+			literalStart = len(target)
+		}
+	}
+	e.literal(target[literalStart:])
+	e.flushCopy()
+
+	sum := sha256.Sum256(target)
+	bw.WriteByte(opEnd)
+	bw.Write(sum[:])
+	if e.err != nil {
+		return e.err
+	}
+	return bw.Flush()
+}
+
+// findBlock returns the index of a block of sig whose checksums match window
+func findBlock(sig *Signature, index map[uint32][]int, weak uint32, window []byte) (int, bool) {
+	candidates := index[weak]
+	if len(candidates) == 0 {
+		return 0, false
+	}
+	strong := strongSum(window)
+	for _, i := range candidates {
+		blockLen := sig.BlockSize
+		if i == len(sig.Blocks)-1 {
+			blockLen = int(sig.Size - int64(i)*int64(sig.BlockSize))
+		}
+		if blockLen == len(window) && sig.Blocks[i].Strong == strong {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// encoder writes delta operations, merging runs of consecutive block copies
+type encoder struct {
+	w         *bufio.Writer
+	copyStart int
+	copyCount int
+	err       error
+}
+
+// copyBlock adds a copy of block i
+func (e *encoder) copyBlock(i int) {
+	if e.copyCount > 0 && e.copyStart+e.copyCount == i {
+		e.copyCount++
+		return
+	}
+	e.flushCopy()
+	e.copyStart, e.copyCount = i, 1
+}
+
+// flushCopy writes the pending run of block copies
+func (e *encoder) flushCopy() {
+	if e.copyCount == 0 {
+		return
+	}
+	op := []byte{opCopy}
+	op = binary.BigEndian.AppendUint64(op, uint64(e.copyStart))
+	op = binary.BigEndian.AppendUint32(op, uint32(e.copyCount))
+	e.write(op)
+	e.copyCount = 0
+}
+
+// literal writes bytes sent as is, in runs of at most maxLiteral
+func (e *encoder) literal(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	e.flushCopy()
+	for len(data) > 0 {
+		n := min(len(data), maxLiteral)
+		e.write(binary.BigEndian.AppendUint32([]byte{opLiteral}, uint32(n)))
+		e.write(data[:n])
+		data = data[n:]
+	}
+}
+
+func (e *encoder) write(b []byte) {
+	if e.err == nil {
+		_, e.err = e.w.Write(b)
+	}
+}
+
+// Stats counts the bytes a delta copied from the base file and sent literally
+type Stats struct {
+	Size    int64 `json:"size"`
+	Copied  int64 `json:"copied"`
+	Literal int64 `json:"literal"`
+}
+
+// Apply reconstructs a file from the base file of size baseSize and a delta
+// read from r, writing it to w. The result is checked against the delta's
+// checksum before Apply returns successfully, so w should be discarded on error.
+func Apply(base io.ReaderAt, baseSize int64, r io.Reader, w io.Writer) (Stats, error) {
+	var stats Stats
+	br := bufio.NewReader(r)
+	hash := sha256.New()
+	out := io.MultiWriter(w, hash)
+
+	header := make([]byte, len(magic)+4)
+	if _, err := io.ReadFull(br, header); err != nil || string(header[:len(magic)]) != magic {
+		return stats, ErrMalformed
+	}
+	blockSize := int64(binary.BigEndian.Uint32(header[len(magic):]))
+	if !ValidBlockSize(int(blockSize)) {
+		return stats, ErrMalformed
+	}
+
+	for {
+		op, err := br.ReadByte()
+		if err != nil {
+			return stats, ErrMalformed
+		}
+
+		switch op {
+		case opCopy:
+			var args [12]byte
+			if _, err := io.ReadFull(br, args[:]); err != nil {
+				return stats, ErrMalformed
+			}
+			first := int64(binary.BigEndian.Uint64(args[:8]))
+			count := int64(binary.BigEndian.Uint32(args[8:]))
+			start := first * blockSize
+			if first < 0 || count <= 0 || start >= baseSize || count > (baseSize-start+blockSize-1)/blockSize {
+				return stats, fmt.Errorf("%w: copy of blocks %d+%d outside the base file", ErrMalformed, first, count)
+			}
+			length := min(count*blockSize, baseSize-start)
+			n, err := io.Copy(out, io.NewSectionReader(base, start, length))
+			stats.Copied += n
+			stats.Size += n
+			if err != nil {
+				return stats, err
+			}
+
+		case opLiteral:
+			var args [4]byte
+			if _, err := io.ReadFull(br, args[:]); err != nil {
+				return stats, ErrMalformed
+			}
+			length := int64(binary.BigEndian.Uint32(args[:]))
+			if length > maxLiteral {
+				return stats, ErrMalformed
+			}
+			n, err := io.CopyN(out, br, length)
+			stats.Literal += n
+			stats.Size += n
+			if err == io.EOF {
+				return stats, ErrMalformed
+			}
+			if err != nil {
+				return stats, err
+			}
+
+		case opEnd:
+			var sum [sha256.Size]byte
+			if _, err := io.ReadFull(br, sum[:]); err != nil {
+				return stats, ErrMalformed
+			}
+			if !bytes.Equal(sum[:], hash.Sum(nil)) {
+				return stats, ErrChecksumMismatch
+			}
+			return stats, nil
+
+		default:
+			return stats, fmt.Errorf("%w: unknown operation %q", ErrMalformed, op)
+		}
+	}
+}
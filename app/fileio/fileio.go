@@ -0,0 +1,63 @@
+// Package fileio reads and writes the served files. The standard library is
+// used unless the server is built with the "uring" tag on Linux, which adds an
+// experimental io_uring backend that batches large reads and writes into few
+// system calls.
+package fileio
+
+import (
+	"io"
+	"os"
+)
+
+// Backend reads and writes files
+type Backend interface {
+	// Name identifies the backend, e.g. in benchmark results
+	Name() string
+	// ReadAt reads len(p) bytes of f starting at off, like os.File.ReadAt
+	ReadAt(f *os.File, p []byte, off int64) (int, error)
+	// Copy writes everything read from r to f, which must be empty, and returns the bytes written
+	Copy(f *os.File, r io.Reader) (int64, error)
+}
+
+// Std is the backend using the standard library
+var Std Backend = stdBackend{}
+
+// Default is the backend used by ReadAt and Copy: io_uring when built with
+// the "uring" tag and the kernel allows it, Std otherwise
+var Default = Std
+
+// backends are the backends available in this build, Std first
+var backends = []Backend{Std}
+
+// Backends returns the backends available in this build, for comparing them
+func Backends() []Backend {
+	return backends
+}
+
+// ReadAt reads len(p) bytes of f starting at off with the default backend
+func ReadAt(f *os.File, p []byte, off int64) (int, error) {
+	return Default.ReadAt(f, p, off)
+}
+
+// Copy writes everything read from r to the empty file f with the default backend
+func Copy(f *os.File, r io.Reader) (int64, error) {
+	return Default.Copy(f, r)
+}
+
+// stdBackend reads and writes through the os package
+type stdBackend struct{}
+
+// Name identifies the backend
+func (stdBackend) Name() string {
+	return "std"
+}
+
+// ReadAt reads through os.File.ReadAt
+func (stdBackend) ReadAt(f *os.File, p []byte, off int64) (int, error) {
+	return f.ReadAt(p, off)
+}
+
+// Copy writes through io.Copy, which may let the kernel copy the data directly
+func (stdBackend) Copy(f *os.File, r io.Reader) (int64, error) {
+	return io.Copy(f, r)
+}
@@ -0,0 +1,45 @@
+package fileio
+
+import (
+	"errors"
+	"os"
+)
+
+// ErrMapUnsupported is returned by Map on platforms without memory-mapped files
+var ErrMapUnsupported = errors.New("memory-mapped files are not supported on this platform")
+
+// Mapping is a region of a file mapped into memory. Its bytes are read
+// straight from the page cache, without copying them into a buffer first,
+// and stay valid until Close.
+type Mapping struct {
+	data   []byte
+	region []byte
+}
+
+// Map maps length bytes of f starting at off into memory, read-only. The
+// kernel is told whether the whole file or a part of it is being mapped, so
+// that it reads ahead accordingly.
+//
+// Accessing the bytes of a file truncated while mapped faults; readers that
+// cannot rule that out should run with debug.SetPanicOnFault.
+func Map(f *os.File, off, length int64) (*Mapping, error) {
+	if length <= 0 {
+		return nil, errors.New("cannot map an empty region")
+	}
+	return mapFile(f, off, length)
+}
+
+// Bytes returns the mapped bytes, which must not be used after Close
+func (m *Mapping) Bytes() []byte {
+	return m.data
+}
+
+// Close unmaps the region
+func (m *Mapping) Close() error {
+	if m.region == nil {
+		return nil
+	}
+	region := m.region
+	m.data, m.region = nil, nil
+	return unmap(region)
+}
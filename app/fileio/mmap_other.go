@@ -0,0 +1,15 @@
+//go:build !unix
+
+package fileio
+
+import "os"
+
+// mapFile reports that files cannot be mapped on this platform
+func mapFile(f *os.File, off, length int64) (*Mapping, error) {
+	return nil, ErrMapUnsupported
+}
+
+// unmap is never called on this platform
+func unmap(region []byte) error {
+	return nil
+}
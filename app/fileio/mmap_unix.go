@@ -0,0 +1,33 @@
+//go:build unix
+
+package fileio
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// mapFile maps a page-aligned region of f covering [off, off+length)
+func mapFile(f *os.File, off, length int64) (*Mapping, error) {
+	pageSize := int64(os.Getpagesize())
+	start := off &^ (pageSize - 1)
+	region, err := unix.Mmap(int(f.Fd()), start, int(off-start+length), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return nil, &os.PathError{Op: "mmap", Path: f.Name(), Err: err}
+	}
+
+	// A whole file is read front to back; a range of it is wanted in full right away
+	advice := unix.MADV_WILLNEED
+	if info, err := f.Stat(); err == nil && off == 0 && length == info.Size() {
+		advice = unix.MADV_SEQUENTIAL
+	}
+	unix.Madvise(region, advice) // only a hint
+
+	return &Mapping{data: region[off-start:], region: region}, nil
+}
+
+// unmap releases a region mapped by mapFile
+func unmap(region []byte) error {
+	return unix.Munmap(region)
+}
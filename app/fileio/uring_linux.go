@@ -0,0 +1,422 @@
+//go:build uring
+
+package fileio
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// io_uring system calls, numbered alike on every architecture
+const (
+	sysIOURingSetup = 425
+	sysIOURingEnter = 426
+)
+
+// io_uring constants from linux/io_uring.h
+const (
+	opRead         = 22 // IORING_OP_READ, Linux 5.6
+	opWrite        = 23 // IORING_OP_WRITE, Linux 5.6
+	enterGetEvents = 1  // IORING_ENTER_GETEVENTS
+
+	offSQRing = 0          // IORING_OFF_SQ_RING
+	offCQRing = 0x8000000  // IORING_OFF_CQ_RING
+	offSQEs   = 0x10000000 // IORING_OFF_SQES
+)
+
+// ringDepth is the number of submission queue entries of each ring
+const ringDepth = 32
+
+// chunkSize is the size of each read or write submitted
+const chunkSize = 256 * 1024
+
+// copyBuffers is the number of chunks Copy keeps in flight while reading the next
+const copyBuffers = 8
+
+// sqringOffsets is struct io_sqring_offsets
+type sqringOffsets struct {
+	head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+	userAddr                                                        uint64
+}
+
+// cqringOffsets is struct io_cqring_offsets
+type cqringOffsets struct {
+	head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+	userAddr                                                        uint64
+}
+
+// params is struct io_uring_params
+type params struct {
+	sqEntries, cqEntries, flags, sqThreadCPU, sqThreadIdle, features, wqFD uint32
+	resv                                                                   [3]uint32
+	sqOff                                                                  sqringOffsets
+	cqOff                                                                  cqringOffsets
+}
+
+// sqe is struct io_uring_sqe, a submission queue entry
+type sqe struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	rwFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFDIn  int32
+	addr3       uint64
+	pad         uint64
+}
+
+// cqe is struct io_uring_cqe, a completion queue entry
+type cqe struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// ring is an io_uring instance. It is used by one goroutine at a time.
+type ring struct {
+	fd      int
+	entries uint32
+	// broken is set when the ring is in an unknown state and must not be reused
+	broken bool
+
+	sqMem, cqMem, sqeMem []byte
+
+	sqHead, sqTail, sqMask *uint32
+	sqArray                []uint32
+	sqes                   []sqe
+
+	cqHead, cqTail, cqMask *uint32
+	cqes                   []cqe
+}
+
+// newRing sets up a ring with the given number of submission queue entries
+func newRing(entries uint32) (*ring, error) {
+	var p params
+	fd, _, errno := syscall.Syscall(sysIOURingSetup, uintptr(entries), uintptr(unsafe.Pointer(&p)), 0)
+	if errno != 0 {
+		return nil, os.NewSyscallError("io_uring_setup", errno)
+	}
+	r := &ring{fd: int(fd), entries: p.sqEntries}
+
+	mmap := func(offset int64, size uint32) ([]byte, error) {
+		mem, err := syscall.Mmap(r.fd, offset, int(size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE)
+		if err != nil {
+			return nil, os.NewSyscallError("mmap", err)
+		}
+		return mem, nil
+	}
+	var err error
+	if r.sqMem, err = mmap(offSQRing, p.sqOff.array+p.sqEntries*4); err != nil {
+		r.close()
+		return nil, err
+	}
+	if r.cqMem, err = mmap(offCQRing, p.cqOff.cqes+p.cqEntries*uint32(unsafe.Sizeof(cqe{}))); err != nil {
+		r.close()
+		return nil, err
+	}
+	if r.sqeMem, err = mmap(offSQEs, p.sqEntries*uint32(unsafe.Sizeof(sqe{}))); err != nil {
+		r.close()
+		return nil, err
+	}
+
+	r.sqHead = (*uint32)(unsafe.Pointer(&r.sqMem[p.sqOff.head]))
+	r.sqTail = (*uint32)(unsafe.Pointer(&r.sqMem[p.sqOff.tail]))
+	r.sqMask = (*uint32)(unsafe.Pointer(&r.sqMem[p.sqOff.ringMask]))
+	r.sqArray = unsafe.Slice((*uint32)(unsafe.Pointer(&r.sqMem[p.sqOff.array])), p.sqEntries)
+	r.sqes = unsafe.Slice((*sqe)(unsafe.Pointer(&r.sqeMem[0])), p.sqEntries)
+	r.cqHead = (*uint32)(unsafe.Pointer(&r.cqMem[p.cqOff.head]))
+	r.cqTail = (*uint32)(unsafe.Pointer(&r.cqMem[p.cqOff.tail]))
+	r.cqMask = (*uint32)(unsafe.Pointer(&r.cqMem[p.cqOff.ringMask]))
+	r.cqes = unsafe.Slice((*cqe)(unsafe.Pointer(&r.cqMem[p.cqOff.cqes])), p.cqEntries)
+	return r, nil
+}
+
+// close unmaps the ring and closes it
+func (r *ring) close() {
+	for _, mem := range [][]byte{r.sqMem, r.cqMem, r.sqeMem} {
+		if mem != nil {
+			syscall.Munmap(mem)
+		}
+	}
+	syscall.Close(r.fd)
+}
+
+// push places a read or write of buf at off in the submission queue. The
+// caller keeps at most r.entries operations in flight, so the queue never fills.
+func (r *ring) push(op uint8, fd int, buf []byte, off int64, userData uint64) {
+	tail := *r.sqTail
+	index := tail & *r.sqMask
+	r.sqes[index] = sqe{
+		opcode:   op,
+		fd:       int32(fd),
+		off:      uint64(off),
+		addr:     uint64(uintptr(unsafe.Pointer(&buf[0]))),
+		len:      uint32(len(buf)),
+		userData: userData,
+	}
+	r.sqArray[index] = index
+	atomic.StoreUint32(r.sqTail, tail+1)
+}
+
+// wait submits the queued entries and waits for at least one completion
+func (r *ring) wait() error {
+	for {
+		// Entries the kernel has not consumed yet lie between the head and the tail
+		queued := *r.sqTail - atomic.LoadUint32(r.sqHead)
+		_, _, errno := syscall.Syscall6(sysIOURingEnter, uintptr(r.fd), uintptr(queued), 1, enterGetEvents, 0, 0)
+		switch errno {
+		case 0:
+			return nil
+		case syscall.EINTR, syscall.EAGAIN, syscall.EBUSY:
+			continue
+		}
+		r.broken = true
+		return os.NewSyscallError("io_uring_enter", errno)
+	}
+}
+
+// reap passes every completion available to fn
+func (r *ring) reap(fn func(c cqe)) {
+	head := *r.cqHead
+	tail := atomic.LoadUint32(r.cqTail)
+	for ; head != tail; head++ {
+		fn(r.cqes[head&*r.cqMask])
+	}
+	atomic.StoreUint32(r.cqHead, head)
+}
+
+// uringBackend reads and writes files through a pool of rings, one per
+// goroutine doing I/O, splitting large operations into chunks in flight together
+type uringBackend struct {
+	rings chan *ring
+}
+
+// init switches the default backend to io_uring if the kernel supports it
+func init() {
+	r, err := newRing(ringDepth)
+	if err == nil {
+		if err = r.probe(); err != nil {
+			r.close()
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "io_uring unavailable, using standard file I/O: %v\n", err)
+		return
+	}
+
+	b := &uringBackend{rings: make(chan *ring, runtime.GOMAXPROCS(0))}
+	b.rings <- r
+	Default = b
+	backends = append(backends, b)
+}
+
+// probe checks that the kernel supports the operations used, by reading a byte of /dev/zero
+func (r *ring) probe() error {
+	f, err := os.Open("/dev/zero")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	buf := []byte{1}
+	r.push(opRead, int(f.Fd()), buf, 0, 0)
+	if err := r.wait(); err != nil {
+		return err
+	}
+	var res int32
+	r.reap(func(c cqe) { res = c.res })
+	runtime.KeepAlive(buf)
+	if res < 0 {
+		return fmt.Errorf("IORING_OP_READ: %w", syscall.Errno(-res))
+	}
+	return nil
+}
+
+// get takes a ring from the pool, setting up a new one if none is idle
+func (b *uringBackend) get() (*ring, error) {
+	select {
+	case r := <-b.rings:
+		return r, nil
+	default:
+		return newRing(ringDepth)
+	}
+}
+
+// put returns a ring to the pool, closing it if the pool is full or the ring broken
+func (b *uringBackend) put(r *ring) {
+	if r.broken {
+		r.close()
+		return
+	}
+	select {
+	case b.rings <- r:
+	default:
+		r.close()
+	}
+}
+
+// Name identifies the backend
+func (b *uringBackend) Name() string {
+	return "io_uring"
+}
+
+// ReadAt reads p in chunks submitted together, resubmitting the rest of short reads
+func (b *uringBackend) ReadAt(f *os.File, p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	r, err := b.get()
+	if err != nil {
+		return Std.ReadAt(f, p, off)
+	}
+	defer b.put(r)
+
+	// segment is a part of p still to be read
+	type segment struct{ start, end int }
+	var queue, inflight []segment
+	for start := 0; start < len(p); start += chunkSize {
+		queue = append(queue, segment{start, min(start+chunkSize, len(p))})
+	}
+
+	fd := int(f.Fd())
+	eof := len(p)
+	var readErr error
+	pending := 0
+	for len(queue) > 0 || pending > 0 {
+		for len(queue) > 0 && pending < int(r.entries) {
+			s := queue[0]
+			queue = queue[1:]
+			if s.start >= eof || readErr != nil {
+				continue
+			}
+			r.push(opRead, fd, p[s.start:s.end], off+int64(s.start), uint64(len(inflight)))
+			inflight = append(inflight, s)
+			pending++
+		}
+		if pending == 0 {
+			break
+		}
+		if err := r.wait(); err != nil {
+			return 0, &os.PathError{Op: "read", Path: f.Name(), Err: err}
+		}
+		r.reap(func(c cqe) {
+			pending--
+			s := inflight[c.userData]
+			switch {
+			case c.res < 0:
+				readErr = syscall.Errno(-c.res)
+			case c.res == 0:
+				eof = min(eof, s.start)
+			case int(c.res) < s.end-s.start:
+				queue = append(queue, segment{s.start + int(c.res), s.end})
+			}
+		})
+	}
+	runtime.KeepAlive(p)
+
+	if readErr != nil {
+		return 0, &os.PathError{Op: "read", Path: f.Name(), Err: readErr}
+	}
+	if eof < len(p) {
+		return eof, io.EOF
+	}
+	return len(p), nil
+}
+
+// Copy reads src into a few chunk buffers, writing each one as soon as it is
+// full while the next is read, and resubmitting the rest of short writes
+func (b *uringBackend) Copy(f *os.File, src io.Reader) (int64, error) {
+	r, err := b.get()
+	if err != nil {
+		return Std.Copy(f, src)
+	}
+	defer b.put(r)
+
+	// chunk is a buffer and the part of it still to be written at off
+	type chunk struct {
+		buf        []byte
+		start, end int
+		off        int64
+	}
+	chunks := make([]chunk, min(copyBuffers, int(r.entries)))
+	free := make([]int, 0, len(chunks))
+	for i := range chunks {
+		free = append(free, i)
+	}
+
+	fd := int(f.Fd())
+	var offset, written int64
+	var readErr, writeErr error
+	pending := 0
+	for {
+		for readErr == nil && writeErr == nil && len(free) > 0 {
+			i := free[len(free)-1]
+			c := &chunks[i]
+			if c.buf == nil {
+				c.buf = make([]byte, chunkSize)
+			}
+			n, err := io.ReadFull(src, c.buf)
+			if n > 0 {
+				free = free[:len(free)-1]
+				*c = chunk{buf: c.buf, end: n, off: offset}
+				offset += int64(n)
+				r.push(opWrite, fd, c.buf[:n], c.off, uint64(i))
+				pending++
+			}
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				readErr = io.EOF
+			} else if err != nil {
+				readErr = err
+			}
+		}
+		if pending == 0 {
+			break
+		}
+
+		if err := r.wait(); err != nil {
+			return written, &os.PathError{Op: "write", Path: f.Name(), Err: err}
+		}
+		r.reap(func(cq cqe) {
+			pending--
+			i := int(cq.userData)
+			c := &chunks[i]
+			switch {
+			case cq.res < 0:
+				writeErr = &os.PathError{Op: "write", Path: f.Name(), Err: syscall.Errno(-cq.res)}
+			case cq.res == 0:
+				writeErr = io.ErrShortWrite
+			default:
+				written += int64(cq.res)
+				c.start += int(cq.res)
+				c.off += int64(cq.res)
+				if c.start < c.end && writeErr == nil {
+					r.push(opWrite, fd, c.buf[c.start:c.end], c.off, uint64(i))
+					pending++
+					return
+				}
+			}
+			free = append(free, i)
+		})
+	}
+	runtime.KeepAlive(chunks)
+
+	if writeErr != nil {
+		return written, writeErr
+	}
+	if readErr != io.EOF {
+		return written, readErr
+	}
+	return written, nil
+}
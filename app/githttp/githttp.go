@@ -0,0 +1,96 @@
+package githttp
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Services of the git smart HTTP protocol
+const (
+	UploadPack  = "git-upload-pack"  // fetch and clone
+	ReceivePack = "git-receive-pack" // push
+)
+
+var (
+	// ErrNoRepository is returned for names that do not resolve to a bare repository
+	ErrNoRepository = errors.New("no such repository")
+	// ErrPushDisabled is returned for pushes when they are not enabled
+	ErrPushDisabled = errors.New("push is disabled")
+	// ErrUnknownService is returned for services other than upload-pack and receive-pack
+	ErrUnknownService = errors.New("unknown git service")
+)
+
+// Repos serves the bare git repositories below a root directory
+type Repos struct {
+	Root string
+	// Push enables git-receive-pack, letting any client that can reach the server push
+	Push bool
+}
+
+// Path resolves a repository name, such as "team/app" or "team/app.git",
+// to the directory of a bare repository below the root
+func (r *Repos) Path(name string) (string, error) {
+	name = strings.Trim(name, "/")
+	if name == "" || !filepath.IsLocal(name) {
+		return "", ErrNoRepository
+	}
+
+	for _, candidate := range []string{name, name + ".git"} {
+		dir := filepath.Join(r.Root, candidate)
+		if info, err := os.Stat(filepath.Join(dir, "HEAD")); err == nil && info.Mode().IsRegular() {
+			if _, err := os.Stat(filepath.Join(dir, "objects")); err == nil {
+				return dir, nil
+			}
+		}
+	}
+	return "", ErrNoRepository
+}
+
+// Command returns the git command serving a request for a service on a
+// repository. With advertise, it lists the repository's refs for the
+// info/refs request starting every exchange. protocol is the client's
+// Git-Protocol header, passed on to select protocol version 2.
+func (r *Repos) Command(service, dir string, advertise bool, protocol string) (*exec.Cmd, error) {
+	switch service {
+	case UploadPack:
+	case ReceivePack:
+		if !r.Push {
+			return nil, ErrPushDisabled
+		}
+	default:
+		return nil, ErrUnknownService
+	}
+
+	args := []string{strings.TrimPrefix(service, "git-"), "--stateless-rpc"}
+	if advertise {
+		args = append(args, "--advertise-refs")
+	}
+	cmd := exec.Command("git", append(args, dir)...)
+	cmd.Env = os.Environ()
+	if protocol != "" {
+		cmd.Env = append(cmd.Env, "GIT_PROTOCOL="+protocol)
+	}
+	return cmd, nil
+}
+
+// IsProtocolV2 reports whether a Git-Protocol header asks for protocol version 2
+func IsProtocolV2(protocol string) bool {
+	for _, param := range strings.Split(protocol, ":") {
+		if param == "version=2" {
+			return true
+		}
+	}
+	return false
+}
+
+// PacketLine encodes s as a pkt-line, prefixed by its length in four hex digits
+func PacketLine(s string) string {
+	return fmt.Sprintf("%04x%s", len(s)+4, s)
+}
+
+// FlushPacket is the pkt-line ending a section of a git protocol message
+const FlushPacket = "0000"
@@ -0,0 +1,54 @@
+package handler
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"octo-server/app/http"
+)
+
+// RedactedHeaders are the headers whose values are never written to the
+// access log, as they carry credentials
+var RedactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// logAccess writes the access log line of a request answered since start,
+// with the configured request and response headers
+func (r *Router) logAccess(req *http.Request, writer *http.Writer, start time.Time) {
+	var line strings.Builder
+	fmt.Fprintf(&line, "Access: client=%s method=%s target=%s version=%s status=%d bytes=%d duration=%s id=%s",
+		req.ClientIP(), req.Method, req.RequestTarget, req.Version, writer.Status(), writer.BytesWritten(), time.Since(start).Round(time.Microsecond),
+		http.RequestID(req.Context()))
+	for _, name := range r.config.AccessLogHeaders {
+		writeLogHeader(&line, "", name, req.Header(name))
+	}
+	for _, name := range r.config.AccessLogResponseHeaders {
+		writeLogHeader(&line, "resp.", name, writer.ResponseHeaders().Join(name))
+	}
+	fmt.Println(line.String())
+}
+
+// writeLogHeader appends a header to an access log line as a lowercased
+// name and a quoted value, "-" if it is absent, redacting credentials
+func writeLogHeader(line *strings.Builder, prefix, name, value string) {
+	switch {
+	case value == "":
+		value = "-"
+	case isRedacted(name):
+		// Keep the authentication scheme, which helps debugging and reveals nothing
+		if scheme, _, ok := strings.Cut(value, " "); ok && strings.HasSuffix(strings.ToLower(name), "authorization") {
+			value = scheme + " [redacted]"
+		} else {
+			value = "[redacted]"
+		}
+	}
+	fmt.Fprintf(line, " %s%s=%q", prefix, strings.ToLower(name), value)
+}
+
+// isRedacted reports whether the value of a header must not be logged
+func isRedacted(name string) bool {
+	return slices.ContainsFunc(RedactedHeaders, func(redacted string) bool {
+		return strings.EqualFold(name, redacted)
+	})
+}
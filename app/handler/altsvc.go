@@ -0,0 +1,49 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+
+	"octo-server/app/http"
+)
+
+// AltService is an alternative endpoint of the server advertised in the
+// Alt-Svc header (RFC 7838), through which clients can switch to a newer protocol
+type AltService struct {
+	// Protocol is the ALPN protocol ID of the endpoint: h2 or h3
+	Protocol string
+	// Port is the port of the endpoint on the same host
+	Port string
+	// MaxAge is how long, in seconds, clients may remember the endpoint
+	MaxAge int
+}
+
+// String formats the service as an Alt-Svc entry such as h3=":443"; ma=86400
+func (a AltService) String() string {
+	return fmt.Sprintf(`%s=":%s"; ma=%d`, a.Protocol, a.Port, a.MaxAge)
+}
+
+// protocolRanks orders protocols from oldest to newest
+var protocolRanks = map[string]int{"h2": 2, "HTTP/2.0": 2, "h3": 3, "HTTP/3.0": 3}
+
+// altSvcHeader returns the Alt-Svc header advertising to a client speaking
+// version the services with a newer protocol, or "" if there are none
+func altSvcHeader(services []AltService, version string) string {
+	var entries []string
+	for _, service := range services {
+		if protocolRanks[service.Protocol] > protocolRanks[version] {
+			entries = append(entries, service.String())
+		}
+	}
+	return strings.Join(entries, ", ")
+}
+
+// altSvcFilter returns a response filter adding an Alt-Svc header unless a handler set one
+func altSvcFilter(value string) http.ResponseFilter {
+	return func(resp *http.Response) error {
+		if !resp.Headers.Has("Alt-Svc") {
+			resp.Headers.Set("Alt-Svc", value)
+		}
+		return nil
+	}
+}
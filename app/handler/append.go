@@ -0,0 +1,134 @@
+package handler
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"octo-server/app/http"
+	"octo-server/app/metrics"
+)
+
+// appendResult is the answer to an append
+type appendResult struct {
+	// Offset is where the body was written, the size of the file before
+	Offset   int64 `json:"offset"`
+	Appended int64 `json:"appended"`
+	Size     int64 `json:"size"`
+}
+
+// appending serializes the appends to each file
+var appending = &pathLocks{locks: make(map[string]*pathLock)}
+
+// pathLocks are mutexes by file path, kept while in use
+type pathLocks struct {
+	mu    sync.Mutex
+	locks map[string]*pathLock
+}
+
+// pathLock is the mutex of a path, with the number of goroutines holding or waiting for it
+type pathLock struct {
+	sync.Mutex
+	users int
+}
+
+// lock locks path, returning the function unlocking it
+func (p *pathLocks) lock(path string) func() {
+	p.mu.Lock()
+	l := p.locks[path]
+	if l == nil {
+		l = &pathLock{}
+		p.locks[path] = l
+	}
+	l.users++
+	p.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		p.mu.Lock()
+		if l.users--; l.users == 0 {
+			delete(p.locks, path)
+		}
+		p.mu.Unlock()
+	}
+}
+
+// AppendFileHandler handles PATCH /files/{name}, appending the body to a file
+// so that agents can ship a growing file, such as a log, in increments. With a
+// Content-Range header such as "bytes 500-999/*", the range must start at the
+// current size of the file, so a retried or out of order append is refused
+// with 416 and the size to resume from; with X-Append: true, the body is
+// appended wherever the file ends. The file is created if missing.
+func AppendFileHandler(req *http.Request, writer *http.Writer, config *Config) error {
+	if config.Directory == "" {
+		return Errorf(http.StatusInternalServerError, "directory not configured")
+	}
+	filename := req.Param("filename")
+	if filename == "" || !filepath.IsLocal(filename) {
+		return Errorf(http.StatusBadRequest, "invalid filename %q", filename)
+	}
+	if reservedPath(filename) {
+		return Errorf(http.StatusForbidden, "%q is reserved", filename)
+	}
+	path := config.Directory + "/" + filename
+
+	contentRange := req.Header("Content-Range")
+	var rng http.ByteRange
+	switch {
+	case contentRange != "":
+		var err error
+		if rng, err = http.ParseContentRange(contentRange); err != nil {
+			return Errorf(http.StatusBadRequest, "%v", err)
+		}
+		if n := req.ContentLength(); n >= 0 && n != rng.Length() {
+			return Errorf(http.StatusBadRequest, "body of %d bytes does not fill the content range %s", n, rng)
+		}
+	case !strings.EqualFold(req.Header("X-Append"), "true"):
+		return Errorf(http.StatusBadRequest, "neither Content-Range nor X-Append: true given")
+	}
+	if !req.HasBody() {
+		return Errorf(http.StatusLengthRequired, "no body to append")
+	}
+
+	unlock := appending.lock(path)
+	defer unlock()
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("failed to seek file: %w", err)
+	}
+	if contentRange != "" && rng.Start != offset {
+		return RangeNotSatisfiableHandler(req, writer, config, offset)
+	}
+
+	body, err := req.BodyReader()
+	if err != nil {
+		return fmt.Errorf("failed to read request body: %w", err)
+	}
+	// Written at the file's offset, which the io_uring backend of fileio.Copy does not honor
+	n, err := io.Copy(file, body)
+	short := err == nil && contentRange != "" && n != rng.Length()
+	if err != nil || short {
+		// A partial append would leave a torn record for the next one to follow
+		if truncErr := file.Truncate(offset); truncErr != nil {
+			fmt.Fprintf(os.Stderr, "Failed to truncate file after a failed append: %v\n", truncErr)
+		}
+		if short {
+			return Errorf(http.StatusBadRequest, "body of %d bytes does not fill the content range %s", n, rng)
+		}
+		return fmt.Errorf("failed to append to file: %w", err)
+	}
+
+	config.Files.Upload(filename, n)
+	metrics.Default.Add("file_append_bytes_total", n)
+	return writeJSON(req, writer, config, appendResult{Offset: offset, Appended: n, Size: offset + n})
+}
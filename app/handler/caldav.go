@@ -0,0 +1,255 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"octo-server/app/caldav"
+	"octo-server/app/http"
+	"octo-server/app/metrics"
+)
+
+// CalDAVEndpointRegex matches the calendar home below /caldav and the calendars in it
+var CalDAVEndpointRegex = regexp.MustCompile(`^/caldav(/.*)?$`)
+
+// calDAVMethods are the methods allowed on calendar resources, which are read-only
+const calDAVMethods = "OPTIONS, GET, HEAD, PROPFIND, REPORT"
+
+// CalDAVHandler serves the calendars through a read-only subset of CalDAV:
+// PROPFIND for discovery, calendar-query and calendar-multiget REPORTs for
+// syncing, and GET for single calendar objects
+func CalDAVHandler(req *http.Request, writer *http.Writer, config *Config) error {
+	if config.Calendars == nil {
+		return NotFoundHandler(req, writer, config)
+	}
+
+	name, err := url.PathUnescape(strings.TrimPrefix(req.Path(), config.Calendars.Prefix))
+	if err != nil {
+		return BadRequestHandler(req, writer, config)
+	}
+
+	switch req.Method {
+	case "OPTIONS":
+		return calDAVOptions(req, writer, config)
+	case "GET", "HEAD", "PROPFIND", "REPORT":
+	default:
+		return calDAVReadOnly(req, writer, config)
+	}
+	metrics.Default.Inc("caldav_requests_total", "method", req.Method)
+
+	resource, err := config.Calendars.Lookup(name)
+	if err != nil {
+		return NotFoundHandler(req, writer, config)
+	}
+
+	switch req.Method {
+	case "PROPFIND":
+		return calDAVPropFind(req, writer, config, resource)
+	case "REPORT":
+		return calDAVReport(req, writer, config, resource)
+	default:
+		return calDAVGet(req, writer, config, resource)
+	}
+}
+
+// calDAVPropFind answers PROPFIND, returning the properties of a resource
+// and, unless the Depth header is 0, of its children
+func calDAVPropFind(req *http.Request, writer *http.Writer, config *Config, resource *caldav.Resource) error {
+	body, err := calDAVBody(req)
+	if err != nil {
+		return bodyError(err)
+	}
+	var propfind caldav.PropFind
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := xml.Unmarshal(body, &propfind); err != nil {
+			return BadRequestHandler(req, writer, config)
+		}
+	}
+
+	// Depth defaults to infinity, which is served as 1 since calendars do not nest
+	resources := []*caldav.Resource{resource}
+	if req.Header("Depth") != "0" {
+		children, err := config.Calendars.Children(resource)
+		if err != nil {
+			return fmt.Errorf("failed to list calendar %s: %w", resource.Path, err)
+		}
+		resources = append(resources, children...)
+	}
+
+	multistatus := caldav.Multistatus{}
+	for _, r := range resources {
+		response := caldav.Response{Href: r.Href}
+		switch {
+		case propfind.PropName != nil:
+			var names []caldav.Property
+			for _, name := range caldav.PropertyNames(r) {
+				names = append(names, caldav.Property{XMLName: name})
+			}
+			response.Propstats = []caldav.Propstat{{Prop: caldav.Prop{Properties: names}, Status: caldav.Status(http.StatusOK)}}
+		case len(propfind.Prop) == 0:
+			response.Propstats = config.Calendars.Propstats(r, caldav.PropertyNames(r))
+		default:
+			response.Propstats = config.Calendars.Propstats(r, propfind.Prop)
+		}
+		multistatus.Responses = append(multistatus.Responses, response)
+	}
+	return writeXML(req, writer, config, http.StatusMultiStatus, multistatus)
+}
+
+// calDAVReport answers the calendar-multiget and calendar-query REPORTs calendar apps sync with
+func calDAVReport(req *http.Request, writer *http.Writer, config *Config, resource *caldav.Resource) error {
+	body, err := calDAVBody(req)
+	if err != nil {
+		return bodyError(err)
+	}
+	var report caldav.Report
+	if err := xml.Unmarshal(body, &report); err != nil {
+		return BadRequestHandler(req, writer, config)
+	}
+
+	names := []xml.Name(report.Prop)
+	if len(names) == 0 {
+		names = []xml.Name{
+			{Space: caldav.NamespaceDAV, Local: "getetag"},
+			{Space: caldav.NamespaceCalDAV, Local: "calendar-data"},
+		}
+	}
+
+	multistatus := caldav.Multistatus{}
+	switch report.XMLName {
+	case caldav.CalendarMultiget:
+		for _, href := range report.Hrefs {
+			object := calDAVObject(config.Calendars, href)
+			if object == nil {
+				multistatus.Responses = append(multistatus.Responses, caldav.Response{Href: href, Status: caldav.Status(http.StatusNotFound)})
+				continue
+			}
+			multistatus.Responses = append(multistatus.Responses, caldav.Response{Href: object.Href, Propstats: config.Calendars.Propstats(object, names)})
+		}
+
+	case caldav.CalendarQuery:
+		objects := []*caldav.Resource{resource}
+		if resource.Kind != caldav.KindObject {
+			if objects, err = config.Calendars.Children(resource); err != nil {
+				return fmt.Errorf("failed to list calendar %s: %w", resource.Path, err)
+			}
+		}
+		for _, object := range objects {
+			if object.Kind != caldav.KindObject {
+				continue
+			}
+			if report.Filter != nil {
+				data, err := os.ReadFile(object.Path)
+				if err != nil || !report.Filter.CompFilter.Matches(caldav.Components(data)) {
+					continue
+				}
+			}
+			multistatus.Responses = append(multistatus.Responses, caldav.Response{Href: object.Href, Propstats: config.Calendars.Propstats(object, names)})
+		}
+
+	default:
+		return writeXML(req, writer, config, http.StatusForbidden, caldav.Error{
+			Condition: caldav.Property{XMLName: xml.Name{Space: caldav.NamespaceDAV, Local: "supported-report"}},
+		})
+	}
+	return writeXML(req, writer, config, http.StatusMultiStatus, multistatus)
+}
+
+// calDAVBody reads the XML body of a request, which PROPFIND requests may leave out
+func calDAVBody(req *http.Request) ([]byte, error) {
+	if req.ContentLength() <= 0 && req.Header("Transfer-Encoding") == "" {
+		return nil, nil
+	}
+	return req.ReadBody()
+}
+
+// calDAVObject resolves an href of a calendar-multiget, which may be a path or a full URL,
+// returning nil if it names no calendar object
+func calDAVObject(home *caldav.Home, href string) *caldav.Resource {
+	u, err := url.Parse(href)
+	if err != nil || !strings.HasPrefix(u.Path, home.Prefix+"/") {
+		return nil
+	}
+	object, err := home.Lookup(strings.TrimPrefix(u.Path, home.Prefix))
+	if err != nil || object.Kind != caldav.KindObject {
+		return nil
+	}
+	return object
+}
+
+// calDAVGet answers GET and HEAD for a calendar object with its iCalendar data
+func calDAVGet(req *http.Request, writer *http.Writer, config *Config, resource *caldav.Resource) error {
+	if resource.Kind != caldav.KindObject {
+		resp := &http.Response{
+			StatusCode: http.StatusMethodNotAllowed,
+			StatusText: http.StatusCodeToText(http.StatusMethodNotAllowed),
+			Headers: http.Header{
+				"Allow":          {"OPTIONS, PROPFIND, REPORT"},
+				"Content-Length": {"0"},
+			},
+		}
+		return writer.WriteResponse(resp)
+	}
+
+	etag := caldav.ETag(resource)
+	headers := http.Header{
+		"Content-Type":  {caldav.ContentType},
+		"Etag":          {etag},
+		"Last-Modified": {resource.Info.ModTime().UTC().Format(http.TimeFormat)},
+	}
+	if req.Header("If-None-Match") == etag {
+		return writer.WriteResponse(&http.Response{StatusCode: http.StatusNotModified, StatusText: http.StatusCodeToText(http.StatusNotModified), Headers: headers})
+	}
+
+	data, err := os.ReadFile(resource.Path)
+	if err != nil {
+		return NotFoundHandler(req, writer, config)
+	}
+	headers.Set("Content-Length", strconv.Itoa(len(data)))
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		StatusText: http.StatusCodeToText(http.StatusOK),
+		Headers:    headers,
+		Body:       data,
+	}
+	if req.Method == "HEAD" {
+		resp.Body = nil
+	}
+	return writer.WriteResponse(resp)
+}
+
+// calDAVOptions answers OPTIONS, advertising CalDAV support to calendar apps
+func calDAVOptions(req *http.Request, writer *http.Writer, config *Config) error {
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		StatusText: http.StatusCodeToText(http.StatusOK),
+		Headers: http.Header{
+			"Dav":            {"1, 3, calendar-access"},
+			"Allow":          {calDAVMethods},
+			"Content-Length": {"0"},
+		},
+	}
+	return writer.WriteResponse(resp)
+}
+
+// calDAVReadOnly refuses requests that would change a calendar
+func calDAVReadOnly(req *http.Request, writer *http.Writer, config *Config) error {
+	const message = "Calendars are read-only"
+	resp := &http.Response{
+		StatusCode: http.StatusForbidden,
+		StatusText: http.StatusCodeToText(http.StatusForbidden),
+		Headers: http.Header{
+			"Allow":          {calDAVMethods},
+			"Content-Type":   {"text/plain"},
+			"Content-Length": {strconv.Itoa(len(message))},
+		},
+		Body: []byte(message),
+	}
+	return writer.WriteResponse(resp)
+}
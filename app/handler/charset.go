@@ -0,0 +1,158 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"octo-server/app/http"
+	"octo-server/app/metrics"
+)
+
+// DefaultTextExtensions are the extensions of the files served as text when
+// a charset is configured and no extensions are given
+var DefaultTextExtensions = []string{".txt", ".csv"}
+
+// textTypes are the media types of common text extensions
+var textTypes = map[string]string{
+	".txt": "text/plain",
+	".csv": "text/csv",
+	".tsv": "text/tab-separated-values",
+	".md":  "text/markdown",
+	".log": "text/plain",
+}
+
+// Byte order marks and the charsets they identify
+var boms = []struct {
+	mark    []byte
+	charset string
+}{
+	{[]byte{0xEF, 0xBB, 0xBF}, "utf-8"},
+	{[]byte{0xFF, 0xFE}, "utf-16le"},
+	{[]byte{0xFE, 0xFF}, "utf-16be"},
+}
+
+// detectBOM returns the charset the byte order mark at the start of data
+// identifies, and the length of the mark; the charset is empty without one
+func detectBOM(data []byte) (string, int) {
+	for _, bom := range boms {
+		if bytes.HasPrefix(data, bom.mark) {
+			return bom.charset, len(bom.mark)
+		}
+	}
+	return "", 0
+}
+
+// isTextFile reports whether name has one of the configured text extensions
+func (c *Config) isTextFile(name string) bool {
+	if c.TextCharset == "" {
+		return false
+	}
+	extensions := c.TextExtensions
+	if len(extensions) == 0 {
+		extensions = DefaultTextExtensions
+	}
+	ext := strings.ToLower(filepath.Ext(name))
+	return ext != "" && slices.ContainsFunc(extensions, func(e string) bool {
+		return strings.EqualFold("."+strings.TrimPrefix(e, "."), ext)
+	})
+}
+
+// textContentType returns the Content-Type of the text file at path with its
+// charset: the one its byte order mark identifies, or else the configured default
+func textContentType(path string, config *Config) (string, string) {
+	mediaType := textTypes[strings.ToLower(filepath.Ext(path))]
+	if mediaType == "" {
+		mediaType, _, _ = mime.ParseMediaType(mime.TypeByExtension(filepath.Ext(path)))
+	}
+	if mediaType == "" {
+		mediaType = "text/plain"
+	}
+
+	charset := config.TextCharset
+	if f, err := os.Open(path); err == nil {
+		prefix := make([]byte, 3)
+		n, _ := io.ReadFull(f, prefix)
+		f.Close()
+		if detected, _ := detectBOM(prefix[:n]); detected != "" {
+			charset = detected
+		}
+	}
+	return mime.FormatMediaType(mediaType, map[string]string{"charset": charset}), charset
+}
+
+// toUTF8 converts text in charset to UTF-8, dropping its byte order mark.
+// Charsets other than UTF-8, its ASCII subset and UTF-16 are not supported.
+func toUTF8(data []byte, charset string) ([]byte, error) {
+	charset = strings.ToLower(charset)
+	if detected, n := detectBOM(data); detected == charset {
+		data = data[n:]
+	}
+
+	var order binary.ByteOrder
+	switch charset {
+	case "utf-8", "us-ascii":
+		if !utf8.Valid(data) {
+			return nil, fmt.Errorf("invalid %s", charset)
+		}
+		return data, nil
+	case "utf-16le":
+		order = binary.LittleEndian
+	case "utf-16be":
+		order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("transcoding from %s is not supported", charset)
+	}
+
+	if len(data)%2 != 0 {
+		return nil, errors.New("odd length UTF-16 text")
+	}
+	units := make([]uint16, len(data)/2)
+	for i := range units {
+		units[i] = order.Uint16(data[2*i:])
+	}
+	return []byte(string(utf16.Decode(units))), nil
+}
+
+// serveTranscoded sends the whole text file at path converted from charset to
+// UTF-8, as asked for by ?charset=utf-8, or 406 if it cannot be converted
+func serveTranscoded(req *http.Request, writer *http.Writer, config *Config, name, path, contentType, charset string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return NotFoundHandler(req, writer, config)
+		}
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+	text, err := toUTF8(data, charset)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to transcode %s to UTF-8: %v\n", name, err)
+		return NotAcceptableHandler(req, writer, config)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		StatusText: http.StatusCodeToText(http.StatusOK),
+		Headers: http.Header{
+			"Content-Type":   {mime.FormatMediaType(mediaType, map[string]string{"charset": "utf-8"})},
+			"Content-Length": {strconv.Itoa(len(text))},
+		},
+		Body: text,
+	}
+	config.Downloads.Complete(name, int64(len(data)))
+	config.Files.Download(name, int64(len(data)))
+	metrics.Default.Inc("file_downloads_total", "kind", "complete")
+	metrics.Default.Inc("text_transcodes_total", "charset", charset)
+	return writer.WriteResponse(resp)
+}
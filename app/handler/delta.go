@@ -0,0 +1,117 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+
+	"octo-server/app/delta"
+	"octo-server/app/http"
+	"octo-server/app/metrics"
+)
+
+var (
+	// FileSignatureEndpointRegex matches GET /api/files/{name}/signature
+	FileSignatureEndpointRegex = regexp.MustCompile(`^/api/files/(?P<filename>.+)/signature$`)
+	// FileDeltaEndpointRegex matches POST /api/files/{name}/delta
+	FileDeltaEndpointRegex = regexp.MustCompile(`^/api/files/(?P<filename>.+)/delta$`)
+)
+
+// FileSignatureHandler handles GET /api/files/{name}/signature, returning the block
+// checksums a client needs to compute a delta against the file
+func FileSignatureHandler(req *http.Request, writer *http.Writer, config *Config) error {
+	filename := req.Param("filename")
+	if filename == "" || config.Directory == "" {
+		return Errorf(http.StatusNotFound, "no file to sign")
+	}
+
+	blockSize := delta.DefaultBlockSize
+	if param := req.Query("block-size"); param != "" {
+		n, err := strconv.Atoi(param)
+		if err != nil || !delta.ValidBlockSize(n) {
+			return Errorf(http.StatusBadRequest, "invalid block size %q", param)
+		}
+		blockSize = n
+	}
+
+	file, err := os.Open(config.Directory + "/" + filename)
+	if err != nil {
+		return Errorf(http.StatusNotFound, "%v", err)
+	}
+	defer file.Close()
+
+	sig, err := delta.NewSignature(file, blockSize)
+	if err != nil {
+		return fmt.Errorf("failed to compute file signature: %w", err)
+	}
+	return writeJSON(req, writer, config, sig)
+}
+
+// FileDeltaHandler handles POST /api/files/{name}/delta, updating a file from a
+// delta against its signature so only changed blocks are uploaded
+func FileDeltaHandler(req *http.Request, writer *http.Writer, config *Config) error {
+	filename := req.Param("filename")
+	if filename == "" || config.Directory == "" {
+		return Errorf(http.StatusNotFound, "no file to update")
+	}
+	if !filepath.IsLocal(filename) {
+		return Errorf(http.StatusBadRequest, "invalid filename %q", filename)
+	}
+	if reservedPath(filename) {
+		return Errorf(http.StatusForbidden, "%q is reserved", filename)
+	}
+	path := config.Directory + "/" + filename
+
+	base, err := os.Open(path)
+	if err != nil {
+		return Errorf(http.StatusNotFound, "%v", err)
+	}
+	defer base.Close()
+
+	info, err := base.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat file: %w", err)
+	}
+
+	if !req.HasBody() {
+		return Errorf(http.StatusLengthRequired, "no delta sent")
+	}
+	body, err := req.BodyReader()
+	if err != nil {
+		return Errorf(http.StatusBadRequest, "failed to read request body: %v", err)
+	}
+
+	// The file is rebuilt from the base and the delta into a temporary file,
+	// which only replaces the base once the result matches the delta's checksum
+	pr, pw := io.Pipe()
+	var stats delta.Stats
+	go func() {
+		var err error
+		stats, err = delta.Apply(base, info.Size(), body, pw)
+		pw.CloseWithError(err)
+	}()
+
+	_, err = config.writeFileAtomic(path, pr, func() error {
+		return config.saveVersion(filename)
+	})
+	pr.Close()
+	if err != nil {
+		switch {
+		case errors.Is(err, delta.ErrChecksumMismatch):
+			// The file most likely changed since the client fetched its signature
+			return Errorf(http.StatusConflict, "%v", err)
+		case errors.Is(err, delta.ErrMalformed):
+			return Errorf(http.StatusBadRequest, "%v", err)
+		}
+		return fmt.Errorf("failed to apply delta: %w", err)
+	}
+
+	config.Files.Upload(filename, stats.Literal)
+	metrics.Default.Add("delta_sync_bytes_total", stats.Copied, "kind", "copied")
+	metrics.Default.Add("delta_sync_bytes_total", stats.Literal, "kind", "literal")
+	return writeJSON(req, writer, config, stats)
+}
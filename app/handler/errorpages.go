@@ -0,0 +1,123 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+
+	"octo-server/app/http"
+)
+
+// errorPageTemplateExt marks error pages that are Go templates rather than static files
+const errorPageTemplateExt = ".tmpl"
+
+// ErrorHandlers are the handlers registered to write the error responses of
+// some statuses in place of the built-in ones
+type ErrorHandlers struct {
+	mu       sync.RWMutex
+	handlers map[int]HandlerFunc
+}
+
+// Set registers the handler writing the error responses with the given
+// status, or removes it if h is nil. The handler is called with a
+// configuration without error handlers, so that it can fall back on the
+// built-in handler of the status.
+func (e *ErrorHandlers) Set(code int, h HandlerFunc) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if h == nil {
+		delete(e.handlers, code)
+		return
+	}
+	if e.handlers == nil {
+		e.handlers = make(map[int]HandlerFunc)
+	}
+	e.handlers[code] = h
+}
+
+// get returns the handler registered for a status, if any
+func (e *ErrorHandlers) get(code int) HandlerFunc {
+	if e == nil {
+		return nil
+	}
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.handlers[code]
+}
+
+// errorPageData is what error page templates are executed with
+type errorPageData struct {
+	Status     int
+	StatusText string
+	Method     string
+	Path       string
+}
+
+// writeError writes an error response built by one of the status handlers.
+// A handler registered for its status writes it instead, or else the
+// configured error page of the status is sent as its body.
+func writeError(req *http.Request, writer *http.Writer, config *Config, resp *http.Response) error {
+	if h := config.ErrorHandlers.get(resp.StatusCode); h != nil {
+		plain := *config
+		plain.ErrorHandlers = nil
+		return h(req, writer, &plain)
+	}
+
+	if path := config.ErrorPages[resp.StatusCode]; path != "" {
+		body, err := renderErrorPage(path, errorPageData{
+			Status:     resp.StatusCode,
+			StatusText: resp.StatusText,
+			Method:     req.Method,
+			Path:       req.Path(),
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to render error page %s: %v\n", path, err)
+		} else {
+			resp.Headers.Set("Content-Type", contentTypeOf(strings.TrimSuffix(path, errorPageTemplateExt)))
+			resp.Headers.Set("Content-Length", strconv.Itoa(len(body)))
+			resp.Headers.Set("Cache-Control", "no-store")
+			if req.Method != "HEAD" {
+				resp.Body = body
+			}
+		}
+	}
+	return writer.WriteResponse(resp)
+}
+
+// renderErrorPage reads an error page, executing it as a template if its name
+// ends in .tmpl. Templates of HTML pages escape what they insert.
+func renderErrorPage(path string, data errorPageData) ([]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil || filepath.Ext(path) != errorPageTemplateExt {
+		return content, err
+	}
+
+	var page bytes.Buffer
+	if strings.HasPrefix(contentTypeOf(strings.TrimSuffix(path, errorPageTemplateExt)), "text/html") {
+		tmpl, err := htmltemplate.New(filepath.Base(path)).Parse(string(content))
+		if err != nil {
+			return nil, err
+		}
+		err = tmpl.Execute(&page, data)
+		return page.Bytes(), err
+	}
+	tmpl, err := template.New(filepath.Base(path)).Parse(string(content))
+	if err != nil {
+		return nil, err
+	}
+	err = tmpl.Execute(&page, data)
+	return page.Bytes(), err
+}
+
+// CheckErrorPage returns why an error page cannot be sent, such as a template
+// failing to parse, or nil if it can
+func CheckErrorPage(path string) error {
+	_, err := renderErrorPage(path, errorPageData{})
+	return err
+}
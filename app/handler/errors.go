@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"octo-server/app/http"
+	"octo-server/app/memory"
+)
+
+// HTTPError is an error a handler returns to have the request answered with a
+// status, rather than writing the response itself. The message is logged for
+// server errors; clients only get the status.
+type HTTPError struct {
+	Code    int
+	Message string
+}
+
+// Error implements error
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Code, http.StatusCodeToText(e.Code), e.Message)
+}
+
+// Errorf returns an HTTPError with the status and a formatted message
+func Errorf(code int, format string, args ...any) *HTTPError {
+	return &HTTPError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// bodyError converts a failure to read a request body into an HTTPError: 413
+// for a body too large to read into memory, 503 for one that would exceed the
+// memory budget, and 400 for any other
+func bodyError(err error) *HTTPError {
+	if errors.Is(err, http.ErrBodyTooLarge) {
+		return Errorf(http.StatusContentTooLarge, "%v", err)
+	}
+	if errors.Is(err, memory.ErrBudgetExceeded) {
+		return Errorf(http.StatusServiceUnavailable, "%v", err)
+	}
+	return Errorf(http.StatusBadRequest, "%v", err)
+}
+
+// statusHandlers are the handlers answering HTTPErrors by status
+var statusHandlers = map[int]HandlerFunc{
+	http.StatusBadRequest:           BadRequestHandler,
+	http.StatusForbidden:            ForbiddenHandler,
+	http.StatusNotFound:             NotFoundHandler,
+	http.StatusNotAcceptable:        NotAcceptableHandler,
+	http.StatusConflict:             ConflictHandler,
+	http.StatusLengthRequired:       LengthRequiredHandler,
+	http.StatusContentTooLarge:      PayloadTooLargeHandler,
+	http.StatusUnsupportedMediaType: UnsupportedMediaTypeHandler,
+	http.StatusExpectationFailed:    ExpectationFailedHandler,
+	http.StatusTooEarly:             TooEarlyHandler,
+	http.StatusTooManyRequests:      TooManyRequestsHandler,
+	http.StatusInternalServerError:  InternalServerErrorHandler,
+	http.StatusBadGateway:           BadGatewayHandler,
+	http.StatusServiceUnavailable:   ServiceUnavailableHandler,
+	http.StatusGatewayTimeout:       GatewayTimeoutHandler,
+}
+
+// answerError answers a request whose handler returned err without writing a
+// response: an HTTPError with its status, a BindError like BindErrorHandler,
+// and any other error with 500, logging it. Errors returned once a response was
+// written, such as the client going away, or once the request timed out are
+// returned as they are.
+func answerError(req *http.Request, writer *http.Writer, config *Config, err error) error {
+	if err == nil || writer.Status() != 0 || errors.Is(err, http.ErrAbandoned) {
+		return err
+	}
+
+	var bindErr *http.BindError
+	if errors.As(err, &bindErr) {
+		return BindErrorHandler(req, writer, config, bindErr)
+	}
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) {
+		httpErr = &HTTPError{Code: http.StatusInternalServerError, Message: err.Error()}
+	}
+	if httpErr.Code >= 500 {
+		fmt.Fprintf(os.Stderr, "Error handling request: client=%s method=%s target=%s status=%d err=%s\n",
+			req.ClientIP(), req.Method, req.RequestTarget, httpErr.Code, httpErr.Message)
+	}
+	if h := statusHandlers[httpErr.Code]; h != nil {
+		return h(req, writer, config)
+	}
+	return writeError(req, writer, config, &http.Response{
+		StatusCode: httpErr.Code,
+		StatusText: http.StatusCodeToText(httpErr.Code),
+		Headers: http.Header{
+			"Content-Length": {"0"},
+		},
+	})
+}
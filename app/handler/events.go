@@ -0,0 +1,45 @@
+package handler
+
+import (
+	"encoding/json"
+	"time"
+
+	"octo-server/app/buildinfo"
+	"octo-server/app/http"
+	"octo-server/app/metrics"
+)
+
+// EventsHandler handles GET /events, a sample Server-Sent Events stream
+// sending a "stats" event every second until the client disconnects or the
+// request times out
+func EventsHandler(req *http.Request, writer *http.Writer, config *Config) error {
+	stream, err := writer.EventStream()
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	ticker := config.clock().NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		stats, err := json.Marshal(map[string]any{
+			"time":          config.clock().Now().UTC().Format(time.RFC3339),
+			"uptimeSeconds": int64(config.clock().Now().Sub(buildinfo.StartTime).Seconds()),
+			"responseBytes": metrics.Default.Get("http_response_bytes_total"),
+		})
+		if err != nil {
+			return err
+		}
+		if err := stream.Send("stats", string(stats)); err != nil {
+			// The client went away
+			return nil
+		}
+		select {
+		case <-ticker.C():
+		case <-req.Context().Done():
+			// The client went away or the request timed out
+			return nil
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"octo-server/app/analytics"
+	"octo-server/app/http"
+)
+
+var (
+	// FileStatsEndpointRegex matches GET /api/files/{name}/stats
+	FileStatsEndpointRegex = regexp.MustCompile(`^/api/files/(?P<filename>.+)/stats$`)
+	// FileVersionsEndpointRegex matches GET /api/files/{name}/versions
+	FileVersionsEndpointRegex = regexp.MustCompile(`^/api/files/(?P<filename>.+)/versions$`)
+)
+
+// FileEntry describes a file in the JSON listing
+type FileEntry struct {
+	Name    string              `json:"name"`
+	Size    int64               `json:"size"`
+	ModTime time.Time           `json:"modTime"`
+	Stats   analytics.FileStats `json:"stats"`
+}
+
+// FileListHandler handles GET /api/files, listing the files of the directory with their access statistics
+func FileListHandler(req *http.Request, writer *http.Writer, config *Config) error {
+	if config.Directory == "" {
+		return Errorf(http.StatusInternalServerError, "directory not configured")
+	}
+
+	entries, err := os.ReadDir(config.Directory)
+	if err != nil {
+		return fmt.Errorf("failed to list directory: %w", err)
+	}
+
+	files := []FileEntry{}
+	for _, entry := range entries {
+		// Skip directories and hidden files such as uploads in progress
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		stats, _ := config.Files.Get(entry.Name())
+		files = append(files, FileEntry{
+			Name:    entry.Name(),
+			Size:    info.Size(),
+			ModTime: info.ModTime().UTC(),
+			Stats:   stats,
+		})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+
+	return writeJSON(req, writer, config, files)
+}
+
+// FileStatsHandler handles GET /api/files/{name}/stats, reporting the access statistics of a file
+func FileStatsHandler(req *http.Request, writer *http.Writer, config *Config) error {
+	filename := req.Param("filename")
+	if filename == "" {
+		return NotFoundHandler(req, writer, config)
+	}
+
+	stats, ok := config.Files.Get(filename)
+	if !ok {
+		// Files that exist but were never accessed have empty statistics
+		if config.Directory == "" {
+			return NotFoundHandler(req, writer, config)
+		}
+		if _, err := os.Stat(config.Directory + "/" + filename); err != nil {
+			return NotFoundHandler(req, writer, config)
+		}
+	}
+
+	return writeJSON(req, writer, config, stats)
+}
+
+// FileVersionsHandler handles GET /api/files/{name}/versions, listing the previous versions of a file
+func FileVersionsHandler(req *http.Request, writer *http.Writer, config *Config) error {
+	filename := req.Param("filename")
+	if config.Versions == nil || filename == "" {
+		return NotFoundHandler(req, writer, config)
+	}
+
+	list, err := config.Versions.List(filename)
+	if err != nil {
+		return fmt.Errorf("failed to list versions: %w", err)
+	}
+	return writeJSON(req, writer, config, list)
+}
+
+// writeJSON writes v as an uncacheable JSON response
+func writeJSON(req *http.Request, writer *http.Writer, config *Config, v any) error {
+	content, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode JSON response: %w", err)
+	}
+
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		StatusText: http.StatusCodeToText(http.StatusOK),
+		Headers: http.Header{
+			"Content-Type":   {"application/json"},
+			"Content-Length": {fmt.Sprintf("%d", len(content))},
+			"Cache-Control":  {"no-store"},
+		},
+		Body: content,
+	}
+
+	return writer.WriteResponse(resp)
+}
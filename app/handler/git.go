@@ -0,0 +1,153 @@
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+
+	"octo-server/app/githttp"
+	"octo-server/app/http"
+	"octo-server/app/metrics"
+)
+
+// GitEndpointRegex matches the smart HTTP endpoints of a repository below /git/
+var GitEndpointRegex = regexp.MustCompile(`^/git/(?P<repo>.+?)/(?P<service>info/refs|git-upload-pack|git-receive-pack)$`)
+
+// GitHandler handles the git smart HTTP protocol, running git upload-pack for
+// fetches and git receive-pack for pushes against bare repositories
+func GitHandler(req *http.Request, writer *http.Writer, config *Config) error {
+	if config.Git == nil {
+		return NotFoundHandler(req, writer, config)
+	}
+
+	service := req.Param("service")
+	dir, err := config.Git.Path(req.Param("repo"))
+	if err != nil {
+		return NotFoundHandler(req, writer, config)
+	}
+
+	if service == "info/refs" {
+		if req.Method != "GET" {
+			return NotFoundHandler(req, writer, config)
+		}
+		return gitAdvertiseRefs(req, writer, config, dir, req.Query("service"))
+	}
+	if req.Method != "POST" {
+		return NotFoundHandler(req, writer, config)
+	}
+	return gitServiceRPC(req, writer, config, dir, service)
+}
+
+// gitAdvertiseRefs answers GET info/refs?service=..., which starts every fetch and push
+func gitAdvertiseRefs(req *http.Request, writer *http.Writer, config *Config, dir, service string) error {
+	protocol := req.Header("Git-Protocol")
+	cmd, err := config.Git.Command(service, dir, true, protocol)
+	if err != nil {
+		return gitCommandError(req, writer, config, err)
+	}
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	refs, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("git %s failed: repo=%s stderr=%s: %w", service, dir, stderr.Bytes(), err)
+	}
+
+	// Protocol version 2 starts directly with the capability advertisement
+	var body bytes.Buffer
+	if !githttp.IsProtocolV2(protocol) {
+		body.WriteString(githttp.PacketLine("# service=" + service + "\n"))
+		body.WriteString(githttp.FlushPacket)
+	}
+	body.Write(refs)
+
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		StatusText: http.StatusCodeToText(http.StatusOK),
+		Headers: http.Header{
+			"Content-Type":   {"application/x-" + service + "-advertisement"},
+			"Content-Length": {fmt.Sprintf("%d", body.Len())},
+			"Cache-Control":  {"no-cache"},
+		},
+		Body: body.Bytes(),
+	}
+	return writer.WriteResponse(resp)
+}
+
+// gitServiceRPC answers POST git-upload-pack or git-receive-pack, streaming the
+// request body to git and its output back to the client
+func gitServiceRPC(req *http.Request, writer *http.Writer, config *Config, dir, service string) error {
+	cmd, err := config.Git.Command(service, dir, false, req.Header("Git-Protocol"))
+	if err != nil {
+		return gitCommandError(req, writer, config, err)
+	}
+	if !req.HasBody() {
+		return LengthRequiredHandler(req, writer, config)
+	}
+
+	body, err := req.BodyReader()
+	if err != nil {
+		return Errorf(http.StatusBadRequest, "failed to read request body: %v", err)
+	}
+	// Clients compress large fetch negotiations
+	if req.Header("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return BadRequestHandler(req, writer, config)
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	var stderr bytes.Buffer
+	cmd.Stdin = body
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to read git %s output: %w", service, err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start git %s: %w", service, err)
+	}
+	metrics.Default.Inc("git_requests_total", "service", service)
+
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		StatusText: http.StatusCodeToText(http.StatusOK),
+		Headers: http.Header{
+			"Content-Type":  {"application/x-" + service + "-result"},
+			"Cache-Control": {"no-cache"},
+		},
+	}
+	writeErr := writer.WriteFrom(resp, stdout)
+	if writeErr != nil {
+		// Stop git if the client went away
+		cmd.Process.Kill()
+		io.Copy(io.Discard, stdout)
+	}
+	if err := cmd.Wait(); err != nil && writeErr == nil {
+		fmt.Fprintf(os.Stderr, "git %s failed: repo=%s err=%v stderr=%s\n", service, dir, err, stderr.Bytes())
+	}
+	return writeErr
+}
+
+// gitCommandError answers a request for a service that cannot be run
+func gitCommandError(req *http.Request, writer *http.Writer, config *Config, err error) error {
+	if errors.Is(err, githttp.ErrPushDisabled) {
+		resp := &http.Response{
+			StatusCode: http.StatusForbidden,
+			StatusText: http.StatusCodeToText(http.StatusForbidden),
+			Headers: http.Header{
+				"Content-Type":   {"text/plain"},
+				"Content-Length": {"19"},
+			},
+			Body: []byte("Push is not enabled"),
+		}
+		return writer.WriteResponse(resp)
+	}
+	return BadRequestHandler(req, writer, config)
+}
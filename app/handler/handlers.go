@@ -1,35 +1,215 @@
 package handler
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path"
+	"path/filepath"
 	"regexp"
-
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"octo-server/app/analytics"
+	"octo-server/app/caldav"
+	"octo-server/app/clock"
 	"octo-server/app/compression"
+	"octo-server/app/conntrack"
+	"octo-server/app/fileio"
+	"octo-server/app/githttp"
 	"octo-server/app/http"
+	"octo-server/app/httpcache"
+	"octo-server/app/ipfilter"
+	"octo-server/app/manifest"
+	"octo-server/app/metrics"
+	"octo-server/app/mirror"
+	"octo-server/app/progress"
+	"octo-server/app/proxy"
+	"octo-server/app/ratelimit"
+	"octo-server/app/recent"
+	"octo-server/app/referer"
+	"octo-server/app/rewrite"
+	"octo-server/app/s3"
+	"octo-server/app/trash"
+	"octo-server/app/versions"
 )
 
 var (
-	EchoEndpointRegex = regexp.MustCompile(`^/echo/(.+)$`)
-	FileEndpointRegex = regexp.MustCompile(`^/files/(.+)$`)
+	EchoEndpointRegex           = regexp.MustCompile(`^/echo/(?P<text>.+)$`)
+	FileEndpointRegex           = regexp.MustCompile(`^/files/(?P<filename>.+)$`)
+	UploadProgressEndpointRegex = regexp.MustCompile(`^/api/uploads/(?P<id>[^/]+)$`)
 )
 
-// HandlerFunc is the type for HTTP handler functions
+// HandlerFunc is the type for HTTP handler functions. A handler either writes
+// the response or returns an error for the router to answer, such as an
+// HTTPError; see answerError.
 type HandlerFunc func(req *http.Request, writer *http.Writer, config *Config) error
 
 // Config holds handler configuration
 type Config struct {
-	Directory string
+	Directory   string
+	RouteLimits []ratelimit.RouteRule
+	ExemptCIDRs ipfilter.CIDRList
+	Compression compression.Options
+
+	// TrustedProxies are the peers whose Forwarded and X-Forwarded-For headers
+	// name the client; IPFilter is applied again to the clients they name
+	TrustedProxies ipfilter.CIDRList
+	IPFilter       ipfilter.Filter
+
+	// DenyFingerprints are the JA3, JA4 and header order fingerprints of the
+	// clients refused with 403; LogFingerprints logs those of every request
+	DenyFingerprints []string
+	LogFingerprints  bool
+
+	// AccessLog logs every request with its status, along with the values of
+	// the AccessLogHeaders of the request and AccessLogResponseHeaders of the response
+	AccessLog                bool
+	AccessLogHeaders         []string
+	AccessLogResponseHeaders []string
+
+	// UploadMaxFileSize and UploadMaxTotalSize limit multipart uploads, in bytes; zero means unlimited
+	UploadMaxFileSize  int64
+	UploadMaxTotalSize int64
+
+	// MmapMinSize is the smallest download, in bytes, served from a memory-mapped file; zero disables mapping
+	MmapMinSize int64
+
+	// AuditContentLength checks every response's Content-Length against the bytes written
+	AuditContentLength bool
+
+	// ServerHeader is the Server header of responses that have none, or "" for none
+	ServerHeader string
+
+	// Maintenance answers every request but those for MaintenanceExempt paths
+	// with 503 and the MaintenancePage file, asking clients to come back after
+	// MaintenanceRetryAfter
+	Maintenance           bool
+	MaintenancePage       string
+	MaintenanceRetryAfter time.Duration
+
+	// WorkerMetricsDir, if set, holds the metrics sockets of every process of
+	// a server run by a supervisor, which /metrics sums up
+	WorkerMetricsDir string
+
+	// ErrorPages are the files sent as the body of error responses by status
+	ErrorPages map[int]string
+	// ErrorHandlers write the error responses of some statuses instead
+	ErrorHandlers *ErrorHandlers
+
+	// Recent keeps the latest requests for crash reports and, with
+	// RecentEndpoint, for GET /api/requests
+	Recent         *recent.Log
+	RecentEndpoint bool
+
+	// RecoverPanics answers requests whose handler panicked with 500 rather than
+	// letting the panic crash the server
+	RecoverPanics bool
+
+	// Connections are the open connections listed at GET /api/connections, if set
+	Connections *conntrack.Registry
+
+	// VirtualEndpoints are computed JSON endpoints, matched before the built-in routes
+	VirtualEndpoints []VirtualEndpoint
+
+	// Uploads tracks the progress of uploads sent with an X-Upload-ID header
+	Uploads *progress.Tracker
+
+	// Downloads records complete and partial file downloads
+	Downloads *analytics.Downloads
+
+	// Files records download and upload statistics per file
+	Files *analytics.Files
+
+	// Trash keeps deleted files for restoring; nil deletes files immediately
+	Trash *trash.Trash
+
+	// Versions keeps previous versions of overwritten files; nil disables versioning
+	Versions *versions.Store
+
+	// Manifest lists the files with their hashes for sync clients; nil when no directory is served
+	Manifest *manifest.Index
+
+	// Rewrites map request targets to other paths, or redirect them, before routing
+	Rewrites []rewrite.Rule
+	// RefererRules restrict paths to requests from pages of allowed sites
+	RefererRules []referer.Rule
+
+	// Mirror fetches files missing from Directory from an origin server; nil serves local files only
+	Mirror *mirror.Mirror
+
+	// S3 exposes the files as a bucket through the S3-compatible API; nil disables the API
+	S3 *s3.Bucket
+	// S3Credentials are required to sign S3 requests; empty credentials allow anonymous access
+	S3Credentials s3.Credentials
+
+	// Calendars serves a directory of iCalendar files through read-only CalDAV; nil disables it
+	Calendars *caldav.Home
+
+	// Git serves bare repositories through the git smart HTTP protocol; nil disables it
+	Git *githttp.Repos
+
+	// Mounts serve directories below URL path prefixes, matched before the built-in routes
+	Mounts []Mount
+
+	// Proxies forward requests under their route's prefix to an upstream, matched before the built-in routes
+	Proxies []*proxy.Proxy
+
+	// ProxyCache stores proxied responses to answer later requests from; nil forwards every request
+	ProxyCache *httpcache.Cache
+
+	// Hosts are the virtual hosts, keyed by lowercased host name, each served
+	// with its own configuration, e.g. for a different files directory. A
+	// name like "*.example.com" matches every subdomain. Requests for other
+	// hosts are served with this configuration, the default host.
+	Hosts map[string]*Config
+
+	// AltSvc are the alternative services advertised in the Alt-Svc header of
+	// responses to clients on an older protocol, such as HTTP/3 to HTTP/1.1 and HTTP/2 clients
+	AltSvc []AltService
+
+	// TextCharset, if set, is declared in the Content-Type of text files
+	// without a byte order mark; empty serves text files as octet streams
+	TextCharset string
+	// TextExtensions are the extensions of text files; empty uses DefaultTextExtensions
+	TextExtensions []string
+
+	// Clock tells the time for cache freshness, events and request signatures; nil is the system clock
+	Clock clock.Clock
+}
+
+// clock returns the clock handlers tell the time with
+func (c *Config) clock() clock.Clock {
+	return clock.Or(c.Clock)
+}
+
+// saveVersion keeps the current content of a file about to be overwritten, if versioning is enabled
+func (c *Config) saveVersion(name string) error {
+	if c.Versions == nil {
+		return nil
+	}
+	return c.Versions.Save(name)
+}
+
+// reservedPath reports whether name lies in a directory the server keeps its own
+// state in, which the files API must not write to or delete from
+func reservedPath(name string) bool {
+	return trash.Within(name, trash.Dir) || trash.Within(name, versions.Dir)
 }
 
 // RootHandler handles the root endpoint
 func RootHandler(req *http.Request, writer *http.Writer, config *Config) error {
 	resp := &http.Response{
-		StatusCode: 200,
-		StatusText: http.StatusCodeToText(200),
-		Headers:    make(map[string]string),
+		StatusCode: http.StatusOK,
+		StatusText: http.StatusCodeToText(http.StatusOK),
+		Headers:    make(http.Header),
 		Body:       nil,
 	}
 	return writer.WriteResponse(resp)
@@ -38,89 +218,342 @@ func RootHandler(req *http.Request, writer *http.Writer, config *Config) error {
 // NotFoundHandler handles 404 responses
 func NotFoundHandler(req *http.Request, writer *http.Writer, config *Config) error {
 	resp := &http.Response{
-		StatusCode: 404,
-		StatusText: http.StatusCodeToText(404),
-		Headers:    make(map[string]string),
+		StatusCode: http.StatusNotFound,
+		StatusText: http.StatusCodeToText(http.StatusNotFound),
+		Headers:    make(http.Header),
 		Body:       nil,
 	}
-	return writer.WriteResponse(resp)
+	return writeError(req, writer, config, resp)
+}
+
+// MethodNotAllowedHandler handles 405 responses, listing the allowed methods
+func MethodNotAllowedHandler(req *http.Request, writer *http.Writer, config *Config, allow string) error {
+	resp := &http.Response{
+		StatusCode: http.StatusMethodNotAllowed,
+		StatusText: http.StatusCodeToText(http.StatusMethodNotAllowed),
+		Headers: http.Header{
+			"Allow":          {allow},
+			"Content-Length": {"0"},
+		},
+		Body: nil,
+	}
+	return writeError(req, writer, config, resp)
+}
+
+// BindErrorHandler answers a request whose body BindJSON rejected with the
+// error's status and a JSON body describing it
+func BindErrorHandler(req *http.Request, writer *http.Writer, config *Config, err error) error {
+	var bindErr *http.BindError
+	if !errors.As(err, &bindErr) {
+		bindErr = &http.BindError{Status: http.StatusBadRequest, Message: err.Error()}
+	}
+	return writer.JSON(bindErr.Status, map[string]*http.BindError{"error": bindErr})
+}
+
+// RedirectHandler handles 3xx responses, redirecting the client to location
+func RedirectHandler(req *http.Request, writer *http.Writer, config *Config, status int, location string) error {
+	return writer.Redirect(status, location)
 }
 
 // BadRequestHandler handles 400 responses
 func BadRequestHandler(req *http.Request, writer *http.Writer, config *Config) error {
 	resp := &http.Response{
-		StatusCode: 400,
-		StatusText: http.StatusCodeToText(400),
-		Headers:    make(map[string]string),
+		StatusCode: http.StatusBadRequest,
+		StatusText: http.StatusCodeToText(http.StatusBadRequest),
+		Headers:    make(http.Header),
 		Body:       nil,
 	}
+	return writeError(req, writer, config, resp)
+}
+
+// RefererDeniedHandler answers a request refused by a referer rule with the
+// rule's placeholder file, or with 403 if it has none or it cannot be read
+func RefererDeniedHandler(req *http.Request, writer *http.Writer, config *Config, placeholder string) error {
+	if placeholder == "" {
+		return ForbiddenHandler(req, writer, config)
+	}
+	content, err := os.ReadFile(placeholder)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read referer placeholder: %v\n", err)
+		return ForbiddenHandler(req, writer, config)
+	}
+
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		StatusText: http.StatusCodeToText(http.StatusOK),
+		Headers: http.Header{
+			"Content-Type":   {contentTypeOf(placeholder)},
+			"Content-Length": {strconv.Itoa(len(content))},
+			"Cache-Control":  {"no-store"},
+		},
+		Body: content,
+	}
 	return writer.WriteResponse(resp)
 }
 
-// InternalServerErrorHandler handles 500 responses
-func InternalServerErrorHandler(req *http.Request, writer *http.Writer, config *Config) error {
+// ForbiddenHandler handles 403 responses
+func ForbiddenHandler(req *http.Request, writer *http.Writer, config *Config) error {
+	resp := &http.Response{
+		StatusCode: http.StatusForbidden,
+		StatusText: http.StatusCodeToText(http.StatusForbidden),
+		Headers: http.Header{
+			"Content-Length": {"0"},
+		},
+		Body: nil,
+	}
+	return writeError(req, writer, config, resp)
+}
+
+// NotAcceptableHandler handles 406 responses
+func NotAcceptableHandler(req *http.Request, writer *http.Writer, config *Config) error {
+	resp := &http.Response{
+		StatusCode: http.StatusNotAcceptable,
+		StatusText: http.StatusCodeToText(http.StatusNotAcceptable),
+		Headers: http.Header{
+			"Content-Length": {"0"},
+		},
+		Body: nil,
+	}
+	return writeError(req, writer, config, resp)
+}
+
+// LengthRequiredHandler handles 411 responses, sent when a request that needs
+// a body declares none. The connection is closed, since a client that left
+// out the length may still send a body.
+func LengthRequiredHandler(req *http.Request, writer *http.Writer, config *Config) error {
 	resp := &http.Response{
-		StatusCode: 500,
-		StatusText: http.StatusCodeToText(500),
-		Headers:    make(map[string]string),
+		StatusCode: http.StatusLengthRequired,
+		StatusText: http.StatusCodeToText(http.StatusLengthRequired),
+		Headers: http.Header{
+			"Connection":     {"close"},
+			"Content-Length": {"0"},
+		},
+		Body: nil,
+	}
+	return writeError(req, writer, config, resp)
+}
+
+// PayloadTooLargeHandler handles 413 responses, closing the connection
+// since the rest of the request body is left unread
+func PayloadTooLargeHandler(req *http.Request, writer *http.Writer, config *Config) error {
+	resp := &http.Response{
+		StatusCode: http.StatusContentTooLarge,
+		StatusText: http.StatusCodeToText(http.StatusContentTooLarge),
+		Headers: http.Header{
+			"Connection":     {"close"},
+			"Content-Length": {"0"},
+		},
+		Body: nil,
+	}
+	return writeError(req, writer, config, resp)
+}
+
+// UnsupportedMediaTypeHandler handles 415 responses
+func UnsupportedMediaTypeHandler(req *http.Request, writer *http.Writer, config *Config) error {
+	resp := &http.Response{
+		StatusCode: http.StatusUnsupportedMediaType,
+		StatusText: http.StatusCodeToText(http.StatusUnsupportedMediaType),
+		Headers: http.Header{
+			"Content-Length": {"0"},
+		},
+		Body: nil,
+	}
+	return writeError(req, writer, config, resp)
+}
+
+// ExpectationFailedHandler handles 417 responses, sent for Expect headers
+// other than 100-continue
+func ExpectationFailedHandler(req *http.Request, writer *http.Writer, config *Config) error {
+	resp := &http.Response{
+		StatusCode: http.StatusExpectationFailed,
+		StatusText: http.StatusCodeToText(http.StatusExpectationFailed),
+		Headers: http.Header{
+			"Content-Length": {"0"},
+		},
+		Body: nil,
+	}
+	return writeError(req, writer, config, resp)
+}
+
+// NoContentHandler handles 204 responses
+func NoContentHandler(req *http.Request, writer *http.Writer, config *Config) error {
+	resp := &http.Response{
+		StatusCode: http.StatusNoContent,
+		StatusText: http.StatusCodeToText(http.StatusNoContent),
+		Headers:    make(http.Header),
 		Body:       nil,
 	}
 	return writer.WriteResponse(resp)
 }
 
-// EchoHandler handles the /echo/<str> endpoint
-func EchoHandler(req *http.Request, writer *http.Writer, config *Config) error {
-	matches := EchoEndpointRegex.FindStringSubmatch(req.RequestTarget)
-	if len(matches) < 2 {
-		return NotFoundHandler(req, writer, config)
+// ConflictHandler handles 409 responses
+func ConflictHandler(req *http.Request, writer *http.Writer, config *Config) error {
+	resp := &http.Response{
+		StatusCode: http.StatusConflict,
+		StatusText: http.StatusCodeToText(http.StatusConflict),
+		Headers: http.Header{
+			"Connection":     {"close"},
+			"Content-Length": {"0"},
+		},
+		Body: nil,
 	}
+	return writeError(req, writer, config, resp)
+}
 
-	str := matches[1]
-	compressor := compression.NewCompressor()
+// TooEarlyHandler handles 425 responses, sent for requests that arrived in
+// TLS early data and could do harm if an attacker replayed them (RFC 8470)
+func TooEarlyHandler(req *http.Request, writer *http.Writer, config *Config) error {
+	resp := &http.Response{
+		StatusCode: http.StatusTooEarly,
+		StatusText: http.StatusCodeToText(http.StatusTooEarly),
+		Headers: http.Header{
+			"Content-Length": {"0"},
+		},
+		Body: nil,
+	}
+	return writeError(req, writer, config, resp)
+}
+
+// TooManyRequestsHandler handles 429 responses
+func TooManyRequestsHandler(req *http.Request, writer *http.Writer, config *Config) error {
+	resp := &http.Response{
+		StatusCode: http.StatusTooManyRequests,
+		StatusText: http.StatusCodeToText(http.StatusTooManyRequests),
+		Headers: http.Header{
+			"Retry-After":    {"1"},
+			"Content-Length": {"0"},
+		},
+		Body: nil,
+	}
+	return writeError(req, writer, config, resp)
+}
 
+// ServiceUnavailableHandler handles 503 responses, closing the connection
+// since any request body was left unread
+func ServiceUnavailableHandler(req *http.Request, writer *http.Writer, config *Config) error {
 	resp := &http.Response{
-		StatusCode: 200,
-		StatusText: http.StatusCodeToText(200),
-		Headers:    make(map[string]string),
+		StatusCode: http.StatusServiceUnavailable,
+		StatusText: http.StatusCodeToText(http.StatusServiceUnavailable),
+		Headers: http.Header{
+			"Connection":     {"close"},
+			"Content-Length": {"0"},
+		},
+		Body: nil,
 	}
+	return writeError(req, writer, config, resp)
+}
+
+// MaintenanceExempt are the paths served in maintenance mode, so that
+// monitoring keeps seeing the actual health of the server and its upstreams
+var MaintenanceExempt = []string{"/metrics", "/api/upstreams"}
 
-	acceptEncoding := req.Headers["Accept-Encoding"]
-	if compressor.SupportsGzip(acceptEncoding) {
-		compressed, err := compressor.CompressGzip([]byte(str))
+// maintenanceNotice is the body of maintenance mode responses without a page
+const maintenanceNotice = "The service is down for maintenance, please try again later.\n"
+
+// MaintenanceHandler handles 503 responses in maintenance mode, sending the
+// configured page and asking the client to retry after the configured delay
+func MaintenanceHandler(req *http.Request, writer *http.Writer, config *Config) error {
+	content, contentType := []byte(maintenanceNotice), "text/plain; charset=utf-8"
+	if config.MaintenancePage != "" {
+		page, err := os.ReadFile(config.MaintenancePage)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to compress data: %v\n", err)
-			return InternalServerErrorHandler(req, writer, config)
+			fmt.Fprintf(os.Stderr, "Failed to read maintenance page: %v\n", err)
+		} else {
+			content, contentType = page, contentTypeOf(config.MaintenancePage)
 		}
-
-		resp.Headers["Content-Type"] = "text/plain"
-		resp.Headers["Content-Encoding"] = "gzip"
-		resp.Headers["Content-Length"] = fmt.Sprintf("%d", len(compressed))
-		resp.Body = compressed
-	} else {
-		resp.Headers["Content-Type"] = "text/plain"
-		resp.Headers["Content-Length"] = fmt.Sprintf("%d", len(str))
-		resp.Body = []byte(str)
 	}
 
+	resp := &http.Response{
+		StatusCode: http.StatusServiceUnavailable,
+		StatusText: http.StatusCodeToText(http.StatusServiceUnavailable),
+		Headers: http.Header{
+			"Content-Type":   {contentType},
+			"Content-Length": {strconv.Itoa(len(content))},
+			"Retry-After":    {strconv.Itoa(int(config.MaintenanceRetryAfter.Seconds()))},
+			"Cache-Control":  {"no-store"},
+		},
+		Body: content,
+	}
 	return writer.WriteResponse(resp)
 }
 
+// InternalServerErrorHandler handles 500 responses
+func InternalServerErrorHandler(req *http.Request, writer *http.Writer, config *Config) error {
+	resp := &http.Response{
+		StatusCode: http.StatusInternalServerError,
+		StatusText: http.StatusCodeToText(http.StatusInternalServerError),
+		Headers:    make(http.Header),
+		Body:       nil,
+	}
+	return writeError(req, writer, config, resp)
+}
+
+// BadGatewayHandler handles 502 responses
+func BadGatewayHandler(req *http.Request, writer *http.Writer, config *Config) error {
+	resp := &http.Response{
+		StatusCode: http.StatusBadGateway,
+		StatusText: http.StatusCodeToText(http.StatusBadGateway),
+		Headers: http.Header{
+			"Content-Length": {"0"},
+		},
+		Body: nil,
+	}
+	return writeError(req, writer, config, resp)
+}
+
+// GatewayTimeoutHandler handles 504 responses
+func GatewayTimeoutHandler(req *http.Request, writer *http.Writer, config *Config) error {
+	resp := &http.Response{
+		StatusCode: http.StatusGatewayTimeout,
+		StatusText: http.StatusCodeToText(http.StatusGatewayTimeout),
+		Headers: http.Header{
+			"Content-Length": {"0"},
+		},
+		Body: nil,
+	}
+	return writeError(req, writer, config, resp)
+}
+
+// EchoHandler handles the /echo/<str> endpoint
+func EchoHandler(req *http.Request, writer *http.Writer, config *Config) error {
+	str := req.Param("text")
+	if str == "" {
+		return NotFoundHandler(req, writer, config)
+	}
+
+	return writer.Text(http.StatusOK, str)
+}
+
 // UserAgentHandler handles the /user-agent endpoint
 func UserAgentHandler(req *http.Request, writer *http.Writer, config *Config) error {
-	userAgent, ok := req.Headers["User-Agent"]
-	if !ok {
+	userAgent := req.Header("User-Agent")
+	if !req.Headers.Has("User-Agent") {
 		fmt.Fprintf(os.Stderr, "No 'User-Agent' header present!\n")
 		os.Exit(1)
 	}
 
+	return writer.Text(http.StatusOK, userAgent)
+}
+
+// MetricsHandler handles the /metrics endpoint
+func MetricsHandler(req *http.Request, writer *http.Writer, config *Config) error {
+	var buf bytes.Buffer
+	write := metrics.Default.WriteText
+	if config.WorkerMetricsDir != "" {
+		write = func(w io.Writer) error { return metrics.Gather(w, config.WorkerMetricsDir) }
+	}
+	if err := write(&buf); err != nil {
+		return fmt.Errorf("failed to render metrics: %w", err)
+	}
+
 	resp := &http.Response{
-		StatusCode: 200,
-		StatusText: http.StatusCodeToText(200),
-		Headers: map[string]string{
-			"Content-Type":   "text/plain",
-			"Content-Length": fmt.Sprintf("%d", len(userAgent)),
+		StatusCode: http.StatusOK,
+		StatusText: http.StatusCodeToText(http.StatusOK),
+		Headers: http.Header{
+			"Content-Type":   {"text/plain; version=0.0.4"},
+			"Content-Length": {fmt.Sprintf("%d", buf.Len())},
 		},
-		Body: []byte(userAgent),
+		Body: buf.Bytes(),
 	}
 
 	return writer.WriteResponse(resp)
@@ -129,79 +562,384 @@ func UserAgentHandler(req *http.Request, writer *http.Writer, config *Config) er
 // GetFileHandler handles GET /files/{filename} endpoint
 func GetFileHandler(req *http.Request, writer *http.Writer, config *Config) error {
 	if config.Directory == "" {
-		fmt.Fprintf(os.Stderr, "Directory not configured\n")
-		return InternalServerErrorHandler(req, writer, config)
+		return Errorf(http.StatusInternalServerError, "directory not configured")
 	}
 
-	matches := FileEndpointRegex.FindStringSubmatch(req.RequestTarget)
-	if len(matches) < 2 || matches[1] == "" {
+	filename, query := req.Param("filename"), req.QueryValues()
+	if filename == "" {
 		return BadRequestHandler(req, writer, config)
 	}
 
-	filename := matches[1]
+	if !filepath.IsLocal(filename) {
+		return BadRequestHandler(req, writer, config)
+	}
+	if reservedPath(filename) {
+		return ForbiddenHandler(req, writer, config)
+	}
 	filepath := config.Directory + "/" + filename
 
+	// A previous version is served as stored
+	if versionParam := query.Get("version"); versionParam != "" {
+		version, err := strconv.Atoi(versionParam)
+		if err != nil || config.Versions == nil {
+			return NotFoundHandler(req, writer, config)
+		}
+		if filepath, err = config.Versions.Path(filename, version); err != nil {
+			return NotFoundHandler(req, writer, config)
+		}
+	}
+
+	// Files missing locally are pulled from the mirror's origin first
+	if config.Mirror != nil && query.Get("version") == "" {
+		if _, err := os.Stat(filepath); errors.Is(err, os.ErrNotExist) {
+			if err := fetchFromOrigin(filename, filepath, config); err != nil {
+				if errors.Is(err, mirror.ErrNotFound) {
+					return NotFoundHandler(req, writer, config)
+				}
+				return BadGatewayHandler(req, writer, config)
+			}
+		}
+	}
+
+	// Text files declare their charset, and are converted to UTF-8 without a byte order mark on request
+	contentType := "application/octet-stream"
+	if config.isTextFile(filename) {
+		var charset string
+		contentType, charset = textContentType(filepath, config)
+		if strings.EqualFold(query.Get("charset"), "utf-8") {
+			return serveTranscoded(req, writer, config, filename, filepath, contentType, charset)
+		}
+	}
+
+	return serveFile(req, writer, config, servedFile{
+		name:        filename,
+		path:        filepath,
+		contentType: contentType,
+		variants:    query.Get("version") == "",
+	})
+}
+
+// servedFile describes a file sent by serveFile
+type servedFile struct {
+	// name identifies the file in download statistics
+	name string
+	// path locates the file on disk
+	path        string
+	contentType string
+	// variants allows sending a precompressed variant of the file instead
+	variants bool
+}
+
+// serveFile sends a file, or the byte range of it a Range header asks for,
+// and records the download
+func serveFile(req *http.Request, writer *http.Writer, config *Config, f servedFile) error {
+	filename, filepath := f.name, f.path
+
+	// Prefer a precompressed variant next to the file over compressing on the fly
+	contentEncoding := ""
+	if _, err := os.Stat(filepath); err == nil && f.variants {
+		variant, encoding, found := compression.FindPrecompressed(filepath, req.Header("Accept-Encoding"))
+		if found {
+			writer.Vary("Accept-Encoding")
+		}
+		if variant != "" {
+			filepath, contentEncoding = variant, encoding
+		}
+	}
+
 	file, err := os.Open(filepath)
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
 			return NotFoundHandler(req, writer, config)
 		}
-		fmt.Fprintf(os.Stderr, "Error opening file: %v\n", err)
-		return InternalServerErrorHandler(req, writer, config)
+		return fmt.Errorf("failed to open file: %w", err)
 	}
 	defer file.Close()
 
-	content, err := io.ReadAll(file)
+	info, err := file.Stat()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to read file: %v\n", err)
-		return InternalServerErrorHandler(req, writer, config)
+		return fmt.Errorf("failed to stat file: %w", err)
+	}
+	size := info.Size()
+
+	byteRange, partial, err := http.ParseRange(req.Header("Range"), size)
+	if errors.Is(err, http.ErrRangeNotSatisfiable) {
+		config.Downloads.Unsatisfiable(filename)
+		metrics.Default.Inc("file_downloads_total", "kind", "unsatisfiable")
+		return RangeNotSatisfiableHandler(req, writer, config, size)
+	}
+	if !partial {
+		byteRange = http.ByteRange{Start: 0, End: size - 1}
+	}
+
+	// Large downloads are sent straight from the page cache when mapping is
+	// enabled. Only writers that copy the body on this goroutine qualify, so
+	// that a fault in a truncated file is caught by writeMapped.
+	var content []byte
+	var mapping *fileio.Mapping
+	if config.MmapMinSize > 0 && byteRange.Length() >= config.MmapMinSize && writer.Direct() {
+		mapping, err = fileio.Map(file, byteRange.Start, byteRange.Length())
+		if err != nil && !errors.Is(err, fileio.ErrMapUnsupported) {
+			fmt.Fprintf(os.Stderr, "Failed to map file, reading it instead: %v\n", err)
+		}
+		if mapping != nil {
+			defer mapping.Close()
+			content = mapping.Bytes()
+			metrics.Default.Inc("file_reads_total", "method", "mmap")
+		}
+	}
+	if mapping == nil {
+		content = make([]byte, byteRange.Length())
+		if _, err := fileio.ReadAt(file, content, byteRange.Start); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("failed to read file: %w", err)
+		}
+		metrics.Default.Inc("file_reads_total", "method", "read")
 	}
 
 	resp := &http.Response{
-		StatusCode: 200,
-		StatusText: http.StatusCodeToText(200),
-		Headers: map[string]string{
-			"Content-Type":   "application/octet-stream",
-			"Content-Length": fmt.Sprintf("%d", len(content)),
+		StatusCode: http.StatusOK,
+		StatusText: http.StatusCodeToText(http.StatusOK),
+		Headers: http.Header{
+			"Content-Type":   {f.contentType},
+			"Content-Length": {fmt.Sprintf("%d", len(content))},
+			"Accept-Ranges":  {"bytes"},
 		},
 		Body: content,
 	}
+	if contentEncoding != "" {
+		resp.Headers.Set("Content-Encoding", contentEncoding)
+	}
+
+	if partial {
+		resp.StatusCode = http.StatusPartialContent
+		resp.StatusText = http.StatusCodeToText(http.StatusPartialContent)
+		resp.Headers.Set("Content-Range", byteRange.ContentRange(size))
 
+		resumed := byteRange.Start > 0 && byteRange.End == size-1
+		config.Downloads.Partial(filename, byteRange.String(), byteRange.Length(), resumed)
+		config.Files.Download(filename, byteRange.Length())
+		metrics.Default.Inc("file_downloads_total", "kind", "partial")
+		fmt.Printf("Partial download file=%s range=%s size=%d client=%s\n", filename, byteRange, size, req.ClientIP())
+	} else {
+		config.Downloads.Complete(filename, size)
+		config.Files.Download(filename, size)
+		metrics.Default.Inc("file_downloads_total", "kind", "complete")
+	}
+
+	if mapping != nil {
+		return writeMapped(writer, resp)
+	}
+	return writer.WriteResponse(resp)
+}
+
+// writeMapped writes a response whose body is a memory-mapped file. A file
+// truncated while it is being written faults, which fails the response
+// instead of crashing the server.
+func writeMapped(writer *http.Writer, resp *http.Response) (err error) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if r := recover(); r != nil {
+			fault, ok := r.(interface{ Addr() uintptr })
+			if !ok {
+				panic(r)
+			}
+			err = fmt.Errorf("mapped file changed while being sent (fault at %#x)", fault.Addr())
+		}
+	}()
 	return writer.WriteResponse(resp)
 }
 
+// fetchFromOrigin stores a file missing locally by fetching it from the mirror's origin
+func fetchFromOrigin(filename, dest string, config *Config) error {
+	if path.Clean("/"+filename) != "/"+filename {
+		return mirror.ErrNotFound
+	}
+
+	err := config.Mirror.Fetch(filename, func(r io.Reader) error {
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return err
+		}
+		size, err := config.writeFileAtomic(dest, r, nil)
+		if err == nil {
+			fmt.Printf("Mirrored file=%s size=%d origin=%s\n", filename, size, config.Mirror.Origin())
+		}
+		return err
+	})
+
+	switch {
+	case err == nil:
+		metrics.Default.Inc("mirror_fetches_total", "result", "stored")
+	case errors.Is(err, mirror.ErrNotFound):
+		metrics.Default.Inc("mirror_fetches_total", "result", "not_found")
+	default:
+		metrics.Default.Inc("mirror_fetches_total", "result", "error")
+		fmt.Fprintf(os.Stderr, "Failed to fetch file from origin: file=%s err=%v\n", filename, err)
+	}
+	return err
+}
+
+// RangeNotSatisfiableHandler handles 416 responses for a file of the given size
+func RangeNotSatisfiableHandler(req *http.Request, writer *http.Writer, config *Config, size int64) error {
+	resp := &http.Response{
+		StatusCode: http.StatusRangeNotSatisfiable,
+		StatusText: http.StatusCodeToText(http.StatusRangeNotSatisfiable),
+		Headers: http.Header{
+			"Content-Range":  {fmt.Sprintf("bytes */%d", size)},
+			"Content-Length": {"0"},
+		},
+		Body: nil,
+	}
+	return writeError(req, writer, config, resp)
+}
+
+// DownloadsHandler handles GET /api/downloads, reporting complete and partial downloads per file
+func DownloadsHandler(req *http.Request, writer *http.Writer, config *Config) error {
+	return writeJSON(req, writer, config, config.Downloads.Report())
+}
+
+// RecentRequestsHandler handles GET /api/requests, listing the latest requests newest first
+func RecentRequestsHandler(req *http.Request, writer *http.Writer, config *Config) error {
+	requests := config.Recent.Requests()
+	slices.Reverse(requests)
+	if requests == nil {
+		requests = []recent.Request{}
+	}
+	return writeJSON(req, writer, config, requests)
+}
+
+// connectionInfo is an open connection as listed by ConnectionsHandler
+type connectionInfo struct {
+	conntrack.Conn
+	Age     string `json:"age"`
+	InState string `json:"in_state_for"`
+}
+
+// ConnectionsHandler handles GET /api/connections, listing the open connections oldest first
+func ConnectionsHandler(req *http.Request, writer *http.Writer, config *Config) error {
+	now := config.clock().Now()
+	conns := []connectionInfo{}
+	for _, c := range config.Connections.Conns() {
+		conns = append(conns, connectionInfo{
+			Conn:    c,
+			Age:     now.Sub(c.Opened).Round(time.Millisecond).String(),
+			InState: now.Sub(c.Since).Round(time.Millisecond).String(),
+		})
+	}
+	return writeJSON(req, writer, config, conns)
+}
+
 // SaveFileHandler handles POST /files/{filename} endpoint
-func SaveFileHandler(req *http.Request, writer *http.Writer, config *Config, parser *http.Parser) error {
+func SaveFileHandler(req *http.Request, writer *http.Writer, config *Config) error {
 	if config.Directory == "" {
-		fmt.Fprintf(os.Stderr, "Directory not configured\n")
-		return InternalServerErrorHandler(req, writer, config)
+		return Errorf(http.StatusInternalServerError, "directory not configured")
 	}
 
-	matches := FileEndpointRegex.FindStringSubmatch(req.RequestTarget)
-	if len(matches) < 2 || matches[1] == "" {
+	filename := req.Param("filename")
+	if filename == "" {
 		return BadRequestHandler(req, writer, config)
 	}
 
-	filename := matches[1]
+	if !filepath.IsLocal(filename) {
+		return BadRequestHandler(req, writer, config)
+	}
+	if reservedPath(filename) {
+		return ForbiddenHandler(req, writer, config)
+	}
 	filepath := config.Directory + "/" + filename
 
-	body, err := parser.ReadBody(req)
+	body, err := req.BodyReader()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to read request body: %v\n", err)
-		return InternalServerErrorHandler(req, writer, config)
+		return fmt.Errorf("failed to read request body: %w", err)
+	}
+
+	if uploadID := req.Header("X-Upload-ID"); uploadID != "" {
+		upload, ok := config.Uploads.Start(uploadID, filename, req.ContentLength())
+		if !ok {
+			return ConflictHandler(req, writer, config)
+		}
+		body = upload.Reader(body)
+		defer func() { config.Uploads.Finish(upload, err) }()
 	}
 
-	if err := os.WriteFile(filepath, body, 0644); err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to write file: %v\n", err)
-		return InternalServerErrorHandler(req, writer, config)
+	// Stream the body to a temporary file so readers never see a partial upload,
+	// keeping the previous content as a version if versioning is enabled
+	size, err := config.writeFileAtomic(filepath, body, func() error {
+		return config.saveVersion(filename)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
 	}
+	config.Files.Upload(filename, size)
 
 	resp := &http.Response{
-		StatusCode: 201,
-		StatusText: http.StatusCodeToText(201),
-		Headers:    make(map[string]string),
+		StatusCode: http.StatusCreated,
+		StatusText: http.StatusCodeToText(http.StatusCreated),
+		Headers:    make(http.Header),
 		Body:       nil,
 	}
 
 	return writer.WriteResponse(resp)
 }
+
+// UploadProgressHandler handles GET /api/uploads/{id}, reporting the progress of an upload
+func UploadProgressHandler(req *http.Request, writer *http.Writer, config *Config) error {
+	snapshot, ok := config.Uploads.Get(req.Param("id"))
+	if !ok {
+		return NotFoundHandler(req, writer, config)
+	}
+
+	return writeJSON(req, writer, config, snapshot)
+}
+
+// writeFileAtomic streams r into a temporary file next to path and renames it into place,
+// returning the number of bytes written. beforeReplace, if not nil, runs right before the rename.
+// The content is hashed as it is written, and the hash recorded for sync manifests.
+func (c *Config) writeFileAtomic(path string, r io.Reader, beforeReplace func() error) (int64, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	hasher := sha256.New()
+	size, err := fileio.Copy(tmp, io.TeeReader(r, hasher))
+	if err != nil {
+		tmp.Close()
+		return size, err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return size, err
+	}
+	if err := tmp.Close(); err != nil {
+		return size, err
+	}
+	// The temporary file is stat'ed since the file at path may change again once renamed
+	info, err := os.Stat(tmp.Name())
+	if err != nil {
+		return size, err
+	}
+	if beforeReplace != nil {
+		if err := beforeReplace(); err != nil {
+			return size, err
+		}
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return size, err
+	}
+	c.recordHash(path, info, hex.EncodeToString(hasher.Sum(nil)))
+	return size, nil
+}
+
+// recordHash records the content hash of a file just written below the directory,
+// sparing the sync manifest from reading it again
+func (c *Config) recordHash(path string, info os.FileInfo, hash string) {
+	if c.Manifest == nil {
+		return
+	}
+	rel, err := filepath.Rel(c.Directory, path)
+	if err != nil || !filepath.IsLocal(rel) {
+		return
+	}
+	c.Manifest.Record(filepath.ToSlash(rel), info, hash)
+}
@@ -0,0 +1,275 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"io/fs"
+	"mime"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"octo-server/app/http"
+	"octo-server/app/metrics"
+)
+
+// mountIndex is the file served for a mounted directory, if present
+const mountIndex = "index.html"
+
+// Mount serves the files of Directory below the URL path Prefix
+type Mount struct {
+	Prefix    string
+	Directory string
+	// ReadOnly refuses uploads and deletions
+	ReadOnly bool
+	// Listing lists the contents of directories without an index.html
+	Listing bool
+}
+
+// String formats the mount as accepted by --mount
+func (m Mount) String() string {
+	var options []string
+	if m.ReadOnly {
+		options = append(options, "ro")
+	}
+	if m.Listing {
+		options = append(options, "listing")
+	}
+	s := m.Prefix + "=" + m.Directory
+	if len(options) > 0 {
+		s += ":" + strings.Join(options, ",")
+	}
+	return s
+}
+
+// pattern matches the request paths below the mount's prefix
+func (m Mount) pattern() *regexp.Regexp {
+	prefix := strings.TrimSuffix(m.Prefix, "/")
+	return regexp.MustCompile("^" + regexp.QuoteMeta(prefix) + `(/|$)`)
+}
+
+// describe summarizes the mount for the route table
+func (m Mount) describe() string {
+	access := "read-write"
+	if m.ReadOnly {
+		access = "read-only"
+	}
+	if m.Listing {
+		access += ", with listings"
+	}
+	return fmt.Sprintf("Static files of %s (%s)", m.Directory, access)
+}
+
+// newMountHandler returns a handler serving a mount: GET sends files, index
+// pages and listings, and PUT, POST and DELETE change files unless read-only
+func newMountHandler(m Mount) HandlerFunc {
+	allowed := []string{"GET", "PUT", "POST", "DELETE"}
+	if m.ReadOnly {
+		allowed = []string{"GET"}
+	}
+	root := strings.TrimSuffix(m.Prefix, "/") + "/"
+
+	return func(req *http.Request, writer *http.Writer, config *Config) error {
+		if !slices.Contains(allowed, req.Method) {
+			return MethodNotAllowedHandler(req, writer, config, strings.Join(allowed, ", "))
+		}
+
+		urlPath, err := url.PathUnescape(req.Path())
+		if err != nil {
+			return BadRequestHandler(req, writer, config)
+		}
+
+		// Names escaping the mounted directory are refused
+		name := strings.TrimPrefix(strings.TrimPrefix(urlPath, root), "/")
+		if urlPath+"/" == root {
+			name = ""
+		}
+		if name != "" && !filepath.IsLocal(name) {
+			return BadRequestHandler(req, writer, config)
+		}
+		// Hidden files, such as the temporary files of uploads, are not served
+		if slices.ContainsFunc(strings.Split(name, "/"), func(segment string) bool { return strings.HasPrefix(segment, ".") }) {
+			return NotFoundHandler(req, writer, config)
+		}
+		path := filepath.Join(m.Directory, filepath.FromSlash(name))
+		metrics.Default.Inc("mount_requests_total", "mount", m.Prefix, "method", req.Method)
+
+		switch req.Method {
+		case "PUT", "POST":
+			return saveMounted(req, writer, config, path)
+		case "DELETE":
+			return deleteMounted(req, writer, config, path)
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return NotFoundHandler(req, writer, config)
+		}
+		if !info.IsDir() {
+			return serveFile(req, writer, config, servedFile{
+				name:        urlPath,
+				path:        path,
+				contentType: contentTypeOf(path),
+				variants:    true,
+			})
+		}
+
+		// Directories are addressed with a trailing slash so relative links resolve within them
+		if !strings.HasSuffix(urlPath, "/") {
+			location := req.Path() + "/"
+			if rawQuery := req.RawQuery(); rawQuery != "" {
+				location += "?" + rawQuery
+			}
+			return RedirectHandler(req, writer, config, http.StatusMovedPermanently, location)
+		}
+		index := filepath.Join(path, mountIndex)
+		if indexInfo, err := os.Stat(index); err == nil && indexInfo.Mode().IsRegular() {
+			return serveFile(req, writer, config, servedFile{
+				name:        urlPath + mountIndex,
+				path:        index,
+				contentType: contentTypeOf(index),
+				variants:    true,
+			})
+		}
+		if !m.Listing {
+			return NotFoundHandler(req, writer, config)
+		}
+		return writeListing(req, writer, config, urlPath, path, urlPath != root)
+	}
+}
+
+// contentTypeOf returns the content type of a file from its extension
+func contentTypeOf(path string) string {
+	if contentType := mime.TypeByExtension(filepath.Ext(path)); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// saveMounted stores the request body as the file at path, creating its directory
+func saveMounted(req *http.Request, writer *http.Writer, config *Config, path string) error {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return ConflictHandler(req, writer, config)
+	}
+	body, err := req.BodyReader()
+	if err != nil {
+		return fmt.Errorf("failed to read request body: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	if _, err := config.writeFileAtomic(path, body, nil); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+
+	resp := &http.Response{
+		StatusCode: http.StatusCreated,
+		StatusText: http.StatusCodeToText(http.StatusCreated),
+		Headers:    make(http.Header),
+		Body:       nil,
+	}
+	return writer.WriteResponse(resp)
+}
+
+// deleteMounted removes the file at path
+func deleteMounted(req *http.Request, writer *http.Writer, config *Config, path string) error {
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return NotFoundHandler(req, writer, config)
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+	return NoContentHandler(req, writer, config)
+}
+
+// listingEntry is an entry of a directory listing sent as JSON
+type listingEntry struct {
+	Name    string    `json:"name"`
+	Dir     bool      `json:"dir"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// writeListing lists the entries of the directory at path, directories first,
+// leaving out hidden ones. Browsers get an HTML page linking to them, and
+// clients asking for JSON get them as an array.
+func writeListing(req *http.Request, writer *http.Writer, config *Config, urlPath, path string, parent bool) error {
+	writer.Vary("Accept")
+	format := req.Negotiate("text/html", "application/json")
+	if format == "" {
+		return NotAcceptableHandler(req, writer, config)
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return NotFoundHandler(req, writer, config)
+		}
+		return fmt.Errorf("failed to list directory: %w", err)
+	}
+	slices.SortStableFunc(entries, func(a, b os.DirEntry) int {
+		switch {
+		case a.IsDir() && !b.IsDir():
+			return -1
+		case !a.IsDir() && b.IsDir():
+			return 1
+		}
+		return strings.Compare(a.Name(), b.Name())
+	})
+
+	listing := []listingEntry{}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		item := listingEntry{Name: entry.Name(), Dir: entry.IsDir(), ModTime: info.ModTime().UTC()}
+		if !item.Dir {
+			item.Size = info.Size()
+		}
+		listing = append(listing, item)
+	}
+	if format == "application/json" {
+		return writeJSON(req, writer, config, listing)
+	}
+
+	title := html.EscapeString("Index of " + urlPath)
+	var page strings.Builder
+	fmt.Fprintf(&page, "<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>%s</title></head>\n<body><h1>%s</h1>\n<ul>\n", title, title)
+	if parent {
+		page.WriteString("<li><a href=\"../\">../</a></li>\n")
+	}
+	for _, item := range listing {
+		name, size := item.Name, ""
+		if item.Dir {
+			name += "/"
+		} else {
+			size = " " + strconv.FormatInt(item.Size, 10)
+		}
+		href := (&url.URL{Path: name}).EscapedPath()
+		fmt.Fprintf(&page, "<li><a href=\"./%s\">%s</a>%s</li>\n", html.EscapeString(href), html.EscapeString(name), size)
+	}
+	page.WriteString("</ul>\n</body></html>\n")
+
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		StatusText: http.StatusCodeToText(http.StatusOK),
+		Headers: http.Header{
+			"Content-Type":   {"text/html; charset=utf-8"},
+			"Content-Length": {strconv.Itoa(page.Len())},
+			"Cache-Control":  {"no-cache"},
+		},
+		Body: []byte(page.String()),
+	}
+	return writer.WriteResponse(resp)
+}
@@ -0,0 +1,122 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	nethttp "net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"octo-server/app/http"
+	"octo-server/app/metrics"
+	"octo-server/app/proxy"
+)
+
+// newProxyHandler returns a handler forwarding requests to the upstream of a proxy
+// and streaming the upstream response back to the client
+func newProxyHandler(p *proxy.Proxy) HandlerFunc {
+	return func(req *http.Request, writer *http.Writer, config *Config) error {
+		if config.ProxyCache != nil {
+			return serveProxyCached(p, req, writer, config)
+		}
+
+		upstream, err := forward(p, req)
+		if err != nil {
+			return upstreamFailed(err, req, writer, config)
+		}
+		defer upstream.Body.Close()
+		return writeProxied(req, writer, upstreamResponse(upstream), upstream.Body, upstream.Trailer)
+	}
+}
+
+// forward sends a request to one of a proxy's upstreams, counting and logging the outcome
+func forward(p *proxy.Proxy, req *http.Request) (*nethttp.Response, error) {
+	name := p.Route().Name()
+
+	upstream, target, err := p.Forward(req)
+	if err != nil {
+		metrics.Default.Inc("proxy_upstream_errors_total", "route", name, "upstream", target.Host)
+		fmt.Fprintf(os.Stderr, "Proxy error: route=%s upstream=%s err=%v\n", name, target.Host, err)
+		return nil, err
+	}
+	metrics.Default.Inc("proxy_requests_total", "route", name, "upstream", target.Host, "code", strconv.Itoa(upstream.StatusCode))
+	return upstream, nil
+}
+
+// upstreamFailed answers a request whose upstream could not be reached or did
+// not answer in time, or that could not be forwarded at all
+func upstreamFailed(err error, req *http.Request, writer *http.Writer, config *Config) error {
+	if errors.Is(err, proxy.ErrBadPath) {
+		return Errorf(http.StatusBadRequest, "%v", err)
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return GatewayTimeoutHandler(req, writer, config)
+	}
+	return BadGatewayHandler(req, writer, config)
+}
+
+// upstreamResponse converts the status and headers of an upstream response into a response to the client
+func upstreamResponse(upstream *nethttp.Response) *http.Response {
+	resp := &http.Response{
+		StatusCode: upstream.StatusCode,
+		StatusText: http.StatusCodeToText(upstream.StatusCode),
+		Headers:    http.Header(upstream.Header).Clone(),
+	}
+	if resp.StatusText == "Unknown" {
+		resp.StatusText = strings.TrimSpace(strings.TrimPrefix(upstream.Status, strconv.Itoa(upstream.StatusCode)))
+	}
+	resp.Headers.DelHopByHop()
+	resp.Headers.Del("Content-Length")
+	if upstream.ContentLength >= 0 {
+		resp.Headers.Set("Content-Length", strconv.FormatInt(upstream.ContentLength, 10))
+	}
+	return resp
+}
+
+// writeProxied writes a proxied response. Responses without a body are written
+// whole; others are streamed from body as it arrives, which the writer leaves
+// out for HEAD. A streamed response of unknown length ends with the trailer
+// fields the upstream declared in trailer, whose values are known once body is
+// read.
+func writeProxied(req *http.Request, writer *http.Writer, resp *http.Response, body io.Reader, trailer nethttp.Header) error {
+	if resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		return writer.WriteResponse(resp)
+	}
+	if len(trailer) == 0 || resp.Headers.Has("Content-Length") {
+		return writer.WriteFrom(resp, body)
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(trailer)) {
+		if http.AllowedTrailer(name) {
+			writer.DeclareTrailer(name)
+		}
+	}
+	chunked, err := writer.WriteChunked(resp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(chunked, body); err != nil {
+		return err
+	}
+	for name, values := range trailer {
+		if http.AllowedTrailer(name) && len(values) > 0 {
+			chunked.Trailer()[name] = values
+		}
+	}
+	return chunked.Close()
+}
+
+// UpstreamsHandler handles GET /api/upstreams, reporting the health of every proxy upstream
+func UpstreamsHandler(req *http.Request, writer *http.Writer, config *Config) error {
+	statuses := []proxy.UpstreamStatus{}
+	for _, p := range config.Proxies {
+		statuses = append(statuses, p.Status()...)
+	}
+	return writeJSON(req, writer, config, statuses)
+}
@@ -0,0 +1,171 @@
+package handler
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"octo-server/app/http"
+	"octo-server/app/httpcache"
+	"octo-server/app/metrics"
+	"octo-server/app/proxy"
+)
+
+// Values of the X-Cache header, telling clients how the proxy cache handled a request
+const (
+	cacheHit         = "HIT"         // answered from a fresh stored response
+	cacheMiss        = "MISS"        // forwarded to the upstream
+	cacheRevalidated = "REVALIDATED" // answered from a stored response the upstream confirmed unchanged
+	cacheStale       = "STALE"       // answered from a stale stored response since the upstream failed
+	cacheBypass      = "BYPASS"      // forwarded without consulting the cache, e.g. for range requests
+)
+
+// notModifiedHeaders are the stored headers repeated in a 304 Not Modified
+// response to a client's conditional request (RFC 9110, section 15.4.5)
+var notModifiedHeaders = []string{"Cache-Control", "Content-Location", "Date", "ETag", "Expires", "Last-Modified", "Vary"}
+
+// serveProxyCached answers a proxied request from the proxy cache when it has
+// a usable response, revalidates stale responses with the upstream, and
+// stores the responses it forwards where allowed
+func serveProxyCached(p *proxy.Proxy, req *http.Request, writer *http.Writer, config *Config) error {
+	cache := config.ProxyCache
+
+	if !httpcache.Cacheable(req) {
+		upstream, err := forward(p, req)
+		if err != nil {
+			return upstreamFailed(err, req, writer, config)
+		}
+		defer upstream.Body.Close()
+
+		if httpcache.Invalidates(req, upstream.StatusCode) {
+			cache.Invalidate(req)
+		}
+		resp := upstreamResponse(upstream)
+		if req.Method == "GET" || req.Method == "HEAD" {
+			metrics.Default.Inc("proxy_cache_requests_total", "result", "bypass")
+			resp.Headers.Set("X-Cache", cacheBypass)
+		}
+		return writeProxied(req, writer, resp, upstream.Body, upstream.Trailer)
+	}
+
+	entry := cache.Lookup(req)
+	if entry != nil && entry.Usable(req, config.clock().Now()) {
+		if body, err := entry.Body(); err == nil {
+			return writeCached(req, writer, entry, body, cacheHit, config.clock().Now())
+		}
+		entry = nil
+	}
+	if httpcache.ParseCacheControl(req.Header("Cache-Control")).Has("only-if-cached") {
+		metrics.Default.Inc("proxy_cache_requests_total", "result", "miss")
+		return GatewayTimeoutHandler(req, writer, config)
+	}
+
+	// A stored response is revalidated with its own validators, replacing the client's
+	if req.Method != "GET" {
+		entry = nil
+	}
+	headers := req.Headers.Clone()
+	if entry != nil {
+		headers.Del("If-None-Match")
+		headers.Del("If-Modified-Since")
+		if etag := entry.Header.Get("ETag"); etag != "" {
+			headers.Set("If-None-Match", etag)
+		}
+		if modified := entry.Header.Get("Last-Modified"); modified != "" {
+			headers.Set("If-Modified-Since", modified)
+		}
+	}
+
+	requestTime := config.clock().Now()
+	upstream, err := forward(p, http.NewRequest(req.Method, req.RequestTarget, req.Version, headers, req.RemoteAddr, nil))
+	if err != nil {
+		if served, err := serveStale(req, writer, entry, config.clock().Now()); served {
+			return err
+		}
+		return upstreamFailed(err, req, writer, config)
+	}
+	defer upstream.Body.Close()
+	responseTime := config.clock().Now()
+
+	if entry != nil && upstream.StatusCode == http.StatusNotModified {
+		entry = cache.Freshen(entry, upstream, requestTime, responseTime)
+		body, err := entry.Body()
+		if err != nil {
+			// The body was evicted while revalidating, so fetch the response anew
+			cache.Invalidate(req)
+			return serveProxyCached(p, req, writer, config)
+		}
+		return writeCached(req, writer, entry, body, cacheRevalidated, config.clock().Now())
+	}
+	if upstream.StatusCode >= 500 {
+		if served, err := serveStale(req, writer, entry, config.clock().Now()); served {
+			return err
+		}
+	}
+
+	metrics.Default.Inc("proxy_cache_requests_total", "result", "miss")
+	resp := upstreamResponse(upstream)
+	resp.Headers.Set("X-Cache", cacheMiss)
+	if !httpcache.Storable(req, upstream) {
+		return writeProxied(req, writer, resp, upstream.Body, upstream.Trailer)
+	}
+
+	rec := cache.NewRecorder()
+	if err := writeProxied(req, writer, resp, io.TeeReader(upstream.Body, rec), upstream.Trailer); err != nil {
+		rec.Discard()
+		return err
+	}
+	if upstream.ContentLength >= 0 && rec.Size() != upstream.ContentLength {
+		rec.Discard()
+		return nil
+	}
+	cache.Store(req, upstream, rec, requestTime, responseTime)
+	return nil
+}
+
+// serveStale answers a request with a stale stored response when its upstream
+// failed, if the response allows it. It reports whether it answered.
+func serveStale(req *http.Request, writer *http.Writer, entry *httpcache.Entry, now time.Time) (bool, error) {
+	if entry == nil || !entry.MayServeStale() {
+		return false, nil
+	}
+	body, err := entry.Body()
+	if err != nil {
+		return false, nil
+	}
+	fmt.Fprintf(os.Stderr, "Serving stale cached response for %s\n", req.RequestTarget)
+	return true, writeCached(req, writer, entry, body, cacheStale, now)
+}
+
+// writeCached answers a request with a stored response, or with 304 Not
+// Modified if it satisfies the request's conditional headers. The Age header
+// is computed as of now.
+func writeCached(req *http.Request, writer *http.Writer, entry *httpcache.Entry, body io.ReadCloser, result string, now time.Time) error {
+	defer body.Close()
+	metrics.Default.Inc("proxy_cache_requests_total", "result", strings.ToLower(result))
+
+	resp := &http.Response{
+		StatusCode: entry.StatusCode,
+		StatusText: entry.StatusText,
+		Headers:    http.Header(entry.Header).Clone(),
+	}
+
+	if entry.NotModified(req) {
+		resp.StatusCode, resp.StatusText = http.StatusNotModified, http.StatusCodeToText(http.StatusNotModified)
+		resp.Headers = make(http.Header, len(notModifiedHeaders)+2)
+		for _, key := range notModifiedHeaders {
+			if values := entry.Header.Values(key); len(values) > 0 {
+				resp.Headers[http.CanonicalHeaderKey(key)] = values
+			}
+		}
+	} else {
+		resp.Headers.Set("Content-Length", strconv.FormatInt(entry.Size(), 10))
+	}
+	resp.Headers.Set("Age", strconv.FormatInt(int64(entry.Age(now)/time.Second), 10))
+	resp.Headers.Set("X-Cache", result)
+
+	return writeProxied(req, writer, resp, body, nil)
+}
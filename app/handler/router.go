@@ -1,65 +1,413 @@
 package handler
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
 	"net"
+	"os"
+	"regexp"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"time"
 
+	"octo-server/app/compression"
+	"octo-server/app/crash"
 	"octo-server/app/http"
+	"octo-server/app/metrics"
+	"octo-server/app/ratelimit"
+	"octo-server/app/recent"
+	"octo-server/app/referer"
+	"octo-server/app/rewrite"
 )
 
+// route maps a method and request target pattern to a handler
+type route struct {
+	method      string // empty matches any method
+	pattern     *regexp.Regexp
+	handler     HandlerFunc
+	description string
+}
+
+// RouteInfo describes a registered route
+type RouteInfo struct {
+	Host        string // empty for the default host
+	Method      string
+	Pattern     string
+	Description string
+}
+
 // Router handles HTTP request routing
 type Router struct {
-	config *Config
+	config       *Config
+	routes       []route
+	routeLimiter *ratelimit.RouteLimiter
+	compressor   *compression.Compressor
+	hosts        map[string]*Router
 }
 
 // NewRouter creates a new router with the given configuration
 func NewRouter(config *Config) *Router {
-	return &Router{
+	var routes []route
+	for _, endpoint := range config.VirtualEndpoints {
+		pattern := regexp.MustCompile("^" + regexp.QuoteMeta(endpoint.Path) + "$")
+		routes = append(routes, route{"GET", pattern, newVirtualHandler(endpoint), "Templated JSON endpoint"})
+	}
+	if config.Git != nil {
+		routes = append(routes, route{"", GitEndpointRegex, GitHandler, "Git smart HTTP protocol for the repositories in " + config.Git.Root})
+	}
+	if config.Calendars != nil {
+		routes = append(routes, route{"", CalDAVEndpointRegex, CalDAVHandler, "Read-only CalDAV access to the calendars in " + config.Calendars.Root})
+	}
+	if config.RecentEndpoint {
+		routes = append(routes, route{"GET", regexp.MustCompile(`^/api/requests$`), RecentRequestsHandler, "Lists the latest requests, newest first"})
+	}
+	if config.Connections != nil {
+		routes = append(routes, route{"GET", regexp.MustCompile(`^/api/connections$`), ConnectionsHandler, "Lists the open connections with their states, oldest first"})
+	}
+	if config.S3 != nil {
+		routes = append(routes, route{"", S3EndpointRegex, S3Handler, "S3-compatible API for the " + config.S3.Name + " bucket"})
+	}
+	for _, p := range config.Proxies {
+		pattern := regexp.MustCompile("^" + regexp.QuoteMeta(p.Route().Prefix) + `(/|$)`)
+		routes = append(routes, route{"", pattern, newProxyHandler(p), "Proxied to " + strings.TrimPrefix(p.Route().String(), p.Route().Prefix+"=")})
+	}
+	// Longer prefixes first, so that a mount nested in another one is reachable
+	mounts := slices.Clone(config.Mounts)
+	slices.SortStableFunc(mounts, func(a, b Mount) int { return len(b.Prefix) - len(a.Prefix) })
+	for _, m := range mounts {
+		routes = append(routes, route{"", m.pattern(), newMountHandler(m), m.describe()})
+	}
+
+	r := &Router{
 		config: config,
+		routes: append(routes, []route{
+			{"", regexp.MustCompile(`^/$`), RootHandler, "Root endpoint"},
+			{"", regexp.MustCompile(`^/metrics$`), MetricsHandler, "Server counters in the Prometheus text format"},
+			{"", regexp.MustCompile(`^/user-agent$`), UserAgentHandler, "Returns the User-Agent header"},
+			{"", EchoEndpointRegex, EchoHandler, "Echoes back the path suffix"},
+			{"GET", FileEndpointRegex, GetFileHandler, "Retrieves a file"},
+			{"POST", FileEndpointRegex, SaveFileHandler, "Saves the request body to a file"},
+			{"PUT", FileEndpointRegex, SaveFileHandler, "Saves the request body to a file"},
+			{"PATCH", FileEndpointRegex, AppendFileHandler, "Appends the request body to a file"},
+			{"DELETE", FileEndpointRegex, DeleteFileHandler, "Moves a file to the trash"},
+			{"POST", regexp.MustCompile(`^/files/?$`), UploadFilesHandler, "Stores every file of a multipart/form-data upload"},
+			{"GET", UploadProgressEndpointRegex, UploadProgressHandler, "Reports the progress of an upload sent with X-Upload-ID"},
+			{"GET", regexp.MustCompile(`^/api/downloads$`), DownloadsHandler, "Reports complete and partial downloads per file"},
+			{"GET", regexp.MustCompile(`^/api/files/?$`), FileListHandler, "Lists the files with their access statistics"},
+			{"GET", FileStatsEndpointRegex, FileStatsHandler, "Reports the access statistics of a file"},
+			{"GET", FileVersionsEndpointRegex, FileVersionsHandler, "Lists the previous versions of a file"},
+			{"GET", FileSignatureEndpointRegex, FileSignatureHandler, "Returns the block checksums of a file for delta sync"},
+			{"POST", FileDeltaEndpointRegex, FileDeltaHandler, "Updates a file from a delta against its signature"},
+			{"GET", regexp.MustCompile(`^/api/sync/?$`), SyncHandler, "Returns a manifest of every file, or the changes since an earlier one"},
+			{"GET", regexp.MustCompile(`^/api/trash/?$`), TrashListHandler, "Lists deleted files that can be restored"},
+			{"POST", TrashRestoreEndpointRegex, TrashRestoreHandler, "Restores a deleted file"},
+			{"GET", regexp.MustCompile(`^/api/upstreams$`), UpstreamsHandler, "Reports the health of the proxy upstreams"},
+			{"GET", regexp.MustCompile(`^/events$`), EventsHandler, "Sample Server-Sent Events stream of server stats"},
+		}...),
+		routeLimiter: ratelimit.NewRouteLimiter(config.RouteLimits),
+		compressor:   compression.NewCompressor(config.Compression),
+		hosts:        make(map[string]*Router, len(config.Hosts)),
+	}
+
+	// Virtual hosts have routers of their own, sharing the server-wide rate limits
+	// and compression cap
+	for host, hostConfig := range config.Hosts {
+		hostRouter := NewRouter(hostConfig)
+		hostRouter.routeLimiter = r.routeLimiter
+		hostRouter.compressor = r.compressor
+		r.hosts[host] = hostRouter
+	}
+	return r
+}
+
+// Routes returns a description of every registered route, in matching order,
+// followed by the routes of each virtual host
+func (r *Router) Routes() []RouteInfo {
+	infos := r.hostRoutes("")
+	hosts := slices.Sorted(maps.Keys(r.hosts))
+	for _, host := range hosts {
+		infos = append(infos, r.hosts[host].hostRoutes(host)...)
+	}
+	return infos
+}
+
+// hostRoutes describes the routes of a router serving host
+func (r *Router) hostRoutes(host string) []RouteInfo {
+	infos := make([]RouteInfo, 0, len(r.routes))
+	for _, rt := range r.routes {
+		method := rt.method
+		if method == "" {
+			method = "*"
+		}
+		infos = append(infos, RouteInfo{
+			Host:        host,
+			Method:      method,
+			Pattern:     rt.pattern.String(),
+			Description: rt.description,
+		})
 	}
+	return infos
 }
 
 // HandleRequest routes an HTTP request to the appropriate handler
 func (r *Router) HandleRequest(req *http.Request, conn net.Conn) error {
-	writer := http.NewWriter(conn)
-	parser := http.NewParser(conn)
-
-	var handler HandlerFunc
-
-	switch {
-	case req.RequestTarget == "/":
-		handler = RootHandler
-
-	case req.RequestTarget == "/user-agent":
-		handler = UserAgentHandler
-
-	case EchoEndpointRegex.MatchString(req.RequestTarget):
-		handler = EchoHandler
-
-	case FileEndpointRegex.MatchString(req.RequestTarget):
-		switch req.Method {
-		case "GET":
-			handler = GetFileHandler
-		case "POST":
-			// POST handler needs parser for reading body
-			return r.handlePostFile(req, writer, parser)
-		default:
-			handler = NotFoundHandler
+	return r.ServeRequest(req, http.NewWriter(conn))
+}
+
+// ErrPanicked is returned by ServeRequest when a handler panicked after it
+// started writing the response, which can only be cut short by closing the
+// connection or resetting the stream
+var ErrPanicked = errors.New("handler panicked after starting the response")
+
+// ServeRequest routes an HTTP request to the appropriate handler, writing the
+// response to writer. It is recorded for crash reports, and logged if the
+// access log is enabled.
+func (r *Router) ServeRequest(req *http.Request, writer *http.Writer) error {
+	defer crash.Default.Recover()
+	start := time.Now()
+	writer.SetServer(r.config.ServerHeader)
+	writer.SetClock(r.config.clock())
+	writer.SetRequest(req)
+	n := r.config.Recent.Begin(recent.Request{Time: start, Client: req.PeerIP(), Method: req.Method, Target: req.RequestTarget, Version: req.Version})
+	writer, err := r.serveTimed(req, writer)
+	r.config.Recent.End(n, req.ClientIP(), writer.Status(), time.Since(start))
+	if r.config.AccessLog {
+		r.logAccess(req, writer, start)
+	}
+	return err
+}
+
+// ErrTimedOut is returned by ServeRequest, wrapped in a TimeoutError, when the
+// handler of a request was still running once the request timed out. The
+// handler is left to return on its own, and the connection or stream must be
+// closed.
+var ErrTimedOut = errors.New("handler did not return before the request timed out")
+
+// TimeoutError is returned by ServeRequest for a request whose handler was
+// abandoned. Done is closed once the handler returns, until which it still
+// holds its worker.
+type TimeoutError struct {
+	Done <-chan struct{}
+}
+
+func (e *TimeoutError) Error() string { return ErrTimedOut.Error() }
+
+func (e *TimeoutError) Unwrap() error { return ErrTimedOut }
+
+// timeoutGrace is how long handlers watching the context of a request that
+// timed out are given to answer it themselves, e.g. with 504 for a proxied one
+const timeoutGrace = 250 * time.Millisecond
+
+// serveTimed serves a request, giving up on its handler shortly after the
+// deadline of its context passes. The request is then answered with 503
+// unless the response was already started. It returns the writer the
+// response was written with, which may no longer be the one given.
+func (r *Router) serveTimed(req *http.Request, writer *http.Writer) (*http.Writer, error) {
+	ctx := req.Context()
+	if _, ok := ctx.Deadline(); !ok {
+		return writer, r.serveRecovering(req, writer)
+	}
+
+	done, finished := make(chan error, 1), make(chan struct{})
+	go func() {
+		defer close(finished)
+		defer crash.Default.Recover()
+		done <- r.serveRecovering(req, writer)
+	}()
+	select {
+	case err := <-done:
+		return writer, err
+	case <-ctx.Done():
+	}
+	if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		// The client went away, which the handler learns from the context
+		return writer, <-done
+	}
+	select {
+	case err := <-done:
+		return writer, err
+	case <-time.After(timeoutGrace):
+	}
+
+	writer, started := writer.Abandon()
+	metrics.Default.Inc("http_request_timeouts_total")
+	fmt.Fprintf(os.Stderr, "Request timed out: client=%s method=%s target=%s id=%s started=%t\n",
+		req.ClientIP(), req.Method, req.RequestTarget, http.RequestID(ctx), started)
+	if !started {
+		// Failing to answer changes nothing: the handler may still be using the connection
+		ServiceUnavailableHandler(req, writer, r.config)
+	}
+	return writer, &TimeoutError{Done: finished}
+}
+
+// serveRecovering serves a request, recovering from a panic in its handler if
+// RecoverPanics is set. The panic is logged with its stack trace, and the
+// request answered with 500 unless the response was already started.
+func (r *Router) serveRecovering(req *http.Request, writer *http.Writer) (err error) {
+	if r.config.RecoverPanics {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			crash.Default.Recovered(v)
+			metrics.Default.Inc("http_handler_panics_total")
+			fmt.Fprintf(os.Stderr, "Recovered from panic: client=%s method=%s target=%s id=%s panic=%v\n%s",
+				req.ClientIP(), req.Method, req.RequestTarget, http.RequestID(req.Context()), v, debug.Stack())
+			if writer.Status() != 0 {
+				err = ErrPanicked
+				return
+			}
+			err = InternalServerErrorHandler(req, writer, r.config)
+		}()
+	}
+	return r.serve(req, writer)
+}
+
+// serve routes an HTTP request to the handler of its virtual host and route
+func (r *Router) serve(req *http.Request, writer *http.Writer) error {
+	req.TrustProxies(r.config.TrustedProxies)
+	if host := r.forHost(req.Host()); host != r {
+		return host.serve(req, writer)
+	}
+
+	if r.config.AuditContentLength {
+		writer.EnableAudit()
+	}
+	writer.Use(r.compressor.Filter(req.Header("Accept-Encoding")))
+	if altSvc := altSvcHeader(r.config.AltSvc, req.Version); altSvc != "" {
+		writer.Use(altSvcFilter(altSvc))
+	}
+
+	// The connection was let in by the address of the proxy, not of the client
+	if clientIP := req.ClientIP(); clientIP != req.PeerIP() && !r.config.IPFilter.Permits(clientIP) {
+		metrics.Default.Inc("http_requests_rejected_total", "reason", "ip_filter")
+		return ForbiddenHandler(req, writer, r.config)
+	}
+
+	if r.config.LogFingerprints || len(r.config.DenyFingerprints) > 0 {
+		fingerprint := req.Fingerprint()
+		if r.config.LogFingerprints {
+			fmt.Fprintf(os.Stderr, "Request fingerprint: client=%s method=%s target=%s %s\n", req.ClientIP(), req.Method, req.RequestTarget, fingerprint)
+		}
+		if slices.ContainsFunc(r.config.DenyFingerprints, fingerprint.Matches) {
+			metrics.Default.Inc("http_requests_rejected_total", "reason", "fingerprint")
+			return ForbiddenHandler(req, writer, r.config)
 		}
+	}
+
+	if r.config.Maintenance && !slices.Contains(MaintenanceExempt, req.Path()) {
+		metrics.Default.Inc("http_requests_rejected_total", "reason", "maintenance")
+		return MaintenanceHandler(req, writer, r.config)
+	}
 
-	default:
-		handler = NotFoundHandler
+	// 100-continue is the only expectation defined, and bodies are read anyway
+	if expect := req.Header("Expect"); expect != "" && !strings.EqualFold(strings.TrimSpace(expect), "100-continue") {
+		metrics.Default.Inc("http_requests_rejected_total", "reason", "expectation")
+		return ExpectationFailedHandler(req, writer, r.config)
+	}
+
+	// Rewrite rules apply before anything else looks at the target
+	if len(r.config.Rewrites) > 0 {
+		target, redirect := rewrite.Apply(r.config.Rewrites, req.RequestTarget)
+		if redirect != 0 {
+			metrics.Default.Inc("http_rewrites_total", "action", "redirect")
+			return RedirectHandler(req, writer, r.config, redirect, target)
+		}
+		if target != req.RequestTarget {
+			metrics.Default.Inc("http_rewrites_total", "action", "rewrite")
+			req.RequestTarget = target
+		}
+	}
+
+	if len(r.config.RefererRules) > 0 {
+		rule, ok := referer.Check(r.config.RefererRules, req.Path(), req.Host(), req.Header("Origin"), req.Header("Referer"))
+		if rule.Prefix != "" {
+			writer.Vary("Origin", "Referer")
+		}
+		if !ok {
+			metrics.Default.Inc("http_requests_rejected_total", "reason", "referer")
+			return RefererDeniedHandler(req, writer, r.config, rule.Placeholder)
+		}
 	}
 
-	return handler(req, writer, r.config)
+	if !r.config.ExemptCIDRs.Contains(req.ClientIP()) {
+		if ok, route := r.routeLimiter.Allow(req.Method, req.Path()); !ok {
+			metrics.Default.Inc("http_requests_shed_total", "reason", "route_rate", "route", route)
+			return TooManyRequestsHandler(req, writer, r.config)
+		}
+	}
+
+	return answerError(req, writer, r.config, r.match(req)(req, writer, r.config))
 }
 
-// handlePostFile handles POST requests to /files/{filename}
-func (r *Router) handlePostFile(req *http.Request, writer *http.Writer, parser *http.Parser) error {
-	return SaveFileHandler(req, writer, r.config, parser)
+// forHost returns the router of the virtual host a request is for, matching
+// its name exactly or else by the closest "*." wildcard, or the router itself
+// for the default host
+func (r *Router) forHost(host string) *Router {
+	if len(r.hosts) == 0 {
+		return r
+	}
+	if hostRouter, ok := r.hosts[host]; ok {
+		return hostRouter
+	}
+	for {
+		_, parent, ok := strings.Cut(host, ".")
+		if !ok {
+			return r
+		}
+		if hostRouter, ok := r.hosts["*."+parent]; ok {
+			return hostRouter
+		}
+		host = parent
+	}
 }
 
-// ShouldCloseConnection checks if the connection should be closed based on request headers
+// match returns the handler of the first route matching the request, setting
+// the path parameters the route captures
+func (r *Router) match(req *http.Request) HandlerFunc {
+	for _, rt := range r.routes {
+		if rt.method != "" && rt.method != req.Method {
+			continue
+		}
+		if matches := rt.pattern.FindStringSubmatch(req.Path()); matches != nil {
+			req.SetParams(routeParams(rt.pattern, matches))
+			return rt.handler
+		}
+	}
+	return NotFoundHandler
+}
+
+// routeParams returns the named groups of a route pattern with what they matched
+func routeParams(pattern *regexp.Regexp, matches []string) map[string]string {
+	var params map[string]string
+	for i, name := range pattern.SubexpNames() {
+		if name == "" {
+			continue
+		}
+		if params == nil {
+			params = make(map[string]string)
+		}
+		params[name] = matches[i]
+	}
+	return params
+}
+
+// ShouldCloseConnection checks if the connection should be closed based on
+// request headers, i.e. whether any Connection option is "close" in any case.
+// HTTP/1.0 connections are closed after every response, as persistent
+// connections are not offered to HTTP/1.0 clients.
 func (r *Router) ShouldCloseConnection(req *http.Request) bool {
-	connection, ok := req.Headers["Connection"]
-	return ok && connection == "close"
+	if req.Version == "HTTP/1.0" {
+		return true
+	}
+	for _, option := range strings.Split(req.Header("Connection"), ",") {
+		if strings.EqualFold(strings.TrimSpace(option), "close") {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,465 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"octo-server/app/http"
+	"octo-server/app/metrics"
+	"octo-server/app/s3"
+)
+
+// S3EndpointRegex matches the S3-compatible API, served path-style below /s3
+var S3EndpointRegex = regexp.MustCompile(`^/s3(/.*)?$`)
+
+// Query parameters understood on bucket and object requests. Others name
+// subresources, such as multipart uploads or ACLs, that are not implemented.
+var (
+	s3BucketParams = []string{"list-type", "prefix", "delimiter", "max-keys", "continuation-token", "start-after", "marker", "encoding-type", "fetch-owner", "location", "x-id"}
+	s3ObjectParams = []string{"x-id"}
+)
+
+// S3Handler handles the S3-compatible API: ListBuckets, ListObjects(V2),
+// HeadBucket, GetBucketLocation, and Put, Copy, Get, Head and Delete Object
+func S3Handler(req *http.Request, writer *http.Writer, config *Config) error {
+	if config.S3 == nil {
+		return NotFoundHandler(req, writer, config)
+	}
+
+	if config.S3Credentials.Enabled() {
+		if err := s3.Verify(req, config.S3Credentials, config.clock().Now()); err != nil {
+			return writeS3Error(req, writer, config, err)
+		}
+		req.SetContext(http.WithClaims(req.Context(), http.Claims{"s3_access_key": config.S3Credentials.AccessKey}))
+	}
+
+	path, query := strings.TrimPrefix(req.Path(), "/s3"), req.QueryValues()
+	bucketName, rawKey, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	key, err := url.PathUnescape(rawKey)
+	if err != nil {
+		return writeS3Error(req, writer, config, s3.ErrInvalidKey)
+	}
+
+	switch {
+	case bucketName == "":
+		if req.Method != "GET" {
+			return writeS3Error(req, writer, config, s3.ErrMethodNotAllowed)
+		}
+		return s3ListBuckets(req, writer, config)
+	case bucketName != config.S3.Name:
+		return writeS3Error(req, writer, config, s3.ErrNoSuchBucket)
+	case key == "":
+		if !s3OnlyParams(query, s3BucketParams) {
+			return writeS3Error(req, writer, config, s3.ErrNotImplemented)
+		}
+		switch req.Method {
+		case "GET":
+			if query.Has("location") {
+				metrics.Default.Inc("s3_requests_total", "op", "GetBucketLocation")
+				return writeXML(req, writer, config, http.StatusOK, s3.LocationConstraint{Xmlns: s3.Namespace})
+			}
+			return s3ListObjects(req, writer, config, query)
+		case "HEAD", "PUT":
+			// The bucket always exists, so creating it succeeds like on us-east-1
+			metrics.Default.Inc("s3_requests_total", "op", "HeadBucket")
+			return writeXML(req, writer, config, http.StatusOK, nil)
+		}
+		return writeS3Error(req, writer, config, s3.ErrNotImplemented)
+	}
+
+	if !s3OnlyParams(query, s3ObjectParams) {
+		return writeS3Error(req, writer, config, s3.ErrNotImplemented)
+	}
+	switch req.Method {
+	case "GET", "HEAD":
+		return s3GetObject(req, writer, config, key)
+	case "PUT":
+		if req.Header("X-Amz-Copy-Source") != "" {
+			return s3CopyObject(req, writer, config, key)
+		}
+		return s3PutObject(req, writer, config, key)
+	case "DELETE":
+		return s3DeleteObject(req, writer, config, key)
+	}
+	return writeS3Error(req, writer, config, s3.ErrNotImplemented)
+}
+
+// s3OnlyParams reports whether a query only holds the given parameters, or response-* overrides
+func s3OnlyParams(query url.Values, allowed []string) bool {
+	for name := range query {
+		if !slices.Contains(allowed, name) && !strings.HasPrefix(name, "response-") {
+			return false
+		}
+	}
+	return true
+}
+
+// s3ListBuckets answers ListBuckets with the single bucket served
+func s3ListBuckets(req *http.Request, writer *http.Writer, config *Config) error {
+	metrics.Default.Inc("s3_requests_total", "op", "ListBuckets")
+	return writeXML(req, writer, config, http.StatusOK, s3.ListAllMyBucketsResult{
+		Xmlns: s3.Namespace,
+		Owner: s3.Owner{ID: "octo-server", DisplayName: "octo-server"},
+		Buckets: []s3.BucketInfo{{
+			Name:         config.S3.Name,
+			CreationDate: s3.Timestamp(config.S3.Created()),
+		}},
+	})
+}
+
+// s3ListObjects answers ListObjects, or ListObjectsV2 when list-type=2
+func s3ListObjects(req *http.Request, writer *http.Writer, config *Config, query url.Values) error {
+	v2 := query.Get("list-type") == "2"
+	opts := s3.ListOptions{
+		Prefix:    query.Get("prefix"),
+		Delimiter: query.Get("delimiter"),
+		After:     query.Get("marker"),
+		MaxKeys:   s3.DefaultMaxKeys,
+	}
+	if maxKeys := query.Get("max-keys"); maxKeys != "" {
+		n, err := strconv.Atoi(maxKeys)
+		if err != nil || n < 0 {
+			return writeS3Error(req, writer, config, &s3.Error{Status: http.StatusBadRequest, Code: "InvalidArgument", Message: "max-keys must be a non-negative integer."})
+		}
+		opts.MaxKeys = n
+	}
+	if v2 {
+		opts.After = query.Get("start-after")
+		if token := query.Get("continuation-token"); token != "" {
+			after, err := base64.RawURLEncoding.DecodeString(token)
+			if err != nil {
+				return writeS3Error(req, writer, config, &s3.Error{Status: http.StatusBadRequest, Code: "InvalidArgument", Message: "The continuation token provided is incorrect."})
+			}
+			opts.After = string(after)
+		}
+	}
+
+	listing := &s3.Listing{}
+	if opts.MaxKeys > 0 {
+		var err error
+		if listing, err = config.S3.List(opts); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to list bucket: %v\n", err)
+			return writeS3Error(req, writer, config, s3.ErrInternalError)
+		}
+	}
+
+	result := s3.ListBucketResult{
+		Xmlns:          s3.Namespace,
+		Name:           config.S3.Name,
+		Prefix:         opts.Prefix,
+		Delimiter:      opts.Delimiter,
+		MaxKeys:        opts.MaxKeys,
+		IsTruncated:    listing.IsTruncated,
+		Contents:       listing.Objects,
+		CommonPrefixes: listing.CommonPrefixes,
+	}
+	if v2 {
+		metrics.Default.Inc("s3_requests_total", "op", "ListObjectsV2")
+		keyCount := len(listing.Objects) + len(listing.CommonPrefixes)
+		result.KeyCount = &keyCount
+		result.ContinuationToken = query.Get("continuation-token")
+		result.StartAfter = query.Get("start-after")
+		if listing.IsTruncated {
+			result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(listing.Next))
+		}
+	} else {
+		metrics.Default.Inc("s3_requests_total", "op", "ListObjects")
+		marker := query.Get("marker")
+		result.Marker = &marker
+		if listing.IsTruncated && opts.Delimiter != "" {
+			result.NextMarker = listing.Next
+		}
+	}
+
+	if query.Get("encoding-type") == "url" {
+		result.EncodingType = "url"
+		result.Prefix = s3.EncodeKey(result.Prefix)
+		result.Delimiter = s3.EncodeKey(result.Delimiter)
+		result.StartAfter = s3.EncodeKey(result.StartAfter)
+		result.NextMarker = s3.EncodeKey(result.NextMarker)
+		for i := range result.Contents {
+			result.Contents[i].Key = s3.EncodeKey(result.Contents[i].Key)
+		}
+		for i := range result.CommonPrefixes {
+			result.CommonPrefixes[i].Prefix = s3.EncodeKey(result.CommonPrefixes[i].Prefix)
+		}
+	}
+
+	return writeXML(req, writer, config, http.StatusOK, result)
+}
+
+// s3GetObject answers GetObject and HeadObject, honoring a single byte range
+func s3GetObject(req *http.Request, writer *http.Writer, config *Config, key string) error {
+	op := "GetObject"
+	if req.Method == "HEAD" {
+		op = "HeadObject"
+	}
+	metrics.Default.Inc("s3_requests_total", "op", op)
+
+	path, err := config.S3.Path(key)
+	if err != nil {
+		return writeS3Error(req, writer, config, err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return writeS3Error(req, writer, config, s3.ErrNoSuchKey)
+		}
+		fmt.Fprintf(os.Stderr, "Error opening file: %v\n", err)
+		return writeS3Error(req, writer, config, s3.ErrInternalError)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return writeS3Error(req, writer, config, s3.ErrNoSuchKey)
+	}
+	size := info.Size()
+
+	byteRange, partial, err := http.ParseRange(req.Header("Range"), size)
+	if errors.Is(err, http.ErrRangeNotSatisfiable) {
+		writer.Use(func(resp *http.Response) error {
+			resp.Headers.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			return nil
+		})
+		return writeS3Error(req, writer, config, s3.ErrInvalidRange)
+	}
+	if !partial {
+		byteRange = http.ByteRange{Start: 0, End: size - 1}
+	}
+
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		StatusText: http.StatusCodeToText(http.StatusOK),
+		Headers: http.Header{
+			"Content-Type":   {"application/octet-stream"},
+			"Content-Length": {strconv.FormatInt(byteRange.Length(), 10)},
+			"Accept-Ranges":  {"bytes"},
+			"Etag":           {s3.ETag(info)},
+			"Last-Modified":  {info.ModTime().UTC().Format(http.TimeFormat)},
+		},
+	}
+	if partial {
+		resp.StatusCode = http.StatusPartialContent
+		resp.StatusText = http.StatusCodeToText(http.StatusPartialContent)
+		resp.Headers.Set("Content-Range", byteRange.ContentRange(size))
+	}
+
+	if req.Method == "HEAD" {
+		return writer.WriteResponse(resp)
+	}
+	config.Files.Download(key, byteRange.Length())
+	return writer.WriteFrom(resp, io.NewSectionReader(file, byteRange.Start, byteRange.Length()))
+}
+
+// s3PutObject answers PutObject, streaming the body to the object's file
+func s3PutObject(req *http.Request, writer *http.Writer, config *Config, key string) error {
+	metrics.Default.Inc("s3_requests_total", "op", "PutObject")
+
+	path, err := config.S3.Path(key)
+	if err != nil {
+		return writeS3Error(req, writer, config, err)
+	}
+	if reservedPath(filepath.FromSlash(key)) {
+		return writeS3Error(req, writer, config, s3.ErrAccessDenied)
+	}
+
+	body, err := req.BodyReader()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read request body: %v\n", err)
+		return writeS3Error(req, writer, config, s3.ErrIncompleteBody)
+	}
+	if s3.IsChunked(req.Header("X-Amz-Content-Sha256")) {
+		body = s3.NewChunkedReader(body)
+	}
+
+	// A signed payload hash is checked before the file replaces the previous one
+	var hasher hash.Hash
+	if expected := s3.PayloadHash(req); expected != "" {
+		hasher = sha256.New()
+		body = io.TeeReader(body, hasher)
+	}
+
+	// Keys ending in a slash are directory markers
+	if strings.HasSuffix(key, "/") {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create directory: %v\n", err)
+			return writeS3Error(req, writer, config, s3.ErrInternalError)
+		}
+		return s3Stored(req, writer, config, path)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create directory: %v\n", err)
+		return writeS3Error(req, writer, config, s3.ErrInternalError)
+	}
+	size, err := config.writeFileAtomic(path, body, func() error {
+		if hasher != nil && hex.EncodeToString(hasher.Sum(nil)) != s3.PayloadHash(req) {
+			return s3.ErrContentSHA256Mismatch
+		}
+		return config.saveVersion(key)
+	})
+	if err != nil {
+		var s3Err *s3.Error
+		if errors.As(err, &s3Err) {
+			return writeS3Error(req, writer, config, err)
+		}
+		fmt.Fprintf(os.Stderr, "Failed to write file: %v\n", err)
+		return writeS3Error(req, writer, config, s3.ErrIncompleteBody)
+	}
+	config.Files.Upload(key, size)
+
+	return s3Stored(req, writer, config, path)
+}
+
+// s3Stored answers a successful PutObject with the new ETag of the object
+func s3Stored(req *http.Request, writer *http.Writer, config *Config, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to stat file: %v\n", err)
+		return writeS3Error(req, writer, config, s3.ErrInternalError)
+	}
+
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		StatusText: http.StatusCodeToText(http.StatusOK),
+		Headers: http.Header{
+			"Etag":           {s3.ETag(info)},
+			"Content-Length": {"0"},
+		},
+	}
+	return writer.WriteResponse(resp)
+}
+
+// s3CopyObject answers CopyObject from another key of the bucket
+func s3CopyObject(req *http.Request, writer *http.Writer, config *Config, key string) error {
+	metrics.Default.Inc("s3_requests_total", "op", "CopyObject")
+
+	source, err := url.PathUnescape(strings.TrimPrefix(req.Header("X-Amz-Copy-Source"), "/"))
+	if err != nil {
+		return writeS3Error(req, writer, config, s3.ErrInvalidKey)
+	}
+	source, _, _ = strings.Cut(source, "?versionId=")
+	sourceBucket, sourceKey, _ := strings.Cut(source, "/")
+	if sourceBucket != config.S3.Name {
+		return writeS3Error(req, writer, config, s3.ErrNoSuchBucket)
+	}
+
+	sourcePath, err := config.S3.Path(sourceKey)
+	if err != nil {
+		return writeS3Error(req, writer, config, err)
+	}
+	path, err := config.S3.Path(key)
+	if err != nil {
+		return writeS3Error(req, writer, config, err)
+	}
+
+	file, err := os.Open(sourcePath)
+	if err != nil {
+		return writeS3Error(req, writer, config, s3.ErrNoSuchKey)
+	}
+	defer file.Close()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create directory: %v\n", err)
+		return writeS3Error(req, writer, config, s3.ErrInternalError)
+	}
+	size, err := config.writeFileAtomic(path, file, func() error {
+		return config.saveVersion(key)
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to copy file: %v\n", err)
+		return writeS3Error(req, writer, config, s3.ErrInternalError)
+	}
+	config.Files.Upload(key, size)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to stat file: %v\n", err)
+		return writeS3Error(req, writer, config, s3.ErrInternalError)
+	}
+	return writeXML(req, writer, config, http.StatusOK, s3.CopyObjectResult{
+		Xmlns:        s3.Namespace,
+		LastModified: s3.Timestamp(info.ModTime()),
+		ETag:         s3.ETag(info),
+	})
+}
+
+// s3DeleteObject answers DeleteObject, moving the file to the trash if enabled.
+// Deleting a missing key succeeds, as on S3.
+func s3DeleteObject(req *http.Request, writer *http.Writer, config *Config, key string) error {
+	metrics.Default.Inc("s3_requests_total", "op", "DeleteObject")
+
+	path, err := config.S3.Path(key)
+	if err != nil {
+		return writeS3Error(req, writer, config, err)
+	}
+
+	if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+		if config.Trash != nil {
+			_, err = config.Trash.Move(key)
+		} else {
+			err = os.Remove(path)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to delete file: %v\n", err)
+			return writeS3Error(req, writer, config, s3.ErrInternalError)
+		}
+	}
+	return NoContentHandler(req, writer, config)
+}
+
+// writeXML writes an S3 API response with v encoded as its XML document, or an empty body if v is nil
+func writeXML(req *http.Request, writer *http.Writer, config *Config, status int, v any) error {
+	var content []byte
+	if v != nil {
+		encoded, err := xml.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("failed to encode XML response: %w", err)
+		}
+		content = append([]byte(xml.Header), encoded...)
+	}
+
+	resp := &http.Response{
+		StatusCode: status,
+		StatusText: http.StatusCodeToText(status),
+		Headers: http.Header{
+			"Content-Type":   {"application/xml"},
+			"Content-Length": {strconv.Itoa(len(content))},
+		},
+		Body: content,
+	}
+	if req.Method == "HEAD" {
+		resp.Body = nil
+	}
+	return writer.WriteResponse(resp)
+}
+
+// writeS3Error writes an S3 error document, treating errors other than *s3.Error as internal errors
+func writeS3Error(req *http.Request, writer *http.Writer, config *Config, err error) error {
+	var s3Err *s3.Error
+	if !errors.As(err, &s3Err) {
+		fmt.Fprintf(os.Stderr, "S3 request failed: %v\n", err)
+		s3Err = s3.ErrInternalError
+	}
+	metrics.Default.Inc("s3_errors_total", "code", s3Err.Code)
+
+	return writeXML(req, writer, config, s3Err.Status, s3.ErrorResponse{
+		Code:     s3Err.Code,
+		Message:  s3Err.Message,
+		Resource: strings.TrimPrefix(req.Path(), "/s3"),
+	})
+}
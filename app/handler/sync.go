@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"octo-server/app/http"
+	"octo-server/app/manifest"
+	"octo-server/app/metrics"
+)
+
+// syncManifest is the body of a full sync manifest
+type syncManifest struct {
+	ETag  string           `json:"etag"`
+	Files []manifest.Entry `json:"files"`
+}
+
+// syncDelta is the body of the changes since an earlier manifest, named by Base
+type syncDelta struct {
+	ETag string `json:"etag"`
+	Base string `json:"base"`
+	manifest.Delta
+}
+
+// SyncHandler handles GET /api/sync, returning a manifest of every file with its hash.
+// A client sending the ETag of its last manifest in If-None-Match gets 304 Not Modified
+// if nothing changed, or only the changes since that manifest while it is still known.
+func SyncHandler(req *http.Request, writer *http.Writer, config *Config) error {
+	if config.Manifest == nil {
+		return Errorf(http.StatusInternalServerError, "directory not configured")
+	}
+
+	current, err := config.Manifest.Current()
+	if err != nil {
+		return fmt.Errorf("failed to build sync manifest: %w", err)
+	}
+
+	var base *manifest.Manifest
+	for _, tag := range strings.Split(req.Header("If-None-Match"), ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == current.ETag || tag == "*" {
+			metrics.Default.Inc("sync_manifest_requests_total", "result", "not_modified")
+			return writer.WriteResponse(&http.Response{
+				StatusCode: http.StatusNotModified,
+				StatusText: http.StatusCodeToText(http.StatusNotModified),
+				Headers:    http.Header{"Etag": {current.ETag}, "Cache-Control": {"no-cache"}},
+			})
+		}
+		if base == nil && tag != "" {
+			base = config.Manifest.Lookup(tag)
+		}
+	}
+
+	if base != nil {
+		metrics.Default.Inc("sync_manifest_requests_total", "result", "delta")
+		return writeManifest(req, writer, config, current.ETag, syncDelta{ETag: current.ETag, Base: base.ETag, Delta: current.Diff(base)})
+	}
+	metrics.Default.Inc("sync_manifest_requests_total", "result", "full")
+	return writeManifest(req, writer, config, current.ETag, syncManifest{ETag: current.ETag, Files: current.Entries})
+}
+
+// writeManifest writes a JSON sync response tagged with the ETag of the current manifest
+func writeManifest(req *http.Request, writer *http.Writer, config *Config, etag string, v any) error {
+	content, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode JSON response: %w", err)
+	}
+
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		StatusText: http.StatusCodeToText(http.StatusOK),
+		Headers: http.Header{
+			"Content-Type":   {"application/json"},
+			"Content-Length": {strconv.Itoa(len(content))},
+			"Cache-Control":  {"no-cache"},
+			"Etag":           {etag},
+		},
+		Body: content,
+	}
+	return writer.WriteResponse(resp)
+}
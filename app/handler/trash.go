@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"octo-server/app/http"
+	"octo-server/app/trash"
+)
+
+// TrashRestoreEndpointRegex matches POST /api/trash/{id}/restore
+var TrashRestoreEndpointRegex = regexp.MustCompile(`^/api/trash/(?P<id>[^/]+)/restore$`)
+
+// DeleteFileHandler handles DELETE /files/{filename}. With a trash configured the
+// file is moved there and the trash item returned; otherwise it is removed for good.
+func DeleteFileHandler(req *http.Request, writer *http.Writer, config *Config) error {
+	if config.Directory == "" {
+		return Errorf(http.StatusInternalServerError, "directory not configured")
+	}
+
+	filename := req.Param("filename")
+	if filename == "" {
+		return BadRequestHandler(req, writer, config)
+	}
+
+	// Refuse names escaping the directory or reaching into the trash or versions
+	if !filepath.IsLocal(filename) || reservedPath(filename) {
+		return BadRequestHandler(req, writer, config)
+	}
+
+	path := filepath.Join(config.Directory, filename)
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return NotFoundHandler(req, writer, config)
+	}
+
+	if config.Trash == nil {
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("failed to delete file: %w", err)
+		}
+		return NoContentHandler(req, writer, config)
+	}
+
+	item, err := config.Trash.Move(filename)
+	if err != nil {
+		return fmt.Errorf("failed to move file to trash: %w", err)
+	}
+	return writeJSON(req, writer, config, item)
+}
+
+// TrashListHandler handles GET /api/trash, listing the deleted files that can be restored
+func TrashListHandler(req *http.Request, writer *http.Writer, config *Config) error {
+	if config.Trash == nil {
+		return NotFoundHandler(req, writer, config)
+	}
+
+	items, err := config.Trash.List()
+	if err != nil {
+		return fmt.Errorf("failed to list trash: %w", err)
+	}
+	return writeJSON(req, writer, config, items)
+}
+
+// TrashRestoreHandler handles POST /api/trash/{id}/restore, moving a deleted file back into place
+func TrashRestoreHandler(req *http.Request, writer *http.Writer, config *Config) error {
+	if config.Trash == nil {
+		return NotFoundHandler(req, writer, config)
+	}
+
+	item, err := config.Trash.Restore(req.Param("id"))
+	switch {
+	case errors.Is(err, trash.ErrNotFound):
+		return NotFoundHandler(req, writer, config)
+	case errors.Is(err, trash.ErrExists):
+		return ConflictHandler(req, writer, config)
+	case errors.Is(err, trash.ErrInvalidName):
+		return BadRequestHandler(req, writer, config)
+	case err != nil:
+		return fmt.Errorf("failed to restore trash item: %w", err)
+	}
+	return writeJSON(req, writer, config, item)
+}
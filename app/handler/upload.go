@@ -0,0 +1,189 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"octo-server/app/fileio"
+	"octo-server/app/http"
+)
+
+// errUploadTooLarge is returned when an upload exceeds the per-file or total limit
+var errUploadTooLarge = errors.New("upload exceeds size limit")
+
+// UploadedFile describes a file stored by a multipart upload
+type UploadedFile struct {
+	Field string `json:"field"`
+	Name  string `json:"name"`
+	Size  int64  `json:"size"`
+}
+
+// UploadSummary is the JSON body returned for a multipart upload
+type UploadSummary struct {
+	Files     []UploadedFile `json:"files"`
+	TotalSize int64          `json:"totalSize"`
+}
+
+// UploadFilesHandler handles POST /files with a multipart/form-data body,
+// streaming every file part to its own file in the directory. Files are staged
+// under temporary names and only renamed into place once the whole upload succeeded.
+func UploadFilesHandler(req *http.Request, writer *http.Writer, config *Config) error {
+	if config.Directory == "" {
+		return Errorf(http.StatusInternalServerError, "directory not configured")
+	}
+
+	mediaType, params, err := mime.ParseMediaType(req.Header("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" {
+		return UnsupportedMediaTypeHandler(req, writer, config)
+	}
+	if !req.HasBody() {
+		return LengthRequiredHandler(req, writer, config)
+	}
+
+	body, err := req.BodyReader()
+	if err != nil {
+		return BadRequestHandler(req, writer, config)
+	}
+
+	if uploadID := req.Header("X-Upload-ID"); uploadID != "" {
+		upload, ok := config.Uploads.Start(uploadID, "", req.ContentLength())
+		if !ok {
+			return ConflictHandler(req, writer, config)
+		}
+		body = upload.Reader(body)
+		defer func() { config.Uploads.Finish(upload, err) }()
+	}
+
+	staged := make(map[string]stagedUpload)
+	defer func() {
+		for _, file := range staged {
+			os.Remove(file.path)
+		}
+	}()
+
+	summary := UploadSummary{Files: []UploadedFile{}}
+	reader := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return Errorf(http.StatusBadRequest, "failed to read multipart body: %v", err)
+		}
+
+		// Plain form fields carry no file to store
+		name := uploadFileName(part)
+		if name == "" {
+			io.Copy(io.Discard, part)
+			continue
+		}
+		if name == "." || name == ".." || name == string(filepath.Separator) {
+			return BadRequestHandler(req, writer, config)
+		}
+		if reservedPath(name) {
+			return ForbiddenHandler(req, writer, config)
+		}
+
+		size, file, err := stageUpload(config, part, summary.TotalSize)
+		if file.path != "" {
+			if previous, ok := staged[name]; ok {
+				os.Remove(previous.path)
+			}
+			staged[name] = file
+		}
+		if errors.Is(err, errUploadTooLarge) {
+			return PayloadTooLargeHandler(req, writer, config)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to store uploaded file: %w", err)
+		}
+
+		summary.TotalSize += size
+		summary.Files = append(summary.Files, UploadedFile{Field: part.FormName(), Name: name, Size: size})
+	}
+
+	for name, file := range staged {
+		if err := config.saveVersion(name); err != nil {
+			return fmt.Errorf("failed to keep previous version: %w", err)
+		}
+		info, err := os.Stat(file.path)
+		if err == nil {
+			err = os.Rename(file.path, filepath.Join(config.Directory, name))
+		}
+		if err != nil {
+			return fmt.Errorf("failed to move uploaded file into place: %w", err)
+		}
+		config.recordHash(filepath.Join(config.Directory, name), info, file.hash)
+		delete(staged, name)
+	}
+	for _, file := range summary.Files {
+		config.Files.Upload(file.Name, file.Size)
+	}
+
+	return writer.JSON(http.StatusCreated, summary)
+}
+
+// uploadFileName returns the base name of a file part's filename. Some
+// browsers send the full client path, with backslashes on Windows.
+func uploadFileName(part *multipart.Part) string {
+	name := part.FileName()
+	if i := strings.LastIndexByte(name, '\\'); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
+
+// stagedUpload is a file part written to a temporary file, waiting to be moved into place
+type stagedUpload struct {
+	path string
+	// hash is the hex-encoded SHA-256 of the content, computed while it was written
+	hash string
+}
+
+// stageUpload streams a file part into a temporary file in the directory,
+// enforcing the per-file limit and the total limit given the bytes already stored.
+// The temporary path is returned whenever a file was created, even on error.
+func stageUpload(config *Config, part io.Reader, storedSoFar int64) (int64, stagedUpload, error) {
+	tmp, err := os.CreateTemp(config.Directory, ".upload-*")
+	if err != nil {
+		return 0, stagedUpload{}, err
+	}
+	defer tmp.Close()
+	file := stagedUpload{path: tmp.Name()}
+
+	limit := int64(-1)
+	if config.UploadMaxFileSize > 0 {
+		limit = config.UploadMaxFileSize
+	}
+	if config.UploadMaxTotalSize > 0 {
+		if remaining := config.UploadMaxTotalSize - storedSoFar; limit < 0 || remaining < limit {
+			limit = remaining
+		}
+	}
+
+	src := part
+	if limit >= 0 {
+		// Read one byte past the limit to detect oversized parts
+		src = io.LimitReader(part, limit+1)
+	}
+
+	hasher := sha256.New()
+	size, err := fileio.Copy(tmp, io.TeeReader(src, hasher))
+	if err != nil {
+		return size, file, err
+	}
+	if limit >= 0 && size > limit {
+		return size, file, errUploadTooLarge
+	}
+	file.hash = hex.EncodeToString(hasher.Sum(nil))
+	return size, file, nil
+}
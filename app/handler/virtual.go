@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"runtime"
+	"text/template"
+	"time"
+
+	"octo-server/app/buildinfo"
+	"octo-server/app/http"
+	"octo-server/app/metrics"
+)
+
+// VirtualEndpoint is a computed JSON endpoint defined by a template
+type VirtualEndpoint struct {
+	Path     string
+	Template *template.Template
+}
+
+// TemplateFuncs are the functions available to virtual endpoint templates
+var TemplateFuncs = template.FuncMap{
+	// json encodes a value as JSON, e.g. {{json .Version}} produces a quoted string
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	// metric returns the current value of a counter, e.g. {{metric "http_response_bytes_total"}}
+	"metric": func(name string, labels ...string) int64 {
+		return metrics.Default.Get(name, labels...)
+	},
+}
+
+// Stats is the data passed to virtual endpoint templates
+type Stats struct {
+	Version       string
+	GoVersion     string
+	StartTime     time.Time
+	Uptime        string
+	UptimeSeconds int64
+	Directory     string
+}
+
+// FileCount returns the number of regular files under the served directory
+func (s *Stats) FileCount() int {
+	count := 0
+	s.walkFiles(func(info fs.FileInfo) { count++ })
+	return count
+}
+
+// DirectorySize returns the total size in bytes of the regular files under the served directory
+func (s *Stats) DirectorySize() int64 {
+	var size int64
+	s.walkFiles(func(info fs.FileInfo) { size += info.Size() })
+	return size
+}
+
+// walkFiles calls fn for every regular file under the served directory
+func (s *Stats) walkFiles(fn func(info fs.FileInfo)) {
+	if s.Directory == "" {
+		return
+	}
+	filepath.WalkDir(s.Directory, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			fn(info)
+		}
+		return nil
+	})
+}
+
+// newVirtualHandler returns a handler rendering the endpoint's template as a JSON response
+func newVirtualHandler(endpoint VirtualEndpoint) HandlerFunc {
+	return func(req *http.Request, writer *http.Writer, config *Config) error {
+		uptime := time.Since(buildinfo.StartTime)
+		stats := &Stats{
+			Version:       buildinfo.Version,
+			GoVersion:     runtime.Version(),
+			StartTime:     buildinfo.StartTime,
+			Uptime:        uptime.Round(time.Second).String(),
+			UptimeSeconds: int64(uptime.Seconds()),
+			Directory:     config.Directory,
+		}
+
+		var buf bytes.Buffer
+		if err := endpoint.Template.Execute(&buf, stats); err != nil {
+			return fmt.Errorf("failed to render %s: %w", endpoint.Path, err)
+		}
+		if !json.Valid(buf.Bytes()) {
+			return Errorf(http.StatusInternalServerError, "template for %s did not produce valid JSON", endpoint.Path)
+		}
+
+		resp := &http.Response{
+			StatusCode: http.StatusOK,
+			StatusText: http.StatusCodeToText(http.StatusOK),
+			Headers: http.Header{
+				"Content-Type":   {"application/json"},
+				"Content-Length": {fmt.Sprintf("%d", buf.Len())},
+				"Cache-Control":  {"no-store"},
+			},
+			Body: buf.Bytes(),
+		}
+
+		return writer.WriteResponse(resp)
+	}
+}
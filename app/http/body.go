@@ -0,0 +1,286 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"octo-server/app/metrics"
+)
+
+// BodyReader returns a reader streaming the request body from the connection.
+// Requests without a body yield an empty reader.
+func (r *Request) BodyReader() (io.Reader, error) {
+	if r.body != nil {
+		return r.body, nil
+	}
+	if r.parser == nil {
+		return nil, errors.New("request has no connection to read a body from")
+	}
+	return r.parser.BodyReader(r)
+}
+
+// HasBody reports whether the request declares a body, with chunked transfer
+// coding or a Content-Length header, even of zero. Requests whose body is
+// streamed from elsewhere, e.g. an HTTP/2 stream, are taken to have one.
+func (r *Request) HasBody() bool {
+	if r.body != nil || isChunked(r) {
+		return true
+	}
+	return r.Headers.Has("Content-Length")
+}
+
+// ContentLength returns the declared length of the request body, or -1 if
+// it is unknown because the body is chunked or the header is missing or invalid
+func (r *Request) ContentLength() int64 {
+	if isChunked(r) {
+		return -1
+	}
+	n, err := strconv.ParseInt(r.Header("Content-Length"), 10, 64)
+	if err != nil || n < 0 {
+		return -1
+	}
+	return n
+}
+
+// ErrBodyTooLarge is returned by ReadBody for a body over MaxReadBodySize
+var ErrBodyTooLarge = errors.New("request body too large to read into memory")
+
+// ReadBody reads the request body based on the Content-Length or Transfer-Encoding header.
+// Bodies over MaxReadBodySize fail with ErrBodyTooLarge before they are read.
+func (p *Parser) ReadBody(req *Request) ([]byte, error) {
+	if isChunked(req) {
+		if err := p.sendContinue(); err != nil {
+			return nil, err
+		}
+		return p.readChunkedBody()
+	}
+
+	contentLength, err := p.contentLength(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if contentLength > MaxReadBodySize {
+		return nil, ErrBodyTooLarge
+	}
+	if err := p.reserveBody(contentLength); err != nil {
+		return nil, err
+	}
+	if err := p.sendContinue(); err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, contentLength)
+	if _, err := io.ReadFull(p.reader, data); err != nil {
+		return nil, fmt.Errorf("failed to read body: %w", err)
+	}
+	p.bodyPending = false
+
+	return data, nil
+}
+
+// BodyReader returns a reader streaming the request body from the connection
+// without buffering it in memory
+func (p *Parser) BodyReader(req *Request) (io.Reader, error) {
+	if err := p.sendContinue(); err != nil {
+		return nil, err
+	}
+	if isChunked(req) {
+		return &chunkedReader{parser: p}, nil
+	}
+
+	contentLength, err := p.contentLength(req)
+	if err != nil {
+		return nil, err
+	}
+	return &lengthReader{parser: p, remaining: contentLength}, nil
+}
+
+// contentLength parses the request's Content-Length header. A request
+// without the header or chunked transfer coding has an empty body.
+func (p *Parser) contentLength(req *Request) (int64, error) {
+	contentLengthStr := req.Header("Content-Length")
+	if !req.Headers.Has("Content-Length") {
+		return 0, nil
+	}
+
+	contentLength, err := strconv.ParseInt(contentLengthStr, 10, 64)
+	if err != nil || contentLength < 0 {
+		return 0, newParseError(KindBadHeader, fmt.Errorf("invalid Content-Length: %q", contentLengthStr))
+	}
+	return contentLength, nil
+}
+
+// isChunked reports whether the request body uses chunked transfer coding
+func isChunked(req *Request) bool {
+	return strings.EqualFold(req.Header("Transfer-Encoding"), "chunked")
+}
+
+// reserveBody accounts n more bytes of body held for the current request
+func (p *Parser) reserveBody(n int64) error {
+	if p.account == nil {
+		return nil
+	}
+	if err := p.account.Reserve(n); err != nil {
+		metrics.Default.Inc("http_requests_shed_total", "reason", "memory_budget")
+		return fmt.Errorf("failed to read body: %w", err)
+	}
+	p.bodyHeld += n
+	return nil
+}
+
+// releaseBody returns the memory held for the previous request's body
+func (p *Parser) releaseBody() {
+	if p.account != nil && p.bodyHeld > 0 {
+		p.account.Release(p.bodyHeld)
+	}
+	p.bodyHeld = 0
+	p.bodyPending = false
+}
+
+// readChunkedBody reads a body sent with chunked transfer coding
+func (p *Parser) readChunkedBody() ([]byte, error) {
+	reader := &chunkedReader{parser: p}
+	var body []byte
+	for {
+		// Account for each chunk before buffering it
+		if err := reader.nextChunk(); err != nil {
+			if err == io.EOF {
+				return body, nil
+			}
+			return nil, err
+		}
+		if int64(len(body))+reader.remaining > MaxReadBodySize {
+			return nil, ErrBodyTooLarge
+		}
+		if err := p.reserveBody(reader.remaining); err != nil {
+			return nil, err
+		}
+
+		chunk := make([]byte, reader.remaining)
+		if _, err := io.ReadFull(reader, chunk); err != nil {
+			return nil, err
+		}
+		body = append(body, chunk...)
+	}
+}
+
+// lengthReader streams a body delimited by Content-Length
+type lengthReader struct {
+	parser    *Parser
+	remaining int64
+}
+
+// Read implements io.Reader
+func (r *lengthReader) Read(b []byte) (int, error) {
+	if r.remaining <= 0 {
+		r.parser.bodyPending = false
+		return 0, io.EOF
+	}
+
+	if int64(len(b)) > r.remaining {
+		b = b[:r.remaining]
+	}
+	n, err := r.parser.reader.Read(b)
+	r.remaining -= int64(n)
+	if err == io.EOF && r.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// chunkedReader streams a body sent with chunked transfer coding
+type chunkedReader struct {
+	parser    *Parser
+	remaining int64
+	inChunk   bool
+	err       error
+}
+
+// Read implements io.Reader
+func (r *chunkedReader) Read(b []byte) (int, error) {
+	if !r.inChunk {
+		if err := r.nextChunk(); err != nil {
+			return 0, err
+		}
+	}
+
+	if int64(len(b)) > r.remaining {
+		b = b[:r.remaining]
+	}
+	n, err := r.parser.reader.Read(b)
+	r.remaining -= int64(n)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		r.err = r.parser.classify(KindBadChunk, err)
+		return n, r.err
+	}
+
+	if r.remaining == 0 {
+		r.inChunk = false
+		if err := r.readCRLF(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// nextChunk reads the next chunk size line, returning io.EOF after the last chunk and its trailer
+func (r *chunkedReader) nextChunk() error {
+	if r.err != nil {
+		return r.err
+	}
+
+	line, err := r.parser.readLine(MaxRequestLineSize)
+	if err != nil {
+		r.err = r.parser.classify(KindBadChunk, err)
+		return r.err
+	}
+
+	// Ignore chunk extensions
+	sizeStr, _, _ := strings.Cut(line, ";")
+	size, err := strconv.ParseInt(strings.TrimSpace(sizeStr), 16, 64)
+	if err != nil || size < 0 {
+		r.err = newParseError(KindBadChunk, fmt.Errorf("invalid chunk size: %q", line))
+		return r.err
+	}
+
+	if size > 0 {
+		r.remaining = size
+		r.inChunk = true
+		return nil
+	}
+
+	// Discard trailer fields up to the terminating empty line
+	for {
+		line, err := r.parser.readLine(MaxHeaderBytes)
+		if err != nil {
+			r.err = r.parser.classify(KindBadChunk, err)
+			return r.err
+		}
+		if line == "" {
+			r.parser.bodyPending = false
+			r.err = io.EOF
+			return r.err
+		}
+	}
+}
+
+// readCRLF consumes the CRLF that terminates chunk data
+func (r *chunkedReader) readCRLF() error {
+	var crlf [2]byte
+	if _, err := io.ReadFull(r.parser.reader, crlf[:]); err != nil {
+		r.err = r.parser.classify(KindBadChunk, err)
+		return r.err
+	}
+	if string(crlf[:]) != CRLF {
+		r.err = newParseError(KindBadChunk, errors.New("chunk not terminated by CRLF"))
+		return r.err
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package http
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// maxRequestIDLength bounds the X-Request-ID values taken from clients
+const maxRequestIDLength = 128
+
+// Context returns the context of the request, which carries its ID and is
+// cancelled once the client goes away or the request times out. It is never nil.
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// SetContext replaces the context of the request
+func (r *Request) SetContext(ctx context.Context) {
+	r.ctx = ctx
+}
+
+// requestIDKey and claimsKey are the context keys of request IDs and claims
+type (
+	requestIDKey struct{}
+	claimsKey    struct{}
+)
+
+// WithRequestID returns a copy of ctx carrying a request ID
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID ctx carries, or "" if none
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// NewRequestID returns the ID of a request: its X-Request-ID header, so a
+// request can be followed through the proxies in front of the server, or else
+// a random one
+func NewRequestID(r *Request) string {
+	if id := r.Header("X-Request-ID"); id != "" && len(id) <= maxRequestIDLength && printable(id) {
+		return id
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// printable reports whether s only has printable ASCII characters
+func printable(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < ' ' || s[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// Claims are what a request was authenticated as, such as the access key that signed it
+type Claims map[string]string
+
+// WithClaims returns a copy of ctx carrying the claims of an authenticated request
+func WithClaims(ctx context.Context, claims Claims) context.Context {
+	return context.WithValue(ctx, claimsKey{}, claims)
+}
+
+// ClaimsOf returns the claims ctx carries, or nil if the request was not authenticated
+func ClaimsOf(ctx context.Context) Claims {
+	claims, _ := ctx.Value(claimsKey{}).(Claims)
+	return claims
+}
+
+// RequestContext returns the context to handle a request in, derived from
+// parent: it carries the request's ID and, if timeout is positive, expires
+// once it passes. The returned function releases the context.
+func RequestContext(parent context.Context, r *Request, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx := WithRequestID(parent, NewRequestID(r))
+	if timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
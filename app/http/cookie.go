@@ -0,0 +1,92 @@
+package http
+
+import (
+	nethttp "net/http"
+	"strings"
+	"time"
+)
+
+// SameSite is the SameSite attribute of a cookie
+type SameSite string
+
+// SameSite attribute values
+const (
+	SameSiteLax    SameSite = "Lax"
+	SameSiteStrict SameSite = "Strict"
+	SameSiteNone   SameSite = "None"
+)
+
+// Cookie is a cookie sent by the client, or set by a response with its attributes
+type Cookie struct {
+	Name  string
+	Value string
+
+	Path    string
+	Domain  string
+	Expires time.Time
+	// MaxAge is the lifetime of the cookie in seconds; zero leaves it out and
+	// a negative value deletes the cookie
+	MaxAge   int
+	Secure   bool
+	HttpOnly bool
+	SameSite SameSite
+}
+
+// String formats the cookie as the value of a Set-Cookie header, leaving out
+// invalid attributes. It is empty if the name is invalid.
+func (c *Cookie) String() string {
+	cookie := &nethttp.Cookie{
+		Name:     c.Name,
+		Value:    c.Value,
+		Path:     c.Path,
+		Domain:   c.Domain,
+		Expires:  c.Expires,
+		MaxAge:   c.MaxAge,
+		Secure:   c.Secure,
+		HttpOnly: c.HttpOnly,
+	}
+	switch c.SameSite {
+	case SameSiteLax:
+		cookie.SameSite = nethttp.SameSiteLaxMode
+	case SameSiteStrict:
+		cookie.SameSite = nethttp.SameSiteStrictMode
+	case SameSiteNone:
+		cookie.SameSite = nethttp.SameSiteNoneMode
+	}
+	return cookie.String()
+}
+
+// Cookies returns the cookies of the request's Cookie header in the order
+// sent, skipping malformed ones
+func (r *Request) Cookies() []*Cookie {
+	var cookies []*Cookie
+	for _, pair := range strings.Split(r.Header("Cookie"), ";") {
+		parsed, err := nethttp.ParseCookie(pair)
+		if err != nil {
+			continue
+		}
+		for _, c := range parsed {
+			cookies = append(cookies, &Cookie{Name: c.Name, Value: c.Value})
+		}
+	}
+	return cookies
+}
+
+// Cookie returns the value of the first cookie of the request with the given
+// name, and whether there is one
+func (r *Request) Cookie(name string) (string, bool) {
+	for _, c := range r.Cookies() {
+		if c.Name == name {
+			return c.Value, true
+		}
+	}
+	return "", false
+}
+
+// SetCookie adds a Set-Cookie header for the cookie to the response written
+// next. Each cookie is sent as a header of its own; invalid ones are dropped.
+func (w *Writer) SetCookie(c *Cookie) {
+	if s := c.String(); s != "" {
+		w.cookies = append(w.cookies, s)
+	}
+}
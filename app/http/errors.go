@@ -0,0 +1,51 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+
+	"octo-server/app/metrics"
+)
+
+// ParseErrorKind classifies why a request could not be parsed
+type ParseErrorKind string
+
+const (
+	KindBadRequestLine ParseErrorKind = "bad_request_line"
+	KindBadHeader      ParseErrorKind = "bad_header"
+	KindOversized      ParseErrorKind = "oversized"
+	KindTimeout        ParseErrorKind = "timeout"
+	KindBadChunk       ParseErrorKind = "bad_chunk"
+	KindBadCoding      ParseErrorKind = "bad_coding"
+)
+
+// ParseError is returned by the parser when a request is malformed
+type ParseError struct {
+	Kind ParseErrorKind
+	Err  error
+}
+
+// Error implements the error interface
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Kind, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// ParseErrorKindOf returns the kind of a parse error, or an empty kind if err is not one
+func ParseErrorKindOf(err error) ParseErrorKind {
+	var parseErr *ParseError
+	if errors.As(err, &parseErr) {
+		return parseErr.Kind
+	}
+	return ""
+}
+
+// newParseError creates a classified parse error and counts it
+func newParseError(kind ParseErrorKind, err error) *ParseError {
+	metrics.Default.Inc("http_parse_errors_total", "kind", string(kind))
+	return &ParseError{Kind: kind, Err: err}
+}
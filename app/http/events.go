@@ -0,0 +1,115 @@
+package http
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventStreamKeepAlive is how often an idle event stream sends a comment,
+// keeping proxies from timing out the connection
+const EventStreamKeepAlive = 15 * time.Second
+
+// EventStream sends Server-Sent Events to a client
+type EventStream struct {
+	mu   sync.Mutex
+	body *ChunkedWriter
+	err  error
+	last time.Time
+	done chan struct{}
+}
+
+// EventStream starts a text/event-stream response. Events are written as soon
+// as they are sent, and a keep-alive comment is sent whenever the stream is
+// idle. The caller must Close the stream to end the response.
+func (w *Writer) EventStream() (*EventStream, error) {
+	body, err := w.WriteChunked(&Response{
+		StatusCode: StatusOK,
+		StatusText: StatusCodeToText(StatusOK),
+		Headers: Header{
+			"Content-Type":  {"text/event-stream"},
+			"Cache-Control": {"no-cache"},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s := &EventStream{body: body, last: time.Now(), done: make(chan struct{})}
+	go s.keepAlive()
+	return s, nil
+}
+
+// Send sends an event with the given type and data; an empty event type sends
+// an unnamed "message" event. Multi-line data is split into several data fields.
+// It returns an error once the client has gone away.
+func (s *EventStream) Send(event, data string) error {
+	var msg strings.Builder
+	if event != "" {
+		msg.WriteString("event: " + event + "\n")
+	}
+	for _, line := range strings.Split(data, "\n") {
+		msg.WriteString("data: " + line + "\n")
+	}
+	msg.WriteString("\n")
+
+	return s.write(msg.String(), 0)
+}
+
+// Done returns a channel closed when the stream is closed
+func (s *EventStream) Done() <-chan struct{} {
+	return s.done
+}
+
+// Close stops the keep-alive comments and ends the response
+func (s *EventStream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.done:
+		return s.err
+	default:
+	}
+	close(s.done)
+
+	if s.err != nil {
+		return s.err
+	}
+	return s.body.Close()
+}
+
+// write sends raw event stream text unless something was written within the
+// last idle duration, remembering the first write error
+func (s *EventStream) write(text string, idle time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+	if time.Since(s.last) < idle {
+		return nil
+	}
+	_, s.err = s.body.Write([]byte(text))
+	s.last = time.Now()
+	return s.err
+}
+
+// keepAlive sends a comment whenever the stream has been idle for EventStreamKeepAlive,
+// until it is closed
+func (s *EventStream) keepAlive() {
+	ticker := time.NewTicker(EventStreamKeepAlive / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if s.write(": keep-alive\n\n", EventStreamKeepAlive) != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package http
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Fingerprint identifies the client software a request came from by how it
+// speaks TLS and HTTP, so that abuse rules can single out client stacks
+// whatever addresses and User-Agent they use
+type Fingerprint struct {
+	// JA3 and JA4 fingerprint the TLS ClientHello of the connection; empty without TLS
+	JA3 string
+	JA4 string
+	// HeaderOrder fingerprints the order of the header names of the request;
+	// empty over HTTP/2 and HTTP/3, which do not keep it
+	HeaderOrder string
+}
+
+// Matches reports whether value is one of the fingerprints
+func (f Fingerprint) Matches(value string) bool {
+	return value != "" && (value == f.JA3 || value == f.JA4 || value == f.HeaderOrder)
+}
+
+// String formats the fingerprints for logs
+func (f Fingerprint) String() string {
+	return fmt.Sprintf("ja3=%s ja4=%s headers=%s", orDash(f.JA3), orDash(f.JA4), orDash(f.HeaderOrder))
+}
+
+// Fingerprint returns the fingerprints of the request and its connection
+func (r *Request) Fingerprint() Fingerprint {
+	fingerprint := r.tlsFingerprint
+	if len(r.headerOrder) > 0 {
+		fingerprint.HeaderOrder = headerOrderHash(r.headerOrder)
+	}
+	return fingerprint
+}
+
+// SetTLSFingerprint sets the JA3 and JA4 fingerprints of the TLS connection the request arrived on
+func (r *Request) SetTLSFingerprint(ja3, ja4 string) {
+	r.tlsFingerprint.JA3, r.tlsFingerprint.JA4 = ja3, ja4
+}
+
+// headerOrderHash returns the first 12 hex digits of the SHA-256 hash of the
+// header names in the order they were sent, lowercased and joined with commas
+func headerOrderHash(names []string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.Join(names, ","))))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// orDash returns s, or "-" if it is empty
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,114 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+// MaxFormSize is the maximum accepted size of an urlencoded form body
+const MaxFormSize = 10 << 20
+
+var (
+	// ErrFormTooLarge is returned for form bodies larger than MaxFormSize
+	ErrFormTooLarge = errors.New("form body too large")
+	// ErrFormCharset is returned for form bodies in a charset other than
+	// UTF-8, its ASCII subset or ISO-8859-1
+	ErrFormCharset = errors.New("unsupported form charset")
+)
+
+// form is the parsed body of an application/x-www-form-urlencoded request
+type form struct {
+	values url.Values
+	err    error
+}
+
+// Form returns the fields of an application/x-www-form-urlencoded request
+// body, reading it on the first call. Requests with another Content-Type or
+// without a body have no fields. The body is read up to its Content-Length,
+// and values are converted to UTF-8 from the charset parameter of the
+// Content-Type.
+func (r *Request) Form() (url.Values, error) {
+	if r.form == nil {
+		values, err := r.parseForm()
+		r.form = &form{values: values, err: err}
+	}
+	return r.form.values, r.form.err
+}
+
+// FormValue returns the first value of a field of the urlencoded request
+// body, or else of the query, or "" if neither has it or the body is invalid
+func (r *Request) FormValue(key string) string {
+	if values, err := r.Form(); err == nil {
+		if vs, ok := values[key]; ok && len(vs) > 0 {
+			return vs[0]
+		}
+	}
+	return r.Query(key)
+}
+
+// parseForm reads and decodes the urlencoded request body
+func (r *Request) parseForm() (url.Values, error) {
+	values := url.Values{}
+	mediaType, params, err := mime.ParseMediaType(r.Header("Content-Type"))
+	if err != nil || mediaType != "application/x-www-form-urlencoded" || !r.HasBody() {
+		return values, nil
+	}
+	charset := strings.ToLower(params["charset"])
+	switch charset {
+	case "", "utf-8", "us-ascii", "iso-8859-1":
+	default:
+		return values, fmt.Errorf("%w: %s", ErrFormCharset, charset)
+	}
+	if r.ContentLength() > MaxFormSize {
+		return values, ErrFormTooLarge
+	}
+
+	body, err := r.BodyReader()
+	if err != nil {
+		return values, err
+	}
+	data, err := io.ReadAll(io.LimitReader(body, MaxFormSize+1))
+	if err != nil {
+		return values, fmt.Errorf("failed to read form: %w", err)
+	}
+	if len(data) > MaxFormSize {
+		return values, ErrFormTooLarge
+	}
+
+	parsed, err := url.ParseQuery(string(data))
+	if err != nil {
+		return values, fmt.Errorf("invalid form: %w", err)
+	}
+	for key, vs := range parsed {
+		if key, err = formText(key, charset); err != nil {
+			return values, err
+		}
+		for _, v := range vs {
+			if v, err = formText(v, charset); err != nil {
+				return values, err
+			}
+			values.Add(key, v)
+		}
+	}
+	return values, nil
+}
+
+// formText converts a decoded form key or value from charset to UTF-8
+func formText(s, charset string) (string, error) {
+	if charset != "iso-8859-1" {
+		if !utf8.ValidString(s) {
+			return "", errors.New("invalid form: not valid UTF-8")
+		}
+		return s, nil
+	}
+	runes := make([]rune, len(s))
+	for i := 0; i < len(s); i++ {
+		runes[i] = rune(s[i])
+	}
+	return string(runes), nil
+}
@@ -0,0 +1,79 @@
+package http
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+
+	"octo-server/app/ipfilter"
+)
+
+// TrustProxies makes ClientIP report the client a trusted proxy forwarded the
+// request for. When the peer of the connection is in trusted, the addresses in
+// the Forwarded header, or else X-Forwarded-For, are walked from the nearest
+// hop back, and the first one not in trusted is the client. A hop that is
+// "unknown" or obfuscated ends the walk at the proxy that reported it.
+// Requests from other peers keep the peer as the client, whatever they claim.
+func (r *Request) TrustProxies(trusted ipfilter.CIDRList) {
+	r.clientIP = ""
+	ip := r.PeerIP()
+	if !trusted.Contains(ip) {
+		return
+	}
+
+	hops := forwardedFor(r.Header("Forwarded"))
+	if hops == nil {
+		hops = xForwardedFor(r.Header("X-Forwarded-For"))
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if hops[i] == "" {
+			break
+		}
+		ip = hops[i]
+		if !trusted.Contains(ip) {
+			break
+		}
+	}
+	r.clientIP = ip
+}
+
+// forwardedFor returns the for= nodes of a Forwarded header (RFC 7239) as IP
+// addresses, empty for nodes without one, or nil if the header has none
+func forwardedFor(header string) []string {
+	var hops []string
+	for _, element := range strings.Split(header, ",") {
+		for _, pair := range strings.Split(element, ";") {
+			key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if ok && strings.EqualFold(key, "for") {
+				hops = append(hops, nodeIP(strings.Trim(value, `"`)))
+			}
+		}
+	}
+	return hops
+}
+
+// xForwardedFor returns the addresses of an X-Forwarded-For header, empty for
+// entries that are not addresses, or nil if the header is empty
+func xForwardedFor(header string) []string {
+	if strings.TrimSpace(header) == "" {
+		return nil
+	}
+	var hops []string
+	for _, entry := range strings.Split(header, ",") {
+		hops = append(hops, nodeIP(strings.TrimSpace(entry)))
+	}
+	return hops
+}
+
+// nodeIP returns the IP address of a node such as 192.0.2.1, 192.0.2.1:80,
+// [2001:db8::1]:80 or 2001:db8::1, or "" if it has none
+func nodeIP(node string) string {
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		node = host
+	}
+	addr, err := netip.ParseAddr(strings.Trim(node, "[]"))
+	if err != nil {
+		return ""
+	}
+	return addr.Unmap().String()
+}
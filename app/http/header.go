@@ -0,0 +1,106 @@
+package http
+
+import (
+	"maps"
+	"net/textproto"
+	"slices"
+	"strings"
+)
+
+// Header holds the fields of a request or response head by their canonical
+// names, e.g. "Content-Type" for "content-type", with every value of a field
+// given more than once, such as Set-Cookie. Its methods canonicalize the names
+// they are given, so keys set directly must be canonical.
+type Header map[string][]string
+
+// CanonicalHeaderKey returns the canonical form of a header name, e.g.
+// "Content-Length" for "content-length"
+func CanonicalHeaderKey(name string) string {
+	return textproto.CanonicalMIMEHeaderKey(name)
+}
+
+// Get returns the first value of a field, or "" if it is absent
+func (h Header) Get(name string) string {
+	if values := h[CanonicalHeaderKey(name)]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// Values returns every value of a field, in the order given
+func (h Header) Values(name string) []string {
+	return h[CanonicalHeaderKey(name)]
+}
+
+// Join returns the values of a field joined with commas, as fields defined as
+// lists, such as Accept, may be sent in one line or several
+func (h Header) Join(name string) string {
+	return strings.Join(h[CanonicalHeaderKey(name)], ", ")
+}
+
+// Has reports whether a field is present, even if empty
+func (h Header) Has(name string) bool {
+	_, ok := h[CanonicalHeaderKey(name)]
+	return ok
+}
+
+// Set replaces the values of a field with value
+func (h Header) Set(name, value string) {
+	h[CanonicalHeaderKey(name)] = []string{value}
+}
+
+// Add adds a value to a field, after those it has
+func (h Header) Add(name, value string) {
+	key := CanonicalHeaderKey(name)
+	h[key] = append(h[key], value)
+}
+
+// Del removes a field
+func (h Header) Del(name string) {
+	delete(h, CanonicalHeaderKey(name))
+}
+
+// DelHopByHop removes the connection-specific fields, those of HopByHopHeaders
+// and those named in the Connection field (RFC 9110, section 7.6.1)
+func (h Header) DelHopByHop() {
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, key := range HopByHopHeaders {
+		h.Del(key)
+	}
+}
+
+// Clone returns a copy of the header that can be changed independently
+func (h Header) Clone() Header {
+	if h == nil {
+		return nil
+	}
+	clone := make(Header, len(h))
+	for key, values := range h {
+		clone[key] = slices.Clone(values)
+	}
+	return clone
+}
+
+// lineBreaks replaces line breaks in values, which would otherwise start new
+// header lines
+var lineBreaks = strings.NewReplacer("\r", " ", "\n", " ")
+
+// appendTo appends the fields to b as header lines, one per value, ordered by
+// name so that the same header is always written the same way
+func (h Header) appendTo(b []byte) []byte {
+	for _, key := range slices.Sorted(maps.Keys(h)) {
+		for _, value := range h[key] {
+			b = append(b, key...)
+			b = append(b, ": "...)
+			b = append(b, lineBreaks.Replace(value)...)
+			b = append(b, CRLF...)
+		}
+	}
+	return b
+}
@@ -0,0 +1,107 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+)
+
+// MaxJSONSize is the maximum accepted size of a JSON request body
+const MaxJSONSize = 1 << 20
+
+// BindError is why a request body could not be bound by BindJSON, with the
+// status to answer it with
+type BindError struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+	// Field is the dotted path of the offending field, if the error is about one
+	Field string `json:"field,omitempty"`
+}
+
+// Error implements error
+func (e *BindError) Error() string {
+	if e.Field != "" {
+		return fmt.Sprintf("%s: %s", e.Field, e.Message)
+	}
+	return e.Message
+}
+
+// Validator is implemented by request types checking their own fields once
+// bound. Errors that are a *BindError keep their field and status, such as
+// 422 for a missing field; any other error is answered with 400 and its message.
+type Validator interface {
+	Validate() error
+}
+
+// BindJSON decodes an application/json request body into v, which must be a
+// pointer, and validates it if it is a Validator. Fields unknown to v, bodies
+// over MaxJSONSize and anything after the JSON value are rejected. Errors are
+// a *BindError.
+func (r *Request) BindJSON(v any) error {
+	mediaType, _, err := mime.ParseMediaType(r.Header("Content-Type"))
+	if err != nil || (mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json")) {
+		return &BindError{Status: 415, Message: "Content-Type must be application/json"}
+	}
+	if r.ContentLength() > MaxJSONSize {
+		return &BindError{Status: 413, Message: fmt.Sprintf("body exceeds %d bytes", MaxJSONSize)}
+	}
+
+	body, err := r.BodyReader()
+	if err != nil {
+		return &BindError{Status: 400, Message: err.Error()}
+	}
+	data, err := io.ReadAll(io.LimitReader(body, MaxJSONSize+1))
+	if err != nil {
+		return &BindError{Status: 400, Message: fmt.Sprintf("failed to read body: %v", err)}
+	}
+	if len(data) > MaxJSONSize {
+		return &BindError{Status: 413, Message: fmt.Sprintf("body exceeds %d bytes", MaxJSONSize)}
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return &BindError{Status: 400, Message: "body is empty"}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return decodeError(err)
+	}
+	if decoder.More() {
+		return &BindError{Status: 400, Message: fmt.Sprintf("unexpected data after the JSON value at offset %d", decoder.InputOffset())}
+	}
+
+	if validator, ok := v.(Validator); ok {
+		if err := validator.Validate(); err != nil {
+			var bindErr *BindError
+			if errors.As(err, &bindErr) {
+				return bindErr
+			}
+			return &BindError{Status: 400, Message: err.Error()}
+		}
+	}
+	return nil
+}
+
+// decodeError describes an error of json.Decoder.Decode for the client
+func decodeError(err error) *BindError {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		return &BindError{Status: 400, Message: fmt.Sprintf("malformed JSON at offset %d: %v", syntaxErr.Offset, syntaxErr)}
+	case errors.As(err, &typeErr):
+		return &BindError{Status: 400, Field: typeErr.Field, Message: fmt.Sprintf("expected %s, got JSON %s", typeErr.Type, typeErr.Value)}
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return &BindError{Status: 400, Message: "malformed JSON: unexpected end of body"}
+	}
+
+	// Unknown fields are reported as `json: unknown field "name"`
+	if name, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		return &BindError{Status: 400, Field: strings.Trim(name, `"`), Message: "unknown field"}
+	}
+	return &BindError{Status: 400, Message: strings.TrimPrefix(err.Error(), "json: ")}
+}
@@ -0,0 +1,67 @@
+package http
+
+import (
+	"mime"
+	"strings"
+)
+
+// Negotiate returns the offered media type the request's Accept header
+// prefers, e.g. Negotiate("text/html", "application/json"), or "" if it
+// accepts none of them. Each offer takes the q weight of the most specific
+// range matching it, so "text/*;q=0.5, text/html" prefers text/html over
+// text/plain; ties go to the earlier offer. Without an Accept header, the
+// first offer is returned. A response chosen this way should vary on Accept.
+func (r *Request) Negotiate(offers ...string) string {
+	accept := r.Header("Accept")
+	if strings.TrimSpace(accept) == "" {
+		if len(offers) == 0 {
+			return ""
+		}
+		return offers[0]
+	}
+	ranges := ParseQualityList(accept)
+
+	best, bestQuality := "", 0.0
+	for _, offer := range offers {
+		if q := offerQuality(ranges, offer); q > bestQuality {
+			best, bestQuality = offer, q
+		}
+	}
+	return best
+}
+
+// offerQuality returns the weight of the most specific media range matching
+// an offered media type, or 0 if none does
+func offerQuality(ranges []QualityValue, offer string) float64 {
+	mediaType, params, err := mime.ParseMediaType(offer)
+	if err != nil {
+		return 0
+	}
+	typ, subtype, _ := strings.Cut(mediaType, "/")
+
+	quality, specificity := 0.0, -1
+	for _, rng := range ranges {
+		rangeType, rangeSubtype, _ := strings.Cut(rng.Value, "/")
+		var s int
+		switch {
+		case rangeType == "*" && (rangeSubtype == "*" || rangeSubtype == ""):
+			s = 0
+		case rangeType == typ && rangeSubtype == "*":
+			s = 1
+		case rangeType == typ && rangeSubtype == subtype:
+			// Parameters narrow a range down further, and must all match the offer's
+			s = 2 + len(rng.Params)
+			for key, value := range rng.Params {
+				if !strings.EqualFold(params[key], value) {
+					s = -1
+				}
+			}
+		default:
+			s = -1
+		}
+		if s > specificity {
+			quality, specificity = rng.Quality, s
+		}
+	}
+	return quality
+}
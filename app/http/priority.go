@@ -0,0 +1,47 @@
+package http
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Priority is the urgency and incremental flag a client gives a request in its
+// Priority header (RFC 9218)
+type Priority struct {
+	// Urgency ranges from 0, the most urgent, to 7
+	Urgency int
+	// Incremental responses are useful to the client before they are complete
+	Incremental bool
+}
+
+// DefaultPriority is the priority of a request without a Priority header
+var DefaultPriority = Priority{Urgency: 3}
+
+// ParsePriority parses a Priority header such as "u=1, i". Members that are
+// unknown or malformed, including urgencies out of range, keep their defaults.
+func ParsePriority(header string) Priority {
+	p := DefaultPriority
+	for _, member := range strings.Split(header, ",") {
+		member, _, _ = strings.Cut(member, ";")
+		key, value, hasValue := strings.Cut(strings.TrimSpace(member), "=")
+		switch key {
+		case "u":
+			if urgency, err := strconv.Atoi(value); err == nil && urgency >= 0 && urgency <= 7 && !strings.HasPrefix(value, "+") {
+				p.Urgency = urgency
+			}
+		case "i":
+			switch {
+			case !hasValue || value == "?1":
+				p.Incremental = true
+			case value == "?0":
+				p.Incremental = false
+			}
+		}
+	}
+	return p
+}
+
+// Priority returns the priority the client gave the request
+func (r *Request) Priority() Priority {
+	return ParsePriority(r.Header("Priority"))
+}
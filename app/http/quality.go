@@ -0,0 +1,55 @@
+package http
+
+import (
+	"strconv"
+	"strings"
+)
+
+// QualityValue is one element of a weighted list header such as Accept-Encoding
+type QualityValue struct {
+	Value   string
+	Params  map[string]string
+	Quality float64
+}
+
+// ParseQualityList parses a comma-separated list of values with optional
+// parameters and q weights, e.g. "gzip;q=0.8, br, *;q=0". Values are lower-cased,
+// the quality defaults to 1, and elements with a malformed weight are skipped.
+func ParseQualityList(header string) []QualityValue {
+	var list []QualityValue
+	for _, element := range strings.Split(header, ",") {
+		parts := strings.Split(element, ";")
+		value := strings.ToLower(strings.TrimSpace(parts[0]))
+		if value == "" {
+			continue
+		}
+
+		qv := QualityValue{Value: value, Quality: 1}
+		valid := true
+		for _, param := range parts[1:] {
+			key, val, _ := strings.Cut(param, "=")
+			key = strings.ToLower(strings.TrimSpace(key))
+			val = strings.Trim(strings.TrimSpace(val), `"`)
+
+			if key != "q" {
+				if qv.Params == nil {
+					qv.Params = make(map[string]string)
+				}
+				qv.Params[key] = val
+				continue
+			}
+
+			q, err := strconv.ParseFloat(val, 64)
+			if err != nil || q < 0 || q > 1 {
+				valid = false
+				break
+			}
+			qv.Quality = q
+		}
+
+		if valid {
+			list = append(list, qv)
+		}
+	}
+	return list
+}
@@ -0,0 +1,113 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrRangeNotSatisfiable is returned for a byte range lying entirely past the end of the representation
+var ErrRangeNotSatisfiable = errors.New("range not satisfiable")
+
+// ByteRange is an inclusive range of byte offsets into a representation
+type ByteRange struct {
+	Start int64
+	End   int64
+}
+
+// Length returns the number of bytes in the range
+func (r ByteRange) Length() int64 {
+	return r.End - r.Start + 1
+}
+
+// ContentRange formats the range as a Content-Range header value for a representation of size bytes
+func (r ByteRange) ContentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.Start, r.End, size)
+}
+
+// String formats the range as "START-END"
+func (r ByteRange) String() string {
+	return fmt.Sprintf("%d-%d", r.Start, r.End)
+}
+
+// ParseRange parses a Range header such as "bytes=0-499", "bytes=500-" or
+// "bytes=-500" against a representation of size bytes. It reports false when
+// the header should be ignored and the full representation served: a missing,
+// malformed or multi-range header, or a unit other than bytes.
+// ErrRangeNotSatisfiable is returned when the range starts past the end.
+func ParseRange(header string, size int64) (ByteRange, bool, error) {
+	spec, ok := strings.CutPrefix(strings.TrimSpace(header), "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return ByteRange{}, false, nil
+	}
+
+	startStr, endStr, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return ByteRange{}, false, nil
+	}
+
+	// A suffix range selects the last N bytes
+	if startStr == "" {
+		n, err := strconv.ParseInt(endStr, 10, 64)
+		if err != nil || n < 0 {
+			return ByteRange{}, false, nil
+		}
+		if n == 0 || size == 0 {
+			return ByteRange{}, true, ErrRangeNotSatisfiable
+		}
+		return ByteRange{Start: max(size-n, 0), End: size - 1}, true, nil
+	}
+
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil || start < 0 {
+		return ByteRange{}, false, nil
+	}
+
+	end := size - 1
+	if endStr != "" {
+		end, err = strconv.ParseInt(endStr, 10, 64)
+		if err != nil || end < start {
+			return ByteRange{}, false, nil
+		}
+		end = min(end, size-1)
+	}
+
+	if start >= size {
+		return ByteRange{}, true, ErrRangeNotSatisfiable
+	}
+	return ByteRange{Start: start, End: end}, true, nil
+}
+
+// ParseContentRange parses the Content-Range header of a request body, such as
+// "bytes 500-999/*" or "bytes 500-999/2000", returning the range the body covers.
+// The complete length, if given, must lie past the end of the range.
+func ParseContentRange(header string) (ByteRange, error) {
+	spec, ok := strings.CutPrefix(strings.TrimSpace(header), "bytes ")
+	if !ok {
+		return ByteRange{}, fmt.Errorf("invalid content range %q", header)
+	}
+	rangeStr, total, ok := strings.Cut(strings.TrimSpace(spec), "/")
+	if !ok {
+		return ByteRange{}, fmt.Errorf("invalid content range %q", header)
+	}
+	startStr, endStr, ok := strings.Cut(rangeStr, "-")
+	if !ok {
+		return ByteRange{}, fmt.Errorf("invalid content range %q", header)
+	}
+
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil || start < 0 {
+		return ByteRange{}, fmt.Errorf("invalid content range %q", header)
+	}
+	end, err := strconv.ParseInt(endStr, 10, 64)
+	if err != nil || end < start {
+		return ByteRange{}, fmt.Errorf("invalid content range %q", header)
+	}
+	if total != "*" {
+		if n, err := strconv.ParseInt(total, 10, 64); err != nil || n <= end {
+			return ByteRange{}, fmt.Errorf("invalid content range %q", header)
+		}
+	}
+	return ByteRange{Start: start, End: end}, nil
+}
@@ -3,17 +3,49 @@ package http
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"octo-server/app/clock"
+	"octo-server/app/memory"
 )
 
 const (
 	CRLF = "\r\n"
+
+	// MaxRequestLineSize is the maximum accepted length of the request line
+	MaxRequestLineSize = 8 * 1024
+	// MaxHeaderBytes is the maximum accepted total size of the request headers
+	MaxHeaderBytes = 64 * 1024
+	// ReadBufferSize is the size of the per-connection read buffer
+	ReadBufferSize = 4096
+	// MaxReadBodySize is the largest body ReadBody holds in memory; larger
+	// bodies must be streamed with BodyReader
+	MaxReadBodySize = 10 * 1024 * 1024
+
+	readTimeout = time.Second
+)
+
+// TargetForm is the form of a request target (RFC 9112, section 3.2)
+type TargetForm string
+
+const (
+	// OriginForm is a path and query, such as /files/a.txt?v=2
+	OriginForm TargetForm = "origin"
+	// AbsoluteForm is a whole URL, such as http://example.com/files/a.txt, sent to proxies
+	AbsoluteForm TargetForm = "absolute"
+	// AuthorityForm is a host and port, such as example.com:443, sent with CONNECT
+	AuthorityForm TargetForm = "authority"
+	// AsteriskForm is "*", sent with OPTIONS to ask about the server as a whole
+	AsteriskForm TargetForm = "asterisk"
 )
 
 // Request represents an HTTP request
@@ -21,23 +53,204 @@ type Request struct {
 	Method        string
 	RequestTarget string
 	Version       string
-	Headers       map[string]string
+	Headers       Header
+	RemoteAddr    string
+
+	// TargetForm is the form the request target was sent in. A target in
+	// absolute form is reduced to origin form once parsed, with its host moved
+	// to the Host header and its scheme, such as "http", kept in Scheme, which
+	// is empty for the other forms.
+	TargetForm TargetForm
+	Scheme     string
+
+	clientIP    string
+	query       url.Values
+	queryTarget string
+	params      map[string]string
+	form        *form
+	parser      *Parser
+	body        io.Reader
+
+	// headerOrder are the header names in the order the client sent them
+	headerOrder    []string
+	tlsFingerprint Fingerprint
+
+	ctx context.Context
+}
+
+// NewRequest creates a request whose body, if any, is read from body rather
+// than from a connection, e.g. for requests arriving on an HTTP/2 stream
+func NewRequest(method, target, version string, headers Header, remoteAddr string, body io.Reader) *Request {
+	form, _ := targetForm(method, target)
+	return &Request{
+		Method:        method,
+		RequestTarget: target,
+		TargetForm:    form,
+		Version:       version,
+		Headers:       headers,
+		RemoteAddr:    remoteAddr,
+		body:          body,
+	}
+}
+
+// Header returns the value of a header, whatever the case of its name. The
+// values of a header sent more than once are joined with commas, as headers
+// defined as lists, such as Accept, may be split over several lines.
+func (r *Request) Header(name string) string {
+	return r.Headers.Join(name)
+}
+
+// ReadBody reads the whole request body from the connection the request arrived on
+func (r *Request) ReadBody() ([]byte, error) {
+	if r.body != nil {
+		return io.ReadAll(r.body)
+	}
+	if r.parser == nil {
+		return nil, errors.New("request has no connection to read a body from")
+	}
+	return r.parser.ReadBody(r)
+}
+
+// ClientIP returns the IP address of the client that sent the request: the
+// peer of the connection, or the client a trusted proxy forwarded it for
+func (r *Request) ClientIP() string {
+	if r.clientIP != "" {
+		return r.clientIP
+	}
+	return r.PeerIP()
+}
+
+// PeerIP returns the IP address of the peer of the connection the request arrived on
+func (r *Request) PeerIP() string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Path returns the path of the request target, without its query
+func (r *Request) Path() string {
+	path, _, _ := strings.Cut(r.RequestTarget, "?")
+	return path
+}
+
+// RawQuery returns the query of the request target, without the "?"
+func (r *Request) RawQuery() string {
+	_, query, _ := strings.Cut(r.RequestTarget, "?")
+	return query
+}
+
+// QueryValues returns the parameters of the query of the request target,
+// skipping malformed ones. The query is parsed once, and again only if the
+// target has been rewritten since.
+func (r *Request) QueryValues() url.Values {
+	if r.query == nil || r.queryTarget != r.RequestTarget {
+		r.query, _ = url.ParseQuery(r.RawQuery())
+		r.queryTarget = r.RequestTarget
+	}
+	return r.query
+}
+
+// Query returns the first value of a query parameter, or "" if it is absent
+func (r *Request) Query(key string) string {
+	return r.QueryValues().Get(key)
+}
+
+// Param returns the path parameter of the route the request matched, such as
+// "filename" for /files/{filename}, or "" if the route has no such parameter
+func (r *Request) Param(name string) string {
+	return r.params[name]
+}
+
+// SetParams sets the path parameters of the route the request matched
+func (r *Request) SetParams(params map[string]string) {
+	r.params = params
 }
 
 // Parser handles parsing of HTTP requests
 type Parser struct {
-	conn net.Conn
+	conn   net.Conn
+	reader *bufio.Reader
+	clock  clock.Clock
+
+	account     *memory.Account
+	bodyHeld    int64
+	bodyPending bool
+
+	// continuePending is set while the client of the last request parsed
+	// waits for 100 Continue before sending its body
+	continuePending bool
 }
 
-// NewParser creates a new request parser for a connection
+// NewParser creates a new request parser for a connection.
+// A single parser must be used for the lifetime of the connection, since it
+// buffers bytes that belong to subsequent requests.
 func NewParser(conn net.Conn) *Parser {
-	return &Parser{conn: conn}
+	return NewParserSize(conn, ReadBufferSize)
+}
+
+// NewParserSize creates a new request parser for a connection with a read
+// buffer of the given size, which bounds how much is read ahead per system call
+func NewParserSize(conn net.Conn, size int) *Parser {
+	return &Parser{
+		conn:   conn,
+		reader: bufio.NewReaderSize(conn, size),
+		clock:  clock.Real,
+	}
+}
+
+// SetClock sets the clock the read timeout is measured on
+func (p *Parser) SetClock(c clock.Clock) {
+	p.clock = c
+}
+
+// SetMemoryAccount makes the parser account request bodies it reads against
+// the connection's memory account, refusing bodies that exceed the budget
+func (p *Parser) SetMemoryAccount(account *memory.Account) {
+	p.account = account
+}
+
+// BodyPending reports whether the last request parsed has a body that was not read.
+// The connection cannot be reused for another request in that case.
+func (p *Parser) BodyPending() bool {
+	return p.bodyPending
+}
+
+// WatchClose calls onClose if the client closes the connection or it fails
+// while the last request parsed is handled, by reading ahead on the connection.
+// Nothing is watched while the request has a body pending, nor once the next
+// request has arrived. The returned function stops watching, and must be
+// called before the next request is parsed.
+func (p *Parser) WatchClose(onClose func()) (stop func()) {
+	if p.bodyPending || p.reader.Buffered() > 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// Bytes read ahead stay buffered for the next request
+		if _, err := p.reader.Peek(1); err != nil && !isTimeout(err) {
+			onClose()
+		}
+	}()
+	return func() {
+		p.conn.SetReadDeadline(time.Unix(1, 0))
+		<-done
+		p.conn.SetReadDeadline(time.Time{})
+	}
 }
 
-// ParseRequest parses a complete HTTP request from the connection
+// ParseRequest parses a complete HTTP request from the connection.
+// It returns io.EOF if the connection was closed or went idle before a new request started.
 func (p *Parser) ParseRequest() (*Request, error) {
+	p.releaseBody()
+
 	req := &Request{
-		Headers: make(map[string]string),
+		Headers:    make(Header),
+		RemoteAddr: p.conn.RemoteAddr().String(),
+		parser:     p,
 	}
 
 	// Parse request line
@@ -50,55 +263,198 @@ func (p *Parser) ParseRequest() (*Request, error) {
 		return nil, err
 	}
 
+	if err := resolveHost(req); err != nil {
+		return nil, err
+	}
+	if err := checkFraming(req); err != nil {
+		return nil, err
+	}
+
+	p.bodyPending = req.Header("Transfer-Encoding") != "" ||
+		(req.Header("Content-Length") != "" && req.Header("Content-Length") != "0")
+	p.continuePending = p.bodyPending && req.Version == "HTTP/1.1" &&
+		strings.EqualFold(strings.TrimSpace(req.Header("Expect")), "100-continue")
+
 	return req, nil
 }
 
-// ReadBody reads the request body based on Content-Length header
-func (p *Parser) ReadBody(req *Request) ([]byte, error) {
-	contentLengthStr, ok := req.Headers["Content-Length"]
-	if !ok {
-		return nil, errors.New("header 'Content-Length' is missing")
+// sendContinue sends the interim 100 Continue the client of the last request
+// waits for before sending its body, once it is about to be read. Requests
+// answered without reading their body never get one, so their clients do not
+// send bodies that would be thrown away (RFC 9110, section 10.1.1).
+func (p *Parser) sendContinue() error {
+	if !p.continuePending {
+		return nil
 	}
-
-	contentLength, err := strconv.Atoi(contentLengthStr)
-	if err != nil {
-		return nil, fmt.Errorf("invalid Content-Length: %w", err)
-	}
-
-	data := make([]byte, contentLength)
-	if _, err := p.conn.Read(data); err != nil && err != io.EOF {
-		return nil, fmt.Errorf("failed to read body: %w", err)
+	p.continuePending = false
+	if _, err := io.WriteString(p.conn, "HTTP/1.1 100 Continue"+CRLF+CRLF); err != nil {
+		return fmt.Errorf("failed to send 100 Continue: %w", err)
 	}
-
-	return data, nil
+	return nil
 }
 
 // parseRequestLine parses the HTTP request line (method, target, version)
 func (p *Parser) parseRequestLine(req *Request) error {
-	line, err := p.readUntilCRLF()
+	line, err := p.readLine(MaxRequestLineSize)
 	if err != nil {
-		return fmt.Errorf("failed to read request line: %w", err)
+		// Nothing received yet, so the client simply closed or idled out between requests
+		if errors.Is(err, io.EOF) || (isTimeout(err) && p.reader.Buffered() == 0 && line == "") {
+			return io.EOF
+		}
+		return p.classify(KindBadRequestLine, fmt.Errorf("failed to read request line: %w", err))
 	}
 
 	tokens := strings.Split(line, " ")
 	if len(tokens) != 3 {
-		return fmt.Errorf("invalid request line: expected 3 tokens, got %d", len(tokens))
+		return newParseError(KindBadRequestLine, fmt.Errorf("invalid request line: expected 3 tokens, got %d", len(tokens)))
 	}
 
 	req.Method = tokens[0]
 	req.RequestTarget = tokens[1]
 	req.Version = tokens[2]
+	if !isHTTPVersion(req.Version) {
+		return newParseError(KindBadRequestLine, fmt.Errorf("invalid HTTP version %q", req.Version))
+	}
 
+	req.TargetForm, err = targetForm(req.Method, req.RequestTarget)
+	if err != nil {
+		return newParseError(KindBadRequestLine, err)
+	}
+	return nil
+}
+
+// targetForm returns the form of a request target, or an error if it is in
+// none of the forms allowed for the method
+func targetForm(method, target string) (TargetForm, error) {
+	switch {
+	case method == "CONNECT":
+		// CONNECT names the host and port to tunnel to instead of a path (RFC 9110, section 9.3.6)
+		if !IsAuthorityForm(target) {
+			return "", fmt.Errorf("invalid CONNECT target %q: expected host:port", target)
+		}
+		return AuthorityForm, nil
+	case strings.HasPrefix(target, "/"):
+		return OriginForm, nil
+	case target == "*":
+		// PRI * starts the HTTP/2 connection preface, read as a request
+		if method != "OPTIONS" && method != "PRI" {
+			return "", fmt.Errorf("invalid target * for %s", method)
+		}
+		return AsteriskForm, nil
+	}
+	scheme, _, ok := strings.Cut(target, "://")
+	if !ok || !(strings.EqualFold(scheme, "http") || strings.EqualFold(scheme, "https")) {
+		return "", fmt.Errorf("invalid request target %q", target)
+	}
+	return AbsoluteForm, nil
+}
+
+// isHTTPVersion reports whether a protocol version is well formed, such as
+// HTTP/1.1, whether or not it is supported (RFC 9112, section 2.3)
+func isHTTPVersion(version string) bool {
+	digits, ok := strings.CutPrefix(version, "HTTP/")
+	return ok && len(digits) == 3 && digits[1] == '.' &&
+		'0' <= digits[0] && digits[0] <= '9' && '0' <= digits[2] && digits[2] <= '9'
+}
+
+// isToken reports whether s is a non-empty token, as header field names
+// must be (RFC 9110, section 5.6.2)
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte("\"(),/:;<=>?@[\\]{}", c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// IsAuthorityForm reports whether a request target is in authority form, i.e. host:port
+func IsAuthorityForm(target string) bool {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil || host == "" || strings.ContainsAny(host, "/?#@") {
+		return false
+	}
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n <= 65535
+}
+
+// resolveHost settles which host a request is for. HTTP/1.1 requests must
+// carry exactly one valid Host header (RFC 9112, section 3.2), which a target
+// in absolute form, as sent to proxies, overrides with the host it names
+// before being reduced to origin form (RFC 9112, section 3.2.2).
+func resolveHost(req *Request) error {
+	hosts := req.Headers.Values("Host")
+	switch {
+	case len(hosts) > 1:
+		return newParseError(KindBadHeader, fmt.Errorf("multiple Host headers %q", hosts))
+	case len(hosts) == 1 && !isValidHost(hosts[0]):
+		return newParseError(KindBadHeader, fmt.Errorf("invalid Host header %q", hosts[0]))
+	case len(hosts) == 0 && req.Version == "HTTP/1.1":
+		return newParseError(KindBadHeader, errors.New("missing Host header"))
+	}
+
+	if req.TargetForm == AbsoluteForm {
+		u, err := url.Parse(req.RequestTarget)
+		if err != nil || u.Host == "" || !isValidHost(u.Host) {
+			return newParseError(KindBadRequestLine, fmt.Errorf("invalid absolute request target %q", req.RequestTarget))
+		}
+		req.Scheme = strings.ToLower(u.Scheme)
+		req.Headers.Set("Host", u.Host)
+		req.RequestTarget = u.RequestURI()
+	}
 	return nil
 }
 
+// isValidHost reports whether a Host header is a host with an optional port,
+// or empty for targets without one (RFC 9110, section 7.2)
+func isValidHost(host string) bool {
+	if strings.ContainsFunc(host, func(r rune) bool {
+		return r <= ' ' || r == 0x7f || strings.ContainsRune("/?#@\\", r)
+	}) {
+		return false
+	}
+	port := ""
+	if strings.HasPrefix(host, "[") {
+		// An IPv6 literal, whose colons are not a port separator
+		end := strings.IndexByte(host, ']')
+		if end < 0 {
+			return false
+		}
+		if rest := host[end+1:]; rest != "" {
+			var ok bool
+			if port, ok = strings.CutPrefix(rest, ":"); !ok {
+				return false
+			}
+		}
+	} else {
+		_, port, _ = strings.Cut(host, ":")
+	}
+	return strings.Trim(port, "0123456789") == ""
+}
+
+// Host returns the name of the host a request is for, from its Host header,
+// lowercased and without port, or "" if the request names none
+func (r *Request) Host() string {
+	host := r.Header("Host")
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	return strings.TrimSuffix(strings.ToLower(strings.Trim(host, "[]")), ".")
+}
+
 // parseHeaders parses HTTP headers until an empty line
 func (p *Parser) parseHeaders(req *Request) error {
+	remaining := MaxHeaderBytes
 	for {
-		line, err := p.readUntilCRLF()
+		line, err := p.readLine(remaining)
 		if err != nil {
-			return fmt.Errorf("failed to read header: %w", err)
+			return p.classify(KindBadHeader, fmt.Errorf("failed to read header: %w", err))
 		}
+		remaining -= len(line) + len(CRLF)
 
 		if line == "" {
 			break
@@ -106,42 +462,159 @@ func (p *Parser) parseHeaders(req *Request) error {
 
 		parts := strings.SplitN(line, ":", 2)
 		if len(parts) != 2 {
-			return fmt.Errorf("invalid header format: %s", line)
+			return newParseError(KindBadHeader, fmt.Errorf("invalid header format: %s", line))
 		}
 
-		key := strings.TrimSpace(parts[0])
+		// Whitespace before the colon is refused, as intermediaries may not
+		// agree on the name of the field (RFC 9112, section 5.1)
+		key := parts[0]
+		if !isToken(key) {
+			return newParseError(KindBadHeader, fmt.Errorf("invalid header name %q", key))
+		}
 		value := strings.TrimSpace(parts[1])
-		req.Headers[key] = value
+		canonical := CanonicalHeaderKey(key)
+		switch prior, ok := req.Headers[canonical]; {
+		case ok && canonical == "Cookie":
+			// Cookies split over several headers are joined as if sent in one
+			req.Headers[canonical] = []string{prior[0] + "; " + value}
+		case ok && canonical == "Content-Length":
+			// Differing lengths leave the end of the body ambiguous (RFC 9112, section 6.3)
+			if prior[0] != value {
+				return newParseError(KindBadHeader, fmt.Errorf("conflicting Content-Length headers %q and %q", prior[0], value))
+			}
+		default:
+			req.Headers.Add(canonical, value)
+		}
+		req.headerOrder = append(req.headerOrder, key)
 	}
 
 	return nil
 }
 
-// readUntilCRLF reads from the connection until it finds a CRLF sequence
-func (p *Parser) readUntilCRLF() (string, error) {
-	p.conn.SetReadDeadline(time.Now().Add(time.Second))
-	defer p.conn.SetReadDeadline(time.Time{})
+// checkFraming rejects requests whose body could be framed more than one way,
+// which is how requests are smuggled past intermediaries (RFC 9112, section
+// 6.3). Transfer-Encoding and Content-Length together are malformed, and chunked
+// is the only transfer coding the server decodes.
+func checkFraming(req *Request) error {
+	if !req.Headers.Has("Transfer-Encoding") {
+		return nil
+	}
+	if req.Headers.Has("Content-Length") {
+		return newParseError(KindBadHeader, errors.New("both Transfer-Encoding and Content-Length given"))
+	}
+	if coding := req.Header("Transfer-Encoding"); !strings.EqualFold(coding, "chunked") {
+		return newParseError(KindBadCoding, fmt.Errorf("unsupported transfer coding %q", coding))
+	}
+	return nil
+}
 
-	reader := bufio.NewReader(p.conn)
-	var buf bytes.Buffer
+// readLine reads from the connection until it finds a CRLF sequence.
+// Lines longer than limit bytes fail with errLineTooLong.
+func (p *Parser) readLine(limit int) (string, error) {
+	if p.clock == clock.Real {
+		p.conn.SetReadDeadline(time.Now().Add(readTimeout))
+		defer p.conn.SetReadDeadline(time.Time{})
+	} else {
+		defer expireRead(p.conn, p.clock, readTimeout)()
+	}
 
+	var line []byte
 	for {
-		line, err := reader.ReadBytes('\n')
+		chunk, err := p.reader.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > limit+len(CRLF) {
+			return "", errLineTooLong
+		}
+
+		if err == bufio.ErrBufferFull {
+			continue
+		}
 		if err != nil {
-			if err == io.EOF {
-				return buf.String(), io.EOF
-			}
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				return buf.String(), nil
-			}
-			return "", err
+			return string(line), err
 		}
 
-		buf.Write(line)
-		result := buf.String()
+		if len(line) >= 2 && line[len(line)-2] == '\r' {
+			return string(line[:len(line)-2]), nil
+		}
+		return "", errors.New("line not terminated by CRLF")
+	}
+}
 
-		if len(result) >= 2 && result[len(result)-2:] == CRLF {
-			return result[:len(result)-2], nil
+var errLineTooLong = errors.New("line exceeds size limit")
+
+// expireRead makes reads from conn time out once timeout passes on c, until
+// the returned function is called. Connection deadlines follow the system
+// clock, so other clocks, such as fakes in tests, expire reads with a timer.
+func expireRead(conn net.Conn, c clock.Clock, timeout time.Duration) (stop func()) {
+	var mu sync.Mutex
+	stopped := false
+	timer := c.AfterFunc(timeout, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if !stopped {
+			conn.SetReadDeadline(time.Unix(1, 0))
+		}
+	})
+	return func() {
+		mu.Lock()
+		stopped = true
+		mu.Unlock()
+		if !timer.Stop() {
+			conn.SetReadDeadline(time.Time{})
 		}
 	}
 }
+
+// classify maps read errors onto the parse error taxonomy, using kind for plain syntax errors
+func (p *Parser) classify(kind ParseErrorKind, err error) error {
+	switch {
+	case errors.Is(err, errLineTooLong):
+		return newParseError(KindOversized, err)
+	case isTimeout(err):
+		return newParseError(KindTimeout, err)
+	default:
+		return newParseError(kind, err)
+	}
+}
+
+// isTimeout reports whether err is a network timeout
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// http2PrefaceLine is the request line an HTTP/2 client with prior knowledge starts its connection preface with
+const http2PrefaceLine = "PRI * HTTP/2.0"
+
+// IsHTTP2Preface reports whether the request is the start of the HTTP/2
+// connection preface, sent by clients using HTTP/2 without negotiating it
+func (r *Request) IsHTTP2Preface() bool {
+	return r.Method+" "+r.RequestTarget+" "+r.Version == http2PrefaceLine && len(r.Headers) == 0
+}
+
+// HTTP2PrefaceHead returns the part of the HTTP/2 connection preface consumed
+// when the parser read it as a request, so it can be replayed to an HTTP/2 server
+func HTTP2PrefaceHead() []byte {
+	return []byte(http2PrefaceLine + CRLF + CRLF)
+}
+
+// Detach hands the connection over to another protocol. Reads from the returned
+// connection yield replay, then any bytes the parser buffered, then the
+// connection's own. The parser must not be used afterwards.
+func (p *Parser) Detach(replay []byte) net.Conn {
+	return &detachedConn{
+		Conn:   p.conn,
+		reader: io.MultiReader(bytes.NewReader(replay), p.reader),
+	}
+}
+
+// detachedConn is a connection whose reads start with bytes buffered elsewhere
+type detachedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+// Read implements net.Conn
+func (c *detachedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
@@ -1,73 +1,474 @@
 package http
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"mime"
 	"net"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+
+	"octo-server/app/clock"
+	"octo-server/app/metrics"
 )
 
+// TimeFormat is the format of dates in HTTP headers, such as Last-Modified
+const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
 // Response represents an HTTP response
 type Response struct {
 	StatusCode int
+	// StatusText is the reason phrase sent with the status code, the one
+	// registered for it if empty, as given by StatusCodeToText
 	StatusText string
-	Headers    map[string]string
-	Body       []byte
+	// Headers are sent one line per value, so that fields which cannot be
+	// combined into one, such as Set-Cookie, keep all of their values
+	Headers Header
+	Body    []byte
+}
+
+// AddVary adds request header names to the response's Vary header,
+// skipping names already listed and leaving a "*" untouched
+func (r *Response) AddVary(names ...string) {
+	if r.Headers == nil {
+		r.Headers = make(Header)
+	}
+
+	vary := r.Headers.Join("Vary")
+	for _, name := range names {
+		if varies(vary, name) {
+			continue
+		}
+		if vary == "" {
+			vary = name
+		} else {
+			vary += ", " + name
+		}
+	}
+
+	if vary != "" {
+		r.Headers.Set("Vary", vary)
+	}
+}
+
+// varies reports whether a Vary header value already covers the header name
+func varies(vary, name string) bool {
+	for _, field := range strings.Split(vary, ",") {
+		field = strings.TrimSpace(field)
+		if field == "*" || strings.EqualFold(field, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// HopByHopHeaders are connection-specific headers, which are meaningful for a
+// single connection only and must not be forwarded by proxies nor sent over HTTP/2
+var HopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// ResponseFilter transforms a response before it is written, e.g. to compress its body
+type ResponseFilter func(resp *Response) error
+
+// ResponseSink delivers responses over a transport other than an HTTP/1.1
+// connection, such as an HTTP/2 stream, which frames them itself
+type ResponseSink interface {
+	// WriteHead sends the status and headers of a response
+	WriteHead(resp *Response) error
+	// Write sends body bytes
+	Write(b []byte) (int, error)
+	// Flush sends any buffered body bytes to the client
+	Flush() error
+	// WriteTrailer sets the trailer fields sent once the body ends
+	WriteTrailer(trailer Header) error
 }
 
 // Writer handles writing HTTP responses
 type Writer struct {
-	conn net.Conn
+	conn    net.Conn
+	sink    ResponseSink
+	filters []ResponseFilter
+	vary    []string
+	cookies []string
+	// trailer names the trailer fields the next streamed response ends with
+	trailer []string
+	audit   bool
+	written int64
+	// last is the response whose head was last written
+	last *Response
+
+	// server is the Server header added to responses without one, if not empty
+	server string
+	// clock tells the time given in the Date header
+	clock clock.Clock
+	// method and version are those of the request answered, if known, which
+	// decide how a response is framed
+	method  string
+	version string
+
+	// mu guards last, written and abandoned against Abandon, called while
+	// the handler of a request that timed out may still be writing
+	mu        sync.Mutex
+	abandoned bool
 }
 
+// ErrAbandoned is returned when writing a response abandoned because its request timed out
+var ErrAbandoned = errors.New("response abandoned after the request timed out")
+
 // NewWriter creates a new response writer for a connection
 func NewWriter(conn net.Conn) *Writer {
-	return &Writer{conn: conn}
+	return &Writer{conn: conn, clock: clock.Real}
 }
 
-// WriteResponse writes a complete HTTP response to the connection
-func (w *Writer) WriteResponse(resp *Response) error {
-	// Build status line
-	statusLine := fmt.Sprintf("HTTP/1.1 %d %s%s", resp.StatusCode, resp.StatusText, CRLF)
+// NewSinkWriter creates a new response writer delivering responses to a sink
+func NewSinkWriter(sink ResponseSink) *Writer {
+	return &Writer{sink: sink, clock: clock.Real}
+}
+
+// SetServer sets the Server header added to every response written that has
+// none, such as "octo-server"; an empty name adds none
+func (w *Writer) SetServer(name string) {
+	w.server = name
+}
+
+// SetClock sets the clock the Date header of responses is taken from
+func (w *Writer) SetClock(c clock.Clock) {
+	w.clock = c
+}
+
+// SetRequest records the request answered, so that responses to HEAD and
+// CONNECT requests are not given a Content-Length of their body, and streamed
+// responses to HTTP/1.0 requests are not chunked
+func (w *Writer) SetRequest(req *Request) {
+	w.method, w.version = req.Method, req.Version
+}
+
+// Direct reports whether responses are written straight to a connection by
+// the calling goroutine, rather than handed to a sink such as an HTTP/2 stream
+func (w *Writer) Direct() bool {
+	return w.sink == nil
+}
+
+// Use adds a filter applied to every response written, in the order added
+func (w *Writer) Use(filter ResponseFilter) {
+	w.filters = append(w.filters, filter)
+}
+
+// EnableAudit turns on Content-Length auditing: every response written is
+// checked for a Content-Length header that matches the body bytes actually
+// written, and mismatches are logged and counted
+func (w *Writer) EnableAudit() {
+	w.audit = true
+}
 
-	// Build headers
-	var headers strings.Builder
-	for key, value := range resp.Headers {
-		headers.WriteString(fmt.Sprintf("%s: %s%s", key, value, CRLF))
+// BytesWritten returns the number of bytes written to the connection, headers included
+func (w *Writer) BytesWritten() int64 {
+	return w.written
+}
+
+// Status returns the status code of the response written, or 0 if none has been
+func (w *Writer) Status() int {
+	if w.last == nil {
+		return 0
 	}
-	headers.WriteString(CRLF)
+	return w.last.StatusCode
+}
 
-	// Combine all parts
-	response := statusLine + headers.String()
-	if resp.Body != nil {
-		responseBytes := []byte(response)
-		responseBytes = append(responseBytes, resp.Body...)
-		response = string(responseBytes)
+// ResponseHeaders returns the headers of the response written, or nil if none has been
+func (w *Writer) ResponseHeaders() Header {
+	if w.last == nil {
+		return nil
 	}
+	return w.last.Headers
+}
+
+// Abandon stops anything more of the response from being written, for a
+// request whose handler did not return in time. It returns a writer to the
+// same client reporting the status and size of what was sent so far, and
+// whether a response was started; if not, the request can be answered
+// through the returned writer.
+func (w *Writer) Abandon() (*Writer, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.abandoned = true
+	return &Writer{conn: w.conn, sink: w.sink, audit: w.audit, written: w.written, last: w.last, server: w.server, clock: w.clock, method: w.method, version: w.version}, w.last != nil
+}
+
+// Vary records that the response depends on the given request headers, e.g. because
+// a handler negotiated on Accept or Origin. They are added to the Vary header of
+// every response written afterwards.
+func (w *Writer) Vary(names ...string) {
+	w.vary = append(w.vary, names...)
+}
+
+// DeclareTrailer records trailer fields the next response streamed with
+// WriteChunked ends with, such as a checksum of the body computed while
+// streaming it. They are named in its Trailer header so that clients expect
+// them (RFC 9110, section 6.6.2).
+func (w *Writer) DeclareTrailer(names ...string) {
+	w.trailer = append(w.trailer, names...)
+}
+
+// Redirect writes a redirect with the given 3xx status to location
+func (w *Writer) Redirect(code int, location string) error {
+	return w.WriteResponse(&Response{
+		StatusCode: code,
+		StatusText: StatusCodeToText(code),
+		Headers: Header{
+			"Location":       {location},
+			"Content-Length": {"0"},
+		},
+	})
+}
+
+// JSON writes a response with the given status whose body is v encoded as JSON
+func (w *Writer) JSON(code int, v any) error {
+	content, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode JSON response: %w", err)
+	}
+	return w.WriteResponse(&Response{
+		StatusCode: code,
+		StatusText: StatusCodeToText(code),
+		Headers: Header{
+			"Content-Type":   {"application/json"},
+			"Content-Length": {strconv.Itoa(len(content))},
+		},
+		Body: content,
+	})
+}
+
+// Text writes a response with the given status whose body is s as plain text
+func (w *Writer) Text(code int, s string) error {
+	return w.WriteResponse(&Response{
+		StatusCode: code,
+		StatusText: StatusCodeToText(code),
+		Headers: Header{
+			"Content-Type":   {"text/plain; charset=utf-8"},
+			"Content-Length": {strconv.Itoa(len(s))},
+		},
+		Body: []byte(s),
+	})
+}
+
+// File writes a 200 response streaming the regular file at path, typed by its
+// extension. Nothing is written if the file cannot be opened, so the caller
+// can answer with an error status instead.
+func (w *Writer) File(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(path))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return w.WriteFrom(&Response{
+		StatusCode: StatusOK,
+		StatusText: StatusCodeToText(StatusOK),
+		Headers: Header{
+			"Content-Type":   {contentType},
+			"Content-Length": {strconv.FormatInt(info.Size(), 10)},
+			"Last-Modified":  {info.ModTime().UTC().Format(TimeFormat)},
+		},
+	}, f)
+}
+
+// WriteResponse writes a complete HTTP response to the connection, with a
+// Content-Length of its body unless it has one or another framing
+func (w *Writer) WriteResponse(resp *Response) error {
+	if err := w.prepare(resp); err != nil {
+		return err
+	}
+	if w.needsContentLength(resp) {
+		resp.Headers.Set("Content-Length", strconv.Itoa(len(resp.Body)))
+	}
+	if w.sink != nil {
+		return w.writeToSink(resp)
+	}
+
+	// The head and body go out in one write, the body bytes as they are.
+	// Responses to HEAD are framed like those to GET, but leave the body out.
+	head := w.head(resp)
+	if w.method == "HEAD" {
+		if _, err := w.write(head); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing response: %v\n", err)
+			return err
+		}
+		return nil
+	}
+	response := append(head, resp.Body...)
 
 	// Write to connection
-	if _, err := w.conn.Write([]byte(response)); err != nil {
+	n, err := w.write(response)
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error writing response: %v\n", err)
 		return err
 	}
 
+	if w.audit {
+		auditContentLength(resp, int64(n-len(head)))
+	}
+
 	return nil
 }
 
-// StatusCodeToText converts HTTP status code to status text
-func StatusCodeToText(code int) string {
-	switch code {
-	case 200:
-		return "OK"
-	case 201:
-		return "Created"
-	case 400:
-		return "Bad Request"
-	case 404:
-		return "Not Found"
-	case 500:
-		return "Internal Server Error"
-	default:
-		return "Unknown"
+// needsContentLength reports whether a complete response must be given a
+// Content-Length so that clients can tell where its body ends. Responses to
+// HEAD get the length of the body they leave out, as GET would, and those that
+// cannot have a body must not declare one (RFC 9110, section 8.6).
+func (w *Writer) needsContentLength(resp *Response) bool {
+	switch {
+	case resp.Headers.Has("Content-Length"), resp.Headers.Has("Transfer-Encoding"):
+		return false
+	case resp.StatusCode < 200, resp.StatusCode == StatusNoContent, resp.StatusCode == StatusNotModified:
+		return false
+	case w.method == "CONNECT" && resp.StatusCode < 300:
+		return false
+	}
+	return true
+}
+
+// writeToSink writes a complete response to the writer's sink
+func (w *Writer) writeToSink(resp *Response) error {
+	if err := w.sink.WriteHead(resp); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing response: %v\n", err)
+		return err
 	}
+	if w.method == "HEAD" {
+		return nil
+	}
+
+	n, err := w.write(resp.Body)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing response: %v\n", err)
+		return err
+	}
+
+	if w.audit {
+		auditContentLength(resp, int64(n))
+	}
+	return nil
+}
+
+// prepare applies the recorded Vary headers and the filters to a response
+func (w *Writer) prepare(resp *Response) error {
+	if resp.Headers == nil {
+		resp.Headers = make(Header)
+	}
+	// A response may give its own reason phrase, which must fit on the status line
+	if resp.StatusText == "" {
+		resp.StatusText = StatusCodeToText(resp.StatusCode)
+	} else if strings.ContainsAny(resp.StatusText, "\r\n") {
+		return fmt.Errorf("invalid reason phrase %q", resp.StatusText)
+	}
+	// Responses are dated when sent (RFC 9110, section 6.6.1), unless they are
+	// relayed with the date of their origin, such as cached or proxied ones
+	if !resp.Headers.Has("Date") {
+		resp.Headers.Set("Date", w.clock.Now().UTC().Format(TimeFormat))
+	}
+	if w.server != "" && !resp.Headers.Has("Server") {
+		resp.Headers.Set("Server", w.server)
+	}
+	// HTTP/1.0 connections are not kept open, which the response says
+	if w.version == "HTTP/1.0" && w.sink == nil {
+		resp.Headers.Set("Connection", "close")
+	}
+	if len(w.vary) > 0 {
+		resp.AddVary(w.vary...)
+	}
+	for _, cookie := range w.cookies {
+		resp.Headers.Add("Set-Cookie", cookie)
+	}
+	w.cookies = nil
+	for _, filter := range w.filters {
+		if err := filter(resp); err != nil {
+			fmt.Fprintf(os.Stderr, "Error filtering response: %v\n", err)
+			return err
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.abandoned {
+		return ErrAbandoned
+	}
+	w.last = resp
+	return nil
+}
+
+// head builds the status line and headers of a response
+func (w *Writer) head(resp *Response) []byte {
+	head := make([]byte, 0, 512)
+	head = append(head, "HTTP/1.1 "...)
+	head = strconv.AppendInt(head, int64(resp.StatusCode), 10)
+	head = append(head, ' ')
+	head = append(head, resp.StatusText...)
+	head = append(head, CRLF...)
+	head = resp.Headers.appendTo(head)
+	return append(head, CRLF...)
+}
+
+// write writes raw bytes to the connection, or body bytes to the sink, counting them
+func (w *Writer) write(b []byte) (int, error) {
+	w.mu.Lock()
+	abandoned := w.abandoned
+	w.mu.Unlock()
+	if abandoned {
+		return 0, ErrAbandoned
+	}
+
+	var n int
+	var err error
+	if w.sink != nil {
+		n, err = w.sink.Write(b)
+	} else {
+		n, err = w.conn.Write(b)
+	}
+	w.mu.Lock()
+	w.written += int64(n)
+	w.mu.Unlock()
+	metrics.Default.Add("http_response_bytes_total", int64(n))
+	return n, err
+}
+
+// auditContentLength logs and counts a response whose declared Content-Length
+// differs from the number of body bytes written. A missing Content-Length is a
+// mismatch too, since keep-alive clients cannot tell where such a body ends.
+func auditContentLength(resp *Response, bodyWritten int64) {
+	declared, ok := resp.Headers.Get("Content-Length"), resp.Headers.Has("Content-Length")
+	if !ok {
+		if resp.StatusCode < 200 || resp.StatusCode == StatusNoContent || resp.StatusCode == StatusNotModified {
+			return
+		}
+		declared = "missing"
+	} else if declared == strconv.FormatInt(bodyWritten, 10) {
+		return
+	}
+
+	metrics.Default.Inc("http_content_length_mismatches_total")
+	fmt.Fprintf(os.Stderr, "Content-Length mismatch: status=%d declared=%s written=%d\n",
+		resp.StatusCode, declared, bodyWritten)
 }
@@ -0,0 +1,252 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+// ChunkedWriter streams a response body to the connection with chunked
+// transfer coding, so the connection stays usable after the body ends
+type ChunkedWriter struct {
+	writer  *Writer
+	closed  bool
+	trailer Header
+	// declared are the trailer fields named in the Trailer header, the only
+	// ones that may be sent
+	declared []string
+	// unframed is set for HTTP/1.0 clients, which do not know chunked coding,
+	// so the body is sent as is and ends when the connection is closed
+	unframed bool
+	// bodiless is set for responses to HEAD, whose body and trailer fields are
+	// left out
+	bodiless bool
+}
+
+// forbiddenTrailers are fields that must not be sent as trailer fields, as
+// they are needed to frame, route, authenticate or process a message before
+// its body is (RFC 9110, section 6.5.1)
+var forbiddenTrailers = map[string]bool{
+	"Authorization":       true,
+	"Cache-Control":       true,
+	"Connection":          true,
+	"Content-Encoding":    true,
+	"Content-Length":      true,
+	"Content-Range":       true,
+	"Content-Type":        true,
+	"Expect":              true,
+	"Host":                true,
+	"Keep-Alive":          true,
+	"Max-Forwards":        true,
+	"Pragma":              true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Proxy-Connection":    true,
+	"Range":               true,
+	"Set-Cookie":          true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+	"Www-Authenticate":    true,
+}
+
+// AllowedTrailer reports whether a field may be sent as a trailer field
+func AllowedTrailer(name string) bool {
+	return !forbiddenTrailers[CanonicalHeaderKey(name)]
+}
+
+// WriteChunked writes the status line and headers of a response whose body is
+// streamed through the returned writer rather than given in resp.Body.
+// The caller must Close the writer to end the body. Trailer fields declared
+// with DeclareTrailer are named in the Trailer header. HTTP/1.0 clients get
+// the body unchunked, ending when the connection is closed after it.
+func (w *Writer) WriteChunked(resp *Response) (*ChunkedWriter, error) {
+	var declared []string
+	for _, name := range w.trailer {
+		name = CanonicalHeaderKey(name)
+		if !AllowedTrailer(name) {
+			return nil, fmt.Errorf("%s cannot be a trailer field", name)
+		}
+		if !slices.Contains(declared, name) {
+			declared = append(declared, name)
+		}
+	}
+	w.trailer = nil
+
+	resp.Body = nil
+	if err := w.prepare(resp); err != nil {
+		return nil, err
+	}
+	resp.Headers.Del("Content-Length")
+	chunked := &ChunkedWriter{writer: w, declared: declared, bodiless: w.method == "HEAD"}
+
+	// A sink frames the body itself, so only HTTP/1.1 needs chunked coding
+	if w.sink != nil {
+		if err := w.sink.WriteHead(resp); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing response: %v\n", err)
+			return nil, err
+		}
+		return chunked, nil
+	}
+
+	chunked.unframed = w.version == "HTTP/1.0"
+	if !chunked.unframed {
+		resp.Headers.Set("Transfer-Encoding", "chunked")
+		if len(declared) > 0 {
+			resp.Headers.Set("Trailer", strings.Join(declared, ", "))
+		}
+	}
+	if _, err := w.write(w.head(resp)); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing response: %v\n", err)
+		return nil, err
+	}
+	return chunked, nil
+}
+
+// Write sends b as one chunk, reaching the client immediately
+func (c *ChunkedWriter) Write(b []byte) (int, error) {
+	if c.closed {
+		return 0, errors.New("write to closed chunked body")
+	}
+	if len(b) == 0 || c.bodiless {
+		return len(b), nil
+	}
+
+	if sink := c.writer.sink; sink != nil {
+		n, err := c.writer.write(b)
+		if err != nil {
+			return n, err
+		}
+		return n, sink.Flush()
+	}
+	if c.unframed {
+		return c.writer.write(b)
+	}
+
+	chunk := append([]byte(fmt.Sprintf("%x%s", len(b), CRLF)), b...)
+	if _, err := c.writer.write(append(chunk, CRLF...)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Trailer returns the trailer fields sent after the last chunk. They can be
+// set until Close, and only those declared with DeclareTrailer before
+// WriteChunked are sent.
+func (c *ChunkedWriter) Trailer() Header {
+	if c.trailer == nil {
+		c.trailer = make(Header)
+	}
+	return c.trailer
+}
+
+// Close ends the body with the last chunk, followed by the trailer fields. A
+// trailer field that was not declared, or may not be a trailer field, fails
+// Close; the body is still ended, without any trailer fields.
+func (c *ChunkedWriter) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+
+	trailer, checkErr := c.checkTrailer()
+	if c.bodiless {
+		return checkErr
+	}
+	if sink := c.writer.sink; sink != nil {
+		if len(trailer) > 0 {
+			if err := sink.WriteTrailer(trailer); err != nil {
+				return err
+			}
+		}
+		if err := sink.Flush(); err != nil {
+			return err
+		}
+		return checkErr
+	}
+	// The body ends with the connection, and trailer fields cannot be sent
+	if c.unframed {
+		return checkErr
+	}
+
+	last := []byte("0" + CRLF)
+	last = trailer.appendTo(last)
+	if _, err := c.writer.write(append(last, CRLF...)); err != nil {
+		return err
+	}
+	return checkErr
+}
+
+// checkTrailer returns the trailer fields to send, or none and an error if
+// any of them may not be sent
+func (c *ChunkedWriter) checkTrailer() (Header, error) {
+	for key := range c.trailer {
+		name := CanonicalHeaderKey(key)
+		if !AllowedTrailer(name) {
+			return nil, fmt.Errorf("%s cannot be a trailer field", name)
+		}
+		if !slices.Contains(c.declared, name) {
+			return nil, fmt.Errorf("trailer field %s was not declared", name)
+		}
+	}
+	return c.trailer, nil
+}
+
+// WriteFrom writes a response whose body is copied from body as it is read,
+// e.g. from an upstream server. If resp declares a Content-Length, body must
+// yield exactly that many bytes; otherwise the body is sent chunked. Responses
+// to HEAD are framed the same way, but body is not read.
+func (w *Writer) WriteFrom(resp *Response, body io.Reader) error {
+	if !resp.Headers.Has("Content-Length") {
+		chunked, err := w.WriteChunked(resp)
+		if err != nil {
+			return err
+		}
+		if chunked.bodiless {
+			return chunked.Close()
+		}
+		if _, err := io.Copy(chunked, body); err != nil {
+			return err
+		}
+		return chunked.Close()
+	}
+
+	resp.Body = nil
+	if err := w.prepare(resp); err != nil {
+		return err
+	}
+	if w.sink != nil {
+		err := w.sink.WriteHead(resp)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing response: %v\n", err)
+			return err
+		}
+	} else if _, err := w.write(w.head(resp)); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing response: %v\n", err)
+		return err
+	}
+
+	if w.method == "HEAD" {
+		return nil
+	}
+
+	n, err := io.Copy(bodyWriter{w}, body)
+	if w.audit {
+		auditContentLength(resp, n)
+	}
+	return err
+}
+
+// bodyWriter writes body bytes through a Writer, counting them
+type bodyWriter struct {
+	w *Writer
+}
+
+// Write implements io.Writer
+func (b bodyWriter) Write(p []byte) (int, error) {
+	return b.w.write(p)
+}
@@ -0,0 +1,395 @@
+// Package httpcache implements a shared HTTP cache in the style of RFC 9111,
+// storing responses in memory and optionally spilling them to disk
+package httpcache
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	nethttp "net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"octo-server/app/http"
+	"octo-server/app/metrics"
+)
+
+// entryFilePattern names the files of entries spilled to disk
+const entryFilePattern = "entry-*"
+
+// maxEntryFraction limits a single body to this fraction of its tier's size,
+// so that one large response cannot evict everything else
+const maxEntryFraction = 8
+
+// Options configure a cache
+type Options struct {
+	// MaxMemory is the total size of the bodies kept in memory
+	MaxMemory int64
+	// Dir, if set, is the directory that bodies evicted from memory or too
+	// large for it are spilled to. Its entry files are removed on startup.
+	Dir string
+	// MaxDisk is the total size of the bodies kept in Dir; zero means unlimited
+	MaxDisk int64
+}
+
+// Cache stores responses, evicting the least recently used ones first
+type Cache struct {
+	options Options
+
+	mu          sync.Mutex
+	entries     map[string][]*Entry // variants of each request target
+	memory      *list.List          // entries with their body in memory, most recently used first
+	disk        *list.List          // entries with their body on disk, most recently used first
+	memoryBytes int64
+	diskBytes   int64
+}
+
+// New creates a cache, clearing any entry files left in its directory by a previous run
+func New(options Options) (*Cache, error) {
+	if options.Dir != "" {
+		if err := os.MkdirAll(options.Dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create cache directory: %w", err)
+		}
+		leftovers, _ := filepath.Glob(filepath.Join(options.Dir, entryFilePattern))
+		for _, name := range leftovers {
+			os.Remove(name)
+		}
+	}
+
+	c := &Cache{
+		options: options,
+		entries: make(map[string][]*Entry),
+		memory:  list.New(),
+		disk:    list.New(),
+	}
+	metrics.Default.Gauge("proxy_cache_bytes", c.locked(func() int64 { return c.memoryBytes }), "tier", "memory")
+	metrics.Default.Gauge("proxy_cache_bytes", c.locked(func() int64 { return c.diskBytes }), "tier", "disk")
+	metrics.Default.Gauge("proxy_cache_entries", c.locked(func() int64 { return int64(c.memory.Len() + c.disk.Len()) }))
+	return c, nil
+}
+
+// locked wraps a gauge so that it reads the cache's state under its lock
+func (c *Cache) locked(fn func() int64) func() int64 {
+	return func() int64 {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return fn()
+	}
+}
+
+// key identifies the stored responses for a request by its effective target URI
+func key(req *http.Request) string {
+	return req.Header("Host") + req.RequestTarget
+}
+
+// Lookup returns the stored response selected by a request, or nil if there is none
+func (c *Cache) Lookup(req *http.Request) *Entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, e := range c.entries[key(req)] {
+		if e.varyMatches(req) {
+			c.touch(e)
+			return e
+		}
+	}
+	return nil
+}
+
+// Store stores the response to a request, whose body was captured by rec.
+// Responses that could never be reused, lacking both a freshness lifetime
+// and a validator, are dropped.
+func (c *Cache) Store(req *http.Request, resp *nethttp.Response, rec *Recorder, requestTime, responseTime time.Time) {
+	e := &Entry{
+		StatusCode:   resp.StatusCode,
+		StatusText:   http.StatusCodeToText(resp.StatusCode),
+		Header:       storedHeader(resp.Header),
+		cache:        c,
+		key:          key(req),
+		vary:         make(map[string]string),
+		requestTime:  requestTime,
+		responseTime: responseTime,
+	}
+	if e.StatusText == "Unknown" {
+		e.StatusText = strings.TrimSpace(strings.TrimPrefix(resp.Status, strconv.Itoa(resp.StatusCode)))
+	}
+	for _, name := range varyNames(resp.Header) {
+		e.vary[name] = normalizeHeader(req.Header(name))
+	}
+	e.control = ParseCacheControl(strings.Join(e.Header.Values("Cache-Control"), ","))
+	e.lifetime = e.freshnessLifetime()
+
+	if rec.failed || (e.lifetime == 0 && !e.hasValidator()) {
+		rec.Discard()
+		return
+	}
+	e.size = rec.size
+	if rec.file != nil {
+		e.file = rec.file.Name()
+		if err := rec.file.Close(); err != nil {
+			os.Remove(e.file)
+			return
+		}
+	} else {
+		e.body = rec.buf.Bytes()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	variants := c.entries[e.key]
+	for i, old := range variants {
+		if sameVary(old.vary, e.vary) {
+			c.unlink(old)
+			variants = append(variants[:i], variants[i+1:]...)
+			break
+		}
+	}
+	c.entries[e.key] = append(variants, e)
+	c.link(e)
+	c.evict()
+}
+
+// Freshen updates a stored response with the headers of a 304 Not Modified
+// response validating it (RFC 9111, section 4.3.4), returning the updated entry
+func (c *Cache) Freshen(e *Entry, resp *nethttp.Response, requestTime, responseTime time.Time) *Entry {
+	header := e.Header.Clone()
+	for name, values := range storedHeader(resp.Header) {
+		if name != "Content-Length" {
+			header[name] = values
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fresh := *e
+	fresh.Header = header
+	fresh.requestTime = requestTime
+	fresh.responseTime = responseTime
+	fresh.control = ParseCacheControl(strings.Join(header.Values("Cache-Control"), ","))
+	fresh.lifetime = fresh.freshnessLifetime()
+
+	// The entry may have been replaced or evicted since it was looked up
+	for i, old := range c.entries[e.key] {
+		if old == e {
+			c.entries[e.key][i] = &fresh
+			fresh.elem.Value = &fresh
+			c.touch(&fresh)
+			break
+		}
+	}
+	return &fresh
+}
+
+// Invalidate removes the stored responses for a request's target
+func (c *Cache) Invalidate(req *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	k := key(req)
+	for _, e := range c.entries[k] {
+		c.unlink(e)
+	}
+	delete(c.entries, k)
+}
+
+// link adds an entry to the LRU list of the tier holding its body. Caller must hold c.mu.
+func (c *Cache) link(e *Entry) {
+	if e.file != "" {
+		e.elem = c.disk.PushFront(e)
+		c.diskBytes += e.size
+	} else {
+		e.elem = c.memory.PushFront(e)
+		c.memoryBytes += e.size
+	}
+}
+
+// unlink removes an entry from its LRU list, deleting its file. Caller must hold c.mu.
+func (c *Cache) unlink(e *Entry) {
+	if e.file != "" {
+		c.disk.Remove(e.elem)
+		c.diskBytes -= e.size
+		os.Remove(e.file)
+	} else {
+		c.memory.Remove(e.elem)
+		c.memoryBytes -= e.size
+	}
+}
+
+// touch marks an entry as the most recently used of its tier. Caller must hold c.mu.
+func (c *Cache) touch(e *Entry) {
+	if e.file != "" {
+		c.disk.MoveToFront(e.elem)
+	} else {
+		c.memory.MoveToFront(e.elem)
+	}
+}
+
+// evict brings both tiers back within their size, spilling the least recently
+// used bodies from memory to disk, if there is a directory, and dropping the
+// least recently used ones from disk. Caller must hold c.mu.
+func (c *Cache) evict() {
+	for c.memoryBytes > c.options.MaxMemory && c.memory.Len() > 0 {
+		e := c.memory.Back().Value.(*Entry)
+		c.memory.Remove(e.elem)
+		c.memoryBytes -= e.size
+
+		if c.options.Dir != "" && c.fitsDisk(e.size) {
+			file, err := c.spill(e.body)
+			if err == nil {
+				e.body, e.file = nil, file
+				c.link(e)
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "Failed to spill cache entry to disk: %v\n", err)
+		}
+		c.forget(e)
+	}
+
+	for c.options.MaxDisk > 0 && c.diskBytes > c.options.MaxDisk && c.disk.Len() > 0 {
+		e := c.disk.Back().Value.(*Entry)
+		c.unlink(e)
+		c.forget(e)
+	}
+}
+
+// forget removes an entry, already unlinked, from the index. Caller must hold c.mu.
+func (c *Cache) forget(e *Entry) {
+	variants := c.entries[e.key]
+	for i, v := range variants {
+		if v == e {
+			variants = append(variants[:i], variants[i+1:]...)
+			break
+		}
+	}
+	if len(variants) == 0 {
+		delete(c.entries, e.key)
+	} else {
+		c.entries[e.key] = variants
+	}
+}
+
+// spill writes a body to a new file in the cache directory
+func (c *Cache) spill(body []byte) (string, error) {
+	f, err := os.CreateTemp(c.options.Dir, entryFilePattern)
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// fitsMemory reports whether a body of n bytes may be kept in memory
+func (c *Cache) fitsMemory(n int64) bool {
+	return n <= c.options.MaxMemory/maxEntryFraction
+}
+
+// fitsDisk reports whether a body of n bytes may be kept on disk
+func (c *Cache) fitsDisk(n int64) bool {
+	return c.options.MaxDisk == 0 || n <= c.options.MaxDisk/maxEntryFraction
+}
+
+// Recorder captures a response body as it streams to the client, in memory
+// until it outgrows an in-memory entry and then in a file of the cache
+// directory. Writes never fail, so that capturing cannot disturb the stream;
+// a body too large to store is simply dropped.
+type Recorder struct {
+	cache  *Cache
+	buf    bytes.Buffer
+	file   *os.File
+	size   int64
+	failed bool
+}
+
+// NewRecorder creates a recorder for a response body about to be stored
+func (c *Cache) NewRecorder() *Recorder {
+	return &Recorder{cache: c}
+}
+
+// Write implements io.Writer
+func (r *Recorder) Write(p []byte) (int, error) {
+	if r.failed {
+		return len(p), nil
+	}
+	r.size += int64(len(p))
+
+	if r.file == nil && r.cache.fitsMemory(r.size) {
+		r.buf.Write(p)
+		return len(p), nil
+	}
+	if r.cache.options.Dir == "" || !r.cache.fitsDisk(r.size) {
+		r.Discard()
+		return len(p), nil
+	}
+
+	if r.file == nil {
+		file, err := os.CreateTemp(r.cache.options.Dir, entryFilePattern)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to spill cache entry to disk: %v\n", err)
+			r.Discard()
+			return len(p), nil
+		}
+		r.file = file
+		_, err = file.Write(r.buf.Bytes())
+		r.buf = bytes.Buffer{}
+		if err != nil {
+			r.Discard()
+			return len(p), nil
+		}
+	}
+	if _, err := r.file.Write(p); err != nil {
+		r.Discard()
+	}
+	return len(p), nil
+}
+
+// Size returns the number of body bytes captured
+func (r *Recorder) Size() int64 {
+	return r.size
+}
+
+// Discard drops the captured body
+func (r *Recorder) Discard() {
+	r.failed = true
+	r.buf = bytes.Buffer{}
+	if r.file != nil {
+		r.file.Close()
+		os.Remove(r.file.Name())
+		r.file = nil
+	}
+}
+
+// storedHeader copies the headers of a response that are stored with it,
+// leaving out the connection-specific ones
+func storedHeader(header nethttp.Header) nethttp.Header {
+	stored := header.Clone()
+	for _, name := range http.HopByHopHeaders {
+		stored.Del(name)
+	}
+	return stored
+}
+
+// sameVary reports whether two entries were selected by the same request header values
+func sameVary(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, value := range a {
+		if bv, ok := b[name]; !ok || bv != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,85 @@
+package httpcache
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxDeltaSeconds caps delta-seconds values too large to represent (RFC 9111, section 1.2.2)
+const maxDeltaSeconds = math.MaxInt32
+
+// Directives are the directives of a Cache-Control header, mapping each
+// lowercased name to its argument, or to "" if it has none
+type Directives map[string]string
+
+// ParseCacheControl parses a Cache-Control header value. When a directive
+// is repeated, its first occurrence is used.
+func ParseCacheControl(value string) Directives {
+	directives := Directives{}
+	for _, part := range splitList(value) {
+		name, arg, _ := strings.Cut(part, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if _, seen := directives[name]; !seen {
+			directives[name] = strings.Trim(strings.TrimSpace(arg), `"`)
+		}
+	}
+	return directives
+}
+
+// Has reports whether a directive is present
+func (d Directives) Has(name string) bool {
+	_, ok := d[name]
+	return ok
+}
+
+// Seconds returns the delta-seconds argument of a directive such as max-age
+func (d Directives) Seconds(name string) (time.Duration, bool) {
+	arg, ok := d[name]
+	if !ok {
+		return 0, false
+	}
+	return deltaSeconds(arg), true
+}
+
+// deltaSeconds parses a delta-seconds value such as the argument of max-age
+// or an Age header. A value that is not a non-negative number counts as zero.
+func deltaSeconds(s string) time.Duration {
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil {
+		if numErr, ok := err.(*strconv.NumError); !ok || numErr.Err != strconv.ErrRange || strings.HasPrefix(s, "-") {
+			return 0
+		}
+		n = maxDeltaSeconds
+	}
+	if n < 0 {
+		return 0
+	}
+	return time.Duration(min(n, maxDeltaSeconds)) * time.Second
+}
+
+// splitList splits a comma-separated header value, ignoring commas inside quoted strings
+func splitList(value string) []string {
+	var parts []string
+	start, quoted := 0, false
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '"':
+			quoted = !quoted
+		case '\\':
+			if quoted {
+				i++
+			}
+		case ',':
+			if !quoted {
+				parts = append(parts, value[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, value[start:])
+}
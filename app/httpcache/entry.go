@@ -0,0 +1,272 @@
+package httpcache
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	nethttp "net/http"
+	"os"
+	"strings"
+	"time"
+
+	"octo-server/app/http"
+)
+
+// maxHeuristicLifetime caps the freshness lifetime guessed from Last-Modified
+const maxHeuristicLifetime = 24 * time.Hour
+
+// heuristicStatuses are the status codes whose responses may be stored and
+// given a heuristic freshness lifetime without explicit caching headers
+// (RFC 9110, section 15.1). 206 is left out since partial content is not stored.
+var heuristicStatuses = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// Entry is a stored response. Entries are not modified once stored;
+// revalidation replaces an entry with a freshened copy.
+type Entry struct {
+	StatusCode int
+	StatusText string
+	// Header holds the end-to-end headers of the response
+	Header nethttp.Header
+
+	cache        *Cache
+	key          string
+	vary         map[string]string // request header values the response was selected by
+	control      Directives
+	lifetime     time.Duration
+	requestTime  time.Time
+	responseTime time.Time
+
+	// Body storage, guarded by cache.mu: in memory, or in a file once spilled to disk
+	size int64
+	body []byte
+	file string
+	elem *list.Element
+}
+
+// Size returns the length of the stored body
+func (e *Entry) Size() int64 {
+	return e.size
+}
+
+// Body opens the stored body. It fails if the entry was evicted from disk
+// in the meantime, in which case the response must be fetched again.
+func (e *Entry) Body() (io.ReadCloser, error) {
+	e.cache.mu.Lock()
+	body, file := e.body, e.file
+	e.cache.mu.Unlock()
+
+	if file != "" {
+		return os.Open(file)
+	}
+	return io.NopCloser(bytes.NewReader(body)), nil
+}
+
+// Age returns the current age of the entry, i.e. the time since the
+// upstream generated or last validated it (RFC 9111, section 4.2.3)
+func (e *Entry) Age(now time.Time) time.Duration {
+	apparentAge := max(0, e.responseTime.Sub(e.date()))
+	correctedAge := deltaSeconds(e.Header.Get("Age")) + e.responseTime.Sub(e.requestTime)
+	return max(apparentAge, correctedAge) + now.Sub(e.responseTime)
+}
+
+// Usable reports whether the entry may answer a request without contacting
+// the upstream: it must be fresh enough for the request's Cache-Control, or
+// stale within a max-stale allowance the response does not forbid
+func (e *Entry) Usable(req *http.Request, now time.Time) bool {
+	control := requestControl(req)
+	if control.Has("no-cache") || e.control.Has("no-cache") {
+		return false
+	}
+
+	age := e.Age(now)
+	if maxAge, ok := control.Seconds("max-age"); ok && age > maxAge {
+		return false
+	}
+	if minFresh, ok := control.Seconds("min-fresh"); ok && e.lifetime-age < minFresh {
+		return false
+	}
+	if age < e.lifetime {
+		return true
+	}
+
+	if !control.Has("max-stale") || !e.MayServeStale() {
+		return false
+	}
+	maxStale, _ := control.Seconds("max-stale")
+	return control["max-stale"] == "" || age-e.lifetime <= maxStale
+}
+
+// MayServeStale reports whether the response allows serving it once stale,
+// e.g. when the upstream cannot be reached (RFC 9111, section 4.2.4)
+func (e *Entry) MayServeStale() bool {
+	for _, directive := range []string{"must-revalidate", "proxy-revalidate", "s-maxage", "no-cache"} {
+		if e.control.Has(directive) {
+			return false
+		}
+	}
+	return true
+}
+
+// NotModified reports whether the conditional headers of a request are
+// satisfied by the entry, so the client's copy can be confirmed with a
+// 304 Not Modified instead of resending the body (RFC 9110, section 13.2.2)
+func (e *Entry) NotModified(req *http.Request) bool {
+	if e.StatusCode != 200 {
+		return false
+	}
+
+	if ifNoneMatch := req.Header("If-None-Match"); ifNoneMatch != "" {
+		etag := strings.TrimPrefix(e.Header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range splitList(ifNoneMatch) {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	since, err := nethttp.ParseTime(req.Header("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	modified, err := nethttp.ParseTime(e.Header.Get("Last-Modified"))
+	return err == nil && !modified.After(since)
+}
+
+// date returns when the upstream generated the response, from its Date header
+func (e *Entry) date() time.Time {
+	if date, err := nethttp.ParseTime(e.Header.Get("Date")); err == nil {
+		return date
+	}
+	return e.responseTime
+}
+
+// freshnessLifetime computes how long a response stays fresh after it was
+// generated, from explicit directives or else heuristically from its
+// Last-Modified time (RFC 9111, section 4.2.1)
+func (e *Entry) freshnessLifetime() time.Duration {
+	if lifetime, ok := e.control.Seconds("s-maxage"); ok {
+		return lifetime
+	}
+	if lifetime, ok := e.control.Seconds("max-age"); ok {
+		return lifetime
+	}
+	if expires := e.Header.Get("Expires"); expires != "" {
+		// An invalid Expires, such as "0", means already expired
+		t, err := nethttp.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+		return max(0, t.Sub(e.date()))
+	}
+
+	if !heuristicStatuses[e.StatusCode] && !e.control.Has("public") {
+		return 0
+	}
+	modified, err := nethttp.ParseTime(e.Header.Get("Last-Modified"))
+	if err != nil {
+		return 0
+	}
+	return min(max(0, e.date().Sub(modified)/10), maxHeuristicLifetime)
+}
+
+// hasValidator reports whether the entry can be revalidated with a conditional request
+func (e *Entry) hasValidator() bool {
+	return e.Header.Get("ETag") != "" || e.Header.Get("Last-Modified") != ""
+}
+
+// varyMatches reports whether a request selects the same response as the one the entry was stored for
+func (e *Entry) varyMatches(req *http.Request) bool {
+	for name, value := range e.vary {
+		if normalizeHeader(req.Header(name)) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Storable reports whether a shared cache may store the response to a
+// request (RFC 9111, section 3). Only complete responses to GET requests
+// are stored, and responses setting cookies are never shared.
+func Storable(req *http.Request, resp *nethttp.Response) bool {
+	if req.Method != "GET" || req.Header("Range") != "" || resp.StatusCode < 200 || resp.StatusCode == 206 || resp.StatusCode == 304 {
+		return false
+	}
+	if requestControl(req).Has("no-store") {
+		return false
+	}
+
+	control := ParseCacheControl(strings.Join(resp.Header.Values("Cache-Control"), ","))
+	if control.Has("no-store") || control.Has("private") {
+		return false
+	}
+	if req.Header("Authorization") != "" && !control.Has("public") && !control.Has("s-maxage") && !control.Has("must-revalidate") {
+		return false
+	}
+	if resp.Header.Get("Set-Cookie") != "" {
+		return false
+	}
+	for _, name := range varyNames(resp.Header) {
+		if name == "*" {
+			return false
+		}
+	}
+
+	explicit := control.Has("max-age") || control.Has("s-maxage") || resp.Header.Get("Expires") != ""
+	return explicit || control.Has("public") || heuristicStatuses[resp.StatusCode]
+}
+
+// Cacheable reports whether a request may be answered from the cache at all.
+// Other requests are forwarded untouched.
+func Cacheable(req *http.Request) bool {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return false
+	}
+	return req.Header("Range") == "" && req.Header("Transfer-Encoding") == "" &&
+		(req.Header("Content-Length") == "" || req.Header("Content-Length") == "0")
+}
+
+// Invalidates reports whether a response to a request invalidates the stored
+// responses for its target, as successful unsafe requests do (RFC 9111, section 4.4)
+func Invalidates(req *http.Request, statusCode int) bool {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return false
+	}
+	return statusCode >= 200 && statusCode < 400
+}
+
+// requestControl returns the Cache-Control directives of a request, treating
+// "Pragma: no-cache" as "no-cache" for clients that send no Cache-Control
+func requestControl(req *http.Request) Directives {
+	value := req.Header("Cache-Control")
+	if value == "" && strings.Contains(strings.ToLower(req.Header("Pragma")), "no-cache") {
+		value = "no-cache"
+	}
+	return ParseCacheControl(value)
+}
+
+// varyNames returns the request header names listed in a response's Vary header
+func varyNames(header nethttp.Header) []string {
+	var names []string
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// normalizeHeader normalizes a header value for comparison when matching Vary
+func normalizeHeader(value string) string {
+	return strings.Join(strings.Fields(value), " ")
+}
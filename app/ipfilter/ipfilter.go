@@ -0,0 +1,93 @@
+package ipfilter
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// CIDRList is a list of network prefixes.
+// It implements flag.Value, accepting comma-separated prefixes or bare addresses.
+type CIDRList []netip.Prefix
+
+// ParseCIDRList parses a comma-separated list of prefixes or bare addresses
+func ParseCIDRList(s string) (CIDRList, error) {
+	var list CIDRList
+	if err := list.Set(s); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// String returns the list as comma-separated prefixes
+func (l *CIDRList) String() string {
+	prefixes := make([]string, 0, len(*l))
+	for _, prefix := range *l {
+		prefixes = append(prefixes, prefix.String())
+	}
+	return strings.Join(prefixes, ",")
+}
+
+// Type returns the flag value type name shown in usage
+func (l *CIDRList) Type() string {
+	return "cidrs"
+}
+
+// Set parses and appends comma-separated prefixes
+func (l *CIDRList) Set(value string) error {
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		if !strings.Contains(part, "/") {
+			addr, err := netip.ParseAddr(part)
+			if err != nil {
+				return fmt.Errorf("invalid address %q: %w", part, err)
+			}
+			*l = append(*l, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(part)
+		if err != nil {
+			return fmt.Errorf("invalid CIDR %q: %w", part, err)
+		}
+		*l = append(*l, prefix.Masked())
+	}
+	return nil
+}
+
+// Contains reports whether ip falls within any prefix of the list. IPv4
+// addresses mapped into IPv6 match as IPv4, and zones of link-local IPv6
+// addresses are ignored. Unparseable addresses are never contained.
+func (l CIDRList) Contains(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap().WithZone("")
+
+	for _, prefix := range l {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Filter decides which clients may connect, based on allow and deny lists
+type Filter struct {
+	Allow CIDRList
+	Deny  CIDRList
+}
+
+// Permits reports whether a client with the given IP may connect.
+// Denied addresses are always refused; when an allow list is set, only its addresses are permitted.
+func (f *Filter) Permits(ip string) bool {
+	if f.Deny.Contains(ip) {
+		return false
+	}
+	return len(f.Allow) == 0 || f.Allow.Contains(ip)
+}
@@ -0,0 +1,261 @@
+package lifecycle
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"octo-server/app/clock"
+	"octo-server/app/fsys"
+	"octo-server/app/metrics"
+)
+
+// Policy describes the lifecycle rules applied to the files directory.
+// Zero values disable the corresponding rule.
+type Policy struct {
+	// DeleteAfter removes files not modified for this long, including archived ones
+	DeleteAfter time.Duration
+	// ArchiveAfter moves files not modified for this long into ArchiveDir
+	ArchiveAfter time.Duration
+	// ArchiveDir is the subdirectory archived files are moved to
+	ArchiveDir string
+	// MaxSize caps the total size of the files, evicting the least recently used first
+	MaxSize int64
+	// Interval is how often the scheduler applies the rules
+	Interval time.Duration
+	// DryRun logs the actions that would be taken without touching any file
+	DryRun bool
+}
+
+// DefaultArchiveDir is the archive subdirectory used when none is configured
+const DefaultArchiveDir = "archive"
+
+// DefaultInterval is how often the rules are applied when no interval is configured
+const DefaultInterval = time.Hour
+
+// Enabled reports whether any rule is configured
+func (p Policy) Enabled() bool {
+	return p.DeleteAfter > 0 || p.ArchiveAfter > 0 || p.MaxSize > 0
+}
+
+// Validate reports the first problem found in the policy
+func (p Policy) Validate() error {
+	if p.DeleteAfter < 0 || p.ArchiveAfter < 0 || p.MaxSize < 0 || p.Interval < 0 {
+		return fmt.Errorf("lifecycle ages, sizes and intervals must not be negative")
+	}
+	if p.ArchiveDir != "" {
+		clean := filepath.Clean(p.ArchiveDir)
+		if filepath.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("lifecycle archive directory %q must be a subdirectory of the files directory", p.ArchiveDir)
+		}
+	}
+	return nil
+}
+
+// Action is one change made, or planned in a dry run, by a lifecycle pass
+type Action struct {
+	Kind string // "delete", "archive" or "evict"
+	File string
+	Size int64
+}
+
+// Runner applies a policy to a directory
+type Runner struct {
+	dir        string
+	policy     Policy
+	lastAccess func(name string) time.Time
+	log        io.Writer
+	clock      clock.Clock
+	fs         fsys.FS
+}
+
+// NewRunner creates a runner for the files in dir. lastAccess returns when a
+// file, named relative to dir, was last accessed, or the zero time if unknown;
+// it orders evictions, falling back to the modification time.
+func NewRunner(dir string, policy Policy, lastAccess func(name string) time.Time) *Runner {
+	if policy.ArchiveDir == "" {
+		policy.ArchiveDir = DefaultArchiveDir
+	}
+	if policy.Interval == 0 {
+		policy.Interval = DefaultInterval
+	}
+	if lastAccess == nil {
+		lastAccess = func(string) time.Time { return time.Time{} }
+	}
+	return &Runner{dir: dir, policy: policy, lastAccess: lastAccess, log: os.Stdout, clock: clock.Real, fs: fsys.OS}
+}
+
+// SetLog redirects the log of actions, which goes to standard output by default
+func (r *Runner) SetLog(w io.Writer) {
+	r.log = w
+}
+
+// SetClock sets the clock file ages and the schedule are measured on
+func (r *Runner) SetClock(c clock.Clock) {
+	r.clock = c
+}
+
+// SetFS sets the file system the directory is on
+func (r *Runner) SetFS(fs fsys.FS) {
+	r.fs = fs
+}
+
+// Start applies the rules every interval until the process exits
+func (r *Runner) Start() {
+	go func() {
+		ticker := r.clock.NewTicker(r.policy.Interval)
+		defer ticker.Stop()
+
+		for {
+			if _, err := r.Run(); err != nil {
+				fmt.Fprintf(os.Stderr, "Lifecycle pass failed: %v\n", err)
+			}
+			<-ticker.C()
+		}
+	}()
+}
+
+// file is a candidate for lifecycle actions
+type file struct {
+	name     string // relative to the directory
+	size     int64
+	modTime  time.Time
+	archived bool
+}
+
+// Run applies the rules once: expired files are deleted, old files archived,
+// then the least recently used files evicted until the directory fits its cap.
+// It returns the actions taken, or that would be taken in a dry run. An error is
+// only returned if the directory cannot be listed; failing actions are logged.
+func (r *Runner) Run() ([]Action, error) {
+	files, err := r.scan()
+	if err != nil {
+		return nil, err
+	}
+
+	now := r.clock.Now()
+	var actions []Action
+	var kept []file
+	for _, f := range files {
+		age := now.Sub(f.modTime)
+		switch {
+		case r.policy.DeleteAfter > 0 && age > r.policy.DeleteAfter:
+			if !r.apply(Action{"delete", f.name, f.size}, &actions) {
+				kept = append(kept, f)
+			}
+		case r.policy.ArchiveAfter > 0 && age > r.policy.ArchiveAfter && !f.archived:
+			if r.apply(Action{"archive", f.name, f.size}, &actions) {
+				f.name = filepath.Join(r.policy.ArchiveDir, f.name)
+			}
+			kept = append(kept, f)
+		default:
+			kept = append(kept, f)
+		}
+	}
+
+	if r.policy.MaxSize > 0 {
+		var total int64
+		for _, f := range kept {
+			total += f.size
+		}
+
+		// Least recently used first
+		sort.Slice(kept, func(i, j int) bool { return r.used(kept[i]).Before(r.used(kept[j])) })
+		for _, f := range kept {
+			if total <= r.policy.MaxSize {
+				break
+			}
+			if r.apply(Action{"evict", f.name, f.size}, &actions) {
+				total -= f.size
+			}
+		}
+	}
+
+	return actions, nil
+}
+
+// used returns when a file was last used, by access or modification
+func (r *Runner) used(f file) time.Time {
+	if accessed := r.lastAccess(f.name); accessed.After(f.modTime) {
+		return accessed
+	}
+	return f.modTime
+}
+
+// scan lists the visible regular files at the top of the directory and in the archive
+func (r *Runner) scan() ([]file, error) {
+	var files []file
+	for _, sub := range []string{"", r.policy.ArchiveDir} {
+		entries, err := r.fs.ReadDir(filepath.Join(r.dir, sub))
+		if err != nil {
+			if sub != "" && os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			// Skip directories and hidden files such as uploads in progress
+			if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			files = append(files, file{
+				name:     filepath.Join(sub, entry.Name()),
+				size:     info.Size(),
+				modTime:  info.ModTime(),
+				archived: sub != "",
+			})
+		}
+	}
+	return files, nil
+}
+
+// apply carries out an action unless in a dry run, logging and recording it.
+// Failures are logged and reported as false so the pass carries on with other files.
+func (r *Runner) apply(action Action, actions *[]Action) bool {
+	if r.policy.DryRun {
+		fmt.Fprintf(r.log, "Lifecycle (dry run): would %s %s (%d bytes)\n", action.Kind, action.File, action.Size)
+		*actions = append(*actions, action)
+		return true
+	}
+
+	path := filepath.Join(r.dir, action.File)
+	var err error
+	if action.Kind == "archive" {
+		archiveDir := filepath.Join(r.dir, r.policy.ArchiveDir)
+		if err = r.fs.MkdirAll(archiveDir, 0755); err == nil {
+			err = r.fs.Rename(path, filepath.Join(archiveDir, action.File))
+		}
+	} else {
+		err = r.fs.Remove(path)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Lifecycle: failed to %s %s: %v\n", action.Kind, action.File, err)
+		return false
+	}
+
+	fmt.Fprintf(r.log, "Lifecycle: %s %s (%d bytes)\n", pastTense(action.Kind), action.File, action.Size)
+	metrics.Default.Inc("lifecycle_actions_total", "action", action.Kind)
+	*actions = append(*actions, action)
+	return true
+}
+
+// pastTense returns the log verb for an action kind
+func pastTense(kind string) string {
+	switch kind {
+	case "archive":
+		return "archived"
+	case "evict":
+		return "evicted"
+	default:
+		return kind + "d"
+	}
+}
@@ -1,27 +1,13 @@
 package main
 
 import (
-	"flag"
-	"fmt"
 	"os"
 
-	"octo-server/app/config"
-	"octo-server/app/server"
+	"octo-server/app/cli"
 )
 
 func main() {
-	// Parse command-line flags
-	directory := flag.String("directory", "", "The directory from which files should be served")
-	port := flag.String("port", "4221", "The port on which the server should listen")
-	flag.Parse()
-
-	// Create configuration
-	cfg := config.NewConfig(*directory, *port)
-
-	// Create and start server
-	srv := server.NewServer(cfg)
-	if err := srv.Start(); err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to start server: %v\n", err)
+	if err := cli.Execute(); err != nil {
 		os.Exit(1)
 	}
 }
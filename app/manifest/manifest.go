@@ -0,0 +1,225 @@
+// Package manifest lists every file of a directory with its content hash, so
+// sync clients can tell what changed since their last sync with one request
+package manifest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"octo-server/app/metrics"
+)
+
+// historySize is how many earlier manifests are kept to answer delta requests
+const historySize = 16
+
+// Entry describes one file of a manifest
+type Entry struct {
+	// Path is the file's path relative to the directory, separated by "/"
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	// Hash is the hex-encoded SHA-256 of the file's content
+	Hash string `json:"hash"`
+}
+
+// Manifest is a snapshot of the files of a directory, sorted by path
+type Manifest struct {
+	// ETag identifies the snapshot; it changes whenever any file is added, removed or changed
+	ETag    string
+	Entries []Entry
+}
+
+// Delta lists the changes between two manifests
+type Delta struct {
+	// Changed are the files added or changed since the base manifest
+	Changed []Entry `json:"changed"`
+	// Deleted are the paths of the files removed since the base manifest
+	Deleted []string `json:"deleted"`
+}
+
+// cachedHash is the hash of a file as of the size and modification time it was computed at
+type cachedHash struct {
+	size    int64
+	modTime time.Time
+	hash    string
+}
+
+// Index builds manifests of a directory. Hashes are only recomputed for files
+// whose size or modification time changed, and recent manifests are kept so
+// that clients can ask for the changes since one of them. Uploads record the
+// hashes they compute while streaming, so new files are not read again.
+type Index struct {
+	dir string
+
+	// walking serializes walks, which may take long while files are hashed
+	walking sync.Mutex
+
+	mu      sync.Mutex
+	hashes  map[string]cachedHash
+	history []*Manifest
+}
+
+// New creates an index of the files in dir
+func New(dir string) *Index {
+	return &Index{dir: dir, hashes: make(map[string]cachedHash)}
+}
+
+// Current walks the directory and returns its manifest. Hidden files and
+// directories, such as the trash and uploads in progress, are left out.
+func (x *Index) Current() (*Manifest, error) {
+	x.walking.Lock()
+	defer x.walking.Unlock()
+
+	m := &Manifest{Entries: []Entry{}}
+	seen := make(map[string]bool)
+	err := filepath.WalkDir(x.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == x.dir {
+				return err
+			}
+			// Files removed while walking are left out
+			return nil
+		}
+		if path == x.dir {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(x.dir, path)
+		if err != nil {
+			return nil
+		}
+		name := filepath.ToSlash(rel)
+		hash, err := x.hash(name, path, info)
+		if err != nil {
+			return nil
+		}
+		seen[name] = true
+		m.Entries = append(m.Entries, Entry{Path: name, Size: info.Size(), ModTime: info.ModTime().UTC(), Hash: hash})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for name := range x.hashes {
+		// Files recorded after the walk passed them are kept
+		if _, err := os.Stat(filepath.Join(x.dir, filepath.FromSlash(name))); !seen[name] && err != nil {
+			delete(x.hashes, name)
+		}
+	}
+
+	slices.SortFunc(m.Entries, func(a, b Entry) int { return strings.Compare(a.Path, b.Path) })
+	tag := sha256.New()
+	for _, e := range m.Entries {
+		fmt.Fprintf(tag, "%s\x00%d\x00%d\x00%s\n", e.Path, e.Size, e.ModTime.UnixNano(), e.Hash)
+	}
+	m.ETag = `"` + hex.EncodeToString(tag.Sum(nil)[:16]) + `"`
+
+	if len(x.history) == 0 || x.history[len(x.history)-1].ETag != m.ETag {
+		x.history = append(x.history, m)
+		if len(x.history) > historySize {
+			x.history = x.history[1:]
+		}
+	}
+	return m, nil
+}
+
+// hash returns the content hash of a file, reusing the cached one while its size and modification time are unchanged
+func (x *Index) hash(name, path string, info fs.FileInfo) (string, error) {
+	x.mu.Lock()
+	cached, ok := x.hashes[name]
+	x.mu.Unlock()
+	if ok && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+		return cached.hash, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, file)
+	metrics.Default.Add("sync_manifest_hashed_bytes_total", n)
+	if err != nil {
+		return "", err
+	}
+
+	hash := hex.EncodeToString(h.Sum(nil))
+	x.Record(name, info, hash)
+	return hash, nil
+}
+
+// Record stores the hex-encoded SHA-256 of a file's content, computed by the
+// caller while writing it, as of the size and modification time in info.
+// name is the file's path relative to the directory, separated by "/".
+func (x *Index) Record(name string, info fs.FileInfo, hash string) {
+	// Hidden files are never listed, so their hashes would only linger
+	for _, segment := range strings.Split(name, "/") {
+		if strings.HasPrefix(segment, ".") {
+			return
+		}
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.hashes[name] = cachedHash{size: info.Size(), modTime: info.ModTime(), hash: hash}
+}
+
+// Lookup returns a recent manifest by its ETag, or nil if it is unknown or too old
+func (x *Index) Lookup(etag string) *Manifest {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	for _, m := range x.history {
+		if m.ETag == etag {
+			return m
+		}
+	}
+	return nil
+}
+
+// Diff returns the changes that turn the base manifest into m
+func (m *Manifest) Diff(base *Manifest) Delta {
+	delta := Delta{Changed: []Entry{}, Deleted: []string{}}
+	old := make(map[string]Entry, len(base.Entries))
+	for _, e := range base.Entries {
+		old[e.Path] = e
+	}
+	for _, e := range m.Entries {
+		if prev, ok := old[e.Path]; !ok || prev.Hash != e.Hash || prev.Size != e.Size || !prev.ModTime.Equal(e.ModTime) {
+			delta.Changed = append(delta.Changed, e)
+		}
+		delete(old, e.Path)
+	}
+	for _, e := range base.Entries {
+		if _, ok := old[e.Path]; ok {
+			delta.Deleted = append(delta.Deleted, e.Path)
+		}
+	}
+	return delta
+}
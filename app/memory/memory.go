@@ -0,0 +1,91 @@
+package memory
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// ErrBudgetExceeded is returned when a reservation would exceed the global budget
+var ErrBudgetExceeded = errors.New("memory budget exceeded")
+
+// Budget accounts approximate memory held by all connections against a global limit
+type Budget struct {
+	limit int64
+	used  atomic.Int64
+}
+
+// NewBudget creates a budget of limit bytes; zero means unlimited
+func NewBudget(limit int64) *Budget {
+	return &Budget{limit: limit}
+}
+
+// Reserve takes n bytes from the budget, reporting false if that would exceed the limit
+func (b *Budget) Reserve(n int64) bool {
+	for {
+		used := b.used.Load()
+		if b.limit > 0 && used+n > b.limit {
+			return false
+		}
+		if b.used.CompareAndSwap(used, used+n) {
+			return true
+		}
+	}
+}
+
+// Release returns n bytes to the budget
+func (b *Budget) Release(n int64) {
+	b.used.Add(-n)
+}
+
+// Used returns the number of bytes currently reserved
+func (b *Budget) Used() int64 {
+	return b.used.Load()
+}
+
+// Limit returns the budget size in bytes, or zero if unlimited
+func (b *Budget) Limit() int64 {
+	return b.limit
+}
+
+// Account tracks the memory held by a single connection
+type Account struct {
+	budget *Budget
+	held   atomic.Int64
+}
+
+// NewAccount creates an empty account drawing on the budget
+func (b *Budget) NewAccount() *Account {
+	return &Account{budget: b}
+}
+
+// Reserve takes n bytes from the budget on behalf of the connection
+func (a *Account) Reserve(n int64) error {
+	if !a.budget.Reserve(n) {
+		return ErrBudgetExceeded
+	}
+	a.held.Add(n)
+	return nil
+}
+
+// Charge records n bytes of fixed connection overhead, such as read buffers,
+// which count against the budget but are never refused
+func (a *Account) Charge(n int64) {
+	a.budget.used.Add(n)
+	a.held.Add(n)
+}
+
+// Release returns n bytes previously reserved by the connection
+func (a *Account) Release(n int64) {
+	a.held.Add(-n)
+	a.budget.Release(n)
+}
+
+// Held returns the number of bytes currently held by the connection
+func (a *Account) Held() int64 {
+	return a.held.Load()
+}
+
+// Close releases everything the connection still holds
+func (a *Account) Close() {
+	a.Release(a.held.Load())
+}
@@ -0,0 +1,191 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Registry holds a set of named counters and gauges
+type Registry struct {
+	mu       sync.Mutex
+	counters map[string]*atomic.Int64
+	gauges   map[string]func() int64
+}
+
+// Default is the registry used by the server
+var Default = NewRegistry()
+
+// NewRegistry creates an empty metrics registry
+func NewRegistry() *Registry {
+	return &Registry{
+		counters: make(map[string]*atomic.Int64),
+		gauges:   make(map[string]func() int64),
+	}
+}
+
+// Inc increments the counter with the given name and labels by one
+func (r *Registry) Inc(name string, labels ...string) {
+	r.Add(name, 1, labels...)
+}
+
+// Add increments the counter with the given name and labels by delta.
+// Labels are given as alternating key/value pairs.
+func (r *Registry) Add(name string, delta int64, labels ...string) {
+	r.counter(seriesName(name, labels)).Add(delta)
+}
+
+// Get returns the current value of the counter with the given name and labels
+func (r *Registry) Get(name string, labels ...string) int64 {
+	return r.counter(seriesName(name, labels)).Load()
+}
+
+// Gauge registers a gauge whose value is read from fn whenever metrics are written,
+// replacing any gauge previously registered with the same name and labels
+func (r *Registry) Gauge(name string, fn func() int64, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.gauges[seriesName(name, labels)] = fn
+}
+
+// WriteText writes all counters and gauges in the Prometheus text exposition format
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	values := make(map[string]func() int64, len(r.counters)+len(r.gauges))
+	for name, c := range r.counters {
+		values[name] = c.Load
+	}
+	for name, fn := range r.gauges {
+		values[name] = fn
+	}
+	r.mu.Unlock()
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := fmt.Fprintf(w, "%s %d\n", name, values[name]()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Serve answers every connection accepted on listener with the registry's
+// metrics in the text format, until the listener is closed
+func (r *Registry) Serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		conn.SetWriteDeadline(time.Now().Add(gatherTimeout))
+		r.WriteText(conn)
+		conn.Close()
+	}
+}
+
+// gatherTimeout bounds how long Gather waits for each process's metrics
+const gatherTimeout = time.Second
+
+// Gather writes the metrics served by Serve on every Unix socket in dir, e.g.
+// by each process of a server, summed series by series. Sockets that cannot
+// be read, such as those of processes that exited, are skipped.
+func Gather(w io.Writer, dir string) error {
+	sockets, err := filepath.Glob(filepath.Join(dir, "*.sock"))
+	if err != nil {
+		return err
+	}
+	totals := make(map[string]int64)
+	for _, socket := range sockets {
+		if err := gatherFrom(socket, totals); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to gather metrics from %s: %v\n", socket, err)
+		}
+	}
+
+	names := make([]string, 0, len(totals))
+	for name := range totals {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := fmt.Fprintf(w, "%s %d\n", name, totals[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// gatherFrom adds the metrics served on a Unix socket to totals
+func gatherFrom(socket string, totals map[string]int64) error {
+	conn, err := net.DialTimeout("unix", socket, gatherTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(gatherTimeout))
+
+	// Only whole responses are counted, so a process dying midway changes nothing
+	values := make(map[string]int64)
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		i := strings.LastIndexByte(scanner.Text(), ' ')
+		if i < 0 {
+			continue
+		}
+		value, err := strconv.ParseInt(scanner.Text()[i+1:], 10, 64)
+		if err != nil {
+			continue
+		}
+		values[scanner.Text()[:i]] += value
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	for name, value := range values {
+		totals[name] += value
+	}
+	return nil
+}
+
+// counter returns the counter for a series, creating it if needed
+func (r *Registry) counter(series string) *atomic.Int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.counters[series]
+	if !ok {
+		c = &atomic.Int64{}
+		r.counters[series] = c
+	}
+	return c
+}
+
+// seriesName builds a series name such as name{key="value"}
+func seriesName(name string, labels []string) string {
+	if len(labels) < 2 {
+		return name
+	}
+
+	series := name + "{"
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			series += ","
+		}
+		series += fmt.Sprintf("%s=%q", labels[i], labels[i+1])
+	}
+	return series + "}"
+}
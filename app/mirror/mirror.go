@@ -0,0 +1,110 @@
+package mirror
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	nethttp "net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fetchTimeout bounds how long the origin may take to send response headers
+const fetchTimeout = 30 * time.Second
+
+// ErrNotFound is returned when the origin does not have the requested file
+var ErrNotFound = errors.New("file not found at origin")
+
+// fetch is an in-flight fetch of one file, shared by concurrent requests for it
+type fetch struct {
+	done chan struct{}
+	err  error
+}
+
+// Mirror fetches files missing locally from an origin server, so the files
+// directory fills lazily as files are requested
+type Mirror struct {
+	origin *url.URL
+	client *nethttp.Client
+
+	mu       sync.Mutex
+	inflight map[string]*fetch
+}
+
+// New creates a mirror of the files below an origin URL, e.g. "https://example.com/files"
+func New(origin *url.URL) *Mirror {
+	return &Mirror{
+		origin: origin,
+		client: &nethttp.Client{
+			Transport: &nethttp.Transport{
+				Proxy:                 nethttp.ProxyFromEnvironment,
+				ResponseHeaderTimeout: fetchTimeout,
+			},
+		},
+		inflight: make(map[string]*fetch),
+	}
+}
+
+// ParseOrigin parses and validates an origin URL
+func ParseOrigin(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid origin %q: must be an http or https URL", s)
+	}
+	return u, nil
+}
+
+// Origin returns the URL files are fetched from
+func (m *Mirror) Origin() *url.URL {
+	return m.origin
+}
+
+// Fetch downloads a file from the origin and passes its content to store.
+// Concurrent fetches of the same file are merged: only the first downloads
+// it, and the others wait for it and return its result.
+func (m *Mirror) Fetch(name string, store func(r io.Reader) error) error {
+	m.mu.Lock()
+	if f, ok := m.inflight[name]; ok {
+		m.mu.Unlock()
+		<-f.done
+		return f.err
+	}
+	f := &fetch{done: make(chan struct{})}
+	m.inflight[name] = f
+	m.mu.Unlock()
+
+	f.err = m.fetch(name, store)
+
+	m.mu.Lock()
+	delete(m.inflight, name)
+	m.mu.Unlock()
+	close(f.done)
+	return f.err
+}
+
+// fetch downloads a single file from the origin
+func (m *Mirror) fetch(name string, store func(r io.Reader) error) error {
+	target := *m.origin
+	target.Path = strings.TrimSuffix(target.Path, "/") + "/" + name
+	target.RawPath = ""
+
+	resp, err := m.client.Get(target.String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == nethttp.StatusNotFound || resp.StatusCode == nethttp.StatusGone:
+		return ErrNotFound
+	case resp.StatusCode != nethttp.StatusOK:
+		return fmt.Errorf("origin responded with %s", resp.Status)
+	}
+
+	if err := store(resp.Body); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package progress
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"octo-server/app/clock"
+)
+
+// Upload states reported in snapshots
+const (
+	StateUploading = "uploading"
+	StateDone      = "done"
+	StateFailed    = "failed"
+)
+
+// Upload tracks the bytes received for one in-flight upload
+type Upload struct {
+	id       string
+	file     string
+	total    int64
+	started  time.Time
+	clock    clock.Clock
+	received atomic.Int64
+	updated  atomic.Int64 // unix nanoseconds
+	state    atomic.Value // string
+}
+
+// Reader wraps r, counting the bytes read from it as received
+func (u *Upload) Reader(r io.Reader) io.Reader {
+	return &countingReader{upload: u, reader: r}
+}
+
+// Snapshot is the progress of an upload at a point in time
+type Snapshot struct {
+	ID        string    `json:"id"`
+	File      string    `json:"file"`
+	State     string    `json:"state"`
+	Received  int64     `json:"received"`
+	Total     int64     `json:"total"` // -1 when the client did not declare a length
+	Percent   float64   `json:"percent,omitempty"`
+	StartedAt time.Time `json:"startedAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Tracker holds the uploads in flight, and finished ones for a retention period
+// so that clients polling for progress observe the final state
+type Tracker struct {
+	mu        sync.Mutex
+	uploads   map[string]*Upload
+	retention time.Duration
+	clock     clock.Clock
+}
+
+// NewTracker creates a tracker keeping finished uploads for the retention period
+func NewTracker(retention time.Duration) *Tracker {
+	return &Tracker{
+		uploads:   make(map[string]*Upload),
+		retention: retention,
+		clock:     clock.Real,
+	}
+}
+
+// SetClock sets the clock progress and retention are timed on
+func (t *Tracker) SetClock(c clock.Clock) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.clock = c
+}
+
+// Start begins tracking an upload of total bytes (-1 if unknown) to file.
+// It reports false if an upload with the same ID is still in flight.
+func (t *Tracker) Start(id, file string, total int64) (*Upload, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.expire()
+	if existing, ok := t.uploads[id]; ok && existing.state.Load() == StateUploading {
+		return nil, false
+	}
+
+	now := t.clock.Now()
+	u := &Upload{id: id, file: file, total: total, started: now, clock: t.clock}
+	u.updated.Store(now.UnixNano())
+	u.state.Store(StateUploading)
+	t.uploads[id] = u
+	return u, true
+}
+
+// Finish marks an upload as done, or failed if err is not nil
+func (t *Tracker) Finish(u *Upload, err error) {
+	if err != nil {
+		u.state.Store(StateFailed)
+	} else {
+		u.state.Store(StateDone)
+	}
+	u.updated.Store(u.clock.Now().UnixNano())
+}
+
+// Get returns the progress of the upload with the given ID
+func (t *Tracker) Get(id string) (Snapshot, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.expire()
+	u, ok := t.uploads[id]
+	if !ok {
+		return Snapshot{}, false
+	}
+
+	snapshot := Snapshot{
+		ID:        u.id,
+		File:      u.file,
+		State:     u.state.Load().(string),
+		Received:  u.received.Load(),
+		Total:     u.total,
+		StartedAt: u.started,
+		UpdatedAt: time.Unix(0, u.updated.Load()),
+	}
+	if u.total > 0 {
+		snapshot.Percent = float64(snapshot.Received) * 100 / float64(u.total)
+	}
+	return snapshot, true
+}
+
+// expire forgets finished uploads older than the retention period; t.mu must be held
+func (t *Tracker) expire() {
+	cutoff := t.clock.Now().Add(-t.retention).UnixNano()
+	for id, u := range t.uploads {
+		if u.state.Load() != StateUploading && u.updated.Load() < cutoff {
+			delete(t.uploads, id)
+		}
+	}
+}
+
+// countingReader counts the bytes read through it into an upload
+type countingReader struct {
+	upload *Upload
+	reader io.Reader
+}
+
+// Read implements io.Reader
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.reader.Read(b)
+	if n > 0 {
+		r.upload.received.Add(int64(n))
+		r.upload.updated.Store(r.upload.clock.Now().UnixNano())
+	}
+	return n, err
+}
@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	nethttp "net/http"
+	"strings"
+	"time"
+
+	"octo-server/app/metrics"
+)
+
+// Consecutive probe results needed to change an upstream's health, so a
+// single slow probe does not take an upstream out of the rotation
+const (
+	unhealthyThreshold = 2
+	healthyThreshold   = 2
+)
+
+// maxProbeTimeout bounds a single health probe
+const maxProbeTimeout = 5 * time.Second
+
+// HealthCheck configures the active health checking of a proxy's upstreams
+type HealthCheck struct {
+	// Interval between probes of each upstream; zero disables health checking
+	Interval time.Duration
+	// Path is requested with GET on each upstream, which is healthy when it
+	// answers 2xx or 3xx. When empty, upstreams are probed with a TCP connect.
+	Path string
+}
+
+// UpstreamStatus is the health of an upstream at a point in time
+type UpstreamStatus struct {
+	Route     string    `json:"route"`
+	URL       string    `json:"url"`
+	Healthy   bool      `json:"healthy"`
+	Active    int64     `json:"active"`
+	LastCheck time.Time `json:"lastCheck,omitzero"`
+	LastError string    `json:"lastError,omitempty"`
+}
+
+// Status reports the health of every upstream of the proxy
+func (p *Proxy) Status() []UpstreamStatus {
+	statuses := make([]UpstreamStatus, 0, len(p.upstreams))
+	for _, u := range p.upstreams {
+		u.mu.Lock()
+		statuses = append(statuses, UpstreamStatus{
+			Route:     p.route.Name(),
+			URL:       u.url.String(),
+			Healthy:   u.healthy.Load(),
+			Active:    u.active.Load(),
+			LastCheck: u.lastCheck,
+			LastError: u.lastError,
+		})
+		u.mu.Unlock()
+	}
+	return statuses
+}
+
+// StartHealthChecks probes the upstreams in the background until the process exits,
+// taking unhealthy ones out of the rotation and putting them back once they recover
+func (p *Proxy) StartHealthChecks() {
+	if p.options.HealthCheck.Interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(p.options.HealthCheck.Interval)
+		defer ticker.Stop()
+
+		for {
+			for _, u := range p.upstreams {
+				go p.check(u)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// check probes an upstream once and updates its health
+func (p *Proxy) check(u *upstream) {
+	err := p.probe(u)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.lastCheck = time.Now()
+	if err != nil {
+		u.lastError = err.Error()
+		u.passes = 0
+		u.fails++
+		if u.fails >= unhealthyThreshold && u.healthy.CompareAndSwap(true, false) {
+			metrics.Default.Inc("proxy_upstream_health_changes_total", "route", p.route.Name(), "upstream", u.url.Host, "to", "unhealthy")
+			fmt.Printf("Upstream unhealthy: route=%s upstream=%s err=%v\n", p.route.Name(), u.url, err)
+		}
+		return
+	}
+
+	u.lastError = ""
+	u.fails = 0
+	u.passes++
+	if u.passes >= healthyThreshold && u.healthy.CompareAndSwap(false, true) {
+		metrics.Default.Inc("proxy_upstream_health_changes_total", "route", p.route.Name(), "upstream", u.url.Host, "to", "healthy")
+		fmt.Printf("Upstream healthy: route=%s upstream=%s\n", p.route.Name(), u.url)
+	}
+}
+
+// probe checks an upstream with a GET of the health check path, or a TCP connect without one
+func (p *Proxy) probe(u *upstream) error {
+	timeout := min(p.options.HealthCheck.Interval, maxProbeTimeout)
+
+	if p.options.HealthCheck.Path == "" {
+		conn, err := net.DialTimeout("tcp", hostPort(u), timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	target := *u.url
+	target.Path = strings.TrimSuffix(target.Path, "/") + "/" + strings.TrimPrefix(p.options.HealthCheck.Path, "/")
+	target.RawPath = ""
+
+	client := &nethttp.Client{
+		Transport: u.transport,
+		Timeout:   timeout,
+		CheckRedirect: func(*nethttp.Request, []*nethttp.Request) error {
+			return nethttp.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get(target.String())
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 399 {
+		return fmt.Errorf("health check responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// hostPort returns the address of an upstream, with the default port of its scheme if none is given
+func hostPort(u *upstream) string {
+	if u.url.Port() != "" {
+		return u.url.Host
+	}
+	if u.url.Scheme == "https" {
+		return net.JoinHostPort(u.url.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.url.Hostname(), "80")
+}
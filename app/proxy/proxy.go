@@ -0,0 +1,276 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	nethttp "net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"octo-server/app/http"
+	"octo-server/app/metrics"
+)
+
+// Upstream timeouts
+const (
+	dialTimeout           = 10 * time.Second
+	responseHeaderTimeout = 30 * time.Second
+)
+
+// ErrBadPath is returned by Forward for a request path with invalid escapes,
+// which cannot be passed on as it was sent
+var ErrBadPath = errors.New("invalid escape in request path")
+
+// Balancing strategies choosing the upstream of each request
+const (
+	RoundRobin = "round-robin"
+	LeastConns = "least-conns"
+)
+
+// Route forwards requests whose target starts with Prefix to one of its
+// upstream servers. A route with a Host only applies to requests for that host.
+type Route struct {
+	Host      string
+	Prefix    string
+	Upstreams []*url.URL
+}
+
+// Name identifies the route in logs and metrics, as its host and prefix
+func (r Route) Name() string {
+	return r.Host + r.Prefix
+}
+
+// String formats the route in the syntax accepted by ParseRoute
+func (r Route) String() string {
+	upstreams := make([]string, 0, len(r.Upstreams))
+	for _, u := range r.Upstreams {
+		upstreams = append(upstreams, u.String())
+	}
+	return r.Name() + "=" + strings.Join(upstreams, "|")
+}
+
+// ParseRoute parses a route of the form "[HOST]PREFIX=URL[|URL...]", e.g.
+// "/api=http://10.0.0.1:8080|http://10.0.0.2:8080", or
+// "api.example.com/v1=http://10.0.0.1:8080" for requests to one host only
+func ParseRoute(s string) (Route, error) {
+	prefix, upstreams, ok := strings.Cut(strings.TrimSpace(s), "=")
+	if !ok {
+		return Route{}, fmt.Errorf("invalid proxy route %q: expected PREFIX=URL", s)
+	}
+	host := ""
+	if slash := strings.Index(prefix, "/"); slash > 0 {
+		host, prefix = strings.ToLower(prefix[:slash]), prefix[slash:]
+	}
+	if !strings.HasPrefix(prefix, "/") {
+		return Route{}, fmt.Errorf("invalid proxy route %q: prefix must start with '/'", s)
+	}
+
+	route := Route{Host: host, Prefix: strings.TrimSuffix(prefix, "/")}
+	for _, upstream := range strings.Split(upstreams, "|") {
+		u, err := url.Parse(strings.TrimSpace(upstream))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return Route{}, fmt.Errorf("invalid proxy route %q: upstream %q must be an http or https URL", s, upstream)
+		}
+		route.Upstreams = append(route.Upstreams, u)
+	}
+	return route, nil
+}
+
+// ValidateBalance checks that a balancing strategy is known
+func ValidateBalance(balance string) error {
+	if balance != RoundRobin && balance != LeastConns {
+		return fmt.Errorf("unknown proxy balancing strategy %q: must be %s or %s", balance, RoundRobin, LeastConns)
+	}
+	return nil
+}
+
+// Options configure a proxy
+type Options struct {
+	// Balance is the strategy choosing among the upstreams, RoundRobin by default
+	Balance string
+	// ForwardedProto is the scheme clients used to reach this server, sent upstream in X-Forwarded-Proto
+	ForwardedProto string
+	// HealthCheck configures probing the upstreams; unhealthy ones are skipped
+	HealthCheck HealthCheck
+}
+
+// upstream is one server of a route, with its own pool of reused connections
+type upstream struct {
+	url       *url.URL
+	transport *nethttp.Transport
+	active    atomic.Int64 // requests in flight, including responses still streaming
+	healthy   atomic.Bool
+
+	// Health check state, guarded by mu
+	mu        sync.Mutex
+	fails     int
+	passes    int
+	lastCheck time.Time
+	lastError string
+}
+
+// Proxy forwards requests matching a route to its upstreams
+type Proxy struct {
+	route     Route
+	options   Options
+	upstreams []*upstream
+
+	mu   sync.Mutex
+	next int
+}
+
+// New creates a proxy for a route
+func New(route Route, options Options) *Proxy {
+	if options.Balance == "" {
+		options.Balance = RoundRobin
+	}
+
+	p := &Proxy{route: route, options: options}
+	for _, u := range route.Upstreams {
+		up := &upstream{
+			url: u,
+			transport: &nethttp.Transport{
+				Proxy:                 nil,
+				DialContext:           (&net.Dialer{Timeout: dialTimeout}).DialContext,
+				ResponseHeaderTimeout: responseHeaderTimeout,
+				MaxIdleConnsPerHost:   32,
+				IdleConnTimeout:       90 * time.Second,
+				// Pass Accept-Encoding through and the upstream's encoding back untouched
+				DisableCompression: true,
+			},
+		}
+		up.healthy.Store(true)
+		p.upstreams = append(p.upstreams, up)
+
+		metrics.Default.Gauge("proxy_upstream_healthy", func() int64 {
+			if up.healthy.Load() {
+				return 1
+			}
+			return 0
+		}, "route", route.Name(), "upstream", u.Host)
+		metrics.Default.Gauge("proxy_upstream_active_requests", up.active.Load, "route", route.Name(), "upstream", u.Host)
+	}
+	return p
+}
+
+// Route returns the route served by the proxy
+func (p *Proxy) Route() Route {
+	return p.route
+}
+
+// pick chooses the upstream of the next request among the healthy ones.
+// When none is healthy, every upstream is tried rather than failing outright.
+func (p *Proxy) pick() *upstream {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	anyHealthy := false
+	for _, u := range p.upstreams {
+		anyHealthy = anyHealthy || u.healthy.Load()
+	}
+	eligible := func(u *upstream) bool {
+		return !anyHealthy || u.healthy.Load()
+	}
+
+	// Candidates are scanned from the one after the last pick, so ties rotate
+	var best *upstream
+	bestIndex := 0
+	for i := range p.upstreams {
+		index := (p.next + i) % len(p.upstreams)
+		u := p.upstreams[index]
+		if !eligible(u) {
+			continue
+		}
+		if best == nil || (p.options.Balance == LeastConns && u.active.Load() < best.active.Load()) {
+			best, bestIndex = u, index
+		}
+	}
+
+	p.next = (bestIndex + 1) % len(p.upstreams)
+	return best
+}
+
+// Forward sends a request to one of the upstreams and returns its response,
+// along with the upstream chosen. The path after the route's prefix is
+// appended to the upstream URL's path, and the caller must close the
+// response body.
+func (p *Proxy) Forward(req *http.Request) (*nethttp.Response, *url.URL, error) {
+	up := p.pick()
+
+	// The path is passed on as it was sent, so escapes such as %2F keep their meaning
+	target := *up.url
+	path, rawQuery, _ := strings.Cut(req.RequestTarget, "?")
+	target.RawPath = strings.TrimSuffix(up.url.EscapedPath(), "/") + "/" + strings.TrimPrefix(strings.TrimPrefix(path, p.route.Prefix), "/")
+	decoded, err := url.PathUnescape(target.RawPath)
+	if err != nil {
+		return nil, up.url, fmt.Errorf("%w %q", ErrBadPath, path)
+	}
+	target.Path = decoded
+	target.RawQuery = rawQuery
+
+	var body io.Reader
+	if req.ContentLength() > 0 || req.Headers.Has("Transfer-Encoding") {
+		if body, err = req.BodyReader(); err != nil {
+			return nil, up.url, err
+		}
+	}
+
+	// The upstream request is abandoned with the request, when the client goes away or it times out
+	out, err := nethttp.NewRequestWithContext(req.Context(), req.Method, target.String(), body)
+	if err != nil {
+		return nil, up.url, err
+	}
+	if n := req.ContentLength(); n >= 0 {
+		out.ContentLength = n
+	}
+
+	for key, values := range req.Headers {
+		out.Header[key] = slices.Clone(values)
+	}
+	http.Header(out.Header).DelHopByHop()
+	out.Header.Del("Host")
+	out.Header.Del("Content-Length")
+
+	// The Host header is rewritten to the upstream's, so pass the original on.
+	// The peer is the next hop of the chain, whether or not it is a trusted proxy.
+	clientIP := req.PeerIP()
+	if prior := req.Header("X-Forwarded-For"); prior != "" {
+		clientIP = prior + ", " + clientIP
+	}
+	out.Header.Set("X-Forwarded-For", clientIP)
+	out.Header.Set("X-Forwarded-Host", req.Header("Host"))
+	out.Header.Set("X-Forwarded-Proto", p.options.ForwardedProto)
+	if id := http.RequestID(req.Context()); id != "" {
+		out.Header.Set("X-Request-ID", id)
+	}
+
+	up.active.Add(1)
+	resp, err := up.transport.RoundTrip(out)
+	if err != nil {
+		up.active.Add(-1)
+		return nil, up.url, err
+	}
+	resp.Body = &activeBody{ReadCloser: resp.Body, upstream: up}
+	return resp, up.url, nil
+}
+
+// activeBody counts a request as in flight on its upstream until the response body is closed
+type activeBody struct {
+	io.ReadCloser
+	upstream *upstream
+	closed   atomic.Bool
+}
+
+// Close closes the body and ends the request on the upstream
+func (b *activeBody) Close() error {
+	if b.closed.CompareAndSwap(false, true) {
+		b.upstream.active.Add(-1)
+	}
+	return b.ReadCloser.Close()
+}
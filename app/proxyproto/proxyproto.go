@@ -0,0 +1,226 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// v1Prefix starts a version 1 (text) header
+const v1Prefix = "PROXY "
+
+// v1MaxLength is the longest version 1 header, including its CRLF
+const v1MaxLength = 107
+
+// v2Signature starts a version 2 (binary) header
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Listener accepts connections that start with a PROXY protocol header, as
+// sent by load balancers such as HAProxy to pass on the address of the client
+type Listener struct {
+	net.Listener
+	// Timeout bounds how long a connection may take to send its header
+	Timeout time.Duration
+}
+
+// Accept implements net.Listener. The header is read by the returned
+// connection when it is first used, so a slow client does not hold up Accept.
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(conn, l.Timeout), nil
+}
+
+// Conn is a connection starting with a PROXY protocol header, whose addresses
+// are the ones the header gives for the client and the address it connected to
+type Conn struct {
+	net.Conn
+	timeout time.Duration
+
+	once   sync.Once
+	err    error
+	remote net.Addr
+	local  net.Addr
+}
+
+// NewConn wraps conn, whose header must arrive within timeout; zero means no limit
+func NewConn(conn net.Conn, timeout time.Duration) *Conn {
+	return &Conn{Conn: conn, timeout: timeout}
+}
+
+// Handshake reads the header if it has not been read yet. A connection
+// whose header is missing or malformed cannot be used.
+func (c *Conn) Handshake() error {
+	c.once.Do(func() {
+		if c.timeout > 0 {
+			c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+			defer c.Conn.SetReadDeadline(time.Time{})
+		}
+		c.remote, c.local, c.err = ReadHeader(c.Conn)
+	})
+	return c.err
+}
+
+// Read implements net.Conn, reading what follows the header
+func (c *Conn) Read(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+// RemoteAddr returns the client address given by the header, or the address
+// of the proxy if the header gives none
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.Handshake() == nil && c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the address the client connected to according to the
+// header, or the local address of the connection if the header gives none
+func (c *Conn) LocalAddr() net.Addr {
+	if c.Handshake() == nil && c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+// NetConn returns the connection from the proxy
+func (c *Conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// ReadHeader reads a version 1 or 2 PROXY protocol header from r, returning
+// the source and destination addresses it gives. They are nil for headers
+// without addresses, such as the health checks a proxy sends itself. Only
+// the header is read, so that what follows can be read from r afterwards.
+func ReadHeader(r io.Reader) (source, destination net.Addr, err error) {
+	start := make([]byte, len(v1Prefix))
+	if _, err := io.ReadFull(r, start); err != nil {
+		return nil, nil, fmt.Errorf("failed to read PROXY header: %w", err)
+	}
+	switch {
+	case string(start) == v1Prefix:
+		return readV1(r)
+	case bytes.Equal(start, v2Signature[:len(start)]):
+		return readV2(r)
+	default:
+		return nil, nil, errors.New("connection does not start with a PROXY header")
+	}
+}
+
+// readV1 reads the rest of a version 1 header, a line such as
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443"
+func readV1(r io.Reader) (net.Addr, net.Addr, error) {
+	line := []byte(v1Prefix)
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= v1MaxLength {
+			return nil, nil, errors.New("PROXY header too long")
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, nil, fmt.Errorf("failed to read PROXY header: %w", err)
+		}
+		line = append(line, b[0])
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("malformed PROXY header %q", line)
+	}
+	source, err := tcpAddr(fields[2], fields[4], fields[1] == "TCP6")
+	if err != nil {
+		return nil, nil, err
+	}
+	destination, err := tcpAddr(fields[3], fields[5], fields[1] == "TCP6")
+	if err != nil {
+		return nil, nil, err
+	}
+	return source, destination, nil
+}
+
+// tcpAddr parses an address and port of a version 1 header
+func tcpAddr(host, port string, ipv6 bool) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil || (ip.To4() == nil) != ipv6 {
+		return nil, fmt.Errorf("invalid address %q in PROXY header", host)
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q in PROXY header", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(n)}, nil
+}
+
+// readV2 reads the rest of a version 2 header, whose first bytes have been
+// read. Type-length-value fields after the addresses are skipped.
+func readV2(r io.Reader) (net.Addr, net.Addr, error) {
+	head := make([]byte, 16)
+	copy(head, v2Signature)
+	if _, err := io.ReadFull(r, head[len(v1Prefix):]); err != nil {
+		return nil, nil, fmt.Errorf("failed to read PROXY header: %w", err)
+	}
+	if !bytes.Equal(head[:12], v2Signature) {
+		return nil, nil, errors.New("connection does not start with a PROXY header")
+	}
+	if head[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported PROXY protocol version %d", head[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(head[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, fmt.Errorf("failed to read PROXY header: %w", err)
+	}
+
+	switch command := head[12] & 0x0F; command {
+	case 0x0: // LOCAL: a connection of the proxy's own, e.g. a health check
+		return nil, nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, nil, fmt.Errorf("unknown PROXY command %d", command)
+	}
+
+	switch family := head[13] >> 4; family {
+	case 0x1: // AF_INET
+		if len(body) < 12 {
+			return nil, nil, errors.New("PROXY header too short for IPv4 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))},
+			&net.TCPAddr{IP: net.IP(body[4:8]), Port: int(binary.BigEndian.Uint16(body[10:12]))}, nil
+	case 0x2: // AF_INET6
+		if len(body) < 36 {
+			return nil, nil, errors.New("PROXY header too short for IPv6 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))},
+			&net.TCPAddr{IP: net.IP(body[16:32]), Port: int(binary.BigEndian.Uint16(body[34:36]))}, nil
+	case 0x3: // AF_UNIX
+		if len(body) < 216 {
+			return nil, nil, errors.New("PROXY header too short for Unix addresses")
+		}
+		return &net.UnixAddr{Name: cString(body[0:108]), Net: "unix"},
+			&net.UnixAddr{Name: cString(body[108:216]), Net: "unix"}, nil
+	default: // AF_UNSPEC, or a family not known yet
+		return nil, nil, nil
+	}
+}
+
+// cString returns the NUL-terminated string at the start of b
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
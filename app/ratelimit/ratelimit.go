@@ -0,0 +1,242 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net/netip"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket that refills at a fixed rate up to a burst size
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket creates a full bucket allowing rate events per second with the given burst
+func NewBucket(rate float64, burst int) *Bucket {
+	return &Bucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Allow takes a token from the bucket, reporting false if none is available
+func (b *Bucket) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// RouteRule limits the server-wide rate of requests to a path prefix
+type RouteRule struct {
+	Method string
+	Prefix string
+	Rate   float64
+	Burst  int
+}
+
+// String formats the rule in the syntax accepted by ParseRouteRule
+func (r RouteRule) String() string {
+	s := fmt.Sprintf("%s=%g:%d", r.Prefix, r.Rate, r.Burst)
+	if r.Method != "" {
+		s = r.Method + " " + s
+	}
+	return s
+}
+
+// ParseRouteRule parses a rule of the form "[METHOD ]PREFIX=RATE[:BURST]",
+// e.g. "POST /files=50:100". The burst defaults to the rate rounded up.
+func ParseRouteRule(s string) (RouteRule, error) {
+	var rule RouteRule
+
+	target, limit, ok := strings.Cut(strings.TrimSpace(s), "=")
+	if !ok {
+		return rule, fmt.Errorf("invalid route limit %q: expected PREFIX=RATE[:BURST]", s)
+	}
+
+	if method, prefix, ok := strings.Cut(target, " "); ok {
+		rule.Method = strings.ToUpper(method)
+		target = strings.TrimSpace(prefix)
+	}
+	if !strings.HasPrefix(target, "/") {
+		return rule, fmt.Errorf("invalid route limit %q: prefix must start with '/'", s)
+	}
+	rule.Prefix = target
+
+	rateStr, burstStr, hasBurst := strings.Cut(limit, ":")
+	rate, err := strconv.ParseFloat(rateStr, 64)
+	if err != nil || rate <= 0 {
+		return rule, fmt.Errorf("invalid route limit %q: rate must be a positive number", s)
+	}
+	rule.Rate = rate
+
+	rule.Burst = int(rate)
+	if float64(rule.Burst) < rate {
+		rule.Burst++
+	}
+	if hasBurst {
+		burst, err := strconv.Atoi(burstStr)
+		if err != nil || burst < 1 {
+			return rule, fmt.Errorf("invalid route limit %q: burst must be a positive integer", s)
+		}
+		rule.Burst = burst
+	}
+
+	return rule, nil
+}
+
+// RouteLimiter applies route rules, each with its own server-wide bucket
+type RouteLimiter struct {
+	rules   []RouteRule
+	buckets []*Bucket
+}
+
+// NewRouteLimiter creates a limiter for the given rules
+func NewRouteLimiter(rules []RouteRule) *RouteLimiter {
+	l := &RouteLimiter{rules: rules}
+	for _, rule := range rules {
+		l.buckets = append(l.buckets, NewBucket(rule.Rate, rule.Burst))
+	}
+	return l
+}
+
+// Allow reports whether a request for a path may proceed. When it may not, the
+// prefix of the rule that shed it is returned. The most specific matching rule
+// applies.
+func (l *RouteLimiter) Allow(method, urlPath string) (bool, string) {
+	urlPath = cleanPath(urlPath)
+	match := -1
+	for i, rule := range l.rules {
+		if rule.Method != "" && rule.Method != method {
+			continue
+		}
+		if !underPrefix(urlPath, rule.Prefix) {
+			continue
+		}
+		if match < 0 || len(rule.Prefix) > len(l.rules[match].Prefix) {
+			match = i
+		}
+	}
+
+	if match < 0 || l.buckets[match].Allow() {
+		return true, ""
+	}
+	return false, l.rules[match].Prefix
+}
+
+// cleanPath decodes and cleans a request path, so that spellings such as
+// /%66iles and /a/../files are limited like /files
+func cleanPath(urlPath string) string {
+	if decoded, err := url.PathUnescape(urlPath); err == nil {
+		urlPath = decoded
+	}
+	return path.Clean("/" + urlPath)
+}
+
+// underPrefix reports whether a cleaned path is a prefix or below it, matching
+// whole segments, so that /files covers /files/a.txt but not /filesystem
+func underPrefix(urlPath, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return prefix == "" || urlPath == prefix || strings.HasPrefix(urlPath, prefix+"/")
+}
+
+// ConnLimiter caps the number of concurrently open connections per client IP
+type ConnLimiter struct {
+	mu         sync.Mutex
+	max        int
+	ipv6Prefix int
+	conns      map[string]int
+}
+
+// NewConnLimiter creates a limiter allowing max connections per IP; zero means unlimited
+func NewConnLimiter(max int) *ConnLimiter {
+	return &ConnLimiter{
+		max:        max,
+		ipv6Prefix: 128,
+		conns:      make(map[string]int),
+	}
+}
+
+// Acquire registers a new connection from ip, reporting false if ip is at its cap
+func (l *ConnLimiter) Acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	client := l.client(ip)
+	if l.max > 0 && l.conns[client] >= l.max {
+		return false
+	}
+	l.conns[client]++
+	return true
+}
+
+// SetIPv6Prefix makes IPv6 clients count as one when they share their first
+// bits bits, such as the /64 network usually handed to a single household.
+// Zero or 128 counts every address on its own, as is the default. It must be called
+// before the first connection is acquired.
+func (l *ConnLimiter) SetIPv6Prefix(bits int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.ipv6Prefix = bits
+}
+
+// client returns the key the connections from ip are counted under; l.mu must be held
+func (l *ConnLimiter) client(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	addr = addr.Unmap().WithZone("")
+	if !addr.Is6() || l.ipv6Prefix <= 0 || l.ipv6Prefix >= 128 {
+		return addr.String()
+	}
+	prefix, err := addr.Prefix(l.ipv6Prefix)
+	if err != nil {
+		return addr.String()
+	}
+	return prefix.String()
+}
+
+// SetMax changes the number of connections allowed per IP; zero means unlimited.
+// IPs over a lowered cap keep their connections but cannot open new ones.
+func (l *ConnLimiter) SetMax(max int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.max = max
+}
+
+// Release unregisters a connection from ip previously admitted by Acquire
+func (l *ConnLimiter) Release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	client := l.client(ip)
+	l.conns[client]--
+	if l.conns[client] <= 0 {
+		delete(l.conns, client)
+	}
+}
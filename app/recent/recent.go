@@ -0,0 +1,81 @@
+// Package recent keeps the latest requests in memory, so what the server has
+// just been doing can be looked into without an access log
+package recent
+
+import (
+	"sync"
+	"time"
+)
+
+// Request is a request the server started serving
+type Request struct {
+	Time    time.Time `json:"time"`
+	Client  string    `json:"client"`
+	Method  string    `json:"method"`
+	Target  string    `json:"target"`
+	Version string    `json:"version"`
+	// Status and Duration are zero while the request is being served
+	Status   int    `json:"status,omitempty"`
+	Duration string `json:"duration,omitempty"`
+}
+
+// Log is a ring buffer of the latest requests. A nil Log keeps none.
+type Log struct {
+	mu       sync.Mutex
+	requests []Request
+	// next is the sequence number of the next request; request n is kept at n % len(requests)
+	next uint64
+}
+
+// New creates a log of the last size requests, or returns nil if size is not positive
+func New(size int) *Log {
+	if size <= 0 {
+		return nil
+	}
+	return &Log{requests: make([]Request, size)}
+}
+
+// Begin records a request the server started serving, returning the number to
+// pass to End once it is answered
+func (l *Log) Begin(req Request) uint64 {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := l.next
+	l.requests[n%uint64(len(l.requests))] = req
+	l.next++
+	return n
+}
+
+// End records the outcome of request n, if it is still among the latest. The
+// client replaces the peer address Begin was given once proxies are trusted.
+func (l *Log) End(n uint64, client string, status int, duration time.Duration) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	size := uint64(len(l.requests))
+	if n >= l.next || n+size < l.next {
+		return
+	}
+	req := &l.requests[n%size]
+	req.Client, req.Status, req.Duration = client, status, duration.Round(time.Microsecond).String()
+}
+
+// Requests returns the latest requests, oldest first, including those in progress
+func (l *Log) Requests() []Request {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	size := uint64(len(l.requests))
+	requests := make([]Request, 0, min(l.next, size))
+	for n := l.next - min(l.next, size); n < l.next; n++ {
+		requests = append(requests, l.requests[n%size])
+	}
+	return requests
+}
@@ -0,0 +1,93 @@
+// Package referer restricts paths to requests made from pages of allowed
+// sites, as named by their Origin or Referer header, e.g. so that other sites
+// cannot embed the images served under /files
+package referer
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// Rule restricts the paths starting with Prefix to requests from pages of Hosts
+type Rule struct {
+	Prefix string
+	// Hosts are the allowed host names; "*.example.com" allows the subdomains
+	// of example.com, but not example.com itself
+	Hosts []string
+	// Placeholder, if set, is the file served instead of refusing a request
+	Placeholder string
+}
+
+// ParseRule parses a rule of the form "PREFIX HOST[,HOST...] [PLACEHOLDER]",
+// e.g. "/files/ example.com,*.example.com /srv/hotlink.png"
+func ParseRule(s string) (Rule, error) {
+	fields := strings.Fields(s)
+	if len(fields) < 2 || len(fields) > 3 {
+		return Rule{}, fmt.Errorf("invalid referer rule %q: expected PREFIX HOSTS [PLACEHOLDER]", s)
+	}
+	if !strings.HasPrefix(fields[0], "/") {
+		return Rule{}, fmt.Errorf("invalid referer rule %q: prefix must start with '/'", s)
+	}
+
+	rule := Rule{Prefix: fields[0]}
+	for _, host := range strings.Split(fields[1], ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			rule.Hosts = append(rule.Hosts, host)
+		}
+	}
+	if len(rule.Hosts) == 0 {
+		return Rule{}, fmt.Errorf("invalid referer rule %q: no hosts", s)
+	}
+	if len(fields) == 3 {
+		rule.Placeholder = fields[2]
+	}
+	return rule, nil
+}
+
+// String formats the rule as accepted by ParseRule
+func (r Rule) String() string {
+	s := r.Prefix + " " + strings.Join(r.Hosts, ",")
+	if r.Placeholder != "" {
+		s += " " + r.Placeholder
+	}
+	return s
+}
+
+// Check returns the first rule whose prefix path starts with, and whether a
+// request for path from the page origin or referer, either of which may be
+// empty, is allowed by it. Requests naming neither, such as those typed into
+// the address bar or sent with a no-referrer policy, and requests from pages
+// of host, the lowercased name of the server itself, are always allowed.
+func Check(rules []Rule, path, host, origin, referer string) (Rule, bool) {
+	i := slices.IndexFunc(rules, func(rule Rule) bool {
+		return strings.HasPrefix(path, rule.Prefix)
+	})
+	if i < 0 {
+		return Rule{}, true
+	}
+	rule := rules[i]
+
+	source := origin
+	if source == "" || source == "null" {
+		source = referer
+	}
+	if source == "" {
+		return rule, true
+	}
+	u, err := url.Parse(source)
+	if err != nil || u.Host == "" {
+		return rule, false
+	}
+	from := strings.ToLower(u.Hostname())
+	if from == host {
+		return rule, true
+	}
+	return rule, slices.ContainsFunc(rule.Hosts, func(allowed string) bool {
+		if parent, ok := strings.CutPrefix(allowed, "*."); ok {
+			return strings.HasSuffix(from, "."+parent)
+		}
+		return from == allowed
+	})
+}
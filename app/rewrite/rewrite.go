@@ -0,0 +1,160 @@
+// Package rewrite maps request targets to other paths, or redirects them,
+// according to regular expression rules applied before routing
+package rewrite
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// redirectStatuses are the statuses a redirect rule may send
+var redirectStatuses = []int{301, 302, 303, 307, 308}
+
+// Rule rewrites the path of a request target matching Pattern to Replacement,
+// in which $1, ${name} and the like refer to the pattern's submatches
+type Rule struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+	// Last stops applying the rules that follow once this one matched
+	Last bool
+	// Redirect, if non-zero, is the status of the redirect sent to the client
+	// instead of rewriting the target internally
+	Redirect int
+}
+
+// ParseRule parses a rule of the form "PATTERN REPLACEMENT [FLAGS]", where
+// FLAGS is a comma-separated list of "last" and "redirect[=STATUS]", e.g.
+// "^/v1/(.*)$ /$1 [last]" or "^/old/(.*)$ /new/$1 [redirect=301]"
+func ParseRule(s string) (Rule, error) {
+	var rule Rule
+
+	fields := strings.Fields(s)
+	if len(fields) < 2 || len(fields) > 3 {
+		return rule, fmt.Errorf("invalid rewrite rule %q: expected PATTERN REPLACEMENT [FLAGS]", s)
+	}
+	pattern, err := regexp.Compile(fields[0])
+	if err != nil {
+		return rule, fmt.Errorf("invalid rewrite rule %q: %w", s, err)
+	}
+	rule.Pattern = pattern
+	rule.Replacement = fields[1]
+
+	if len(fields) == 3 {
+		list, ok := strings.CutPrefix(fields[2], "[")
+		if list, ok = strings.CutSuffix(list, "]"); !ok {
+			return rule, fmt.Errorf("invalid rewrite rule %q: flags must be enclosed in brackets", s)
+		}
+		for _, flag := range strings.Split(list, ",") {
+			name, value, hasValue := strings.Cut(flag, "=")
+			switch {
+			case name == "last" && !hasValue:
+				rule.Last = true
+			case name == "redirect" && !hasValue:
+				rule.Redirect = 302
+			case name == "redirect":
+				status, err := strconv.Atoi(value)
+				if err != nil || !slices.Contains(redirectStatuses, status) {
+					return rule, fmt.Errorf("invalid rewrite rule %q: redirect status must be 301, 302, 303, 307 or 308", s)
+				}
+				rule.Redirect = status
+			default:
+				return rule, fmt.Errorf("invalid rewrite rule %q: unknown flag %q", s, flag)
+			}
+		}
+	}
+
+	if rule.Redirect == 0 && !strings.HasPrefix(rule.Replacement, "/") {
+		return rule, fmt.Errorf("invalid rewrite rule %q: replacement must be a path starting with '/'", s)
+	}
+	return rule, nil
+}
+
+// ParseRedirect parses a redirect of the form "PATH TARGET [STATUS]" into a
+// rule. PATH is matched exactly unless it starts with '^', in which case it is
+// a pattern whose submatches TARGET may refer to. STATUS defaults to 302.
+func ParseRedirect(s string) (Rule, error) {
+	fields := strings.Fields(s)
+	if len(fields) < 2 || len(fields) > 3 {
+		return Rule{}, fmt.Errorf("invalid redirect %q: expected PATH TARGET [STATUS]", s)
+	}
+
+	rule := Rule{Replacement: fields[1], Redirect: 302}
+	if strings.HasPrefix(fields[0], "^") {
+		pattern, err := regexp.Compile(fields[0])
+		if err != nil {
+			return Rule{}, fmt.Errorf("invalid redirect %q: %w", s, err)
+		}
+		rule.Pattern = pattern
+	} else {
+		if !strings.HasPrefix(fields[0], "/") {
+			return Rule{}, fmt.Errorf("invalid redirect %q: path must start with '/' or '^'", s)
+		}
+		rule.Pattern = regexp.MustCompile("^" + regexp.QuoteMeta(fields[0]) + "$")
+		rule.Replacement = strings.ReplaceAll(rule.Replacement, "$", "$$")
+	}
+
+	if len(fields) == 3 {
+		status, err := strconv.Atoi(fields[2])
+		if err != nil || !slices.Contains(redirectStatuses, status) {
+			return Rule{}, fmt.Errorf("invalid redirect %q: status must be 301, 302, 303, 307 or 308", s)
+		}
+		rule.Redirect = status
+	}
+	return rule, nil
+}
+
+// String formats the rule as accepted by ParseRule
+func (r Rule) String() string {
+	var flags []string
+	if r.Last {
+		flags = append(flags, "last")
+	}
+	if r.Redirect != 0 {
+		flags = append(flags, "redirect="+strconv.Itoa(r.Redirect))
+	}
+	s := r.Pattern.String() + " " + r.Replacement
+	if len(flags) > 0 {
+		s += " [" + strings.Join(flags, ",") + "]"
+	}
+	return s
+}
+
+// Apply runs a request target through the rules in order. Each rule matches
+// the path alone; the query string is kept unless a replacement has its own.
+// It returns the rewritten target and, when a redirect rule matched, its
+// status, in which case the target is the Location to redirect to.
+func Apply(rules []Rule, target string) (string, int) {
+	path, query, hasQuery := strings.Cut(target, "?")
+	for _, rule := range rules {
+		match := rule.Pattern.FindStringSubmatchIndex(path)
+		if match == nil {
+			continue
+		}
+
+		replaced := string(rule.Pattern.ExpandString(nil, rule.Replacement, path, match))
+		if newPath, newQuery, ok := strings.Cut(replaced, "?"); ok {
+			path, query, hasQuery = newPath, newQuery, newQuery != ""
+		} else {
+			path = replaced
+		}
+
+		if rule.Redirect != 0 {
+			return join(path, query, hasQuery), rule.Redirect
+		}
+		if rule.Last {
+			break
+		}
+	}
+	return join(path, query, hasQuery), 0
+}
+
+// join reassembles a request target from its path and query string
+func join(path, query string, hasQuery bool) string {
+	if !hasQuery {
+		return path
+	}
+	return path + "?" + query
+}
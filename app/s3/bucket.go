@@ -0,0 +1,195 @@
+package s3
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultMaxKeys is the number of keys listed when a client does not ask for fewer
+const DefaultMaxKeys = 1000
+
+// Bucket exposes the files of a directory as the objects of a bucket, keys
+// mapping to paths below the directory. Hidden files and directories, such
+// as the trash and versions, are not part of the bucket.
+type Bucket struct {
+	Name    string
+	dir     string
+	created time.Time
+}
+
+// NewBucket creates a bucket named name over the files of dir
+func NewBucket(name, dir string) *Bucket {
+	created := time.Now()
+	if info, err := os.Stat(dir); err == nil {
+		created = info.ModTime()
+	}
+	return &Bucket{Name: name, dir: dir, created: created}
+}
+
+// Created returns the time reported as the bucket's creation date
+func (b *Bucket) Created() time.Time {
+	return b.created
+}
+
+// Path returns the file path of an object key
+func (b *Bucket) Path(key string) (string, error) {
+	if key == "" || !filepath.IsLocal(filepath.FromSlash(key)) {
+		return "", ErrInvalidKey
+	}
+	for _, segment := range strings.Split(strings.TrimSuffix(key, "/"), "/") {
+		if strings.HasPrefix(segment, ".") {
+			return "", ErrInvalidKey
+		}
+	}
+	return filepath.Join(b.dir, filepath.FromSlash(key)), nil
+}
+
+// ETag returns the entity tag of an object. It identifies the object's
+// current content but, unlike on AWS, is not its MD5 digest; the "-1" suffix
+// marks it as such, the way multipart upload ETags are, so clients do not
+// compare it against the MD5 of the data.
+func ETag(info os.FileInfo) string {
+	sum := md5.Sum([]byte(fmt.Sprintf("%d:%d", info.Size(), info.ModTime().UnixNano())))
+	return `"` + hex.EncodeToString(sum[:]) + `-1"`
+}
+
+// ListOptions select the objects listed by List
+type ListOptions struct {
+	Prefix    string
+	Delimiter string
+	// After lists only keys and common prefixes sorting after it
+	After   string
+	MaxKeys int
+}
+
+// Listing is a page of objects and common prefixes
+type Listing struct {
+	Objects        []Object
+	CommonPrefixes []CommonPrefix
+	IsTruncated    bool
+	// Next is the last key or common prefix listed when the listing is truncated
+	Next string
+}
+
+// List returns the objects whose keys start with the prefix, in key order.
+// With a delimiter, keys containing it after the prefix are rolled up into
+// common prefixes ending at its first occurrence.
+func (b *Bucket) List(opts ListOptions) (*Listing, error) {
+	if opts.MaxKeys <= 0 || opts.MaxKeys > DefaultMaxKeys {
+		opts.MaxKeys = DefaultMaxKeys
+	}
+
+	files, err := b.walk(opts.Prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	listing := &Listing{}
+	count := 0
+	lastPrefix := ""
+	for _, f := range files {
+		if !strings.HasPrefix(f.key, opts.Prefix) || f.key <= opts.After {
+			continue
+		}
+
+		entry := f.key
+		isPrefix := false
+		if opts.Delimiter != "" {
+			if i := strings.Index(f.key[len(opts.Prefix):], opts.Delimiter); i >= 0 {
+				entry = f.key[:len(opts.Prefix)+i+len(opts.Delimiter)]
+				isPrefix = true
+				if entry <= opts.After || entry == lastPrefix {
+					continue
+				}
+			}
+		}
+
+		if count == opts.MaxKeys {
+			listing.IsTruncated = true
+			break
+		}
+		count++
+		listing.Next = entry
+
+		if isPrefix {
+			lastPrefix = entry
+			listing.CommonPrefixes = append(listing.CommonPrefixes, CommonPrefix{Prefix: entry})
+			continue
+		}
+		listing.Objects = append(listing.Objects, Object{
+			Key:          f.key,
+			LastModified: Timestamp(f.info.ModTime()),
+			ETag:         ETag(f.info),
+			Size:         f.info.Size(),
+			StorageClass: "STANDARD",
+		})
+	}
+
+	if !listing.IsTruncated {
+		listing.Next = ""
+	}
+	return listing, nil
+}
+
+// file is a regular file of the bucket found by walk
+type file struct {
+	key  string
+	info os.FileInfo
+}
+
+// walk returns the files that may match a key prefix, sorted by key. Only
+// the directory holding the prefix's last complete path segment is walked.
+func (b *Bucket) walk(prefix string) ([]file, error) {
+	root := b.dir
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		path, err := b.Path(prefix[:i+1])
+		if err != nil {
+			return nil, nil
+		}
+		root = path
+	}
+
+	var files []file
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root && errors.Is(err, fs.ErrNotExist) {
+				return filepath.SkipAll
+			}
+			return err
+		}
+		if path != root && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(b.dir, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, file{key: filepath.ToSlash(rel), info: info})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].key < files[j].key })
+	return files, nil
+}
@@ -0,0 +1,112 @@
+package s3
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// maxChunkHeaderSize bounds a chunk header line, e.g. "10000;chunk-signature=<64 hex digits>"
+const maxChunkHeaderSize = 4096
+
+// chunkedReader decodes an aws-chunked request body, sent by SDKs that sign
+// uploads chunk by chunk. Chunk signatures are not verified.
+type chunkedReader struct {
+	r         *bufio.Reader
+	remaining int64
+	done      bool
+}
+
+// NewChunkedReader returns a reader decoding an aws-chunked body read from r
+func NewChunkedReader(r io.Reader) io.Reader {
+	return &chunkedReader{r: bufio.NewReader(r)}
+}
+
+// IsChunked reports whether a request body is aws-chunked, judging by its X-Amz-Content-Sha256
+func IsChunked(contentSHA256 string) bool {
+	return strings.HasPrefix(contentSHA256, StreamingPayload)
+}
+
+func (c *chunkedReader) Read(b []byte) (int, error) {
+	for c.remaining == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if err := c.nextChunk(); err != nil {
+			return 0, err
+		}
+	}
+
+	if int64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.r.Read(b)
+	c.remaining -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil && c.remaining == 0 {
+		err = c.readCRLF()
+	}
+	return n, err
+}
+
+// nextChunk reads the header of the next chunk, and the trailer after the last one
+func (c *chunkedReader) nextChunk() error {
+	line, err := c.readLine()
+	if err != nil {
+		return err
+	}
+	sizeField, _, _ := strings.Cut(line, ";")
+	size, err := strconv.ParseInt(strings.TrimSpace(sizeField), 16, 64)
+	if err != nil || size < 0 {
+		return ErrIncompleteBody
+	}
+
+	if size == 0 {
+		// Skip trailing headers, e.g. x-amz-checksum-crc32, up to the final empty line
+		for {
+			line, err := c.readLine()
+			if err != nil || line == "" {
+				c.done = true
+				return nil
+			}
+		}
+	}
+	c.remaining = size
+	return nil
+}
+
+// readLine reads a CRLF-terminated line without its terminator
+func (c *chunkedReader) readLine() (string, error) {
+	var line []byte
+	for {
+		part, isPrefix, err := c.r.ReadLine()
+		if err != nil {
+			if err == io.EOF {
+				return "", io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		line = append(line, part...)
+		if len(line) > maxChunkHeaderSize {
+			return "", ErrIncompleteBody
+		}
+		if !isPrefix {
+			return string(line), nil
+		}
+	}
+}
+
+// readCRLF consumes the line break ending a chunk's data
+func (c *chunkedReader) readCRLF() error {
+	line, err := c.readLine()
+	if err != nil {
+		return err
+	}
+	if line != "" {
+		return ErrIncompleteBody
+	}
+	return nil
+}
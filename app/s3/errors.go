@@ -0,0 +1,31 @@
+package s3
+
+// Error is an S3 error, answered with its status and an XML error document
+type Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+// Error returns the S3 error code and message
+func (e *Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// Errors returned to S3 clients
+var (
+	ErrAccessDenied                 = &Error{403, "AccessDenied", "Access Denied"}
+	ErrAuthorizationHeaderMalformed = &Error{400, "AuthorizationHeaderMalformed", "The authorization header is malformed."}
+	ErrInvalidAccessKeyID           = &Error{403, "InvalidAccessKeyId", "The access key ID you provided does not exist in our records."}
+	ErrSignatureDoesNotMatch        = &Error{403, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided."}
+	ErrRequestTimeTooSkewed         = &Error{403, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large."}
+	ErrContentSHA256Mismatch        = &Error{400, "XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed."}
+	ErrIncompleteBody               = &Error{400, "IncompleteBody", "The request body is malformed or shorter than declared."}
+	ErrNoSuchBucket                 = &Error{404, "NoSuchBucket", "The specified bucket does not exist."}
+	ErrNoSuchKey                    = &Error{404, "NoSuchKey", "The specified key does not exist."}
+	ErrInvalidKey                   = &Error{400, "InvalidArgument", "The specified key is not valid."}
+	ErrInvalidRange                 = &Error{416, "InvalidRange", "The requested range is not satisfiable."}
+	ErrMethodNotAllowed             = &Error{405, "MethodNotAllowed", "The specified method is not allowed against this resource."}
+	ErrNotImplemented               = &Error{501, "NotImplemented", "A header or query you provided implies functionality that is not implemented."}
+	ErrInternalError                = &Error{500, "InternalError", "We encountered an internal error. Please try again."}
+)
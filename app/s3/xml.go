@@ -0,0 +1,102 @@
+package s3
+
+import (
+	"encoding/xml"
+	"strings"
+	"time"
+)
+
+// Namespace is the XML namespace of S3 API documents
+const Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+// timeFormat is the format of timestamps in S3 API documents
+const timeFormat = "2006-01-02T15:04:05.000Z"
+
+// Timestamp formats a time the way S3 API documents do
+func Timestamp(t time.Time) string {
+	return t.UTC().Format(timeFormat)
+}
+
+// ErrorResponse is the XML document of an S3 error
+type ErrorResponse struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource,omitempty"`
+}
+
+// BucketInfo describes a bucket in a ListBuckets result
+type BucketInfo struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+// Owner is the owner of the buckets in a ListBuckets result
+type Owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+// ListAllMyBucketsResult is the XML document of a ListBuckets result
+type ListAllMyBucketsResult struct {
+	XMLName xml.Name     `xml:"ListAllMyBucketsResult"`
+	Xmlns   string       `xml:"xmlns,attr"`
+	Owner   Owner        `xml:"Owner"`
+	Buckets []BucketInfo `xml:"Buckets>Bucket"`
+}
+
+// Object describes an object in a ListObjects result
+type Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+// CommonPrefix is a key prefix rolled up by the delimiter in a ListObjects result
+type CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+// ListBucketResult is the XML document of a ListObjects or ListObjectsV2 result.
+// Marker and NextMarker belong to version 1, the other paging fields to version 2.
+type ListBucketResult struct {
+	XMLName               xml.Name       `xml:"ListBucketResult"`
+	Xmlns                 string         `xml:"xmlns,attr"`
+	Name                  string         `xml:"Name"`
+	Prefix                string         `xml:"Prefix"`
+	Delimiter             string         `xml:"Delimiter,omitempty"`
+	MaxKeys               int            `xml:"MaxKeys"`
+	EncodingType          string         `xml:"EncodingType,omitempty"`
+	IsTruncated           bool           `xml:"IsTruncated"`
+	Marker                *string        `xml:"Marker"`
+	NextMarker            string         `xml:"NextMarker,omitempty"`
+	KeyCount              *int           `xml:"KeyCount"`
+	ContinuationToken     string         `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string         `xml:"StartAfter,omitempty"`
+	Contents              []Object       `xml:"Contents"`
+	CommonPrefixes        []CommonPrefix `xml:"CommonPrefixes"`
+}
+
+// LocationConstraint is the XML document of a GetBucketLocation result
+type LocationConstraint struct {
+	XMLName xml.Name `xml:"LocationConstraint"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Region  string   `xml:",chardata"`
+}
+
+// CopyObjectResult is the XML document of a CopyObject result
+type CopyObjectResult struct {
+	XMLName      xml.Name `xml:"CopyObjectResult"`
+	Xmlns        string   `xml:"xmlns,attr"`
+	LastModified string   `xml:"LastModified"`
+	ETag         string   `xml:"ETag"`
+}
+
+// EncodeKey percent-encodes a key for listings requested with encoding-type=url,
+// which lets clients receive keys containing characters XML cannot carry
+func EncodeKey(key string) string {
+	return strings.ReplaceAll(uriEncode(key), "%2F", "/")
+}
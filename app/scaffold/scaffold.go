@@ -0,0 +1,144 @@
+// Package scaffold generates a Go module embedding the server: a program
+// serving the server's routes along with its own, behind a middleware stack,
+// configured by a YAML file and covered by tests against a running server
+package scaffold
+
+import (
+	"bufio"
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	"go/format"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// serverModule is the module path of the server, which generated modules require
+const serverModule = "octo-server"
+
+// goVersion is the Go version of generated modules, the one the server requires
+const goVersion = "1.24.0"
+
+//go:embed templates
+var templates embed.FS
+
+// Options are what a module is generated with
+type Options struct {
+	// Module is the module path of the generated module
+	Module string
+	// Source is the directory of the server's module, which the generated module is built against
+	Source string
+}
+
+// templateData is what the templates are executed with
+type templateData struct {
+	Module       string
+	Source       string
+	ServerModule string
+	GoVersion    string
+}
+
+// Generate writes the files of a new module to dir, creating it if missing,
+// and returns their names. Nothing is written if any of them already exists.
+func Generate(dir string, opts Options) ([]string, error) {
+	if opts.Module == "" || strings.ContainsAny(opts.Module, " \t\n\"'`\\") {
+		return nil, fmt.Errorf("invalid module path %q", opts.Module)
+	}
+	source, err := filepath.Abs(opts.Source)
+	if err != nil {
+		return nil, err
+	}
+	data := templateData{Module: opts.Module, Source: filepath.ToSlash(source), ServerModule: serverModule, GoVersion: goVersion}
+
+	// Every file is rendered before any is written, so a failure leaves nothing behind
+	files := make(map[string][]byte)
+	var names []string
+	err = fs.WalkDir(templates, "templates", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(path, "templates/"), ".tmpl")
+		content, err := render(path, name, data)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return fmt.Errorf("%s already exists", filepath.Join(dir, name))
+		}
+		files[name] = content
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(dir, name), files[name], 0o644); err != nil {
+			return nil, err
+		}
+	}
+	return names, nil
+}
+
+// render executes a template, formatting the Go source it yields
+func render(path, name string, data templateData) ([]byte, error) {
+	tmpl, err := template.ParseFS(templates, path)
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		return nil, err
+	}
+	if filepath.Ext(name) != ".go" {
+		return out.Bytes(), nil
+	}
+	formatted, err := format.Source(out.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return formatted, nil
+}
+
+// FindSource returns the directory of the server's module that dir is in,
+// looking for its go.mod in dir and then in each of its parents
+func FindSource(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	for {
+		if isServerModule(filepath.Join(dir, "go.mod")) {
+			return dir, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", errors.New("not within the server's source")
+		}
+		dir = parent
+	}
+}
+
+// isServerModule reports whether a go.mod file declares the server's module
+func isServerModule(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if module, ok := strings.CutPrefix(strings.TrimSpace(scanner.Text()), "module "); ok {
+			return strings.Trim(strings.TrimSpace(module), `"`) == serverModule
+		}
+	}
+	return false
+}
@@ -0,0 +1,146 @@
+package scheduler
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+)
+
+// Pool bounds the number of requests handled at once. Requests waiting for a
+// worker are let in by urgency, most urgent first, and in arrival order
+// among those of equal urgency.
+type Pool struct {
+	mu      sync.Mutex
+	workers int
+	busy    int
+	waiting waitQueue
+	arrived uint64
+}
+
+// NewPool creates a pool of the given number of workers; zero means unlimited
+func NewPool(workers int) *Pool {
+	return &Pool{workers: workers}
+}
+
+// Acquire blocks until a worker is free to handle a request of the given
+// urgency, where lower is more urgent, or ctx is done, returning its error.
+// Each successful call must be paired with Release.
+func (p *Pool) Acquire(ctx context.Context, urgency int) error {
+	p.mu.Lock()
+	if p.free() {
+		p.busy++
+		p.mu.Unlock()
+		return nil
+	}
+	p.arrived++
+	w := &waiter{urgency: urgency, arrival: p.arrived, ready: make(chan struct{})}
+	heap.Push(&p.waiting, w)
+	p.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-w.ready:
+		// Let in while giving up, so the worker goes to the next in line
+		p.busy--
+		p.wake()
+	default:
+		heap.Remove(&p.waiting, w.index)
+	}
+	return ctx.Err()
+}
+
+// Release frees the worker taken by Acquire, handing it to the most urgent waiting request
+func (p *Pool) Release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.busy--
+	p.wake()
+}
+
+// SetWorkers changes the number of workers; zero means unlimited. Requests
+// beyond a lowered number finish, and no waiting one is let in until the
+// pool is under it.
+func (p *Pool) SetWorkers(workers int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.workers = workers
+	p.wake()
+}
+
+// Busy returns the number of requests being handled
+func (p *Pool) Busy() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return int64(p.busy)
+}
+
+// Waiting returns the number of requests waiting for a worker
+func (p *Pool) Waiting() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return int64(len(p.waiting))
+}
+
+// free reports whether a worker is free; p.mu must be held
+func (p *Pool) free() bool {
+	return p.workers <= 0 || p.busy < p.workers
+}
+
+// wake lets in waiting requests while workers are free; p.mu must be held
+func (p *Pool) wake() {
+	for len(p.waiting) > 0 && p.free() {
+		w := heap.Pop(&p.waiting).(*waiter)
+		p.busy++
+		close(w.ready)
+	}
+}
+
+// waiter is a request waiting for a worker
+type waiter struct {
+	urgency int
+	arrival uint64
+	ready   chan struct{}
+
+	// index is the waiter's position in the wait queue
+	index int
+}
+
+// waitQueue is a heap of waiters, the most urgent and earliest first
+type waitQueue []*waiter
+
+func (q waitQueue) Len() int { return len(q) }
+
+func (q waitQueue) Less(i, j int) bool {
+	if q[i].urgency != q[j].urgency {
+		return q[i].urgency < q[j].urgency
+	}
+	return q[i].arrival < q[j].arrival
+}
+
+func (q waitQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index, q[j].index = i, j
+}
+
+func (q *waitQueue) Push(x any) {
+	w := x.(*waiter)
+	w.index = len(*q)
+	*q = append(*q, w)
+}
+
+func (q *waitQueue) Pop() any {
+	old := *q
+	w := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return w
+}
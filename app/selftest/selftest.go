@@ -0,0 +1,952 @@
+package selftest
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	nethttp "net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+
+	"octo-server/app/client"
+	"octo-server/app/config"
+	"octo-server/app/delta"
+	"octo-server/app/proxy"
+	"octo-server/app/server"
+)
+
+// check is a single end-to-end check run against a live server
+type check struct {
+	name string
+	run  func(h *Harness) error
+}
+
+// checks lists every check run by Run, in order
+var checks = []check{
+	{"root returns 200", checkRoot},
+	{"echo returns the path suffix", checkEcho},
+	{"echo is gzip-compressed on request", checkEchoGzip},
+	{"echo prefers brotli when accepted", checkEchoBrotli},
+	{"echo is zstd-compressed on request", checkEchoZstd},
+	{"echo honors Accept-Encoding q values", checkEchoQValues},
+	{"user-agent is echoed", checkUserAgent},
+	{"files round-trip through POST and GET", checkFileRoundTrip},
+	{"binary bodies are sent byte for byte after sorted headers", checkBinaryResponse},
+	{"multipart uploads store every file part", checkMultipartUpload},
+	{"range requests return partial content", checkRange},
+	{"delta sync uploads only changed blocks", checkDeltaSync},
+	{"client resumes uploads and reads ranges", checkClient},
+	{"unknown paths return 404", checkNotFound},
+	{"unsupported expectations return 417", checkExpectation},
+	{"100 Continue is sent before the body is read", checkContinue},
+	{"pipelined requests are answered in order", checkPipelining},
+	{"HEAD responses are framed like GET but leave the body out", checkHead},
+	{"keep-alive connections serve successive requests", checkKeepAlive},
+	{"HTTP/1.0 connections close and unknown versions get 505", checkVersions},
+	{"HTTP/1.1 requests without exactly one valid Host get 400", checkHost},
+	{"absolute-form targets are served like origin-form ones", checkAbsoluteForm},
+	{"ambiguously framed bodies get 400 and unknown codings 501", checkFraming},
+	{"chunked request bodies are decoded", checkChunkedUpload},
+	{"proxied streams end in the upstream's checksum trailer", checkTrailers},
+	{"concurrent uploads are all stored intact", checkConcurrentUploads},
+	{"concurrent overwrites leave one whole version", checkConcurrentOverwrites},
+}
+
+// Harness runs a complete server on an ephemeral loopback port
+type Harness struct {
+	Addr      string
+	Directory string
+
+	listener net.Listener
+	done     chan error
+}
+
+// Start boots a server configured by cfg on an ephemeral port.
+// The port and, if empty, the directory are filled in by the harness.
+func Start(cfg *config.Config) (*Harness, error) {
+	h := &Harness{done: make(chan error, 1)}
+
+	if cfg.Directory == "" {
+		dir, err := os.MkdirTemp("", "octo-selftest-")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create directory: %w", err)
+		}
+		cfg.Directory = dir
+		h.Directory = dir
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		h.Close()
+		return nil, fmt.Errorf("failed to listen: %w", err)
+	}
+	h.listener = listener
+	h.Addr = listener.Addr().String()
+
+	srv := server.NewServer(cfg)
+	go func() {
+		h.done <- srv.Serve(listener)
+	}()
+
+	return h, nil
+}
+
+// Close stops the server and removes any directory the harness created
+func (h *Harness) Close() error {
+	var err error
+	if h.listener != nil {
+		h.listener.Close()
+		err = <-h.done
+	}
+	if h.Directory != "" {
+		os.RemoveAll(h.Directory)
+	}
+	return err
+}
+
+// Exchange sends raw bytes on a new connection and reads n responses from it
+func (h *Harness) Exchange(raw string, n int) ([]*nethttp.Response, [][]byte, error) {
+	conn, err := net.Dial("tcp", h.Addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := io.WriteString(conn, raw); err != nil {
+		return nil, nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	var responses []*nethttp.Response
+	var bodies [][]byte
+	for i := 0; i < n; i++ {
+		resp, err := nethttp.ReadResponse(reader, nil)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read response %d: %w", i+1, err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read body %d: %w", i+1, err)
+		}
+		responses = append(responses, resp)
+		bodies = append(bodies, body)
+	}
+
+	return responses, bodies, nil
+}
+
+// Do sends a single request built from the method, target, headers and body and returns the response
+func (h *Harness) Do(method, target string, headers map[string]string, body []byte) (*nethttp.Response, []byte, error) {
+	var raw strings.Builder
+	fmt.Fprintf(&raw, "%s %s HTTP/1.1\r\nHost: %s\r\n", method, target, h.Addr)
+	for key, value := range headers {
+		fmt.Fprintf(&raw, "%s: %s\r\n", key, value)
+	}
+	if body != nil {
+		fmt.Fprintf(&raw, "Content-Length: %d\r\n", len(body))
+	}
+	raw.WriteString("Connection: close\r\n\r\n")
+	raw.Write(body)
+
+	responses, bodies, err := h.Exchange(raw.String(), 1)
+	if err != nil {
+		return nil, nil, err
+	}
+	return responses[0], bodies[0], nil
+}
+
+// Run boots a server and runs every check whose name matches filter, or every
+// check if filter is empty, against it, reporting results to out
+func Run(out io.Writer, filter string) error {
+	pattern, err := regexp.Compile(filter)
+	if err != nil {
+		return fmt.Errorf("invalid check filter: %w", err)
+	}
+
+	h, err := Start(&config.Config{Port: "0"})
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	failed, ran := 0, 0
+	for _, c := range checks {
+		if !pattern.MatchString(c.name) {
+			continue
+		}
+		ran++
+		if err := c.run(h); err != nil {
+			failed++
+			fmt.Fprintf(out, "FAIL  %s: %v\n", c.name, err)
+			continue
+		}
+		fmt.Fprintf(out, "PASS  %s\n", c.name)
+	}
+
+	if ran == 0 {
+		return fmt.Errorf("no check matches %q", filter)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, ran)
+	}
+	fmt.Fprintf(out, "All %d checks passed\n", ran)
+	return nil
+}
+
+// expect returns an error unless resp has the wanted status and, if want is non-nil, body
+func expect(resp *nethttp.Response, body []byte, status int, want []byte) error {
+	if resp.StatusCode != status {
+		return fmt.Errorf("got status %d, want %d", resp.StatusCode, status)
+	}
+	if want != nil && !bytes.Equal(body, want) {
+		return fmt.Errorf("got body %q, want %q", body, want)
+	}
+	return nil
+}
+
+func checkRoot(h *Harness) error {
+	resp, body, err := h.Do("GET", "/", nil, nil)
+	if err != nil {
+		return err
+	}
+	return expect(resp, body, 200, nil)
+}
+
+func checkEcho(h *Harness) error {
+	resp, body, err := h.Do("GET", "/echo/octo", nil, nil)
+	if err != nil {
+		return err
+	}
+	return expect(resp, body, 200, []byte("octo"))
+}
+
+func checkEchoGzip(h *Harness) error {
+	resp, body, err := h.Do("GET", "/echo/octo", map[string]string{"Accept-Encoding": "gzip"}, nil)
+	if err != nil {
+		return err
+	}
+	if err := expect(resp, body, 200, nil); err != nil {
+		return err
+	}
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		return errors.New("response is not gzip-encoded")
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	plain, err := io.ReadAll(gz)
+	if err != nil {
+		return err
+	}
+	if string(plain) != "octo" {
+		return fmt.Errorf("got decompressed body %q, want %q", plain, "octo")
+	}
+	return nil
+}
+
+func checkEchoBrotli(h *Harness) error {
+	resp, body, err := h.Do("GET", "/echo/octo", map[string]string{"Accept-Encoding": "gzip, br"}, nil)
+	if err != nil {
+		return err
+	}
+	if err := expect(resp, body, 200, nil); err != nil {
+		return err
+	}
+	if resp.Header.Get("Content-Encoding") != "br" {
+		return fmt.Errorf("got Content-Encoding %q, want br", resp.Header.Get("Content-Encoding"))
+	}
+
+	plain, err := io.ReadAll(brotli.NewReader(bytes.NewReader(body)))
+	if err != nil {
+		return err
+	}
+	if string(plain) != "octo" {
+		return fmt.Errorf("got decompressed body %q, want %q", plain, "octo")
+	}
+	return nil
+}
+
+func checkEchoZstd(h *Harness) error {
+	resp, body, err := h.Do("GET", "/echo/octo", map[string]string{"Accept-Encoding": "gzip, zstd"}, nil)
+	if err != nil {
+		return err
+	}
+	if err := expect(resp, body, 200, nil); err != nil {
+		return err
+	}
+	if resp.Header.Get("Content-Encoding") != "zstd" {
+		return fmt.Errorf("got Content-Encoding %q, want zstd", resp.Header.Get("Content-Encoding"))
+	}
+
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		return err
+	}
+	defer decoder.Close()
+
+	plain, err := decoder.DecodeAll(body, nil)
+	if err != nil {
+		return err
+	}
+	if string(plain) != "octo" {
+		return fmt.Errorf("got decompressed body %q, want %q", plain, "octo")
+	}
+	return nil
+}
+
+func checkEchoQValues(h *Harness) error {
+	cases := map[string]string{
+		"gzip;q=0":                   "",
+		"br;q=0.5, deflate":          "deflate",
+		"gzip;q=0.4, identity;q=0.5": "",
+		"*":                          "br",
+		"*;q=0.1, gzip;q=0.9":        "gzip",
+	}
+
+	for acceptEncoding, want := range cases {
+		resp, _, err := h.Do("GET", "/echo/octo", map[string]string{"Accept-Encoding": acceptEncoding}, nil)
+		if err != nil {
+			return err
+		}
+		if got := resp.Header.Get("Content-Encoding"); got != want {
+			return fmt.Errorf("Accept-Encoding %q: got Content-Encoding %q, want %q", acceptEncoding, got, want)
+		}
+	}
+	return nil
+}
+
+func checkUserAgent(h *Harness) error {
+	resp, body, err := h.Do("GET", "/user-agent", map[string]string{"User-Agent": "selftest/1.0"}, nil)
+	if err != nil {
+		return err
+	}
+	return expect(resp, body, 200, []byte("selftest/1.0"))
+}
+
+func checkFileRoundTrip(h *Harness) error {
+	content := []byte("hello from selftest")
+	resp, body, err := h.Do("POST", "/files/selftest.txt", nil, content)
+	if err != nil {
+		return err
+	}
+	if err := expect(resp, body, 201, nil); err != nil {
+		return err
+	}
+
+	resp, body, err = h.Do("GET", "/files/selftest.txt", nil, nil)
+	if err != nil {
+		return err
+	}
+	return expect(resp, body, 200, content)
+}
+
+func checkBinaryResponse(h *Harness) error {
+	// Every byte value, and bytes that look like the end of a head or a new response
+	var content []byte
+	for i := range 4 * 256 {
+		content = append(content, byte(i))
+	}
+	content = append(content, "\r\n\r\nHTTP/1.1 200 OK\r\n%s%d\x00"...)
+	resp, body, err := h.Do("POST", "/files/binary.bin", nil, content)
+	if err != nil {
+		return err
+	}
+	if err := expect(resp, body, 201, nil); err != nil {
+		return err
+	}
+
+	conn, err := net.Dial("tcp", h.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, "GET /files/binary.bin HTTP/1.1\r\nHost: selftest\r\nConnection: close\r\n\r\n"); err != nil {
+		return err
+	}
+	raw, err := io.ReadAll(conn)
+	if err != nil {
+		return err
+	}
+
+	head, body, ok := bytes.Cut(raw, []byte("\r\n\r\n"))
+	if !ok {
+		return errors.New("response has no end of head")
+	}
+	if !bytes.Equal(body, content) {
+		return fmt.Errorf("got %d body bytes, not the %d uploaded", len(body), len(content))
+	}
+	lines := strings.Split(string(head), "\r\n")
+	if lines[0] != "HTTP/1.1 200 OK" {
+		return fmt.Errorf("status line %q, want HTTP/1.1 200 OK", lines[0])
+	}
+	var names []string
+	for _, line := range lines[1:] {
+		name, _, _ := strings.Cut(line, ":")
+		names = append(names, name)
+	}
+	if !slices.IsSorted(names) {
+		return fmt.Errorf("headers not sorted: %s", strings.Join(names, ", "))
+	}
+	return nil
+}
+
+func checkRange(h *Harness) error {
+	resp, body, err := h.Do("POST", "/files/range.txt", nil, []byte("0123456789"))
+	if err != nil {
+		return err
+	}
+	if err := expect(resp, body, 201, nil); err != nil {
+		return err
+	}
+
+	resp, body, err = h.Do("GET", "/files/range.txt", map[string]string{"Range": "bytes=4-"}, nil)
+	if err != nil {
+		return err
+	}
+	if err := expect(resp, body, 206, []byte("456789")); err != nil {
+		return err
+	}
+	if got := resp.Header.Get("Content-Range"); got != "bytes 4-9/10" {
+		return fmt.Errorf("got Content-Range %q, want %q", got, "bytes 4-9/10")
+	}
+
+	resp, body, err = h.Do("GET", "/files/range.txt", map[string]string{"Range": "bytes=10-"}, nil)
+	if err != nil {
+		return err
+	}
+	return expect(resp, body, 416, nil)
+}
+
+func checkClient(h *Harness) error {
+	ctx := context.Background()
+	c, err := client.New("http://"+h.Addr, nil)
+	if err != nil {
+		return err
+	}
+
+	// An upload cut short after its first part resumes with the rest
+	content := bytes.Repeat([]byte("client resumes uploads "), 1000)
+	if _, err := c.AppendAt(ctx, "resumed.txt", 0, content[:1000]); err != nil {
+		return fmt.Errorf("first part: %w", err)
+	}
+	var offsetErr *client.OffsetError
+	if _, err := c.AppendAt(ctx, "resumed.txt", 0, content[:1000]); !errors.As(err, &offsetErr) || offsetErr.Size != 1000 {
+		return fmt.Errorf("repeated append: got %v, want an offset error with size 1000", err)
+	}
+	size, err := c.Resume(ctx, "resumed.txt", bytes.NewReader(content))
+	if err != nil {
+		return fmt.Errorf("resume: %w", err)
+	}
+	if size != int64(len(content)) {
+		return fmt.Errorf("resumed to %d bytes, want %d", size, len(content))
+	}
+
+	r, err := c.DownloadRange(ctx, "resumed.txt", 1000, 500)
+	if err != nil {
+		return err
+	}
+	part, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(part, content[1000:1500]) {
+		return fmt.Errorf("range: got %d bytes that differ from the upload", len(part))
+	}
+	if _, err := c.Download(ctx, "missing.txt"); !errors.Is(err, client.ErrNotFound) {
+		return fmt.Errorf("missing file: got %v, want ErrNotFound", err)
+	}
+	return nil
+}
+
+func checkDeltaSync(h *Harness) error {
+	original := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	resp, body, err := h.Do("POST", "/files/delta.bin", nil, original)
+	if err != nil {
+		return err
+	}
+	if err := expect(resp, body, 201, nil); err != nil {
+		return err
+	}
+
+	resp, body, err = h.Do("GET", "/api/files/delta.bin/signature?block-size=1024", nil, nil)
+	if err != nil {
+		return err
+	}
+	if err := expect(resp, body, 200, nil); err != nil {
+		return err
+	}
+	var sig delta.Signature
+	if err := json.Unmarshal(body, &sig); err != nil {
+		return err
+	}
+
+	// Insert bytes near the start, shifting every later block
+	updated := append([]byte("inserted"), original...)
+	var patch bytes.Buffer
+	if err := delta.Diff(&sig, updated, &patch); err != nil {
+		return err
+	}
+	resp, body, err = h.Do("POST", "/api/files/delta.bin/delta", nil, patch.Bytes())
+	if err != nil {
+		return err
+	}
+	if err := expect(resp, body, 200, nil); err != nil {
+		return err
+	}
+	var stats delta.Stats
+	if err := json.Unmarshal(body, &stats); err != nil {
+		return err
+	}
+	if stats.Literal >= int64(len(updated))/2 {
+		return fmt.Errorf("sent %d literal bytes of %d", stats.Literal, len(updated))
+	}
+
+	resp, body, err = h.Do("GET", "/files/delta.bin", nil, nil)
+	if err != nil {
+		return err
+	}
+	return expect(resp, body, 200, updated)
+}
+
+func checkMultipartUpload(h *Harness) error {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for name, content := range map[string]string{"one.txt": "first", "two.txt": "second"} {
+		part, err := mw.CreateFormFile("file", name)
+		if err != nil {
+			return err
+		}
+		io.WriteString(part, content)
+	}
+	mw.Close()
+
+	headers := map[string]string{"Content-Type": mw.FormDataContentType()}
+	resp, respBody, err := h.Do("POST", "/files", headers, body.Bytes())
+	if err != nil {
+		return err
+	}
+	if err := expect(resp, respBody, 201, nil); err != nil {
+		return err
+	}
+
+	for name, content := range map[string]string{"one.txt": "first", "two.txt": "second"} {
+		resp, body, err := h.Do("GET", "/files/"+name, nil, nil)
+		if err != nil {
+			return err
+		}
+		if err := expect(resp, body, 200, []byte(content)); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func checkNotFound(h *Harness) error {
+	resp, body, err := h.Do("GET", "/no/such/path", nil, nil)
+	if err != nil {
+		return err
+	}
+	return expect(resp, body, 404, nil)
+}
+
+func checkExpectation(h *Harness) error {
+	raw := "GET /echo/continue HTTP/1.1\r\nHost: selftest\r\nExpect: 100-continue\r\n\r\n" +
+		"GET /echo/other HTTP/1.1\r\nHost: selftest\r\nExpect: something-else\r\nConnection: close\r\n\r\n"
+
+	responses, bodies, err := h.Exchange(raw, 2)
+	if err != nil {
+		return err
+	}
+	if err := expect(responses[0], bodies[0], 200, []byte("continue")); err != nil {
+		return fmt.Errorf("100-continue: %w", err)
+	}
+	return expect(responses[1], bodies[1], 417, nil)
+}
+
+func checkContinue(h *Harness) error {
+	conn, err := net.Dial("tcp", h.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// The body is only sent once the server asked for it
+	content := "sent after 100 Continue"
+	if _, err := fmt.Fprintf(conn, "POST /files/continue.txt HTTP/1.1\r\nHost: selftest\r\nContent-Length: %d\r\nExpect: 100-continue\r\nConnection: close\r\n\r\n", len(content)); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(conn)
+	interim, err := nethttp.ReadResponse(reader, nil)
+	if err != nil {
+		return fmt.Errorf("interim response: %w", err)
+	}
+	if interim.StatusCode != 100 {
+		return fmt.Errorf("got status %d before the body, want 100", interim.StatusCode)
+	}
+	if _, err := io.WriteString(conn, content); err != nil {
+		return err
+	}
+	resp, err := nethttp.ReadResponse(reader, nil)
+	if err != nil {
+		return err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if err := expect(resp, body, 201, nil); err != nil {
+		return err
+	}
+
+	resp, body, err = h.Do("GET", "/files/continue.txt", nil, nil)
+	if err != nil {
+		return err
+	}
+	return expect(resp, body, 200, []byte(content))
+}
+
+func checkPipelining(h *Harness) error {
+	raw := "GET /echo/one HTTP/1.1\r\nHost: selftest\r\n\r\n" +
+		"GET /echo/two HTTP/1.1\r\nHost: selftest\r\nConnection: close\r\n\r\n"
+
+	responses, bodies, err := h.Exchange(raw, 2)
+	if err != nil {
+		return err
+	}
+	if err := expect(responses[0], bodies[0], 200, []byte("one")); err != nil {
+		return fmt.Errorf("first response: %w", err)
+	}
+	return expect(responses[1], bodies[1], 200, []byte("two"))
+}
+
+func checkHead(h *Harness) error {
+	conn, err := net.Dial("tcp", h.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Body bytes sent after the HEAD response would be read as the next one
+	raw := "HEAD /echo/octo HTTP/1.1\r\nHost: selftest\r\n\r\n" +
+		"GET /echo/two HTTP/1.1\r\nHost: selftest\r\nConnection: close\r\n\r\n"
+	if _, err := io.WriteString(conn, raw); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := nethttp.ReadResponse(reader, &nethttp.Request{Method: "HEAD"})
+	if err != nil {
+		return fmt.Errorf("HEAD response: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 || resp.ContentLength != int64(len("octo")) {
+		return fmt.Errorf("HEAD response: got status %d and Content-Length %d, want 200 and %d", resp.StatusCode, resp.ContentLength, len("octo"))
+	}
+
+	resp, err = nethttp.ReadResponse(reader, nil)
+	if err != nil {
+		return fmt.Errorf("response after HEAD: %w", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	return expect(resp, body, 200, []byte("two"))
+}
+
+func checkKeepAlive(h *Harness) error {
+	conn, err := net.Dial("tcp", h.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Each request is sent only after the previous response was read
+	reader := bufio.NewReader(conn)
+	for _, word := range []string{"one", "two", "three"} {
+		if _, err := fmt.Fprintf(conn, "GET /echo/%s HTTP/1.1\r\nHost: selftest\r\n\r\n", word); err != nil {
+			return fmt.Errorf("request %q: %w", word, err)
+		}
+		resp, err := nethttp.ReadResponse(reader, nil)
+		if err != nil {
+			return fmt.Errorf("response to %q: %w", word, err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if err := expect(resp, body, 200, []byte(word)); err != nil {
+			return fmt.Errorf("response to %q: %w", word, err)
+		}
+	}
+	return nil
+}
+
+func checkVersions(h *Harness) error {
+	// The second request goes unanswered, as the connection closes after the first
+	responses, bodies, err := h.Exchange("GET /echo/old HTTP/1.0\r\n\r\nGET /echo/again HTTP/1.0\r\n\r\n", 1)
+	if err != nil {
+		return err
+	}
+	if err := expect(responses[0], bodies[0], 200, []byte("old")); err != nil {
+		return fmt.Errorf("HTTP/1.0: %w", err)
+	}
+	if !responses[0].Close {
+		return errors.New("HTTP/1.0: connection kept open")
+	}
+
+	responses, bodies, err = h.Exchange("GET / HTTP/2.0\r\nHost: selftest\r\n\r\n", 1)
+	if err != nil {
+		return err
+	}
+	return expect(responses[0], bodies[0], 505, nil)
+}
+
+func checkHost(h *Harness) error {
+	for name, head := range map[string]string{
+		"missing":   "",
+		"repeated":  "Host: selftest\r\nHost: other\r\n",
+		"malformed": "Host: self test\r\n",
+		// Whitespace before the colon leaves the field's name in doubt
+		"spaced": "Host : selftest\r\n",
+	} {
+		responses, bodies, err := h.Exchange("GET /echo/host HTTP/1.1\r\n"+head+"\r\n", 1)
+		if err != nil {
+			return fmt.Errorf("%s Host: %w", name, err)
+		}
+		if err := expect(responses[0], bodies[0], 400, nil); err != nil {
+			return fmt.Errorf("%s Host: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func checkAbsoluteForm(h *Harness) error {
+	responses, bodies, err := h.Exchange("GET http://selftest/echo/absolute HTTP/1.1\r\nHost: selftest\r\nConnection: close\r\n\r\n", 1)
+	if err != nil {
+		return err
+	}
+	if err := expect(responses[0], bodies[0], 200, []byte("absolute")); err != nil {
+		return err
+	}
+
+	// A target in none of the forms is malformed
+	responses, bodies, err = h.Exchange("GET echo/relative HTTP/1.1\r\nHost: selftest\r\n\r\n", 1)
+	if err != nil {
+		return err
+	}
+	return expect(responses[0], bodies[0], 400, nil)
+}
+
+func checkFraming(h *Harness) error {
+	// The bytes after the declared length must not be served as a second request
+	smuggled := "GET /echo/smuggled HTTP/1.1\r\nHost: selftest\r\n\r\n"
+	for head, status := range map[string]int{
+		"Transfer-Encoding: chunked\r\nContent-Length: 3\r\n":       400,
+		"Transfer-Encoding: gzip, chunked\r\nContent-Length: 3\r\n": 400,
+		"Transfer-Encoding: gzip, chunked\r\n":                      501,
+		"Transfer-Encoding: chunked, gzip\r\n":                      501,
+	} {
+		raw := "POST /files/framing.txt HTTP/1.1\r\nHost: selftest\r\n" + head + "\r\n0\r\n\r\n" + smuggled
+		responses, bodies, err := h.Exchange(raw, 1)
+		if err != nil {
+			return fmt.Errorf("%q: %w", head, err)
+		}
+		if err := expect(responses[0], bodies[0], status, nil); err != nil {
+			return fmt.Errorf("%q: %w", head, err)
+		}
+		if !responses[0].Close {
+			return fmt.Errorf("%q: connection left open", head)
+		}
+	}
+	return nil
+}
+
+func checkChunkedUpload(h *Harness) error {
+	chunks := []string{"hello ", "from a ", strings.Repeat("chunked ", 1000), "body"}
+	var raw strings.Builder
+	raw.WriteString("POST /files/chunked.txt HTTP/1.1\r\nHost: selftest\r\nTransfer-Encoding: chunked\r\nConnection: close\r\n\r\n")
+	for _, chunk := range chunks {
+		fmt.Fprintf(&raw, "%x\r\n%s\r\n", len(chunk), chunk)
+	}
+	raw.WriteString("0\r\n\r\n")
+
+	responses, bodies, err := h.Exchange(raw.String(), 1)
+	if err != nil {
+		return err
+	}
+	if err := expect(responses[0], bodies[0], 201, nil); err != nil {
+		return err
+	}
+
+	resp, body, err := h.Do("GET", "/files/chunked.txt", nil, nil)
+	if err != nil {
+		return err
+	}
+	return expect(resp, body, 200, []byte(strings.Join(chunks, "")))
+}
+
+func checkTrailers(h *Harness) error {
+	parts := []string{"octo ", "streams ", "trailers"}
+	upstream := &nethttp.Server{Handler: nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.Header().Set("Trailer", "Content-Digest")
+		sum := sha256.New()
+		for _, part := range parts {
+			io.WriteString(io.MultiWriter(w, sum), part)
+			w.(nethttp.Flusher).Flush()
+		}
+		w.Header().Set("Content-Digest", digest(sum.Sum(nil)))
+	})}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	go upstream.Serve(listener)
+	defer upstream.Close()
+
+	route, err := proxy.ParseRoute("/upstream=http://" + listener.Addr().String())
+	if err != nil {
+		return err
+	}
+	proxied, err := Start(&config.Config{Port: "0", Proxies: []proxy.Route{route}})
+	if err != nil {
+		return err
+	}
+	defer proxied.Close()
+
+	resp, body, err := proxied.Do("GET", "/upstream/stream", nil, nil)
+	if err != nil {
+		return err
+	}
+	if err := expect(resp, body, 200, []byte(strings.Join(parts, ""))); err != nil {
+		return err
+	}
+	if !slices.Equal(resp.TransferEncoding, []string{"chunked"}) {
+		return fmt.Errorf("got Transfer-Encoding %q, want chunked", resp.TransferEncoding)
+	}
+	sum := sha256.Sum256(body)
+	if got, want := resp.Trailer.Get("Content-Digest"), digest(sum[:]); got != want {
+		return fmt.Errorf("got Content-Digest trailer %q, want %q", got, want)
+	}
+	return nil
+}
+
+// digest formats a SHA-256 checksum as a Content-Digest field value (RFC 9530)
+func digest(sum []byte) string {
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(sum) + ":"
+}
+
+// concurrency is the number of clients of the concurrent checks
+const concurrency = 16
+
+// parallel runs fn for each of concurrency clients at once and returns the first error
+func parallel(fn func(i int) error) error {
+	var wg sync.WaitGroup
+	errs := make([]error, concurrency)
+	for i := range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = fn(i)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+func checkConcurrentUploads(h *Harness) error {
+	content := func(i int) []byte {
+		return bytes.Repeat([]byte{byte('a' + i)}, 64<<10+i)
+	}
+
+	err := parallel(func(i int) error {
+		resp, body, err := h.Do("POST", fmt.Sprintf("/files/concurrent-%d.bin", i), nil, content(i))
+		if err != nil {
+			return err
+		}
+		return expect(resp, body, 201, nil)
+	})
+	if err != nil {
+		return err
+	}
+
+	return parallel(func(i int) error {
+		resp, body, err := h.Do("GET", fmt.Sprintf("/files/concurrent-%d.bin", i), nil, nil)
+		if err != nil {
+			return err
+		}
+		if err := expect(resp, body, 200, nil); err != nil {
+			return err
+		}
+		if !bytes.Equal(body, content(i)) {
+			return fmt.Errorf("concurrent-%d.bin: got %d bytes, not what was uploaded", i, len(body))
+		}
+		return nil
+	})
+}
+
+func checkConcurrentOverwrites(h *Harness) error {
+	versions := make(map[string]bool, concurrency)
+	for i := range concurrency {
+		versions[strings.Repeat(fmt.Sprintf("version %02d;", i), 8<<10)] = true
+	}
+	contents := make([]string, 0, concurrency)
+	for content := range versions {
+		contents = append(contents, content)
+	}
+
+	err := parallel(func(i int) error {
+		resp, _, err := h.Do("PUT", "/files/overwritten.txt", nil, []byte(contents[i]))
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != 200 && resp.StatusCode != 201 {
+			return fmt.Errorf("got status %d, want 200 or 201", resp.StatusCode)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Uploads are written atomically, so readers never see a mix of two of them
+	resp, body, err := h.Do("GET", "/files/overwritten.txt", nil, nil)
+	if err != nil {
+		return err
+	}
+	if err := expect(resp, body, 200, nil); err != nil {
+		return err
+	}
+	if !versions[string(body)] {
+		return fmt.Errorf("file holds %d bytes matching none of the uploads", len(body))
+	}
+	return nil
+}
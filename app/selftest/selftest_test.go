@@ -0,0 +1,25 @@
+package selftest
+
+import (
+	"testing"
+
+	"octo-server/app/config"
+)
+
+// TestChecks runs every check of the selftest command against one server, in
+// the order the command runs them
+func TestChecks(t *testing.T) {
+	h, err := Start(&config.Config{Port: "0", Directory: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+
+	for _, c := range checks {
+		t.Run(c.name, func(t *testing.T) {
+			if err := c.run(h); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
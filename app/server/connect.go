@@ -0,0 +1,106 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"octo-server/app/http"
+	"octo-server/app/metrics"
+)
+
+// tunnelDialTimeout bounds how long connecting to a CONNECT target may take
+const tunnelDialTimeout = 10 * time.Second
+
+// tunnel answers a CONNECT request by opening a TCP connection to the
+// requested host and port and splicing bytes in both directions until
+// either side closes
+func (s *Server) tunnel(conn net.Conn, parser *http.Parser, req *http.Request) {
+	_, portField, _ := net.SplitHostPort(req.RequestTarget)
+	port, _ := strconv.Atoi(portField)
+	if !slices.Contains(s.current().config.ConnectPorts, port) {
+		metrics.Default.Inc("connect_tunnels_total", "result", "forbidden_port")
+		s.refuseTunnel(conn, http.StatusForbidden)
+		return
+	}
+
+	upstream, err := net.DialTimeout("tcp", req.RequestTarget, tunnelDialTimeout)
+	if err != nil {
+		metrics.Default.Inc("connect_tunnels_total", "result", "dial_error")
+		fmt.Fprintf(os.Stderr, "Tunnel failed: target=%s client=%s err=%v\n", req.RequestTarget, req.ClientIP(), err)
+		status := http.StatusBadGateway
+		if isTimeoutError(err) {
+			status = http.StatusGatewayTimeout
+		}
+		s.refuseTunnel(conn, status)
+		return
+	}
+	defer upstream.Close()
+
+	// A 2xx answer to CONNECT has no body and no framing headers
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		StatusText: "Connection Established",
+		Headers:    make(http.Header),
+	}
+	writer := s.newWriter(conn)
+	writer.SetRequest(req)
+	if err := writer.WriteResponse(resp); err != nil {
+		return
+	}
+	metrics.Default.Inc("connect_tunnels_total", "result", "established")
+	fmt.Printf("Tunnel established: target=%s client=%s\n", req.RequestTarget, req.ClientIP())
+
+	// Bytes the client sent right after the request were buffered by the parser
+	client := parser.Detach(nil)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		splice(upstream, client, "upstream")
+	}()
+	go func() {
+		defer wg.Done()
+		splice(conn, upstream, "client")
+	}()
+	wg.Wait()
+}
+
+// splice copies bytes from src to dst, then closes dst for writing so the
+// other side sees the end of the stream while the opposite direction drains
+func splice(dst net.Conn, src io.Reader, direction string) {
+	n, _ := io.Copy(dst, src)
+	metrics.Default.Add("connect_tunnel_bytes_total", n, "direction", direction)
+
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	} else {
+		dst.Close()
+	}
+}
+
+// refuseTunnel answers a CONNECT request that is not tunneled and closes the connection
+func (s *Server) refuseTunnel(conn net.Conn, status int) {
+	resp := &http.Response{
+		StatusCode: status,
+		StatusText: http.StatusCodeToText(status),
+		Headers: http.Header{
+			"Connection":     {"close"},
+			"Content-Length": {"0"},
+		},
+	}
+	s.newWriter(conn).WriteResponse(resp)
+}
+
+// isTimeoutError reports whether err is a network timeout
+func isTimeoutError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,32 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+
+	"octo-server/app/tlsconf"
+)
+
+// tlsFingerprint holds the JA3 and JA4 fingerprints of the ClientHello of a TLS connection
+type tlsFingerprint struct {
+	ja3, ja4 string
+}
+
+// fingerprintKey is the context key of the TLS fingerprint of an HTTP/2 connection
+type fingerprintKey struct{}
+
+// recordClientHello keeps the fingerprints of a ClientHello until the
+// handshake is over. It implements tls.Config.GetConfigForClient, keeping the
+// configuration as it is.
+func (s *Server) recordClientHello(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	s.clientHellos.Store(hello.Conn, tlsFingerprint{ja3: tlsconf.JA3(hello), ja4: tlsconf.JA4(hello)})
+	return nil, nil
+}
+
+// takeFingerprint returns and forgets the fingerprints recorded for the
+// connection under a TLS connection, once its handshake is over
+func (s *Server) takeFingerprint(conn net.Conn) tlsFingerprint {
+	fingerprint, _ := s.clientHellos.LoadAndDelete(conn)
+	f, _ := fingerprint.(tlsFingerprint)
+	return f
+}
@@ -0,0 +1,224 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	nethttp "net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	"octo-server/app/handler"
+	"octo-server/app/http"
+	"octo-server/app/memory"
+)
+
+// serveHTTP2 serves an HTTP/2 connection, negotiated over TLS or started in
+// cleartext, handling each stream as a request routed like any HTTP/1.1 request.
+// The requests carry the fingerprint of the TLS connection.
+func (s *Server) serveHTTP2(conn net.Conn, fingerprint tlsFingerprint) {
+	s.http2.ServeConn(conn, &http2.ServeConnOpts{
+		Context: context.WithValue(context.Background(), fingerprintKey{}, fingerprint),
+		Handler: nethttp.HandlerFunc(s.serveStream),
+	})
+}
+
+// isH2CUpgrade reports whether a request asks to upgrade the connection to cleartext HTTP/2
+func isH2CUpgrade(req *http.Request) bool {
+	return req.Headers.Has("HTTP2-Settings") && strings.EqualFold(req.Header("Upgrade"), "h2c") && req.Version == "HTTP/1.1"
+}
+
+// upgradeH2C switches a cleartext connection to HTTP/2 as asked by req, which
+// is then answered as the connection's first stream (RFC 7540, section 3.2)
+func (s *Server) upgradeH2C(conn net.Conn, parser *http.Parser, req *http.Request) error {
+	settings, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(req.Header("HTTP2-Settings"), "="))
+	if err != nil {
+		return fmt.Errorf("invalid HTTP2-Settings header: %w", err)
+	}
+
+	// The request is handed to the HTTP/2 server as a whole, so its body must be read first
+	var body []byte
+	if parser.BodyPending() {
+		if body, err = req.ReadBody(); err != nil {
+			switch {
+			case errors.Is(err, http.ErrBodyTooLarge):
+				s.closeWith(conn, http.StatusContentTooLarge)
+			case errors.Is(err, memory.ErrBudgetExceeded):
+				s.closeWith(conn, http.StatusServiceUnavailable)
+			}
+			return fmt.Errorf("failed to read upgrade request body: %w", err)
+		}
+	}
+
+	upgrade, err := nethttp.NewRequest(req.Method, "http://"+req.Header("Host")+req.RequestTarget, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("invalid upgrade request: %w", err)
+	}
+	upgrade.Header = nethttp.Header(req.Headers.Clone())
+	upgrade.RemoteAddr = req.RemoteAddr
+
+	resp := &http.Response{
+		StatusCode: http.StatusSwitchingProtocols,
+		StatusText: http.StatusCodeToText(http.StatusSwitchingProtocols),
+		Headers: http.Header{
+			"Connection": {"Upgrade"},
+			"Upgrade":    {"h2c"},
+		},
+	}
+	if err := s.newWriter(conn).WriteResponse(resp); err != nil {
+		return err
+	}
+
+	s.http2.ServeConn(parser.Detach(nil), &http2.ServeConnOpts{
+		Handler:        nethttp.HandlerFunc(s.serveStream),
+		UpgradeRequest: upgrade,
+		Settings:       settings,
+	})
+	return nil
+}
+
+// serveStream handles a single HTTP/2 stream
+func (s *Server) serveStream(w nethttp.ResponseWriter, r *nethttp.Request) {
+	headers := http.Header(r.Header).Clone()
+	headers.Set("Host", r.Host)
+	if r.ContentLength >= 0 {
+		headers.Set("Content-Length", strconv.FormatInt(r.ContentLength, 10))
+	}
+
+	req := http.NewRequest(r.Method, r.URL.RequestURI(), r.Proto, headers, r.RemoteAddr, r.Body)
+	if fingerprint, ok := r.Context().Value(fingerprintKey{}).(tlsFingerprint); ok {
+		req.SetTLSFingerprint(fingerprint.ja3, fingerprint.ja4)
+	}
+	// The stream's context is cancelled once the client resets it or the connection closes
+	current := s.current()
+	ctx, cancel := http.RequestContext(r.Context(), req, current.config.RequestTimeout)
+	defer cancel()
+	req.SetContext(ctx)
+	sink := &streamSink{w: w}
+	writer := http.NewSinkWriter(sink)
+
+	// Requests in HTTP/3 0-RTT data can be replayed, so only those without side effects are handled
+	if r.TLS != nil && !r.TLS.HandshakeComplete && !isSafeMethod(r.Method) {
+		if err := handler.TooEarlyHandler(req, writer, current.handler); err != nil {
+			fmt.Fprintf(os.Stderr, "Error handling request: %v\n", err)
+		}
+		return
+	}
+
+	if err := s.workers.Acquire(ctx, req.Priority().Urgency); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			// Timed out while queued; a reset stream has no one left to answer
+			handler.ServiceUnavailableHandler(req, writer, current.handler)
+		}
+		return
+	}
+	err := s.current().router.ServeRequest(req, writer)
+	s.releaseWorker(err)
+	if errors.Is(err, handler.ErrTimedOut) {
+		if writer.Status() == 0 {
+			// The request was answered with 503 in place of its handler
+			return
+		}
+		// The handler may still be writing its response, which must not reach the stream once reset
+		sink.close()
+		panic(nethttp.ErrAbortHandler)
+	}
+	if errors.Is(err, handler.ErrPanicked) {
+		// Resets the stream, so the client cannot take the response cut short for a whole one
+		panic(nethttp.ErrAbortHandler)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error handling request: %v\n", err)
+	}
+}
+
+// isSafeMethod reports whether a request method is safe to replay, having no side effects
+func isSafeMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	}
+	return false
+}
+
+// errStreamClosed is returned by writes to a stream whose request timed out
+var errStreamClosed = errors.New("stream closed after the request timed out")
+
+// streamSink writes responses to an HTTP/2 stream
+type streamSink struct {
+	w nethttp.ResponseWriter
+
+	// mu keeps the handler of a request that timed out from writing to the
+	// stream once the stream is done with
+	mu     sync.Mutex
+	closed bool
+}
+
+// close stops writes to the stream, interrupting the one in progress if any
+func (s *streamSink) close() {
+	nethttp.NewResponseController(s.w).SetWriteDeadline(time.Now())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+}
+
+// WriteHead implements http.ResponseSink
+func (s *streamSink) WriteHead(resp *http.Response) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errStreamClosed
+	}
+	header := s.w.Header()
+	for key, values := range resp.Headers {
+		header[key] = values
+	}
+	for _, key := range http.HopByHopHeaders {
+		header.Del(key)
+	}
+	s.w.WriteHeader(resp.StatusCode)
+	return nil
+}
+
+// Write implements http.ResponseSink
+func (s *streamSink) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0, errStreamClosed
+	}
+	return s.w.Write(b)
+}
+
+// WriteTrailer implements http.ResponseSink
+func (s *streamSink) WriteTrailer(trailer http.Header) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errStreamClosed
+	}
+	// Trailers not declared before the head are sent under their prefixed names
+	header := s.w.Header()
+	for key, values := range trailer {
+		header[nethttp.TrailerPrefix+key] = values
+	}
+	return nil
+}
+
+// Flush implements http.ResponseSink
+func (s *streamSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errStreamClosed
+	}
+	return nethttp.NewResponseController(s.w).Flush()
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	nethttp "net/http"
+	"os"
+	"slices"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+
+	"octo-server/app/config"
+	"octo-server/app/handler"
+)
+
+// AltSvcMaxAge is how long, in seconds, clients may remember the HTTP/3 endpoint advertised in Alt-Svc
+const AltSvcMaxAge = 86400
+
+// altServices returns the alternative services advertised in Alt-Svc: HTTP/3,
+// if enabled, on --http3-port or else the port of each TLS listener, and HTTP/2
+// on the port of each TLS listener, HTTP/3 first
+func altServices(cfg *config.Config) []handler.AltService {
+	var ports []string
+	for _, l := range cfg.ListenersOrDefault() {
+		if l.TLS && l.Network == "tcp" {
+			if _, port, err := net.SplitHostPort(l.Address); err == nil && !slices.Contains(ports, port) {
+				ports = append(ports, port)
+			}
+		}
+	}
+
+	var services []handler.AltService
+	if cfg.HTTP3 {
+		quicPorts := ports
+		if cfg.HTTP3Port != "" && len(ports) > 0 {
+			quicPorts = []string{cfg.HTTP3Port}
+		}
+		for _, port := range quicPorts {
+			services = append(services, handler.AltService{Protocol: "h3", Port: port, MaxAge: AltSvcMaxAge})
+		}
+	}
+	for _, port := range ports {
+		services = append(services, handler.AltService{Protocol: "h2", Port: port, MaxAge: AltSvcMaxAge})
+	}
+	return services
+}
+
+// serveHTTP3 starts serving the routes over HTTP/3 on the UDP socket conn
+// bound to address, handling each stream like an HTTP/2 stream
+func (s *Server) serveHTTP3(conn net.PacketConn, address string, tlsConfig *tls.Config) {
+	h3 := &http3.Server{
+		Handler:    nethttp.HandlerFunc(s.serveStream),
+		TLSConfig:  http3.ConfigureTLSConfig(tlsConfig),
+		QUICConfig: &quic.Config{Allow0RTT: s.current().config.HTTP3EarlyData},
+	}
+	s.sockets.Lock()
+	s.packetConns = append(s.packetConns, conn)
+	s.http3 = append(s.http3, h3)
+	s.sockets.Unlock()
+	go func() {
+		if err := h3.Serve(conn); err != nil && !errors.Is(err, nethttp.ErrServerClosed) && !s.stopping.Load() {
+			fmt.Fprintf(os.Stderr, "HTTP/3 listener stopped: %v\n", err)
+		}
+	}()
+
+	fmt.Fprintf(os.Stdout, "Server listening on %s/udp (HTTP/3)\n", address)
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+
+	"octo-server/app/config"
+)
+
+// listenFDsStart is the first file descriptor of the sockets a parent process
+// passes down, as in systemd socket activation
+const listenFDsStart = 3
+
+// inheritedSockets are the sockets passed down by a parent process in
+// LISTEN_FDS, by an upgrading server or by systemd socket activation. Each is
+// taken by the listener bound to the same address; the rest are closed.
+type inheritedSockets struct {
+	listeners []net.Listener
+	packets   []net.PacketConn
+}
+
+// inheritSockets takes over the sockets passed down in LISTEN_FDS, if any
+func inheritSockets() *inheritedSockets {
+	inherited := &inheritedSockets{}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return inherited
+	}
+	if pid := os.Getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return inherited
+	}
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_PID")
+
+	for fd := listenFDsStart; fd < listenFDsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), "inherited socket "+strconv.Itoa(fd))
+		if listener, err := net.FileListener(f); err == nil {
+			inherited.listeners = append(inherited.listeners, listener)
+		} else if conn, err := net.FilePacketConn(f); err == nil {
+			inherited.packets = append(inherited.packets, conn)
+		} else {
+			fmt.Fprintf(os.Stderr, "Ignoring inherited file descriptor %d: %v\n", fd, err)
+		}
+		f.Close()
+	}
+	return inherited
+}
+
+// listener takes the inherited listener bound to the address of l, or returns nil
+func (in *inheritedSockets) listener(l config.Listener) net.Listener {
+	for i, listener := range in.listeners {
+		if sameAddress(listener.Addr(), l.Network, l.Address) {
+			in.listeners = append(in.listeners[:i], in.listeners[i+1:]...)
+			return listener
+		}
+	}
+	return nil
+}
+
+// packetConn takes the inherited UDP socket bound to address, or returns nil
+func (in *inheritedSockets) packetConn(address string) net.PacketConn {
+	for i, conn := range in.packets {
+		if sameAddress(conn.LocalAddr(), "udp", address) {
+			in.packets = append(in.packets[:i], in.packets[i+1:]...)
+			return conn
+		}
+	}
+	return nil
+}
+
+// close closes the inherited sockets no listener took
+func (in *inheritedSockets) close() {
+	for _, listener := range in.listeners {
+		fmt.Fprintf(os.Stderr, "Closing inherited socket %s, which no listener is configured for\n", listener.Addr())
+		listener.Close()
+	}
+	for _, conn := range in.packets {
+		fmt.Fprintf(os.Stderr, "Closing inherited UDP socket %s, which HTTP/3 is not served on\n", conn.LocalAddr())
+		conn.Close()
+	}
+	in.listeners, in.packets = nil, nil
+}
+
+// sameAddress reports whether a bound socket's address is the configured address
+// on network. TCP and UDP addresses match by port, and by host unless either is unspecified.
+func sameAddress(addr net.Addr, network, address string) bool {
+	if network == "unix" {
+		return addr.Network() == "unix" && addr.String() == address
+	}
+	if addr.Network() != network {
+		return false
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	boundHost, boundPort, err := net.SplitHostPort(addr.String())
+	if err != nil || boundPort != port {
+		return false
+	}
+	ip, boundIP := net.ParseIP(host), net.ParseIP(boundHost)
+	return host == "" || ip == nil || ip.IsUnspecified() || boundIP.IsUnspecified() || ip.Equal(boundIP)
+}
+
+// listen binds the socket of a listener, with SO_REUSEPORT if reusePort is
+// set so that another process can bind the same address. A Unix socket left
+// behind by a previous run is replaced.
+func listen(l config.Listener, reusePort bool) (net.Listener, error) {
+	if l.Network == "unix" {
+		if info, err := os.Lstat(l.Address); err == nil && info.Mode().Type() == os.ModeSocket {
+			os.Remove(l.Address)
+		}
+	}
+	lc := net.ListenConfig{}
+	if reusePort && l.Network == "tcp" {
+		lc.Control = reusePortControl
+	}
+	network := l.Network
+	if network == "tcp" {
+		network += l.Family()
+	}
+	listener, err := lc.Listen(context.Background(), network, l.Address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to bind to %s: %w", l.Name(), err)
+	}
+	return listener, nil
+}
+
+// listenPacket binds the UDP socket HTTP/3 is served on alongside the TLS
+// listener l, with SO_REUSEPORT if reusePort is set
+func listenPacket(l config.Listener, reusePort bool) (net.PacketConn, error) {
+	lc := net.ListenConfig{}
+	if reusePort {
+		lc.Control = reusePortControl
+	}
+	conn, err := lc.ListenPacket(context.Background(), "udp"+l.Family(), l.Address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to bind UDP %s for HTTP/3: %w", l.Address, err)
+	}
+	return conn, nil
+}
+
+// reusePortControl sets SO_REUSEPORT on a socket before it is bound
+func reusePortControl(network, address string, conn syscall.RawConn) error {
+	var sockErr error
+	err := conn.Control(func(fd uintptr) {
+		sockErr = setReusePort(fd)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package server
+
+// setNonblock does nothing, since sockets are not passed on to other processes on this platform
+func setNonblock(fd uintptr) error {
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package server
+
+import "golang.org/x/sys/unix"
+
+// setNonblock puts the socket fd back into non-blocking mode
+func setNonblock(fd uintptr) error {
+	return unix.SetNonblock(int(fd), true)
+}
@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package server
+
+import "errors"
+
+// setReusePort fails, since SO_REUSEPORT is not available on this platform
+func setReusePort(fd uintptr) error {
+	return errors.New("SO_REUSEPORT is not supported on this platform")
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"octo-server/app/config"
+)
+
+// tuneRuntime applies the garbage collector settings of the configuration,
+// leaving the runtime defaults and GOGC/GOMEMLIMIT in effect for unset ones
+func tuneRuntime(cfg *config.Config) {
+	switch {
+	case cfg.GCPercent == -1:
+		debug.SetGCPercent(-1)
+	case cfg.GCPercent > 0:
+		debug.SetGCPercent(cfg.GCPercent)
+	}
+	if cfg.MemoryLimit > 0 {
+		debug.SetMemoryLimit(int64(cfg.MemoryLimit))
+	}
+}
+
+// setSocketBuffers sizes the kernel buffers of an accepted connection as configured
+func setSocketBuffers(conn net.Conn, cfg *config.Config) {
+	if cfg.SocketSendBuffer == 0 && cfg.SocketReceiveBuffer == 0 {
+		return
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if cfg.SocketSendBuffer > 0 {
+		tcpConn.SetWriteBuffer(int(cfg.SocketSendBuffer))
+	}
+	if cfg.SocketReceiveBuffer > 0 {
+		tcpConn.SetReadBuffer(int(cfg.SocketReceiveBuffer))
+	}
+}
+
+// logPerf periodically logs allocation and garbage collection statistics,
+// as rates over each interval alongside the totals
+func logPerf(interval time.Duration) {
+	var prev runtime.MemStats
+	runtime.ReadMemStats(&prev)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		seconds := interval.Seconds()
+
+		lastPause := time.Duration(0)
+		if stats.NumGC > 0 {
+			lastPause = time.Duration(stats.PauseNs[(stats.NumGC+255)%256])
+		}
+		fmt.Fprintf(os.Stdout, "Perf heap=%s heap_objects=%d alloc_rate=%s/s mallocs_rate=%.0f/s gc=%d gc_rate=%.2f/s gc_pause=%s last_pause=%s gc_cpu=%.2f%% goroutines=%d sys=%s\n",
+			mebibytes(stats.HeapAlloc),
+			stats.HeapObjects,
+			mebibytes(uint64(float64(stats.TotalAlloc-prev.TotalAlloc)/seconds)),
+			float64(stats.Mallocs-prev.Mallocs)/seconds,
+			stats.NumGC,
+			float64(stats.NumGC-prev.NumGC)/seconds,
+			time.Duration(stats.PauseTotalNs-prev.PauseTotalNs),
+			lastPause,
+			stats.GCCPUFraction*100,
+			runtime.NumGoroutine(),
+			mebibytes(stats.Sys),
+		)
+		prev = stats
+	}
+}
+
+// mebibytes formats a byte count in MB with one decimal
+func mebibytes(n uint64) string {
+	return fmt.Sprintf("%.1fMB", float64(n)/(1<<20))
+}
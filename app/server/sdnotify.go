@@ -0,0 +1,28 @@
+package server
+
+import (
+	"net"
+	"os"
+	"strings"
+)
+
+// sdNotify sends a state such as "READY=1" to the service manager in
+// NOTIFY_SOCKET, as systemd's sd_notify does. It does nothing when the server
+// is not run by a service manager that asked for notifications.
+func sdNotify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	// A leading '@' names a socket in the abstract namespace
+	if strings.HasPrefix(path, "@") {
+		path = "\x00" + path[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
@@ -1,77 +1,845 @@
 package server
 
 import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"net"
 	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+
+	"octo-server/app/analytics"
+	"octo-server/app/caldav"
+	"octo-server/app/clock"
 	"octo-server/app/config"
+	"octo-server/app/conntrack"
+	"octo-server/app/crash"
+	"octo-server/app/githttp"
 	"octo-server/app/handler"
 	"octo-server/app/http"
+	"octo-server/app/httpcache"
+	"octo-server/app/lifecycle"
+	"octo-server/app/manifest"
+	"octo-server/app/memory"
+	"octo-server/app/metrics"
+	"octo-server/app/mirror"
+	"octo-server/app/progress"
+	"octo-server/app/proxy"
+	"octo-server/app/proxyproto"
+	"octo-server/app/ratelimit"
+	"octo-server/app/recent"
+	"octo-server/app/s3"
+	"octo-server/app/scheduler"
+	"octo-server/app/tlsconf"
+	"octo-server/app/trash"
+	"octo-server/app/versions"
 )
 
+// statsSaveInterval is how often changed file statistics are written to the stats file
+const statsSaveInterval = 30 * time.Second
+
+// trashPurgeInterval is how often expired files are removed from the trash
+const trashPurgeInterval = time.Hour
+
+// stuckCheckInterval is how often connections are checked for being stuck, at most
+const stuckCheckInterval = 10 * time.Second
+
+// handshakeTimeout bounds how long a client may take to complete the TLS handshake
+const handshakeTimeout = 10 * time.Second
+
 // Server represents the HTTP server
 type Server struct {
-	config *config.Config
-	router *handler.Router
+	state       atomic.Pointer[state]
+	certs       *tlsconf.Certificates
+	connLimiter *ratelimit.ConnLimiter
+	workers     *scheduler.Pool
+	memory      *memory.Budget
+	http2       *http2.Server
+	files       *analytics.Files
+	clock       clock.Clock
+	proxies     []*proxy.Proxy
+	hostProxies map[string][]*proxy.Proxy
+
+	// reloading serializes reloads and guards purging
+	reloading sync.Mutex
+	// purging are the trashes whose expired files are being purged
+	purging []*trash.Trash
+
+	// sockets guards the listeners and HTTP/3 sockets, which an upgrade passes on
+	sockets     sync.Mutex
+	listeners   []net.Listener
+	packetConns []net.PacketConn
+	http3       []*http3.Server
+	// stopping is set once the server stops accepting connections to drain the open ones
+	stopping atomic.Bool
+	// clientHellos are the fingerprints of TLS connections in their handshake, by connection
+	clientHellos sync.Map
+	// connections counts the open connections
+	connections sync.WaitGroup
+
+	// conns tracks what the open connections are doing, and stuck counts
+	// those in one state for longer than --conn-stuck-after
+	conns *conntrack.Registry
+	stuck atomic.Int64
+}
+
+// state is the configuration a reload replaces as a whole. Each request is
+// handled with the state current when it arrived, so connections open during
+// a reload carry on with the new state from their next request.
+type state struct {
+	config  *config.Config
+	handler *handler.Config
+	router  *handler.Router
 }
 
 // NewServer creates a new HTTP server instance
 func NewServer(cfg *config.Config) *Server {
+	return NewServerClock(cfg, clock.Real)
+}
+
+// NewServerClock creates a server that tells the time with c, which times
+// read timeouts, expiry of uploads and trash items, lifecycle rules and caching
+func NewServerClock(cfg *config.Config, c clock.Clock) *Server {
+	uploads := progress.NewTracker(time.Minute)
+	uploads.SetClock(c)
 	handlerConfig := &handler.Config{
-		Directory: cfg.GetDirectory(),
+		RouteLimits: cfg.RouteLimits,
+		Rewrites:    cfg.Rewrites,
+		Mounts:      cfg.Mounts,
+		ExemptCIDRs: cfg.ExemptCIDRs,
+		Compression: cfg.Compression,
+
+		RefererRules: cfg.RefererRules,
+
+		TrustedProxies:   cfg.TrustedProxies,
+		IPFilter:         cfg.IPFilter,
+		DenyFingerprints: cfg.DenyFingerprints,
+		LogFingerprints:  cfg.LogFingerprints,
+
+		AccessLog:                cfg.AccessLog,
+		AccessLogHeaders:         cfg.AccessLogHeaders,
+		AccessLogResponseHeaders: cfg.AccessLogResponseHeaders,
+
+		UploadMaxFileSize:  int64(cfg.UploadMaxFileSize),
+		UploadMaxTotalSize: int64(cfg.UploadMaxTotalSize),
+		MmapMinSize:        int64(cfg.MmapMinSize),
+		TextCharset:        cfg.TextCharset,
+		TextExtensions:     cfg.TextExtensions,
+		AuditContentLength: cfg.AuditContentLength,
+		ServerHeader:       cfg.ServerHeader,
+		VirtualEndpoints:   cfg.JSONEndpoints,
+		Uploads:            uploads,
+		Downloads:          analytics.NewDownloads(),
+		Files:              analytics.NewFiles(),
+		Clock:              c,
+
+		Maintenance:           cfg.Maintenance,
+		MaintenancePage:       cfg.MaintenancePage,
+		MaintenanceRetryAfter: cfg.MaintenanceRetryAfter,
+
+		ErrorPages:    cfg.ErrorPages,
+		ErrorHandlers: &handler.ErrorHandlers{},
+
+		WorkerMetricsDir: os.Getenv(workerMetricsEnv),
+
+		Recent:         recent.New(cfg.RecentRequests),
+		RecentEndpoint: cfg.RecentRequestsEndpoint,
+		RecoverPanics:  cfg.RecoverPanics,
+	}
+	conns := conntrack.NewRegistry()
+	conns.SetClock(c)
+	if cfg.ConnectionsEndpoint {
+		handlerConfig.Connections = conns
+	}
+	mountDirectory(handlerConfig, cfg, cfg.GetDirectory())
+	if cfg.GitRoot != "" {
+		handlerConfig.Git = &githttp.Repos{Root: cfg.GitRoot, Push: cfg.GitPush}
+	}
+	if cfg.CalDAVRoot != "" {
+		handlerConfig.Calendars = &caldav.Home{Root: cfg.CalDAVRoot, Prefix: "/caldav"}
+	}
+	var proxies []*proxy.Proxy
+	hostProxies := make(map[string][]*proxy.Proxy)
+	for _, route := range cfg.Proxies {
+		p := proxy.New(route, proxy.Options{
+			Balance:        cfg.ProxyBalance,
+			ForwardedProto: forwardedProto(cfg),
+			HealthCheck:    cfg.ProxyHealth,
+		})
+		proxies = append(proxies, p)
+		if route.Host == "" {
+			handlerConfig.Proxies = append(handlerConfig.Proxies, p)
+		} else {
+			hostProxies[route.Host] = append(hostProxies[route.Host], p)
+		}
+	}
+	if len(cfg.Proxies) > 0 && (cfg.ProxyCacheSize > 0 || cfg.ProxyCacheDir != "") {
+		cache, err := httpcache.New(httpcache.Options{
+			MaxMemory: int64(cfg.ProxyCacheSize),
+			Dir:       cfg.ProxyCacheDir,
+			MaxDisk:   int64(cfg.ProxyCacheDiskSize),
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Proxy cache disabled: %v\n", err)
+		}
+		handlerConfig.ProxyCache = cache
+	}
+	handlerConfig.AltSvc = altServices(cfg)
+	handlerConfig.Hosts = virtualHosts(cfg, handlerConfig, hostProxies, nil)
+
+	budget := memory.NewBudget(int64(cfg.MemoryBudget))
+	metrics.Default.Gauge("memory_budget_used_bytes", budget.Used)
+	metrics.Default.Gauge("memory_budget_limit_bytes", budget.Limit)
+	connLimiter := ratelimit.NewConnLimiter(cfg.MaxConnsPerIP)
+	connLimiter.SetIPv6Prefix(cfg.IPv6Prefix)
+	workers := scheduler.NewPool(cfg.MaxWorkers)
+	metrics.Default.Gauge("worker_pool_busy", workers.Busy)
+	metrics.Default.Gauge("worker_pool_waiting", workers.Waiting)
+
+	s := &Server{
+		files:       handlerConfig.Files,
+		clock:       c,
+		proxies:     proxies,
+		hostProxies: hostProxies,
+		connLimiter: connLimiter,
+		workers:     workers,
+		memory:      budget,
+		http2:       &http2.Server{},
+		conns:       conns,
+	}
+	s.certs = tlsconf.NewCertificates(!cfg.TLS.DisableOCSPStapling)
+	s.certs.SetClock(c)
+	s.state.Store(&state{config: cfg, handler: handlerConfig, router: handler.NewRouter(handlerConfig)})
+	for _, state := range conntrack.States {
+		metrics.Default.Gauge("connections_open", func() int64 { return conns.Count(state) }, "state", state)
+	}
+	metrics.Default.Gauge("connections_stuck", s.stuck.Load)
+	metrics.Default.Gauge("maintenance_mode", func() int64 {
+		if s.current().handler.Maintenance {
+			return 1
+		}
+		return 0
+	})
+	return s
+}
+
+// mountDirectory points a handler configuration at the files directory dir,
+// along with everything kept in it: the manifest, trash, versions, mirror and
+// S3 bucket. An empty dir serves no files.
+func mountDirectory(handlerConfig *handler.Config, cfg *config.Config, dir string) {
+	handlerConfig.Directory = dir
+	handlerConfig.Manifest, handlerConfig.Trash, handlerConfig.Versions = nil, nil, nil
+	handlerConfig.Mirror, handlerConfig.S3 = nil, nil
+	if dir == "" {
+		return
 	}
 
-	return &Server{
-		config: cfg,
-		router: handler.NewRouter(handlerConfig),
+	handlerConfig.Manifest = manifest.New(dir)
+	if cfg.TrashRetention > 0 {
+		handlerConfig.Trash = newTrash(handlerConfig, dir, cfg)
+	}
+	if cfg.VersionsKeep > 0 {
+		handlerConfig.Versions = versions.NewStore(dir, cfg.VersionsKeep, int64(cfg.VersionsMaxSize))
+	}
+	if cfg.MirrorOrigin != "" {
+		origin, _ := mirror.ParseOrigin(cfg.MirrorOrigin) // validated by the flag
+		handlerConfig.Mirror = mirror.New(origin)
+	}
+	if cfg.S3Bucket != "" {
+		handlerConfig.S3 = s3.NewBucket(cfg.S3Bucket, dir)
+		handlerConfig.S3Credentials = s3.Credentials{AccessKey: cfg.S3AccessKey, SecretKey: cfg.S3SecretKey}
 	}
 }
 
+// virtualHosts builds the configuration of each virtual host from the default
+// one, with the host's own files directory and proxy routes. Hosts that only
+// have proxy routes share the default directory. A host whose directory is the
+// same as in previous, the hosts before a reload, keeps its statistics,
+// manifest, trash and versions.
+func virtualHosts(cfg *config.Config, defaults *handler.Config, hostProxies map[string][]*proxy.Proxy, previous map[string]*handler.Config) map[string]*handler.Config {
+	directories := make(map[string]string)
+	for _, vhost := range cfg.VirtualHosts {
+		directories[vhost.Host] = ""
+		if info, err := os.Stat(vhost.Directory); err == nil && info.IsDir() {
+			directories[vhost.Host] = vhost.Directory
+		}
+	}
+	for host := range hostProxies {
+		if _, ok := directories[host]; !ok {
+			directories[host] = defaults.Directory
+		}
+	}
+
+	hosts := make(map[string]*handler.Config, len(directories))
+	for host, dir := range directories {
+		hostConfig := *defaults
+		hostConfig.Hosts = nil
+		hostConfig.Proxies = slices.Concat(hostProxies[host], defaults.Proxies)
+
+		// Everything tied to the files directory is the host's own
+		if prev, ok := previous[host]; ok && dir != defaults.Directory && dir == prev.Directory {
+			hostConfig.Directory = dir
+			hostConfig.Files, hostConfig.Manifest, hostConfig.Trash = prev.Files, prev.Manifest, prev.Trash
+			hostConfig.Versions, hostConfig.Mirror = prev.Versions, nil
+		} else if dir != defaults.Directory {
+			hostConfig.Directory = dir
+			hostConfig.Files = analytics.NewFiles()
+			hostConfig.Manifest, hostConfig.Trash, hostConfig.Versions, hostConfig.Mirror = nil, nil, nil, nil
+			if dir != "" {
+				hostConfig.Manifest = manifest.New(dir)
+			}
+			if defaults.Trash != nil && dir != "" {
+				hostConfig.Trash = newTrash(defaults, dir, cfg)
+			}
+			if defaults.Versions != nil && dir != "" {
+				hostConfig.Versions = versions.NewStore(dir, cfg.VersionsKeep, int64(cfg.VersionsMaxSize))
+			}
+		}
+		hosts[host] = &hostConfig
+	}
+	return hosts
+}
+
+// newTrash creates the trash of the files directory dir on the clock of a handler configuration
+func newTrash(handlerConfig *handler.Config, dir string, cfg *config.Config) *trash.Trash {
+	t := trash.New(dir, cfg.TrashRetention)
+	t.SetClock(handlerConfig.Clock)
+	return t
+}
+
+// forwardedProto returns the scheme clients use to reach the server, as told to proxy upstreams
+func forwardedProto(cfg *config.Config) string {
+	if cfg.TLSEnabled() {
+		return "https"
+	}
+	return "http"
+}
+
+// current returns the state requests are handled with
+func (s *Server) current() *state {
+	return s.state.Load()
+}
+
 // Start starts the HTTP server and begins accepting connections
 func (s *Server) Start() error {
-	address := "0.0.0.0:" + s.config.Port
-	listener, err := net.Listen("tcp", address)
-	if err != nil {
-		return fmt.Errorf("failed to bind to port %s: %w", s.config.Port, err)
+	cfg := s.current().config
+	tuneRuntime(cfg)
+	if cfg.PerfLogInterval > 0 {
+		go logPerf(cfg.PerfLogInterval)
 	}
-	defer listener.Close()
 
-	fmt.Fprintf(os.Stdout, "Server listening on %s\n", address)
+	// Every listener is bound before any is served, so a busy address fails the
+	// start. Sockets passed down by systemd or an upgrading server are taken over instead.
+	inherited := inheritSockets()
+	defer inherited.close()
+	listeners := cfg.ListenersOrDefault()
+	bound := make([]net.Listener, 0, len(listeners))
+	defer func() {
+		for _, listener := range bound {
+			listener.Close()
+		}
+	}()
+	for _, l := range listeners {
+		listener := inherited.listener(l)
+		if listener == nil {
+			var err error
+			if listener, err = listen(l, cfg.ReusePort); err != nil {
+				return err
+			}
+		}
+		bound = append(bound, listener)
+	}
+	s.sockets.Lock()
+	s.listeners = bound
+	s.sockets.Unlock()
+	crash.Default.SetRequests(s.current().handler.Recent)
+	if err := serveWorkerMetrics(); err != nil {
+		return err
+	}
+
+	if cfg.StatsFile != "" {
+		if err := s.files.Load(cfg.StatsFile); err != nil {
+			return fmt.Errorf("failed to load stats file: %w", err)
+		}
+		go s.saveStats(cfg.StatsFile)
+	}
+	if cfg.ConnStuckAfter > 0 {
+		go s.watchConnections(cfg.ConnStuckAfter)
+	}
+
+	s.reloading.Lock()
+	s.purgeTrashes(s.current().handler)
+	s.reloading.Unlock()
+
+	for _, p := range s.proxies {
+		p.StartHealthChecks()
+	}
 
+	if cfg.Lifecycle.Enabled() && cfg.GetDirectory() != "" && primaryProcess() {
+		lastAccess := func(name string) time.Time {
+			stats, _ := s.files.Get(name)
+			return stats.LastAccess
+		}
+		runner := lifecycle.NewRunner(cfg.Directory, cfg.Lifecycle, lastAccess)
+		runner.SetClock(s.clock)
+		runner.Start()
+	}
+
+	var tlsConfig *tls.Config
+	if cfg.TLSEnabled() {
+		if err := s.certs.Load(cfg.KeyPairs()); err != nil {
+			return err
+		}
+		tlsConfig = &tls.Config{
+			// The certificate is looked up on every handshake so that a reload can replace it
+			GetCertificate: s.certs.GetCertificate,
+		}
+		if err := cfg.TLS.Apply(tlsConfig); err != nil {
+			return err
+		}
+	}
+
+	served := make(chan error, len(bound))
+	quic := make(map[string]bool)
+	for i, listener := range bound {
+		l := listeners[i]
+		// The PROXY protocol header comes first, before even the TLS handshake
+		if l.ProxyProtocol {
+			listener = &proxyproto.Listener{Listener: listener, Timeout: handshakeTimeout}
+		}
+		switch {
+		case l.TLS:
+			// TLS listeners sharing --http3-port on the same host share its UDP socket
+			udp := l
+			udp.Address = cfg.HTTP3Address(l)
+			if cfg.HTTP3 && l.Network == "tcp" && !quic[udp.Address] {
+				quic[udp.Address] = true
+				conn := inherited.packetConn(udp.Address)
+				if conn == nil {
+					var err error
+					if conn, err = listenPacket(udp, cfg.ReusePort); err != nil {
+						return err
+					}
+				}
+				s.serveHTTP3(conn, udp.Address, tlsConfig.Clone())
+			}
+			tlsListener := tlsConfig.Clone()
+			tlsListener.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+			tlsListener.GetConfigForClient = s.recordClientHello
+			listener = tls.NewListener(listener, tlsListener)
+			fmt.Fprintf(os.Stdout, "Server listening on %s (TLS, HTTP/2 and HTTP/1.1)\n", l.Name())
+		case l.H2C || cfg.H2C:
+			fmt.Fprintf(os.Stdout, "Server listening on %s (cleartext HTTP/2 and HTTP/1.1)\n", l.Name())
+		default:
+			fmt.Fprintf(os.Stdout, "Server listening on %s\n", l.Name())
+		}
+		go func() { served <- s.serve(listener, l) }()
+	}
+	inherited.close()
+
+	// A server started by Upgrade tells its parent, which hands the service manager over
+	if !notifyUpgraded() {
+		if err := sdNotify("READY=1"); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to notify the service manager: %v\n", err)
+		}
+	}
+
+	// The listeners are only closed to shut down or upgrade the server
+	err := <-served
+	if err == nil {
+		s.drain(cfg.DrainTimeout)
+	}
+	return err
+}
+
+// saveStats periodically writes changed file statistics to the stats file at path
+func (s *Server) saveStats(path string) {
+	ticker := s.clock.NewTicker(statsSaveInterval)
+	defer ticker.Stop()
+
+	for range ticker.C() {
+		if err := s.files.Save(path); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to save stats file: %v\n", err)
+		}
+	}
+}
+
+// watchConnections periodically counts the connections stuck in one state for
+// at least threshold, logging each one once per state it gets stuck in
+func (s *Server) watchConnections(threshold time.Duration) {
+	ticker := s.clock.NewTicker(min(threshold, stuckCheckInterval))
+	defer ticker.Stop()
+
+	for range ticker.C() {
+		stuck, newly := s.conns.Stuck(threshold)
+		s.stuck.Store(int64(len(stuck)))
+		now := s.clock.Now()
+		for _, c := range newly {
+			fmt.Fprintf(os.Stderr, "Connection stuck: id=%d remote=%s state=%s for=%s target=%q goroutine=%d\n",
+				c.ID, c.Remote, c.State, now.Sub(c.Since).Round(time.Second), c.Target, c.Goroutine)
+		}
+	}
+}
+
+// purgeTrashes starts purging the trashes of a handler configuration and its
+// virtual hosts that are not purged yet, unless another worker process does.
+// The caller must hold s.reloading.
+func (s *Server) purgeTrashes(handlerConfig *handler.Config) {
+	if !primaryProcess() {
+		return
+	}
+	for _, c := range append([]*handler.Config{handlerConfig}, slices.Collect(maps.Values(handlerConfig.Hosts))...) {
+		if c.Trash != nil && !slices.Contains(s.purging, c.Trash) {
+			c.Trash.PurgeEvery(trashPurgeInterval)
+			s.purging = append(s.purging, c.Trash)
+		}
+	}
+}
+
+// Reload applies the settings of cfg that can change while the server runs:
+// the files directory, mounts and virtual hosts, rewrite rules and redirects, rate,
+// connection, worker, IP and upload limits, and the TLS certificate. Other settings
+// keep their startup values. Requests already being handled finish with the
+// previous configuration; nothing is changed if an error is returned.
+func (s *Server) Reload(cfg *config.Config) error {
+	s.reloading.Lock()
+	defer s.reloading.Unlock()
+
+	old := s.current()
+	next := *old.config
+	if cfg.TLSEnabled() != next.TLSEnabled() {
+		return errors.New("enabling or disabling TLS requires a restart")
+	}
+	next.Directory, next.Mounts, next.VirtualHosts, next.Rewrites = cfg.Directory, cfg.Mounts, cfg.VirtualHosts, cfg.Rewrites
+	next.RouteLimits, next.MaxConnsPerIP, next.ExemptCIDRs, next.IPFilter = cfg.RouteLimits, cfg.MaxConnsPerIP, cfg.ExemptCIDRs, cfg.IPFilter
+	next.ProxyProtocolFrom, next.TrustedProxies, next.DenyFingerprints = cfg.ProxyProtocolFrom, cfg.TrustedProxies, cfg.DenyFingerprints
+	next.UploadMaxFileSize, next.UploadMaxTotalSize = cfg.UploadMaxFileSize, cfg.UploadMaxTotalSize
+	next.RefererRules = cfg.RefererRules
+	next.Maintenance, next.MaintenancePage, next.MaintenanceRetryAfter = cfg.Maintenance, cfg.MaintenancePage, cfg.MaintenanceRetryAfter
+	next.ErrorPages = cfg.ErrorPages
+	next.MaxWorkers, next.RequestTimeout = cfg.MaxWorkers, cfg.RequestTimeout
+	next.TLSCert, next.TLSKey, next.SNICertificates = cfg.TLSCert, cfg.TLSKey, cfg.SNICertificates
+
+	if next.TLSEnabled() {
+		if err := s.certs.Load(next.KeyPairs()); err != nil {
+			return err
+		}
+	}
+
+	handlerConfig := *old.handler
+	handlerConfig.RouteLimits, handlerConfig.Rewrites, handlerConfig.ExemptCIDRs = next.RouteLimits, next.Rewrites, next.ExemptCIDRs
+	handlerConfig.Mounts, handlerConfig.RefererRules = next.Mounts, next.RefererRules
+	handlerConfig.Maintenance, handlerConfig.MaintenancePage, handlerConfig.MaintenanceRetryAfter = next.Maintenance, next.MaintenancePage, next.MaintenanceRetryAfter
+	handlerConfig.ErrorPages = next.ErrorPages
+	handlerConfig.TrustedProxies, handlerConfig.IPFilter = next.TrustedProxies, next.IPFilter
+	handlerConfig.DenyFingerprints = next.DenyFingerprints
+	handlerConfig.UploadMaxFileSize, handlerConfig.UploadMaxTotalSize = int64(next.UploadMaxFileSize), int64(next.UploadMaxTotalSize)
+	if dir := next.GetDirectory(); dir != handlerConfig.Directory {
+		mountDirectory(&handlerConfig, &next, dir)
+	}
+	handlerConfig.Hosts = virtualHosts(&next, &handlerConfig, s.hostProxies, old.handler.Hosts)
+	s.purgeTrashes(&handlerConfig)
+
+	s.connLimiter.SetMax(next.MaxConnsPerIP)
+	s.workers.SetWorkers(next.MaxWorkers)
+	s.state.Store(&state{config: &next, handler: &handlerConfig, router: handler.NewRouter(&handlerConfig)})
+	return nil
+}
+
+// SetErrorHandler registers the handler writing the error responses with the
+// given status in place of the built-in ones and error pages, or removes it if
+// h is nil. Registered handlers are kept across reloads.
+func (s *Server) SetErrorHandler(code int, h handler.HandlerFunc) {
+	s.current().handler.ErrorHandlers.Set(code, h)
+}
+
+// Router returns the router used to handle requests
+func (s *Server) Router() *handler.Router {
+	return s.current().router
+}
+
+// Serve accepts connections on the listener until it is closed
+func (s *Server) Serve(listener net.Listener) error {
+	return s.serve(listener, config.Listener{Network: "tcp", Address: listener.Addr().String()})
+}
+
+// serve accepts connections on a bound listener until it is closed
+func (s *Server) serve(listener net.Listener, l config.Listener) error {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
 			fmt.Fprintf(os.Stderr, "Error accepting connection: %v\n", err)
 			continue
 		}
+		s.connections.Add(1)
+		go s.admit(conn, l)
+	}
+}
+
+// admit applies the IP filters and per-IP limits to a connection accepted by
+// listener l, handling it if it passes. Behind a proxy speaking the PROXY
+// protocol, they apply to the client address the proxy passes on. Clients of
+// a Unix socket are local, so they do not apply to them. No request has been
+// read yet, so exemptions are checked against the same address as the limit,
+// never one named by the headers of a trusted proxy.
+func (s *Server) admit(conn net.Conn, l config.Listener) {
+	defer crash.Default.Recover()
+	cfg := s.current().config
+	if proxyConn := proxyProtocolConn(conn); proxyConn != nil {
+		if !s.acceptProxyHeader(proxyConn, cfg) {
+			conn.Close()
+			s.connections.Done()
+			return
+		}
+	}
+	if _, ok := conn.RemoteAddr().(*net.TCPAddr); !ok {
+		s.handleConnection(conn, l)
+		return
+	}
+
+	ip := remoteIP(conn)
+	setSocketBuffers(conn, cfg)
+	if !cfg.IPFilter.Permits(ip) {
+		metrics.Default.Inc("connections_rejected_total", "reason", "ip_filter")
+		conn.Close()
+		s.connections.Done()
+		return
+	}
+
+	if cfg.ExemptCIDRs.Contains(ip) {
+		s.handleConnection(conn, l)
+		return
+	}
+
+	if !s.connLimiter.Acquire(ip) {
+		metrics.Default.Inc("connections_rejected_total", "reason", "per_ip_limit")
+		defer s.connections.Done()
+		s.rejectConnection(conn)
+		return
+	}
+	defer s.connLimiter.Release(ip)
+	s.handleConnection(conn, l)
+}
+
+// proxyProtocolConn returns the PROXY protocol connection under conn, or nil
+// if conn was not accepted by a listener with the proxy-protocol option
+func proxyProtocolConn(conn net.Conn) *proxyproto.Conn {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	proxyConn, _ := conn.(*proxyproto.Conn)
+	return proxyConn
+}
+
+// acceptProxyHeader reads the PROXY protocol header of a connection, reporting
+// false if it is malformed or comes from an address not trusted to send one
+func (s *Server) acceptProxyHeader(conn *proxyproto.Conn, cfg *config.Config) bool {
+	proxyAddr := conn.NetConn().RemoteAddr()
+	if tcpAddr, ok := proxyAddr.(*net.TCPAddr); ok && len(cfg.ProxyProtocolFrom) > 0 && !cfg.ProxyProtocolFrom.Contains(tcpAddr.IP.String()) {
+		metrics.Default.Inc("connections_rejected_total", "reason", "proxy_protocol")
+		fmt.Fprintf(os.Stderr, "PROXY protocol header from untrusted address refused: remote=%s\n", proxyAddr)
+		return false
+	}
+	if err := conn.Handshake(); err != nil {
+		metrics.Default.Inc("connections_rejected_total", "reason", "proxy_protocol")
+		fmt.Fprintf(os.Stderr, "Invalid PROXY protocol header: remote=%s err=%v\n", proxyAddr, err)
+		return false
+	}
+	return true
+}
+
+// releaseWorker frees the worker of a handled request, or, when its handler
+// was abandoned, once that handler finally returns
+func (s *Server) releaseWorker(err error) {
+	var timeout *handler.TimeoutError
+	if errors.As(err, &timeout) {
+		go func() {
+			<-timeout.Done
+			s.workers.Release()
+		}()
+		return
+	}
+	s.workers.Release()
+}
+
+// rejectConnection answers a connection that is over its limit with a 503 and closes it
+func (s *Server) rejectConnection(conn net.Conn) {
+	s.closeWith(conn, http.StatusServiceUnavailable)
+}
+
+// rejectVersion answers a request of an HTTP version the connection cannot
+// serve with a 505 and closes the connection
+func (s *Server) rejectVersion(conn net.Conn, req *http.Request) {
+	metrics.Default.Inc("http_requests_rejected_total", "reason", "version")
+	fmt.Fprintf(os.Stderr, "Unsupported HTTP version: client=%s version=%q\n", req.ClientIP(), req.Version)
+	s.closeWith(conn, http.StatusHTTPVersionNotSupported)
+}
+
+// closeWith answers a connection with an empty response of the given status and closes it
+func (s *Server) closeWith(conn net.Conn, status int) {
+	defer conn.Close()
 
-		go s.handleConnection(conn)
+	resp := &http.Response{
+		StatusCode: status,
+		Headers: http.Header{
+			"Connection":     {"close"},
+			"Content-Length": {"0"},
+		},
 	}
+	s.newWriter(conn).WriteResponse(resp)
 }
 
-// handleConnection handles a single client connection
-func (s *Server) handleConnection(conn net.Conn) {
+// newWriter creates a writer for responses the server writes to a connection itself
+func (s *Server) newWriter(conn net.Conn) *http.Writer {
+	writer := http.NewWriter(conn)
+	writer.SetServer(s.current().config.ServerHeader)
+	writer.SetClock(s.clock)
+	return writer
+}
+
+// remoteIP returns the IP address of the connection's peer
+func remoteIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// handleConnection handles a single client connection accepted by listener l
+func (s *Server) handleConnection(conn net.Conn, l config.Listener) {
+	defer s.connections.Done()
 	defer conn.Close()
+	tracked := s.conns.Open(conn.RemoteAddr().String(), l.Name(), conntrack.StateIdle)
+	defer tracked.Close()
 
+	// Cleartext HTTP/2 is only spoken on connections that are not TLS
+	h2c := s.current().config.H2C || l.H2C
+
+	var fingerprint tlsFingerprint
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		h2c = false
+		tracked.Set(conntrack.StateHandshake, "")
+		tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+		err := tlsConn.Handshake()
+		fingerprint = s.takeFingerprint(tlsConn.NetConn())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "TLS handshake failed: remote=%s ja4=%s err=%v\n", conn.RemoteAddr(), cmp.Or(fingerprint.ja4, "-"), err)
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+
+		if tlsConn.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS {
+			tracked.Set(conntrack.StateHTTP2, "")
+			s.serveHTTP2(tlsConn, fingerprint)
+			return
+		}
+	}
+
+	bufferSize := http.ReadBufferSize
+	if size := s.current().config.ReadBufferSize; size > 0 {
+		bufferSize = int(size)
+	}
+	account := s.memory.NewAccount()
+	defer account.Close()
+	account.Charge(int64(bufferSize))
+
+	parser := http.NewParserSize(conn, bufferSize)
+	parser.SetMemoryAccount(account)
+	parser.SetClock(s.clock)
 	for {
-		parser := http.NewParser(conn)
+		tracked.Set(conntrack.StateIdle, "")
 		req, err := parser.ParseRequest()
 		if err != nil {
 			if err != io.EOF {
-				fmt.Fprintf(os.Stderr, "Error parsing request: %v\n", err)
+				kind := http.ParseErrorKindOf(err)
+				fmt.Fprintf(os.Stderr, "Error parsing request: kind=%s remote=%s err=%v\n",
+					kind, conn.RemoteAddr(), err)
+				// Malformed requests are told so; the others were cut short or stalled
+				switch kind {
+				case http.KindBadRequestLine, http.KindBadHeader:
+					s.closeWith(conn, http.StatusBadRequest)
+				case http.KindBadCoding:
+					s.closeWith(conn, http.StatusNotImplemented)
+				}
+			}
+			return
+		}
+		req.SetTLSFingerprint(fingerprint.ja3, fingerprint.ja4)
+
+		// Cleartext HTTP/2, either with prior knowledge or upgraded from HTTP/1.1
+		if h2c && req.IsHTTP2Preface() {
+			tracked.Set(conntrack.StateHTTP2, "")
+			s.serveHTTP2(parser.Detach(http.HTTP2PrefaceHead()), fingerprint)
+			return
+		}
+		if h2c && isH2CUpgrade(req) {
+			tracked.Set(conntrack.StateHTTP2, "")
+			if err := s.upgradeH2C(conn, parser, req); err != nil {
+				fmt.Fprintf(os.Stderr, "Error upgrading to h2c: remote=%s err=%v\n", conn.RemoteAddr(), err)
 			}
 			return
 		}
 
-		// Handle the request
-		if err := s.router.HandleRequest(req, conn); err != nil {
+		// Only HTTP/1.x requests can be answered on an HTTP/1 connection
+		if req.Version != "HTTP/1.1" && req.Version != "HTTP/1.0" {
+			s.rejectVersion(conn, req)
+			return
+		}
+
+		// Forward-proxy tunnels take over the connection
+		if req.Method == "CONNECT" && s.current().config.ForwardProxy {
+			tracked.Set(conntrack.StateTunnel, req.RequestTarget)
+			s.tunnel(conn, parser, req)
+			return
+		}
+
+		// Handle the request once a worker is free for its priority, in a
+		// context cancelled if the client goes away or the request times out
+		current := s.current()
+		router := current.router
+		ctx, cancel := http.RequestContext(context.Background(), req, current.config.RequestTimeout)
+		req.SetContext(ctx)
+		stopWatching := parser.WatchClose(cancel)
+		tracked.Set(conntrack.StateQueued, req.Method+" "+req.RequestTarget)
+		if err := s.workers.Acquire(ctx, req.Priority().Urgency); err != nil {
+			// The client went away or the request timed out while queued
+			stopWatching()
+			cancel()
+			if errors.Is(err, context.DeadlineExceeded) {
+				s.closeWith(conn, http.StatusServiceUnavailable)
+			}
+			return
+		}
+		tracked.Set(conntrack.StateActive, req.Method+" "+req.RequestTarget)
+		err = router.HandleRequest(req, conn)
+		s.releaseWorker(err)
+		stopWatching()
+		cancel()
+		if errors.Is(err, handler.ErrPanicked) || errors.Is(err, handler.ErrTimedOut) {
+			// The response was cut short or its handler may still be using the connection
+			return
+		}
+		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error handling request: %v\n", err)
 		}
 
-		// Check if connection should be closed
-		if s.router.ShouldCloseConnection(req) {
+		// Check if connection should be closed, including when an unread body
+		// would otherwise be parsed as the next request, or the server is draining
+		if router.ShouldCloseConnection(req) || parser.BodyPending() || s.stopping.Load() {
 			conn.Close()
 			return
 		}
@@ -0,0 +1,364 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"octo-server/app/config"
+	"octo-server/app/metrics"
+)
+
+const (
+	// workerIDEnv numbers the worker processes of a Supervisor from 1
+	workerIDEnv = "OCTO_WORKER_ID"
+	// workerMetricsEnv names the directory where worker processes serve their
+	// metrics on Unix sockets, for any of them to sum up
+	workerMetricsEnv = "OCTO_WORKER_METRICS_DIR"
+)
+
+const (
+	// minRestartDelay is how long a crashed worker is first waited for to be
+	// restarted; the delay doubles with every crash, up to maxRestartDelay
+	minRestartDelay = time.Second
+	maxRestartDelay = 30 * time.Second
+	// stableAfter is how long a worker must have run for its restart delay to start over
+	stableAfter = time.Minute
+)
+
+// IsWorker reports whether this process is a worker started by a Supervisor
+func IsWorker() bool {
+	return os.Getenv(workerIDEnv) != ""
+}
+
+// primaryProcess reports whether this process runs the background jobs that
+// must only run once per server, such as lifecycle rules: it is not a worker,
+// or it is the first one
+func primaryProcess() bool {
+	id := os.Getenv(workerIDEnv)
+	return id == "" || id == "1"
+}
+
+// serveWorkerMetrics serves the metrics of this worker process in the
+// directory its Supervisor gathers them from, if it is a worker
+func serveWorkerMetrics() error {
+	dir := os.Getenv(workerMetricsEnv)
+	if dir == "" {
+		return nil
+	}
+	listener, err := net.Listen("unix", workerSocket(dir, os.Getpid()))
+	if err != nil {
+		return fmt.Errorf("failed to serve worker metrics: %w", err)
+	}
+	go metrics.Default.Serve(listener)
+	return nil
+}
+
+// workerSocket returns the path of the metrics socket of a worker process
+func workerSocket(dir string, pid int) string {
+	return filepath.Join(dir, "worker-"+strconv.Itoa(pid)+".sock")
+}
+
+// Supervisor serves from worker processes running the server binary with the
+// same arguments, which share the listening sockets it binds. Crashed workers
+// are restarted, and the metrics of every worker are summed up by whichever
+// one answers /metrics.
+type Supervisor struct {
+	cfg *config.Config
+	// listeners are bound by the supervisor but only accepted on by the workers
+	listeners []net.Listener
+	files     []*os.File
+	dir       string
+
+	mu       sync.Mutex
+	workers  map[int]*workerProcess
+	stopping atomic.Bool
+	running  sync.WaitGroup
+	stopped  chan struct{}
+}
+
+// workerProcess is a running worker process
+type workerProcess struct {
+	id      int
+	cmd     *exec.Cmd
+	started time.Time
+	// replaced is set once a rolling restart started another process in its place
+	replaced atomic.Bool
+}
+
+// NewSupervisor creates a supervisor of cfg.WorkerProcesses worker processes
+func NewSupervisor(cfg *config.Config) *Supervisor {
+	return &Supervisor{
+		cfg:     cfg,
+		workers: make(map[int]*workerProcess),
+		stopped: make(chan struct{}),
+	}
+}
+
+// Run binds the listeners and starts the workers, returning once they have
+// all exited after Shutdown. If a worker fails to start, the ones already
+// started are stopped and the error is returned.
+func (s *Supervisor) Run() error {
+	if err := s.bind(); err != nil {
+		return err
+	}
+	defer s.unbind()
+
+	var err error
+	if s.dir, err = os.MkdirTemp("", "octo-workers-"); err != nil {
+		return fmt.Errorf("failed to create the worker metrics directory: %w", err)
+	}
+	defer os.RemoveAll(s.dir)
+	listener, err := net.Listen("unix", filepath.Join(s.dir, "supervisor.sock"))
+	if err != nil {
+		return fmt.Errorf("failed to serve supervisor metrics: %w", err)
+	}
+	defer listener.Close()
+	go metrics.Default.Serve(listener)
+	metrics.Default.Gauge("supervisor_workers_running", func() int64 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return int64(len(s.workers))
+	})
+
+	for id := 1; id <= s.cfg.WorkerProcesses; id++ {
+		w, err := s.spawn(id)
+		if err != nil {
+			s.Shutdown()
+			s.running.Wait()
+			return err
+		}
+		go s.keep(w)
+	}
+	fmt.Fprintf(os.Stdout, "Supervising %d worker processes\n", s.cfg.WorkerProcesses)
+	if err := sdNotify("READY=1"); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to notify the service manager: %v\n", err)
+	}
+
+	<-s.stopped
+	s.running.Wait()
+	fmt.Fprintf(os.Stdout, "All worker processes exited\n")
+	return nil
+}
+
+// Shutdown stops the workers, which drain their connections, after which Run returns
+func (s *Supervisor) Shutdown() {
+	if s.stopping.Swap(true) {
+		return
+	}
+	fmt.Fprintf(os.Stdout, "Shutting down worker processes\n")
+	if err := sdNotify("STOPPING=1"); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to notify the service manager: %v\n", err)
+	}
+	s.signal(syscall.SIGTERM)
+	close(s.stopped)
+}
+
+// Reload has every worker reload its configuration
+func (s *Supervisor) Reload() {
+	s.signal(syscall.SIGHUP)
+}
+
+// Upgrade replaces the workers one at a time with processes of the server
+// binary on disk, starting each new one before the old one is stopped, so
+// that some worker is always accepting connections
+func (s *Supervisor) Upgrade() error {
+	s.mu.Lock()
+	ids := slices.Sorted(maps.Keys(s.workers))
+	s.mu.Unlock()
+
+	for _, id := range ids {
+		if s.stopping.Load() {
+			return errors.New("the server is shutting down")
+		}
+		s.mu.Lock()
+		old := s.workers[id]
+		s.mu.Unlock()
+
+		w, err := s.spawn(id)
+		if err != nil {
+			return err
+		}
+		go s.keep(w)
+		if old != nil {
+			old.replaced.Store(true)
+			old.cmd.Process.Signal(syscall.SIGTERM)
+		}
+	}
+	fmt.Fprintf(os.Stdout, "Upgraded %d worker processes\n", len(ids))
+	return nil
+}
+
+// bind binds the listeners the workers share, taking over those passed down by systemd
+func (s *Supervisor) bind() error {
+	inherited := inheritSockets()
+	defer inherited.close()
+	for _, l := range s.cfg.ListenersOrDefault() {
+		listener := inherited.listener(l)
+		if listener == nil {
+			var err error
+			if listener, err = listen(l, s.cfg.ReusePort); err != nil {
+				s.unbind()
+				return err
+			}
+		}
+		s.listeners = append(s.listeners, listener)
+		f, err := socketFile(listener)
+		if err != nil {
+			s.unbind()
+			return fmt.Errorf("failed to pass on listener %s: %w", listener.Addr(), err)
+		}
+		s.files = append(s.files, f)
+		fmt.Fprintf(os.Stdout, "Server listening on %s\n", l.Name())
+	}
+	return nil
+}
+
+// unbind closes the listeners
+func (s *Supervisor) unbind() {
+	for _, f := range s.files {
+		f.Close()
+	}
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+	s.files, s.listeners = nil, nil
+}
+
+// spawn starts worker id and waits until it is serving
+func (s *Supervisor) spawn(id int) (*workerProcess, error) {
+	ready, notify, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer ready.Close()
+
+	executable, err := os.Executable()
+	if err != nil {
+		notify.Close()
+		return nil, err
+	}
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(slices.Clone(s.files), notify)
+	// The supervisor is the one the service manager hears from
+	cmd.Env = slices.DeleteFunc(os.Environ(), func(env string) bool {
+		return strings.HasPrefix(env, "NOTIFY_SOCKET=") || strings.HasPrefix(env, "LISTEN_PID=")
+	})
+	cmd.Env = append(cmd.Env,
+		"LISTEN_FDS="+strconv.Itoa(len(s.files)),
+		upgradeReadyEnv+"="+strconv.Itoa(listenFDsStart+len(s.files)),
+		workerIDEnv+"="+strconv.Itoa(id),
+		workerMetricsEnv+"="+s.dir,
+	)
+	err = cmd.Start()
+	notify.Close()
+	s.restoreNonblock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start worker %d: %w", id, err)
+	}
+	w := &workerProcess{id: id, cmd: cmd, started: time.Now()}
+	s.running.Add(1)
+
+	// The worker writes a byte once serving; the pipe closing first means it exited
+	started := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(ready, make([]byte, 1))
+		started <- err
+	}()
+	select {
+	case err = <-started:
+	case <-time.After(upgradeTimeout):
+		err = fmt.Errorf("not serving after %s", upgradeTimeout)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		s.running.Done()
+		return nil, fmt.Errorf("worker %d (process %d) failed: %w", id, cmd.Process.Pid, err)
+	}
+
+	s.mu.Lock()
+	s.workers[id] = w
+	s.mu.Unlock()
+	// Shutdown may have signalled the workers while this one was starting
+	if s.stopping.Load() {
+		cmd.Process.Signal(syscall.SIGTERM)
+	}
+	return w, nil
+}
+
+// restoreNonblock puts the listening sockets back into non-blocking mode after
+// starting a process switched them to blocking, which would leave workers stuck
+// in accept when closing their listeners, as the mode is shared between processes
+func (s *Supervisor) restoreNonblock() {
+	for _, f := range s.files {
+		var setErr error
+		conn, err := f.SyscallConn()
+		if err == nil {
+			err = conn.Control(func(fd uintptr) { setErr = setNonblock(fd) })
+		}
+		if err = errors.Join(err, setErr); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to restore non-blocking mode of %s: %v\n", f.Name(), err)
+		}
+	}
+}
+
+// keep waits for a worker to exit, restarting it with a growing delay if it
+// was neither stopped nor replaced
+func (s *Supervisor) keep(w *workerProcess) {
+	delay := minRestartDelay
+	for {
+		w.cmd.Wait()
+		os.Remove(workerSocket(s.dir, w.cmd.Process.Pid))
+		s.mu.Lock()
+		if s.workers[w.id] == w {
+			delete(s.workers, w.id)
+		}
+		s.mu.Unlock()
+		s.running.Done()
+		if s.stopping.Load() || w.replaced.Load() {
+			return
+		}
+
+		if time.Since(w.started) >= stableAfter {
+			delay = minRestartDelay
+		}
+		fmt.Fprintf(os.Stderr, "Worker %d (process %d) exited unexpectedly (%s), restarting it in %s\n", w.id, w.cmd.Process.Pid, w.cmd.ProcessState, delay)
+		metrics.Default.Inc("supervisor_worker_restarts_total")
+		for {
+			time.Sleep(delay)
+			delay = min(2*delay, maxRestartDelay)
+			if s.stopping.Load() {
+				return
+			}
+			next, err := s.spawn(w.id)
+			if err == nil {
+				w = next
+				break
+			}
+			fmt.Fprintf(os.Stderr, "Failed to restart worker: %v, retrying in %s\n", err, delay)
+		}
+	}
+}
+
+// signal sends sig to every worker
+func (s *Supervisor) signal(sig os.Signal) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, w := range s.workers {
+		w.cmd.Process.Signal(sig)
+	}
+}
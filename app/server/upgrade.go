@@ -0,0 +1,175 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// upgradeReadyEnv names the file descriptor a new process started by Upgrade
+// writes to once it is serving
+const upgradeReadyEnv = "OCTO_UPGRADE_READY_FD"
+
+// upgradeTimeout bounds how long Upgrade waits for the new process to serve
+const upgradeTimeout = 30 * time.Second
+
+// Upgrade starts the server binary on disk again with the same arguments,
+// handing it the listening sockets. Once the new process is serving, this one
+// stops accepting connections and Start returns after the open ones are
+// drained, so that no connection is refused or dropped during the upgrade.
+// If the new process fails to start, this one carries on serving.
+func (s *Server) Upgrade() error {
+	s.sockets.Lock()
+	defer s.sockets.Unlock()
+	if s.stopping.Load() {
+		return errors.New("the server is already shutting down")
+	}
+	if len(s.listeners) == 0 {
+		return errors.New("the server is not listening yet")
+	}
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, listener := range s.listeners {
+		f, err := socketFile(listener)
+		if err != nil {
+			return fmt.Errorf("failed to pass on listener %s: %w", listener.Addr(), err)
+		}
+		files = append(files, f)
+	}
+	for _, conn := range s.packetConns {
+		f, err := socketFile(conn)
+		if err != nil {
+			return fmt.Errorf("failed to pass on HTTP/3 socket %s: %w", conn.LocalAddr(), err)
+		}
+		files = append(files, f)
+	}
+
+	ready, notify, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+
+	executable, err := os.Executable()
+	if err != nil {
+		notify.Close()
+		return err
+	}
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, notify)
+	cmd.Env = append(os.Environ(),
+		"LISTEN_FDS="+strconv.Itoa(len(files)),
+		upgradeReadyEnv+"="+strconv.Itoa(listenFDsStart+len(files)),
+	)
+	err = cmd.Start()
+	notify.Close()
+	if err != nil {
+		return fmt.Errorf("failed to start %s: %w", executable, err)
+	}
+	go cmd.Wait()
+
+	// The new process writes a byte once serving; the pipe closing first means it exited
+	started := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(ready, make([]byte, 1))
+		started <- err
+	}()
+	select {
+	case err = <-started:
+	case <-time.After(upgradeTimeout):
+		err = fmt.Errorf("not serving after %s", upgradeTimeout)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		return fmt.Errorf("new server process %d failed: %w", cmd.Process.Pid, err)
+	}
+
+	fmt.Fprintf(os.Stdout, "Upgraded to server process %d, draining connections\n", cmd.Process.Pid)
+	// The service manager follows the new process as the main one of the service
+	if err := sdNotify("MAINPID=" + strconv.Itoa(cmd.Process.Pid)); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to notify the service manager: %v\n", err)
+	}
+	s.stopAccepting(true)
+	return nil
+}
+
+// Shutdown stops accepting connections, after which Start returns once the
+// open ones are drained
+func (s *Server) Shutdown() {
+	s.sockets.Lock()
+	defer s.sockets.Unlock()
+	if !s.stopping.Load() {
+		fmt.Fprintf(os.Stdout, "Shutting down, draining connections\n")
+		if err := sdNotify("STOPPING=1"); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to notify the service manager: %v\n", err)
+		}
+		s.stopAccepting(false)
+	}
+}
+
+// stopAccepting closes the listeners and HTTP/3 servers. After an upgrade,
+// the Unix sockets are left in place for the new process. s.sockets must be held.
+func (s *Server) stopAccepting(upgraded bool) {
+	s.stopping.Store(true)
+	for _, h3 := range s.http3 {
+		h3.Close()
+	}
+	for _, conn := range s.packetConns {
+		conn.Close()
+	}
+	for _, listener := range s.listeners {
+		if unixListener, ok := listener.(*net.UnixListener); ok && upgraded {
+			unixListener.SetUnlinkOnClose(false)
+		}
+		listener.Close()
+	}
+}
+
+// drain waits up to timeout for the open connections to finish their requests
+func (s *Server) drain(timeout time.Duration) {
+	drained := make(chan struct{})
+	go func() {
+		s.connections.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		fmt.Fprintf(os.Stdout, "All connections drained\n")
+	case <-time.After(timeout):
+		fmt.Fprintf(os.Stderr, "Connections still open after %s, closing them\n", timeout)
+	}
+}
+
+// notifyUpgraded tells the process that started this one through Upgrade that
+// this one is serving, reporting false if this one was not started that way
+func notifyUpgraded() bool {
+	fd, err := strconv.Atoi(os.Getenv(upgradeReadyEnv))
+	if err != nil {
+		return false
+	}
+	os.Unsetenv(upgradeReadyEnv)
+	notify := os.NewFile(uintptr(fd), "upgrade notification")
+	notify.Write([]byte{1})
+	notify.Close()
+	return true
+}
+
+// socketFile returns a duplicate of the file descriptor of a listener or packet connection
+func socketFile(socket any) (*os.File, error) {
+	filer, ok := socket.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, errors.New("socket has no file descriptor")
+	}
+	return filer.File()
+}
@@ -0,0 +1,128 @@
+package tlsconf
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"octo-server/app/clock"
+)
+
+// KeyPair names the certificate and key files served to clients asking for
+// Host through SNI. The default certificate has an empty Host, and a Host
+// starting with "*." is served for every subdomain of the rest.
+type KeyPair struct {
+	Host     string
+	CertFile string
+	KeyFile  string
+}
+
+// certEntry is a loaded certificate with the stapler keeping it stapled
+type certEntry struct {
+	cert    atomic.Pointer[tls.Certificate]
+	stapler *Stapler
+}
+
+// Certificates holds the certificates served over TLS and chooses among them
+// by the server name clients ask for
+type Certificates struct {
+	// mu serializes Load
+	mu       sync.Mutex
+	entries  atomic.Pointer[map[string]*certEntry]
+	clock    clock.Clock
+	stapling bool
+}
+
+// NewCertificates creates an empty set of certificates, stapling OCSP
+// responses to them unless stapling is false
+func NewCertificates(stapling bool) *Certificates {
+	return &Certificates{clock: clock.Real, stapling: stapling}
+}
+
+// SetClock sets the clock OCSP refreshes are scheduled on
+func (c *Certificates) SetClock(clk clock.Clock) {
+	c.clock = clk
+}
+
+// Load replaces the certificates with those of pairs. If any of them fails
+// to load, the certificates in place are kept.
+func (c *Certificates) Load(pairs []KeyPair) error {
+	loaded := make(map[string]*tls.Certificate, len(pairs))
+	for _, pair := range pairs {
+		cert, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+		if err != nil {
+			if pair.Host == "" {
+				return fmt.Errorf("failed to load TLS certificate: %w", err)
+			}
+			return fmt.Errorf("failed to load TLS certificate for %s: %w", pair.Host, err)
+		}
+		loaded[pair.Host] = &cert
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var old map[string]*certEntry
+	if entries := c.entries.Load(); entries != nil {
+		old = *entries
+	}
+	entries := make(map[string]*certEntry, len(loaded))
+	for host, cert := range loaded {
+		entry := old[host]
+		if entry == nil {
+			entry = &certEntry{}
+			entry.stapler = NewStapler(&entry.cert)
+			entry.stapler.SetClock(c.clock)
+		}
+		entry.cert.Store(cert)
+		if c.stapling {
+			entry.stapler.Staple()
+		}
+		entries[host] = entry
+	}
+	c.entries.Store(&entries)
+	// Stapling stops for the certificates no longer served
+	for host, entry := range old {
+		if entries[host] == nil {
+			entry.cert.Store(nil)
+		}
+	}
+	return nil
+}
+
+// GetCertificate returns the certificate for the server name of a ClientHello:
+// the one for that exact name, else the one for the closest "*." wildcard,
+// else the default one. It implements tls.Config.GetCertificate.
+func (c *Certificates) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	entries := c.entries.Load()
+	if entries == nil {
+		return nil, fmt.Errorf("no TLS certificate loaded")
+	}
+	name := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+	if cert := (*entries)[name].load(); cert != nil && name != "" {
+		return cert, nil
+	}
+	for {
+		_, parent, ok := strings.Cut(name, ".")
+		if !ok {
+			break
+		}
+		if cert := (*entries)["*."+parent].load(); cert != nil {
+			return cert, nil
+		}
+		name = parent
+	}
+	if cert := (*entries)[""].load(); cert != nil {
+		return cert, nil
+	}
+	return nil, fmt.Errorf("no TLS certificate for %q", hello.ServerName)
+}
+
+// load returns the certificate of an entry, or nil for a missing entry
+func (e *certEntry) load() *tls.Certificate {
+	if e == nil {
+		return nil
+	}
+	return e.cert.Load()
+}
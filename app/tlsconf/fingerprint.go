@@ -0,0 +1,164 @@
+package tlsconf
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// TLS extension IDs left out of the sorted extensions of JA4
+const (
+	extensionServerName       = 0x0000
+	extensionALPN             = 0x0010
+	extensionSupportedVersion = 0x002b
+)
+
+// JA3 returns the JA3 fingerprint of a ClientHello: the MD5 hash of its
+// version, cipher suites, extensions, curves and point formats, in the order
+// the client sent them and without GREASE values. The version field of the
+// ClientHello itself is not reported by crypto/tls; clients offering TLS 1.3
+// always set it to TLS 1.2, and for others it is their highest version.
+func JA3(hello *tls.ClientHelloInfo) string {
+	version := uint16(tls.VersionTLS12)
+	if !slices.Contains(hello.Extensions, extensionSupportedVersion) && len(hello.SupportedVersions) > 0 {
+		version = slices.Max(hello.SupportedVersions)
+	}
+
+	curves := make([]uint16, 0, len(hello.SupportedCurves))
+	for _, curve := range hello.SupportedCurves {
+		curves = append(curves, uint16(curve))
+	}
+	points := make([]uint16, 0, len(hello.SupportedPoints))
+	for _, point := range hello.SupportedPoints {
+		points = append(points, uint16(point))
+	}
+
+	fields := []string{
+		strconv.Itoa(int(version)),
+		joinDecimal(hello.CipherSuites),
+		joinDecimal(hello.Extensions),
+		joinDecimal(curves),
+		joinDecimal(points),
+	}
+	sum := md5.Sum([]byte(strings.Join(fields, ",")))
+	return hex.EncodeToString(sum[:])
+}
+
+// JA4 returns the JA4 fingerprint of a ClientHello received over TCP, e.g.
+// t13d1516h2_8daaf6152771_e5627efa2ab1: the highest version, whether a server
+// name was sent, the numbers of cipher suites and extensions and the first
+// ALPN protocol, then truncated SHA-256 hashes of the sorted cipher suites,
+// and of the sorted extensions with the signature algorithms
+func JA4(hello *tls.ClientHelloInfo) string {
+	version := uint16(0)
+	for _, v := range hello.SupportedVersions {
+		if !isGREASE(v) {
+			version = max(version, v)
+		}
+	}
+	sni := "i"
+	if hello.ServerName != "" {
+		sni = "d"
+	}
+	ciphers := withoutGREASE(hello.CipherSuites)
+	extensions := withoutGREASE(hello.Extensions)
+	alpn := "00"
+	if len(hello.SupportedProtos) > 0 && hello.SupportedProtos[0] != "" {
+		alpn = alpnCode(hello.SupportedProtos[0])
+	}
+	prefix := fmt.Sprintf("t%s%s%02d%02d%s", versionCode(version), sni, min(len(ciphers), 99), min(len(extensions), 99), alpn)
+
+	slices.Sort(ciphers)
+	sorted := slices.DeleteFunc(slices.Clone(extensions), func(id uint16) bool {
+		return id == extensionServerName || id == extensionALPN
+	})
+	slices.Sort(sorted)
+	signed := joinHex(sorted)
+	if len(hello.SignatureSchemes) > 0 {
+		schemes := make([]uint16, 0, len(hello.SignatureSchemes))
+		for _, scheme := range hello.SignatureSchemes {
+			schemes = append(schemes, uint16(scheme))
+		}
+		signed += "_" + joinHex(schemes)
+	}
+	return prefix + "_" + truncatedHash(joinHex(ciphers), len(ciphers)) + "_" + truncatedHash(signed, len(sorted))
+}
+
+// versionCode abbreviates a TLS version for JA4
+func versionCode(version uint16) string {
+	switch version {
+	case tls.VersionTLS13:
+		return "13"
+	case tls.VersionTLS12:
+		return "12"
+	case tls.VersionTLS11:
+		return "11"
+	case tls.VersionTLS10:
+		return "10"
+	case 0x0300:
+		return "s3"
+	}
+	return "00"
+}
+
+// alpnCode abbreviates an ALPN protocol by its first and last characters, or
+// those of its hex encoding if either is not alphanumeric
+func alpnCode(proto string) string {
+	first, last := proto[0], proto[len(proto)-1]
+	if !isAlphanumeric(first) || !isAlphanumeric(last) {
+		encoded := hex.EncodeToString([]byte(proto))
+		return encoded[:1] + encoded[len(encoded)-1:]
+	}
+	return string([]byte{first, last})
+}
+
+// isAlphanumeric reports whether b is an ASCII letter or digit
+func isAlphanumeric(b byte) bool {
+	return '0' <= b && b <= '9' || 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z'
+}
+
+// truncatedHash returns the first 12 hex digits of the SHA-256 hash of s, or
+// zeros when there were no values to hash
+func truncatedHash(s string, values int) string {
+	if values == 0 {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// isGREASE reports whether v is a GREASE value, which clients send at random
+// to keep servers tolerant of unknown values (RFC 8701)
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// withoutGREASE returns a copy of values without GREASE values
+func withoutGREASE(values []uint16) []uint16 {
+	return slices.DeleteFunc(slices.Clone(values), isGREASE)
+}
+
+// joinDecimal joins the values that are not GREASE in decimal with dashes, as in JA3
+func joinDecimal(values []uint16) string {
+	parts := make([]string, 0, len(values))
+	for _, v := range values {
+		if !isGREASE(v) {
+			parts = append(parts, strconv.Itoa(int(v)))
+		}
+	}
+	return strings.Join(parts, "-")
+}
+
+// joinHex joins values as four hex digits with commas, as in JA4
+func joinHex(values []uint16) string {
+	parts := make([]string, 0, len(values))
+	for _, v := range values {
+		parts = append(parts, fmt.Sprintf("%04x", v))
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,196 @@
+package tlsconf
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	nethttp "net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+
+	"octo-server/app/clock"
+	"octo-server/app/metrics"
+)
+
+const (
+	// ocspTimeout bounds a request to an OCSP responder
+	ocspTimeout = 10 * time.Second
+	// maxOCSPResponseSize bounds the OCSP responses read
+	maxOCSPResponseSize = 64 * 1024
+	// Failed fetches are retried after ocspMinRetry, doubling up to ocspMaxRetry
+	ocspMinRetry = time.Minute
+	ocspMaxRetry = time.Hour
+	// ocspDefaultRefresh is the refresh interval of responses without a next update time
+	ocspDefaultRefresh = 12 * time.Hour
+)
+
+// Stapler staples the OCSP response of the responder named in a certificate
+// to it, so that clients need not ask the responder themselves whether the
+// certificate was revoked. Responses are fetched again halfway through their
+// validity, and dropped if they expire before a new one is fetched.
+type Stapler struct {
+	certificate *atomic.Pointer[tls.Certificate]
+	clock       clock.Clock
+	client      *nethttp.Client
+}
+
+// NewStapler creates a stapler replacing the certificate in certificate with
+// copies that carry OCSP responses
+func NewStapler(certificate *atomic.Pointer[tls.Certificate]) *Stapler {
+	return &Stapler{
+		certificate: certificate,
+		clock:       clock.Real,
+		client:      &nethttp.Client{Timeout: ocspTimeout},
+	}
+}
+
+// SetClock sets the clock refreshes are scheduled on
+func (s *Stapler) SetClock(c clock.Clock) {
+	s.clock = c
+}
+
+// Staple fetches an OCSP response for the certificate currently in place in
+// the background and keeps it fresh until the certificate is replaced, after
+// which Staple is called again for the new one. Certificates without an OCSP
+// responder or issuer certificate are left alone.
+func (s *Stapler) Staple() {
+	cert := s.certificate.Load()
+	if _, _, err := chain(cert); err != nil {
+		fmt.Fprintf(os.Stdout, "Not stapling OCSP responses for %s: %v\n", certName(cert), err)
+		return
+	}
+	go s.refresh(cert, 0)
+}
+
+// refresh fetches a new OCSP response for current, staples it to a copy that
+// replaces current, and schedules the next refresh. failures counts the
+// fetches in a row that failed, which back off the retries.
+func (s *Stapler) refresh(current *tls.Certificate, failures int) {
+	if s.certificate.Load() != current {
+		return
+	}
+	leaf, issuer, _ := chain(current)
+
+	next, wait := current, ocspDefaultRefresh
+	resp, err := s.fetch(leaf, issuer)
+	switch {
+	case err != nil:
+		metrics.Default.Inc("ocsp_fetches_total", "result", "error")
+		wait = min(ocspMinRetry<<failures, ocspMaxRetry)
+		failures++
+		fmt.Fprintf(os.Stderr, "Failed to fetch OCSP response for %s, retrying in %s: %v\n", certName(current), wait, err)
+		// The last response stays stapled while it is valid
+		if expired(current.OCSPStaple, issuer, s.clock.Now()) {
+			next = withStaple(current, nil)
+		}
+	case resp.Status != ocsp.Good:
+		status := "revoked"
+		if resp.Status == ocsp.Unknown {
+			status = "unknown"
+		}
+		metrics.Default.Inc("ocsp_fetches_total", "result", status)
+		fmt.Fprintf(os.Stderr, "OCSP responder reports the TLS certificate for %s as %s, not stapling\n", certName(current), status)
+		next, failures = withStaple(current, nil), 0
+	default:
+		metrics.Default.Inc("ocsp_fetches_total", "result", "good")
+		next, failures = withStaple(current, resp.Raw), 0
+		if !resp.NextUpdate.IsZero() {
+			wait = max(resp.NextUpdate.Sub(s.clock.Now())/2, ocspMinRetry)
+		}
+	}
+
+	if next != current && !s.certificate.CompareAndSwap(current, next) {
+		return
+	}
+	s.clock.AfterFunc(wait, func() { s.refresh(next, failures) })
+}
+
+// fetch asks the OCSP responder of leaf whether it is revoked
+func (s *Stapler) fetch(leaf, issuer *x509.Certificate) (*ocsp.Response, error) {
+	request, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Post(leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(request))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != nethttp.StatusOK {
+		return nil, fmt.Errorf("OCSP responder answered %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxOCSPResponseSize))
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := ocsp.ParseResponseForCert(body, leaf, issuer)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OCSP response: %w", err)
+	}
+	if !parsed.NextUpdate.IsZero() && !parsed.NextUpdate.After(s.clock.Now()) {
+		return nil, errors.New("OCSP response is already expired")
+	}
+	return parsed, nil
+}
+
+// chain returns the leaf certificate of cert and the certificate of its issuer
+func chain(cert *tls.Certificate) (*x509.Certificate, *x509.Certificate, error) {
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(leaf.OCSPServer) == 0 {
+		return nil, nil, errors.New("the TLS certificate names no OCSP responder")
+	}
+	if len(cert.Certificate) < 2 {
+		return nil, nil, errors.New("the TLS certificate file has no issuer certificate after the certificate")
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, nil, err
+	}
+	return leaf, issuer, nil
+}
+
+// certName names a certificate in logs by its first DNS name, or else its common name
+func certName(cert *tls.Certificate) string {
+	leaf := cert.Leaf
+	if leaf == nil {
+		leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+	}
+	switch {
+	case leaf == nil:
+		return "the TLS certificate"
+	case len(leaf.DNSNames) > 0:
+		return leaf.DNSNames[0]
+	}
+	return leaf.Subject.CommonName
+}
+
+// expired reports whether an OCSP response is absent or past its next update time
+func expired(staple []byte, issuer *x509.Certificate, now time.Time) bool {
+	if staple == nil {
+		return true
+	}
+	resp, err := ocsp.ParseResponse(staple, issuer)
+	return err != nil || !resp.NextUpdate.IsZero() && !resp.NextUpdate.After(now)
+}
+
+// withStaple returns a copy of cert with staple as its OCSP response
+func withStaple(cert *tls.Certificate, staple []byte) *tls.Certificate {
+	if cert.OCSPStaple == nil && staple == nil {
+		return cert
+	}
+	stapled := *cert
+	stapled.OCSPStaple = staple
+	return &stapled
+}
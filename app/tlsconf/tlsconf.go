@@ -0,0 +1,203 @@
+package tlsconf
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Profiles of TLS settings, after Mozilla's server side TLS recommendations
+const (
+	// Modern only accepts TLS 1.3, for clients from 2020 on
+	Modern = "modern"
+	// Intermediate accepts TLS 1.2 with forward-secret AEAD cipher suites, and TLS 1.3
+	Intermediate = "intermediate"
+	// Old accepts TLS 1.0 and weaker cipher suites, for legacy clients only
+	Old = "old"
+)
+
+// Profiles lists the known profiles
+var Profiles = []string{Modern, Intermediate, Old}
+
+// profile is the versions and TLS 1.0-1.2 cipher suites of a profile
+type profile struct {
+	minVersion   uint16
+	cipherSuites []uint16
+}
+
+// intermediateSuites are the forward-secret AEAD cipher suites for TLS 1.2
+var intermediateSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+// profiles maps the profile names to their settings
+var profiles = map[string]profile{
+	Modern:       {minVersion: tls.VersionTLS13},
+	Intermediate: {minVersion: tls.VersionTLS12, cipherSuites: intermediateSuites},
+	Old: {minVersion: tls.VersionTLS10, cipherSuites: append(append([]uint16{}, intermediateSuites...),
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+		tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_RSA_WITH_AES_128_CBC_SHA256,
+		tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+		tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+		tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+	)},
+}
+
+// versions maps the accepted version names to protocol versions
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// curves maps the accepted key exchange names to curve IDs
+var curves = map[string]tls.CurveID{
+	"X25519MLKEM768": tls.X25519MLKEM768,
+	"X25519":         tls.X25519,
+	"P-256":          tls.CurveP256,
+	"P-384":          tls.CurveP384,
+	"P-521":          tls.CurveP521,
+}
+
+// Options controls the TLS settings of the HTTPS and HTTP/3 listeners.
+// Settings left empty take the values of the profile.
+type Options struct {
+	// Profile is Modern, Intermediate or Old; empty means Intermediate
+	Profile string
+	// MinVersion and MaxVersion are versions such as "1.2"; empty MaxVersion means the newest
+	MinVersion string
+	MaxVersion string
+	// CipherSuites are the names of the cipher suites offered for TLS 1.0-1.2,
+	// such as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, in order of preference.
+	// The TLS 1.3 suites are all secure and cannot be chosen.
+	CipherSuites []string
+	// Curves are the key exchanges offered, such as X25519 or P-256, in order of
+	// preference; empty uses the defaults of Go, including post-quantum hybrids
+	Curves []string
+	// DisableSessionTickets turns off resuming sessions with tickets
+	DisableSessionTickets bool
+	// TicketKeyFile holds the keys session tickets are encrypted with, one
+	// base64-encoded 32-byte key per line, the first of them used for new
+	// tickets. Servers sharing the file can resume each other's sessions.
+	// Empty generates keys in memory, rotated daily.
+	TicketKeyFile string
+	// DisableOCSPStapling turns off fetching and stapling OCSP responses
+	DisableOCSPStapling bool
+}
+
+// Apply sets the TLS settings of config, loading the ticket keys. Reports an
+// error for unknown names and settings that contradict each other.
+func (o Options) Apply(config *tls.Config) error {
+	name := o.Profile
+	if name == "" {
+		name = Intermediate
+	}
+	p, ok := profiles[name]
+	if !ok {
+		return fmt.Errorf("unknown TLS profile %q, expected one of %s", o.Profile, strings.Join(Profiles, ", "))
+	}
+
+	config.MinVersion, config.MaxVersion = p.minVersion, 0
+	if o.MinVersion != "" {
+		if config.MinVersion, ok = versions[o.MinVersion]; !ok {
+			return fmt.Errorf("unknown TLS version %q, expected 1.0, 1.1, 1.2 or 1.3", o.MinVersion)
+		}
+	}
+	if o.MaxVersion != "" {
+		if config.MaxVersion, ok = versions[o.MaxVersion]; !ok {
+			return fmt.Errorf("unknown TLS version %q, expected 1.0, 1.1, 1.2 or 1.3", o.MaxVersion)
+		}
+		if config.MaxVersion < config.MinVersion {
+			return fmt.Errorf("TLS maximum version %s is below the minimum version", o.MaxVersion)
+		}
+	}
+
+	config.CipherSuites = p.cipherSuites
+	if len(o.CipherSuites) > 0 {
+		suites, err := cipherSuites(o.CipherSuites)
+		if err != nil {
+			return err
+		}
+		config.CipherSuites = suites
+	}
+
+	config.CurvePreferences = nil
+	for _, name := range o.Curves {
+		curve, ok := curves[name]
+		if !ok {
+			return fmt.Errorf("unknown TLS key exchange %q", name)
+		}
+		config.CurvePreferences = append(config.CurvePreferences, curve)
+	}
+
+	config.SessionTicketsDisabled = o.DisableSessionTickets
+	if o.TicketKeyFile != "" && !o.DisableSessionTickets {
+		keys, err := readTicketKeys(o.TicketKeyFile)
+		if err != nil {
+			return err
+		}
+		config.SetSessionTicketKeys(keys)
+	}
+	return nil
+}
+
+// cipherSuites looks up cipher suites by name
+func cipherSuites(names []string) ([]uint16, error) {
+	known := make(map[string]*tls.CipherSuite)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[suite.Name] = suite
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		suite, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS cipher suite %q", name)
+		}
+		if len(suite.SupportedVersions) == 1 && suite.SupportedVersions[0] == tls.VersionTLS13 {
+			return nil, fmt.Errorf("TLS 1.3 cipher suite %s cannot be chosen; they are always enabled", name)
+		}
+		ids = append(ids, suite.ID)
+	}
+	return ids, nil
+}
+
+// readTicketKeys reads the session ticket keys in path
+func readTicketKeys(path string) ([][32]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read TLS ticket keys: %w", err)
+	}
+
+	var keys [][32]byte
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(line)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("%s:%d: TLS ticket key is not 32 base64-encoded bytes", path, i+1)
+		}
+		keys = append(keys, [32]byte(key))
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no TLS ticket keys", path)
+	}
+	return keys, nil
+}
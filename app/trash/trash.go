@@ -0,0 +1,244 @@
+package trash
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"octo-server/app/clock"
+	"octo-server/app/fsys"
+	"octo-server/app/versions"
+)
+
+// Dir is the name of the trash subdirectory of the files directory
+const Dir = ".trash"
+
+// DefaultRetention is how long deleted files are kept unless configured otherwise
+const DefaultRetention = 7 * 24 * time.Hour
+
+// metaSuffix is appended to an item's ID to name its metadata file
+const metaSuffix = ".json"
+
+var (
+	// ErrNotFound is returned for an unknown trash item
+	ErrNotFound = errors.New("trash item not found")
+	// ErrExists is returned when restoring an item whose original name is taken again
+	ErrExists = errors.New("a file with the original name exists")
+	// ErrInvalidName is returned when restoring an item whose recorded name lies
+	// outside the directory or inside the trash or versions
+	ErrInvalidName = errors.New("invalid original name")
+)
+
+// Item is a deleted file kept in the trash
+type Item struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	DeletedAt time.Time `json:"deletedAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Trash keeps deleted files of a directory for a retention period so they can be restored
+type Trash struct {
+	dir       string
+	retention time.Duration
+	clock     clock.Clock
+	fs        fsys.FS
+}
+
+// New creates a trash for the files in dir, keeping deleted files for retention
+func New(dir string, retention time.Duration) *Trash {
+	return &Trash{dir: dir, retention: retention, clock: clock.Real, fs: fsys.OS}
+}
+
+// SetClock sets the clock deletions and expiry are timed on
+func (t *Trash) SetClock(c clock.Clock) {
+	t.clock = c
+}
+
+// SetFS sets the file system the directory is on
+func (t *Trash) SetFS(fs fsys.FS) {
+	t.fs = fs
+}
+
+// Move moves the file name, relative to the directory, into the trash
+func (t *Trash) Move(name string) (Item, error) {
+	info, err := t.fs.Stat(filepath.Join(t.dir, name))
+	if err != nil {
+		return Item{}, err
+	}
+
+	id, err := newID()
+	if err != nil {
+		return Item{}, err
+	}
+	now := t.clock.Now().UTC()
+	item := Item{
+		ID:        id,
+		Name:      name,
+		Size:      info.Size(),
+		DeletedAt: now,
+		ExpiresAt: now.Add(t.retention),
+	}
+
+	root := filepath.Join(t.dir, Dir)
+	if err := t.fs.MkdirAll(root, 0755); err != nil {
+		return Item{}, err
+	}
+	meta, err := json.Marshal(item)
+	if err != nil {
+		return Item{}, err
+	}
+	if err := t.fs.WriteFile(filepath.Join(root, id+metaSuffix), meta, 0644); err != nil {
+		return Item{}, err
+	}
+	if err := t.fs.Rename(filepath.Join(t.dir, name), filepath.Join(root, id)); err != nil {
+		t.fs.Remove(filepath.Join(root, id+metaSuffix))
+		return Item{}, err
+	}
+	return item, nil
+}
+
+// List returns the items in the trash, most recently deleted first.
+// Expired items are purged first.
+func (t *Trash) List() ([]Item, error) {
+	t.Purge()
+
+	entries, err := t.fs.ReadDir(filepath.Join(t.dir, Dir))
+	if errors.Is(err, os.ErrNotExist) {
+		return []Item{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	items := []Item{}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), metaSuffix)
+		if !ok {
+			continue
+		}
+		item, err := t.item(id)
+		if err != nil {
+			continue
+		}
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].DeletedAt.After(items[j].DeletedAt) })
+	return items, nil
+}
+
+// Restore moves an item back to its original name
+func (t *Trash) Restore(id string) (Item, error) {
+	item, err := t.item(id)
+	if err != nil {
+		return Item{}, err
+	}
+	// The metadata file may have been planted, so never trust the name in it
+	if !filepath.IsLocal(item.Name) || Within(item.Name, Dir) || Within(item.Name, versions.Dir) {
+		return item, ErrInvalidName
+	}
+
+	target := filepath.Join(t.dir, item.Name)
+	if _, err := t.fs.Stat(target); err == nil {
+		return item, ErrExists
+	}
+	if err := t.fs.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return item, err
+	}
+	if err := t.fs.Rename(filepath.Join(t.dir, Dir, id), target); err != nil {
+		return item, err
+	}
+	t.fs.Remove(filepath.Join(t.dir, Dir, id+metaSuffix))
+	return item, nil
+}
+
+// Within reports whether the relative path name is dir or lies below it
+func Within(name, dir string) bool {
+	first, _, _ := strings.Cut(filepath.ToSlash(filepath.Clean(name)), "/")
+	return first == dir
+}
+
+// Purge permanently removes the items whose retention period has passed
+func (t *Trash) Purge() {
+	root := filepath.Join(t.dir, Dir)
+	entries, err := t.fs.ReadDir(root)
+	if err != nil {
+		return
+	}
+
+	now := t.clock.Now()
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), metaSuffix)
+		if !ok {
+			continue
+		}
+		item, err := t.item(id)
+		if err != nil || now.Before(item.ExpiresAt) {
+			continue
+		}
+		if err := t.fs.Remove(filepath.Join(root, id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			fmt.Fprintf(os.Stderr, "Failed to purge trash item %s: %v\n", id, err)
+			continue
+		}
+		t.fs.Remove(filepath.Join(root, entry.Name()))
+	}
+}
+
+// item reads the metadata of a trash item
+func (t *Trash) item(id string) (Item, error) {
+	if !validID(id) {
+		return Item{}, ErrNotFound
+	}
+
+	data, err := t.fs.ReadFile(filepath.Join(t.dir, Dir, id+metaSuffix))
+	if errors.Is(err, os.ErrNotExist) {
+		return Item{}, ErrNotFound
+	}
+	if err != nil {
+		return Item{}, err
+	}
+
+	var item Item
+	if err := json.Unmarshal(data, &item); err != nil {
+		return Item{}, fmt.Errorf("corrupt trash item %s: %w", id, err)
+	}
+	return item, nil
+}
+
+// newID returns a random trash item ID
+func newID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// validID reports whether id looks like an ID returned by newID
+func validID(id string) bool {
+	if len(id) != 16 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// PurgeEvery purges expired items every interval until the process exits
+func (t *Trash) PurgeEvery(interval time.Duration) {
+	go func() {
+		ticker := t.clock.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C() {
+			t.Purge()
+		}
+	}()
+}
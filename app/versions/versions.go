@@ -0,0 +1,181 @@
+package versions
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Dir is the name of the subdirectory of the files directory holding previous versions
+const Dir = ".versions"
+
+// ErrNotFound is returned for a version that does not exist
+var ErrNotFound = errors.New("version not found")
+
+// Version describes a previous version of a file. Versions are numbered from 1
+// in the order they were replaced, so higher numbers are more recent.
+type Version struct {
+	Version int       `json:"version"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// Store keeps previous versions of the files of a directory when they are overwritten
+type Store struct {
+	mu      sync.Mutex
+	dir     string
+	keep    int
+	maxSize int64
+}
+
+// NewStore creates a store keeping up to keep versions of each file in dir,
+// and at most maxSize bytes of versions overall (0 for unlimited)
+func NewStore(dir string, keep int, maxSize int64) *Store {
+	return &Store{dir: dir, keep: keep, maxSize: maxSize}
+}
+
+// Save keeps the current content of the file name, relative to the directory,
+// as its newest version. It must be called right before the file is replaced;
+// nothing is saved if the file does not exist yet.
+func (s *Store) Save(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current := filepath.Join(s.dir, name)
+	if info, err := os.Stat(current); err != nil || !info.Mode().IsRegular() {
+		return nil
+	}
+
+	versions, err := s.list(name)
+	if err != nil {
+		return err
+	}
+	next := 1
+	if len(versions) > 0 {
+		next = versions[len(versions)-1].Version + 1
+	}
+
+	versionDir := s.versionDir(name)
+	if err := os.MkdirAll(versionDir, 0755); err != nil {
+		return err
+	}
+
+	// A hard link keeps the content while the current file is replaced by a rename
+	target := filepath.Join(versionDir, strconv.Itoa(next))
+	if err := os.Link(current, target); err != nil {
+		if err := copyFile(current, target); err != nil {
+			return fmt.Errorf("failed to keep version: %w", err)
+		}
+	}
+
+	for len(versions)+1 > s.keep {
+		os.Remove(filepath.Join(versionDir, strconv.Itoa(versions[0].Version)))
+		versions = versions[1:]
+	}
+	return s.enforceBudget()
+}
+
+// List returns the versions of a file, oldest first
+func (s *Store) List(name string) ([]Version, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.list(name)
+}
+
+// Path returns the path of a version of a file
+func (s *Store) Path(name string, version int) (string, error) {
+	path := filepath.Join(s.versionDir(name), strconv.Itoa(version))
+	if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() {
+		return "", ErrNotFound
+	}
+	return path, nil
+}
+
+// versionDir returns the directory holding the versions of a file
+func (s *Store) versionDir(name string) string {
+	return filepath.Join(s.dir, Dir, name)
+}
+
+// list returns the versions of a file, oldest first; s.mu must be held
+func (s *Store) list(name string) ([]Version, error) {
+	entries, err := os.ReadDir(s.versionDir(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return []Version{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	versions := []Version{}
+	for _, entry := range entries {
+		n, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.Type().IsRegular() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		versions = append(versions, Version{Version: n, Size: info.Size(), ModTime: info.ModTime().UTC()})
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version < versions[j].Version })
+	return versions, nil
+}
+
+// enforceBudget removes the oldest versions of any file until all versions fit
+// in the storage budget; s.mu must be held
+func (s *Store) enforceBudget() error {
+	if s.maxSize <= 0 {
+		return nil
+	}
+
+	type stored struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var all []stored
+	var total int64
+	err := filepath.WalkDir(filepath.Join(s.dir, Dir), func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		all = append(all, stored{path, info.Size(), info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(all, func(i, j int) bool { return all[i].modTime.Before(all[j].modTime) })
+	for _, v := range all {
+		if total <= s.maxSize {
+			break
+		}
+		if err := os.Remove(v.path); err == nil {
+			total -= v.size
+		}
+	}
+	return nil
+}
+
+// copyFile copies the file at src to dst, for file systems without hard links
+func copyFile(src, dst string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dst, data, 0644)
+}